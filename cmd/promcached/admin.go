@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/f0o/promcache/internal/adminclient"
+)
+
+// adminFlags registers the flags shared by the admin client subcommands,
+// client creates the client they configure once fs is parsed
+func adminFlags(fs *flag.FlagSet) (client func() *adminclient.Client, asJSON *bool) {
+	target := fs.String("target", "http://localhost:9091", "Base URL of the instance's admin endpoints (its -admin-listen address if set)")
+	token := fs.String("token", os.Getenv("PROMCACHE_ADMIN_TOKEN"), "Bearer token of the instance's -admin-token (env PROMCACHE_ADMIN_TOKEN)")
+	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
+	asJSON = fs.Bool("json", false, "Print the result as JSON")
+	client = func() *adminclient.Client {
+		return adminclient.New(*target, *token, *timeout)
+	}
+	return client, asJSON
+}
+
+// printJSON writes v as indented JSON to stdout
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// runPurge implements the purge subcommand
+func runPurge(args []string) int {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	client, asJSON := adminFlags(fs)
+	pattern := fs.String("pattern", "", "Regular expression matching the keys to remove")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if *pattern == "" {
+		logger.Error("Missing -pattern, use -pattern . to purge everything")
+		return 1
+	}
+
+	result, err := client().Purge(context.Background(), *pattern)
+	if err != nil {
+		logger.Error("Purge failed", "error", err)
+		return 1
+	}
+
+	if *asJSON {
+		printJSON(result)
+	} else {
+		fmt.Printf("Deleted %d entries\n", result.Deleted)
+		if result.PeersDeleted > 0 {
+			fmt.Printf("Deleted %d entries on peers\n", result.PeersDeleted)
+		}
+	}
+	if result.Error != "" {
+		logger.Error("Purging peers failed", "error", result.Error)
+		return 1
+	}
+	return 0
+}
+
+// runStats implements the stats subcommand
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	client, asJSON := adminFlags(fs)
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	stats, err := client().Stats(context.Background())
+	if err != nil {
+		logger.Error("Failed to get stats", "error", err)
+		return 1
+	}
+
+	if *asJSON {
+		printJSON(stats)
+		return 0
+	}
+	fmt.Printf("Entries:           %d\n", stats.Entries)
+	fmt.Printf("Hits:              %.0f (%.1f%%)\n", stats.Hits, 100*stats.HitRatio)
+	fmt.Printf("Misses:            %.0f\n", stats.Misses)
+	fmt.Printf("Upstream requests: %.0f\n", stats.UpstreamRequests)
+	fmt.Printf("Upstream latency:  %s avg\n", time.Duration(stats.UpstreamLatency*float64(time.Second)).Round(time.Microsecond))
+	fmt.Printf("Upstream inflight: %.0f\n", stats.UpstreamInflight)
+	if stats.Peers > 0 {
+		fmt.Printf("Peers:             %d\n", stats.Peers)
+	}
+	return 0
+}
+
+// runKeys implements the keys subcommand
+func runKeys(args []string) int {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	client, asJSON := adminFlags(fs)
+	match := fs.String("match", "", "Only list keys, or their readable forms, matching this regular expression")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	var pattern *regexp.Regexp
+	if *match != "" {
+		var err error
+		if pattern, err = regexp.Compile(*match); err != nil {
+			logger.Error("Invalid -match", "error", err)
+			return 1
+		}
+	}
+
+	keys, err := client().Keys(context.Background())
+	if err != nil {
+		logger.Error("Failed to list keys", "error", err)
+		return 1
+	}
+
+	listed := keys.Keys[:0]
+	for _, key := range keys.Keys {
+		if pattern == nil || pattern.MatchString(key) || pattern.MatchString(keys.Labels[key]) {
+			listed = append(listed, key)
+		}
+	}
+	sort.Strings(listed)
+
+	if *asJSON {
+		printJSON(listed)
+		return 0
+	}
+	for _, key := range listed {
+		if label := keys.Labels[key]; label != "" {
+			fmt.Printf("%s\t%s\n", key, label)
+		} else {
+			fmt.Println(key)
+		}
+	}
+	return 0
+}
+
+// runExport implements the export subcommand
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	client, _ := adminFlags(fs)
+	pattern := fs.String("pattern", "", "Only export entries whose key, or its readable form, matches this regular expression")
+	output := fs.String("output", "-", "File to write the dump to, - for stdout")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			logger.Error("Failed to create output", "error", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := client().Export(context.Background(), *pattern, w); err != nil {
+		logger.Error("Export failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runImport implements the import subcommand
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	client, asJSON := adminFlags(fs)
+	input := fs.String("input", "-", "File to read the dump from, - for stdin")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	r := os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			logger.Error("Failed to open input", "error", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := client().Import(context.Background(), r)
+	if err != nil {
+		logger.Error("Import failed", "error", err)
+		return 1
+	}
+
+	if *asJSON {
+		printJSON(result)
+	} else {
+		fmt.Printf("Imported %d entries\n", result.Imported)
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/f0o/promcache/internal/loadgen"
+)
+
+// runBench implements the bench subcommand
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+
+	cfg := loadgen.BenchConfig{}
+	fs.StringVar(&cfg.Target, "target", "http://localhost:9091", "Base URL of the promcached instance to benchmark")
+	fs.StringVar(&cfg.MetricsURL, "metrics-url", "", "Metrics endpoint of the target to count upstream requests from (default: <target>/metrics)")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 10, "Number of workers sending requests back to back")
+	fs.DurationVar(&cfg.Duration, "duration", time.Minute, "How long to run the benchmark for")
+	fs.IntVar(&cfg.Requests, "requests", 0, "Stop after this many requests (0: run for -duration)")
+	fs.Float64Var(&cfg.InstantRatio, "instant-ratio", 0.2, "Fraction of queries issued as instant queries")
+	fs.IntVar(&cfg.Points, "points", 250, "Number of points per range query used to derive the step")
+	fs.DurationVar(&cfg.EndSpread, "end-spread", 0, "Maximum random shift of query end times into the past (0: queries end now)")
+	fs.DurationVar(&cfg.Timeout, "timeout", 2*time.Minute, "Per-request timeout")
+	queriesFile := fs.String("queries", "", "File with PromQL query templates, one per line (default: built-in set)")
+	ranges := fs.String("ranges", "1h=4,6h=2,24h=1", "Comma-separated query time ranges with optional weights, e.g. 1h=4,24h=1")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if *queriesFile != "" {
+		queries, err := loadgen.LoadQueries(*queriesFile)
+		if err != nil {
+			logger.Error("Failed to load queries", "error", err)
+			return 1
+		}
+		cfg.Queries = queries
+	}
+
+	var err error
+	if cfg.Ranges, err = loadgen.ParseRanges(*ranges); err != nil {
+		logger.Error("Invalid ranges", "error", err)
+		return 1
+	}
+	if cfg.MetricsURL == "" {
+		cfg.MetricsURL = strings.TrimSuffix(cfg.Target, "/") + "/metrics"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := loadgen.Bench(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("Benchmark failed", "error", err)
+		return 1
+	}
+
+	fmt.Println()
+	report.WriteTo(os.Stdout)
+	return 0
+}
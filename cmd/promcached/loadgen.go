@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/f0o/promcache/internal/loadgen"
+)
+
+// runLoadgen implements the loadgen subcommand
+func runLoadgen(args []string) int {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+
+	cfg := loadgen.Config{}
+	fs.StringVar(&cfg.Target, "target", "http://localhost:9091", "Base URL of the endpoint to generate load against")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 10, "Number of simulated dashboard clients")
+	fs.DurationVar(&cfg.Duration, "duration", time.Minute, "How long to generate load for")
+	fs.DurationVar(&cfg.RefreshInterval, "refresh", 30*time.Second, "Dashboard refresh interval per client")
+	fs.Float64Var(&cfg.InstantRatio, "instant-ratio", 0.2, "Fraction of queries issued as instant queries")
+	fs.IntVar(&cfg.Points, "points", 250, "Number of points per range query used to derive the step")
+	fs.DurationVar(&cfg.Timeout, "timeout", 2*time.Minute, "Per-request timeout")
+	queriesFile := fs.String("queries", "", "File with PromQL query templates, one per line (default: built-in set)")
+	ranges := fs.String("ranges", "1h,6h,24h", "Comma-separated dashboard time ranges")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if *queriesFile != "" {
+		queries, err := loadgen.LoadQueries(*queriesFile)
+		if err != nil {
+			logger.Error("Failed to load queries", "error", err)
+			return 1
+		}
+		cfg.Queries = queries
+	}
+
+	for _, r := range strings.Split(*ranges, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(r))
+		if err != nil {
+			logger.Error("Invalid range", "range", r, "error", err)
+			return 1
+		}
+		cfg.Ranges = append(cfg.Ranges, d)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := loadgen.Run(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("Load generation failed", "error", err)
+		return 1
+	}
+
+	fmt.Println()
+	report.WriteTo(os.Stdout)
+	return 0
+}
@@ -2,45 +2,134 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/f0o/promcache/internal/cache"
 	"github.com/f0o/promcache/internal/config"
+	"github.com/f0o/promcache/internal/logging"
+	"github.com/f0o/promcache/internal/metrics"
+	"github.com/f0o/promcache/internal/resources"
 	"github.com/f0o/promcache/internal/server"
+	"github.com/f0o/promcache/internal/version"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
+	// Dispatch subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "loadgen":
+			os.Exit(runLoadgen(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "purge":
+			os.Exit(runPurge(os.Args[2:]))
+		case "stats":
+			os.Exit(runStats(os.Args[2:]))
+		case "keys":
+			os.Exit(runKeys(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "version":
+			info := version.Get()
+			fmt.Printf("promcached %s (commit %s, %s)\n", info.Version, info.Commit, info.GoVersion)
+			os.Exit(0)
+		}
+	}
+
 	// Parse configuration
 	cfg := config.Parse()
 
+	// Metrics are served from the default registry, next to the Go
+	// runtime and process metrics
+	m := metrics.New(prometheus.DefaultRegisterer, metrics.Options{NativeHistograms: cfg.NativeHistograms})
+
 	// Setup logging
-	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: cfg.LogLevel,
+	logger, err := logging.New(os.Stdout, logging.Options{
+		Format:          cfg.LogFormat,
+		Level:           cfg.LogLevel,
+		DebugSampleRate: cfg.LogDebugSampleRate,
+		DebugKeyLimit:   cfg.LogDebugKeyLimit,
+		Redact:          cfg.LogRedact,
+		Metrics:         m,
 	})
-	logger := slog.New(logHandler)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	slog.SetDefault(logger)
 
+	if cfg.ConfigFile != "" {
+		if err := cfg.LoadFile(cfg.ConfigFile); err != nil {
+			logger.Error("Failed to load config file", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logger.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	build := version.Get()
+	m.SetBuildInfo(build.Version, build.Commit, build.GoVersion)
 	logger.Info("Starting promcache",
+		"version", build.Version,
+		"commit", build.Commit,
 		"listen", cfg.ListenAddr,
 		"upstream", cfg.UpstreamURL,
 		"ttl", cfg.CacheTTL,
 	)
 
+	// Adapt to container resource limits
+	limits := resources.Detect()
+	if cfg.AutoMaxProcs {
+		limits = resources.AdjustMaxProcs(limits)
+	}
+	m.SetResourceLimits(limits.GOMAXPROCS, limits.CPUQuota, limits.MemoryLimit)
+	logger.Info("Detected resource limits",
+		"cpus", limits.NumCPU,
+		"cpu_quota", limits.CPUQuota,
+		"gomaxprocs", limits.GOMAXPROCS,
+		"memory_limit_bytes", limits.MemoryLimit)
+
 	// Create cache
-	c := cache.New(cfg.CacheTTL, logger)
+	c := cache.New(cfg.CacheTTL, cfg.CacheTTLJitter, cfg.CacheCleanupInterval, logger, m)
+	if cfg.CacheSnapshotFile != "" {
+		restored, err := c.LoadFile(cfg.CacheSnapshotFile)
+		if err != nil {
+			logger.Warn("Failed to restore cache snapshot, starting empty", "error", err)
+		} else {
+			logger.Info("Restored cache snapshot", "path", cfg.CacheSnapshotFile, "items", restored)
+		}
+	}
 
 	// Create and start server
-	srv := server.New(cfg.ListenAddr, cfg.UpstreamURL, c, logger)
+	srv, err := server.New(cfg, c, logger, m)
+	if err != nil {
+		logger.Error("Failed to create server", "error", err)
+		os.Exit(1)
+	}
 
 	// Handle graceful shutdown
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
+	// Hand the listeners over to a new process on upgrade signals
+	upgrade := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgrade, upgradeSignals...)
+	}
+
 	// Start server in a goroutine
 	go func() {
 		if err := srv.Start(); err != nil && err != http.ErrServerClosed {
@@ -50,12 +139,32 @@ func main() {
 	}()
 	logger.Info("Server started")
 
-	// Wait for interrupt signal
-	<-done
+	// Wait for interrupt signal or a successful upgrade
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-upgrade:
+			logger.Info("Upgrading...")
+			// Let the new process start with a warm cache
+			if cfg.CacheSnapshotFile != "" {
+				if err := c.SaveFile(cfg.CacheSnapshotFile); err != nil {
+					logger.Error("Failed to write cache snapshot", "error", err)
+				}
+			}
+			if err := srv.Upgrade(); err != nil {
+				logger.Error("Upgrade failed, continuing to serve", "error", err)
+				continue
+			}
+			break wait
+		}
+	}
 	logger.Info("Shutting down...")
 
-	// Gracefully shutdown with a 5-second timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Gracefully shutdown, waiting for in-flight requests up to the drain
+	// timeout
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownDrainTimeout)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
@@ -63,5 +172,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.CacheSnapshotFile != "" {
+		if err := c.SaveFile(cfg.CacheSnapshotFile); err != nil {
+			logger.Error("Failed to write cache snapshot", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	logger.Info("Server stopped")
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/f0o/promcache/internal/loadgen"
+	"github.com/f0o/promcache/internal/recorder"
+)
+
+// runReplay implements the replay subcommand
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+
+	cfg := loadgen.ReplayConfig{}
+	fs.StringVar(&cfg.Target, "target", "http://localhost:9091", "Base URL of the endpoint to replay the requests against")
+	fs.Float64Var(&cfg.Speed, "speed", 1, "Replay speed relative to the recording, 0 sends requests as fast as possible")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 10, "Maximum number of requests in flight")
+	fs.BoolVar(&cfg.ShiftTimes, "shift-times", true, "Shift time parameters by the time passed since the recording")
+	fs.DurationVar(&cfg.Timeout, "timeout", 2*time.Minute, "Per-request timeout")
+	file := fs.String("file", "", "Request log written by -record-file")
+	fs.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if *file == "" {
+		logger.Error("Missing -file")
+		return 1
+	}
+	entries, err := recorder.ReadFile(*file)
+	if err != nil {
+		logger.Error("Failed to read request log", "error", err)
+		return 1
+	}
+	cfg.Entries = entries
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := loadgen.Replay(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("Replay failed", "error", err)
+		return 1
+	}
+
+	fmt.Println()
+	report.WriteTo(os.Stdout)
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals trigger a zero-downtime upgrade to a new binary, which
+// isn't supported on this platform
+var upgradeSignals []os.Signal
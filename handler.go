@@ -0,0 +1,20 @@
+package promcache
+
+import (
+	"net/http"
+
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// NewHandler returns the caching proxy for the Prometheus server at
+// upstream, e.g. http://prometheus:9090, as an http.Handler. It serves the
+// Prometheus API at /api/v1/ like promcached does; strip any prefix it is
+// mounted under:
+//
+//	mux.Handle("/prometheus/", http.StripPrefix("/prometheus", promcache.NewHandler("http://prometheus:9090")))
+func NewHandler(upstream string, opts ...Option) http.Handler {
+	o := newOptions(opts)
+	// Handlers of different servers may share a cache
+	o.proxy.KeyNamespace = upstream
+	return http.HandlerFunc(proxy.New(upstream, o.newCache(), o.log, o.proxy).HandleRequest)
+}
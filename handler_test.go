@@ -0,0 +1,151 @@
+package promcache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// serve sends a GET of target to h and returns the recorded response
+func serve(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestHandlerHitAndMiss(t *testing.T) {
+	upstream, requests := countingUpstream(t)
+	h := NewHandler(upstream.URL)
+
+	for _, want := range []string{"MISS", "HIT"} {
+		w := serve(h, "/api/v1/query?query=up&time=1700000000")
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", w.Code)
+		}
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("X-Cache = %q, want %q", got, want)
+		}
+		if w.Body.String() != vectorBody {
+			t.Errorf("body = %s, want %s", w.Body.String(), vectorBody)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
+
+func TestHandlerStripPrefix(t *testing.T) {
+	upstream, _ := countingUpstream(t)
+	mux := http.NewServeMux()
+	mux.Handle("/prometheus/", http.StripPrefix("/prometheus", NewHandler(upstream.URL)))
+
+	if w := serve(mux, "/prometheus/api/v1/query?query=up&time=1700000000"); w.Code != http.StatusOK || w.Body.String() != vectorBody {
+		t.Errorf("status = %d with body %s, want 200 with %s", w.Code, w.Body.String(), vectorBody)
+	}
+}
+
+func TestHandlerSharedCache(t *testing.T) {
+	first, firstRequests := countingUpstream(t)
+	second, secondRequests := countingUpstream(t)
+	c := NewMemoryCache(time.Minute)
+
+	// Handlers sharing a cache share the entries of their own server only
+	for _, h := range []http.Handler{
+		NewHandler(first.URL, WithCache(c)),
+		NewHandler(second.URL, WithCache(c)),
+		NewHandler(first.URL, WithCache(c)),
+	} {
+		serve(h, "/api/v1/query?query=up&time=1700000000")
+	}
+	if n, m := firstRequests.Load(), secondRequests.Load(); n != 1 || m != 1 {
+		t.Errorf("upstream requests = %d and %d, want 1 each", n, m)
+	}
+}
+
+func TestHandlerOptions(t *testing.T) {
+	rules, err := NewCacheRules(CacheRule{Name: "no-up", Action: CacheRuleSkip, Metric: "up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		opts     []Option
+		requests int64
+	}{
+		{name: "defaults", body: vectorBody, requests: 1},
+		{name: "cache rule skip", body: vectorBody, opts: []Option{WithCacheRules(rules)}, requests: 2},
+		{
+			name:     "empty results cached",
+			body:     `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			requests: 1,
+		},
+		{
+			name:     "empty results skipped",
+			body:     `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			opts:     []Option{WithEmptyResultTTL(0)},
+			requests: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, tt.body)
+			}))
+			defer upstream.Close()
+
+			h := NewHandler(upstream.URL, tt.opts...)
+			for range 2 {
+				if w := serve(h, "/api/v1/query?query=up&time=1700000000"); w.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", w.Code)
+				}
+			}
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("upstream requests = %d, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestNewCacheRulesInvalid(t *testing.T) {
+	if _, err := NewCacheRules(CacheRule{Name: "broken", Action: CacheRuleSkip, Metric: "("}); err == nil {
+		t.Error("NewCacheRules() of an invalid pattern succeeded")
+	}
+}
+
+func TestWithRegisterer(t *testing.T) {
+	upstream, _ := countingUpstream(t)
+	reg := prometheus.NewRegistry()
+	h := NewHandler(upstream.URL, WithRegisterer(reg))
+
+	serve(h, "/api/v1/query?query=up&time=1700000000")
+	serve(h, "/api/v1/query?query=up&time=1700000000")
+
+	n, err := testutil.GatherAndCount(reg, "promcache_cache_hits_total", "promcache_cache_misses_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("no cache hit or miss metrics registered")
+	}
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range metrics {
+		if !strings.HasPrefix(mf.GetName(), "promcache_") {
+			t.Errorf("metric %s registered, want only promcache_ metrics", mf.GetName())
+		}
+	}
+}
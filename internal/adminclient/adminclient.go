@@ -0,0 +1,213 @@
+// Package adminclient talks to the operational endpoints of a running
+// promcached instance
+package adminclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// Client sends requests to the admin endpoints of an instance
+type Client struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// New creates a client for the instance serving its admin endpoints at
+// baseURL, e.g. http://localhost:9091 or the -admin-listen address,
+// sending token as bearer token unless it is empty
+func New(baseURL string, token string, timeout time.Duration) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Keys lists the cached entries
+type Keys struct {
+	NumKeys int      `json:"num_keys"`
+	Keys    []string `json:"keys"`
+	// Labels are the readable forms of hashed keys, by key
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PurgeResult is the outcome of a purge
+type PurgeResult struct {
+	Deleted      int    `json:"deleted"`
+	PeersDeleted int    `json:"peers_deleted,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ImportResult is the outcome of an import
+type ImportResult struct {
+	Imported int `json:"imported"`
+}
+
+// Stats summarizes the cache metrics of an instance
+type Stats struct {
+	Entries          int     `json:"entries"`
+	Hits             float64 `json:"hits"`
+	Misses           float64 `json:"misses"`
+	HitRatio         float64 `json:"hit_ratio"`
+	UpstreamRequests float64 `json:"upstream_requests"`
+	// UpstreamLatency is the average upstream request duration in seconds
+	UpstreamLatency  float64 `json:"upstream_latency_seconds"`
+	UpstreamInflight float64 `json:"upstream_inflight"`
+	Peers            int     `json:"peers,omitempty"`
+}
+
+// Keys returns the keys of all cached entries
+func (c *Client) Keys(ctx context.Context) (*Keys, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/debug/cache", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var keys Keys
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &keys, nil
+}
+
+// Purge removes the entries whose key matches the regular expression on
+// the instance and its cluster peers
+func (c *Client) Purge(ctx context.Context, pattern string) (*PurgeResult, error) {
+	form := url.Values{"pattern": {pattern}}
+	resp, err := c.do(ctx, http.MethodPost, "/debug/cache/purge", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result PurgeResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &result, nil
+}
+
+// Export writes the entries whose key matches the regular expression, all
+// entries if pattern is empty, to w as a dump for Import
+func (c *Client) Export(ctx context.Context, pattern string, w io.Writer) error {
+	path := "/debug/cache/export"
+	if pattern != "" {
+		path += "?" + url.Values{"pattern": {pattern}}.Encode()
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import adds the unexpired entries of a dump written by Export to the
+// instance
+func (c *Client) Import(ctx context.Context, dump io.Reader) (*ImportResult, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/debug/cache/import", "application/octet-stream", dump)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &result, nil
+}
+
+// Stats returns the cache statistics from the instance's metrics
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/metrics", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics: %w", err)
+	}
+
+	// Sum all series of a metric, reading counters, gauges and histogram
+	// counts alike
+	value := func(name string) (sum float64) {
+		family, found := families[name]
+		if !found {
+			return 0
+		}
+		for _, m := range family.GetMetric() {
+			switch {
+			case m.Counter != nil:
+				sum += m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				sum += m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				sum += float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+		return sum
+	}
+
+	stats := &Stats{
+		Entries:          int(value("promcache_cache_size")),
+		Hits:             value("promcache_cache_hits_total"),
+		Misses:           value("promcache_cache_misses_total"),
+		UpstreamRequests: value("promcache_upstream_request_duration_seconds"),
+		UpstreamInflight: value("promcache_upstream_inflight_requests"),
+		Peers:            int(value("promcache_peers")),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = stats.Hits / total
+	}
+	if family, found := families["promcache_upstream_request_duration_seconds"]; found && stats.UpstreamRequests > 0 {
+		sum := 0.0
+		for _, m := range family.GetMetric() {
+			sum += m.GetHistogram().GetSampleSum()
+		}
+		stats.UpstreamLatency = sum / stats.UpstreamRequests
+	}
+	return stats, nil
+}
+
+// do sends a request with a body of the given content type and returns the
+// response if it succeeded
+func (c *Client) do(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
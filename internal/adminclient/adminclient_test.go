@@ -0,0 +1,204 @@
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request is a request received by the fake instance
+type request struct {
+	method      string
+	uri         string
+	contentType string
+	auth        string
+	body        string
+}
+
+// fakeInstance serves body with status for every request and records the
+// last request it got
+func fakeInstance(t *testing.T, status int, body string) (*httptest.Server, *request) {
+	t.Helper()
+	var last request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		last = request{
+			method:      r.Method,
+			uri:         r.RequestURI,
+			contentType: r.Header.Get("Content-Type"),
+			auth:        r.Header.Get("Authorization"),
+			body:        string(b),
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &last
+}
+
+func TestRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		call     func(c *Client) (any, error)
+		want     request
+		result   any
+	}{
+		{
+			name:     "keys",
+			response: `{"num_keys":1,"keys":["k1"],"labels":{"k1":"/api/v1/query?query=up"}}`,
+			call:     func(c *Client) (any, error) { return c.Keys(context.Background()) },
+			want:     request{method: http.MethodGet, uri: "/debug/cache"},
+			result:   &Keys{NumKeys: 1, Keys: []string{"k1"}, Labels: map[string]string{"k1": "/api/v1/query?query=up"}},
+		},
+		{
+			name:     "purge",
+			response: `{"deleted":3,"peers_deleted":2}`,
+			call:     func(c *Client) (any, error) { return c.Purge(context.Background(), "query=up&") },
+			want: request{
+				method:      http.MethodPost,
+				uri:         "/debug/cache/purge",
+				contentType: "application/x-www-form-urlencoded",
+				body:        "pattern=query%3Dup%26",
+			},
+			result: &PurgeResult{Deleted: 3, PeersDeleted: 2},
+		},
+		{
+			name:     "import",
+			response: `{"imported":7}`,
+			call: func(c *Client) (any, error) {
+				return c.Import(context.Background(), strings.NewReader("dump"))
+			},
+			want:   request{method: http.MethodPost, uri: "/debug/cache/import", contentType: "application/octet-stream", body: "dump"},
+			result: &ImportResult{Imported: 7},
+		},
+		{
+			name:     "export",
+			response: "dump",
+			call: func(c *Client) (any, error) {
+				var b bytes.Buffer
+				err := c.Export(context.Background(), "series", &b)
+				return b.String(), err
+			},
+			want:   request{method: http.MethodGet, uri: "/debug/cache/export?pattern=series"},
+			result: "dump",
+		},
+		{
+			name:     "export all",
+			response: "dump",
+			call: func(c *Client) (any, error) {
+				var b bytes.Buffer
+				err := c.Export(context.Background(), "", &b)
+				return b.String(), err
+			},
+			want:   request{method: http.MethodGet, uri: "/debug/cache/export"},
+			result: "dump",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, token := range []string{"", "secret"} {
+				server, last := fakeInstance(t, http.StatusOK, tt.response)
+				// Trailing slashes of the base URL are ignored
+				result, err := tt.call(New(server.URL+"/", token, time.Second))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := tt.want
+				if token != "" {
+					want.auth = "Bearer " + token
+				}
+				if *last != want {
+					t.Errorf("request = %+v, want %+v", *last, want)
+				}
+				if !reflect.DeepEqual(result, tt.result) {
+					t.Errorf("result = %+v, want %+v", result, tt.result)
+				}
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	metrics := `# TYPE promcache_cache_size gauge
+promcache_cache_size 12
+# TYPE promcache_cache_hits_total counter
+promcache_cache_hits_total{path="/api/v1/query"} 6
+promcache_cache_hits_total{path="/api/v1/query_range"} 3
+# TYPE promcache_cache_misses_total counter
+promcache_cache_misses_total 1
+# TYPE promcache_upstream_request_duration_seconds histogram
+promcache_upstream_request_duration_seconds_bucket{le="1"} 3
+promcache_upstream_request_duration_seconds_bucket{le="+Inf"} 4
+promcache_upstream_request_duration_seconds_sum 2
+promcache_upstream_request_duration_seconds_count 4
+# TYPE promcache_peers gauge
+promcache_peers 3
+`
+	server, last := fakeInstance(t, http.StatusOK, metrics)
+	stats, err := New(server.URL, "", time.Second).Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.uri != "/metrics" {
+		t.Errorf("request to %s, want /metrics", last.uri)
+	}
+	want := &Stats{
+		Entries:          12,
+		Hits:             9,
+		Misses:           1,
+		HitRatio:         0.9,
+		UpstreamRequests: 4,
+		UpstreamLatency:  0.5,
+		Peers:            3,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+
+	// No requests yet leave the ratios at zero
+	server, _ = fakeInstance(t, http.StatusOK, "")
+	if stats, err := New(server.URL, "", time.Second).Stats(context.Background()); err != nil || *stats != (Stats{}) {
+		t.Errorf("Stats of no metrics = %+v, %v, want zero", stats, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"unauthorized", http.StatusUnauthorized, "Unauthorized\n", "GET /debug/cache: 401 Unauthorized: Unauthorized"},
+		{"invalid JSON", http.StatusOK, "<html>", "invalid response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := fakeInstance(t, tt.status, tt.body)
+			_, err := New(server.URL, "", time.Second).Keys(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Keys error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	server, _ := fakeInstance(t, http.StatusOK, "not metrics{")
+	if _, err := New(server.URL, "", time.Second).Stats(context.Background()); err == nil {
+		t.Error("Stats of invalid metrics succeeded")
+	}
+
+	// Export doesn't write error responses as dumps
+	server, _ = fakeInstance(t, http.StatusForbidden, "forbidden")
+	var b bytes.Buffer
+	if err := New(server.URL, "", time.Second).Export(context.Background(), "", &b); err == nil || b.Len() > 0 {
+		t.Errorf("Export = %q, %v, want an error and nothing written", b.String(), err)
+	}
+}
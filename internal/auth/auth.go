@@ -0,0 +1,181 @@
+// Package auth authenticates clients by API key, HMAC-signed token or JWT
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// APIKeyHeader is the header clients may send their API key in instead of
+// an Authorization bearer token
+const APIKeyHeader = "X-API-Key"
+
+var (
+	errMissing = errors.New("missing credentials")
+	errInvalid = errors.New("invalid credentials")
+	errExpired = errors.New("expired token")
+)
+
+// Key is a static API key
+type Key struct {
+	// Name identifies the key in metrics and logs
+	Name string
+	// Key is the secret presented by clients
+	Key string
+	// Namespace is the cache namespace of the key, defaults to its name
+	Namespace string
+	// Tenant is the tenant of the key's clients, empty leaves it to the
+	// tenant header
+	Tenant string
+}
+
+// Config configures the accepted credentials
+type Config struct {
+	// Keys are the accepted static API keys
+	Keys []Key
+	// HMACSecret verifies signed tokens, empty disables them
+	HMACSecret string
+	// OIDC validates JWTs of an OpenID Connect provider, nil disables them
+	OIDC *OIDCConfig
+	// MetricLimit is the number of key, token and tenant names counted
+	// separately in the auth metrics, the rest are counted as other
+	MetricLimit int
+}
+
+// Authenticator validates static API keys, HMAC-signed tokens and JWTs
+type Authenticator struct {
+	// keys maps the SHA-256 of each static key to its identity so lookups
+	// don't compare secrets byte by byte
+	keys map[[sha256.Size]byte]proxy.Identity
+	// secret signs tokens, nil disables token authentication
+	secret []byte
+	// jwt validates JWTs, nil disables JWT authentication
+	jwt     *jwtVerifier
+	metrics *metrics.Metrics
+	// labels caps the names counted in the auth metrics, as token and JWT
+	// tenant names are up to the clients
+	labels *proxy.LabelLimiter
+}
+
+// New creates an authenticator accepting the configured credentials
+func New(cfg Config, log *slog.Logger, m *metrics.Metrics) (*Authenticator, error) {
+	a := &Authenticator{
+		keys:    make(map[[sha256.Size]byte]proxy.Identity, len(cfg.Keys)),
+		metrics: m,
+		labels:  proxy.NewLabelLimiter(cfg.MetricLimit),
+	}
+	for i, key := range cfg.Keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("api key %d: name and key must not be empty", i)
+		}
+		namespace := key.Namespace
+		if namespace == "" {
+			namespace = key.Name
+		}
+		a.keys[sha256.Sum256([]byte(key.Key))] = proxy.Identity{Name: key.Name, Namespace: namespace, Tenant: key.Tenant}
+	}
+	if cfg.HMACSecret != "" {
+		a.secret = []byte(cfg.HMACSecret)
+	}
+	if cfg.OIDC != nil {
+		if cfg.OIDC.Issuer == "" && cfg.OIDC.JWKSURL == "" {
+			return nil, errors.New("oidc: issuer or jwks_url must be set")
+		}
+		a.jwt = newJWTVerifier(*cfg.OIDC, log)
+	}
+	return a, nil
+}
+
+// Middleware rejects unauthenticated requests with 401 Unauthorized and
+// attaches the client identity to authenticated ones
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.authenticate(credentials(r))
+		if err != nil {
+			a.metrics.RecordAuthFailure(err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="promcache"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// The credentials are meant for the proxy, never leak them upstream
+		r.Header.Del(APIKeyHeader)
+		r.Header.Del("Authorization")
+
+		a.metrics.RecordAuthRequest(a.labels.Label(id.Name))
+		next.ServeHTTP(w, proxy.WithIdentity(r, id))
+	})
+}
+
+// credentials returns the API key or token presented by the client
+func credentials(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// authenticate returns the identity of a static key or signed token
+func (a *Authenticator) authenticate(credential string) (proxy.Identity, error) {
+	if credential == "" {
+		return proxy.Identity{}, errMissing
+	}
+	if id, found := a.keys[sha256.Sum256([]byte(credential))]; found {
+		return id, nil
+	}
+	if a.jwt != nil && looksLikeJWT(credential) {
+		return a.jwt.verify(credential, time.Now())
+	}
+	if a.secret != nil {
+		return a.verifyToken(credential, time.Now())
+	}
+	return proxy.Identity{}, errInvalid
+}
+
+// verifyToken validates a signed token of the form
+// <name>.<expiry>.<signature>, where expiry is a Unix timestamp and
+// signature the hex-encoded HMAC-SHA256 of "<name>.<expiry>"
+func (a *Authenticator) verifyToken(token string, now time.Time) (proxy.Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return proxy.Identity{}, errInvalid
+	}
+	name, expiryStr, signature := parts[0], parts[1], parts[2]
+
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(given, sign(a.secret, name+"."+expiryStr)) {
+		return proxy.Identity{}, errInvalid
+	}
+
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil {
+		return proxy.Identity{}, errInvalid
+	}
+	if now.Unix() >= expiry {
+		return proxy.Identity{}, errExpired
+	}
+
+	return proxy.Identity{Name: name, Namespace: name}, nil
+}
+
+// sign returns the HMAC-SHA256 of payload
+func sign(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/f0o/promcache/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAuthMetricLimit(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a, err := New(Config{
+		Keys: []Key{
+			{Name: "first", Key: "k1"},
+			{Name: "second", Key: "k2"},
+			{Name: "third", Key: "k3"},
+		},
+		MetricLimit: 1,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New(reg, metrics.Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, key := range []string{"k1", "k2", "k3", "k1"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set(APIKeyHeader, key)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "promcache_auth_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			got[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	want := map[string]float64{"first": 2, "other": 2}
+	if len(got) != len(want) || got["first"] != want["first"] || got["other"] != want["other"] {
+		t.Errorf("promcache_auth_requests_total = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,443 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// clockSkew is the leeway allowed when checking token validity times
+const clockSkew = time.Minute
+
+// minRefetchInterval bounds how often an unknown key ID triggers a JWKS fetch
+const minRefetchInterval = 30 * time.Second
+
+var errNoTenant = errors.New("token grants no tenant")
+
+// OIDCConfig configures validation of JWTs issued by an OpenID Connect
+// provider
+type OIDCConfig struct {
+	// Issuer is the expected iss claim and, unless JWKSURL is set, the base
+	// URL of the provider's discovery document
+	Issuer string
+	// JWKSURL is the URL of the provider's signing keys
+	JWKSURL string
+	// Audience is the expected aud claim, empty accepts any audience
+	Audience string
+	// TenantClaim is the claim holding the tenant, either a string or a
+	// list of strings such as groups. Empty disables tenant mapping.
+	TenantClaim string
+	// Tenants maps claim values to tenant IDs. Empty uses the first claim
+	// value as tenant ID.
+	Tenants map[string]string
+	// Refresh is how often the signing keys are reloaded
+	Refresh time.Duration
+}
+
+// jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jsonWebKey is a public key of a JWK set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtVerifier validates JWTs against the signing keys of an OIDC provider
+type jwtVerifier struct {
+	cfg    OIDCConfig
+	client *http.Client
+	log    *slog.Logger
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+}
+
+// newJWTVerifier creates a verifier and loads the provider's signing keys.
+// Failing to load them is logged but not fatal; they are retried when a
+// token is presented.
+func newJWTVerifier(cfg OIDCConfig, log *slog.Logger) *jwtVerifier {
+	v := &jwtVerifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		log:    log,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+	if err := v.fetchKeys(); err != nil {
+		log.Warn("Failed to load OIDC signing keys", "error", err)
+	}
+	if cfg.Refresh > 0 {
+		go v.startRefresh()
+	}
+	return v
+}
+
+// startRefresh periodically reloads the signing keys so rotated keys are
+// picked up
+func (v *jwtVerifier) startRefresh() {
+	ticker := time.NewTicker(v.cfg.Refresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := v.fetchKeys(); err != nil {
+			v.log.Warn("Failed to refresh OIDC signing keys", "error", err)
+		}
+	}
+}
+
+// fetchKeys loads the provider's JWK set
+func (v *jwtVerifier) fetchKeys() error {
+	v.mu.Lock()
+	v.lastFetch = time.Now()
+	v.mu.Unlock()
+
+	url := v.cfg.JWKSURL
+	if url == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("discovering JWKS URL: %w", err)
+		}
+		url = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(url, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			v.log.Debug("Skipping unsupported signing key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+
+	v.log.Debug("Loaded OIDC signing keys", "count", len(keys))
+	return nil
+}
+
+// getJSON fetches url and decodes its JSON body into dst
+func (v *jwtVerifier) getJSON(url string, dst any) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// key returns the signing key with the given ID, refetching the key set
+// for unknown IDs at most every minRefetchInterval
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, bool) {
+	v.mu.RLock()
+	key, found := v.lookup(kid)
+	stale := time.Since(v.lastFetch) >= minRefetchInterval
+	v.mu.RUnlock()
+
+	if found || !stale {
+		return key, found
+	}
+	if err := v.fetchKeys(); err != nil {
+		v.log.Warn("Failed to load OIDC signing keys", "error", err)
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.lookup(kid)
+}
+
+// lookup returns the key with the given ID, or the only key if the token
+// names none. Must be called with the lock held.
+func (v *jwtVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, found := v.keys[kid]
+	return key, found
+}
+
+// looksLikeJWT reports whether token has the structure of a JWT
+func looksLikeJWT(token string) bool {
+	header, _, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(header)
+	return err == nil && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{"))
+}
+
+// verify validates a JWT's signature and claims and returns the identity
+// it grants
+func (v *jwtVerifier) verify(token string, now time.Time) (proxy.Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return proxy.Identity{}, errInvalid
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return proxy.Identity{}, errInvalid
+	}
+	key, found := v.key(header.Kid)
+	if !found {
+		return proxy.Identity{}, errInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return proxy.Identity{}, errInvalid
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return proxy.Identity{}, errInvalid
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return proxy.Identity{}, errInvalid
+	}
+	if err := v.checkClaims(claims, now); err != nil {
+		return proxy.Identity{}, err
+	}
+
+	if v.cfg.TenantClaim == "" {
+		return proxy.Identity{Name: "oidc"}, nil
+	}
+	tenant := v.tenant(claims[v.cfg.TenantClaim])
+	if tenant == "" {
+		return proxy.Identity{}, errNoTenant
+	}
+	return proxy.Identity{Name: tenant, Namespace: tenant, Tenant: tenant}, nil
+}
+
+// checkClaims validates the registered claims of a token
+func (v *jwtVerifier) checkClaims(claims map[string]any, now time.Time) error {
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return errInvalid
+	}
+	if v.cfg.Audience != "" && !containsString(claims["aud"], v.cfg.Audience) {
+		return errInvalid
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errInvalid
+	}
+	if now.Add(-clockSkew).Unix() >= int64(exp) {
+		return errExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Unix() < int64(nbf) {
+		return errInvalid
+	}
+	return nil
+}
+
+// tenant maps the value of the tenant claim to a tenant ID
+func (v *jwtVerifier) tenant(claim any) string {
+	var values []string
+	switch c := claim.(type) {
+	case string:
+		values = []string{c}
+	case []any:
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	for _, value := range values {
+		if len(v.cfg.Tenants) == 0 {
+			return value
+		}
+		if tenant, found := v.cfg.Tenants[value]; found {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// containsString reports whether claim is s or a list containing s
+func containsString(claim any, s string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == s
+	case []any:
+		for _, item := range c {
+			if item == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a JWT
+func decodeSegment(segment string, dst any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
+
+// verifySignature checks the signature of a JWT's signing input
+func verifySignature(alg string, key crypto.PublicKey, input string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+
+	switch {
+	case alg == "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, []byte(input), signature) {
+			return errInvalid
+		}
+		return nil
+	case hash == 0:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errInvalid
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errInvalid
+		}
+		return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errInvalid
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errInvalid
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// publicKey decodes the public key of a JWK
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// testKeys are the signing keys served by the test JWKS endpoint
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ecdsa: ecKey, ed25519: edKey}
+}
+
+// jwks returns the JWK set of the public keys
+func (k testKeys) jwks() []byte {
+	b64 := base64.RawURLEncoding.EncodeToString
+	ecPub := k.ecdsa.PublicKey
+	set := map[string][]jsonWebKey{"keys": {
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(k.rsa.N.Bytes()), E: b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecPub.X.FillBytes(make([]byte, 32))), Y: b64(ecPub.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64(k.ed25519.Public().(ed25519.PublicKey))},
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: b64(k.rsa.N.Bytes()), E: "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// sign returns a JWT of claims signed with alg and the key kid names
+func (k testKeys) sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ecdsa, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(k.ed25519, []byte(input))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(keys.jwks())
+	}))
+	defer jwks.Close()
+
+	v := newJWTVerifier(OIDCConfig{
+		Issuer:      "https://issuer.example.com",
+		JWKSURL:     jwks.URL,
+		Audience:    "promcache",
+		TenantClaim: "groups",
+		Tenants:     map[string]string{"team-a-devs": "team-a"},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	now := time.Unix(1700000000, 0)
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":    "https://issuer.example.com",
+			"aud":    "promcache",
+			"exp":    now.Add(time.Hour).Unix(),
+			"groups": []string{"other", "team-a-devs"},
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+	valid := keys.sign(t, "RS256", "rsa", claims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"RS256", valid, nil},
+		{"PS256", keys.sign(t, "PS256", "rsa", claims(nil)), nil},
+		{"ES256", keys.sign(t, "ES256", "ec", claims(nil)), nil},
+		{"EdDSA", keys.sign(t, "EdDSA", "ed", claims(nil)), nil},
+		{"audience list", keys.sign(t, "RS256", "rsa", claims(map[string]any{"aud": []string{"grafana", "promcache"}})), nil},
+		{"within clock skew", keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), nil},
+		{"expired", keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})), errExpired},
+		{"missing exp", keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": nil})), errInvalid},
+		{"not yet valid", keys.sign(t, "RS256", "rsa", claims(map[string]any{"nbf": now.Add(5 * time.Minute).Unix()})), errInvalid},
+		{"wrong issuer", keys.sign(t, "RS256", "rsa", claims(map[string]any{"iss": "https://evil.example.com"})), errInvalid},
+		{"wrong audience", keys.sign(t, "RS256", "rsa", claims(map[string]any{"aud": "grafana"})), errInvalid},
+		{"unmapped tenant", keys.sign(t, "RS256", "rsa", claims(map[string]any{"groups": []string{"other"}})), errNoTenant},
+		{"missing tenant", keys.sign(t, "RS256", "rsa", claims(map[string]any{"groups": nil})), errNoTenant},
+		{"key type mismatch", keys.sign(t, "ES256", "rsa", claims(nil)), errInvalid},
+		{"unknown key", keys.sign(t, "RS256", "unknown", claims(nil)), errInvalid},
+		{"encryption key", keys.sign(t, "RS256", "enc", claims(nil)), errInvalid},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://issuer.example.com","aud":"promcache","exp":9999999999,"groups":"team-a-devs"}`)) + "." + parts[2], errInvalid},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + parts[1] + ".", errInvalid},
+		{"HS256", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"rsa"}`)) + "." + parts[1] + "." + parts[2], errInvalid},
+		{"two segments", parts[0] + "." + parts[1], errInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := v.verify(tt.token, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verify = %v, want %v", err, tt.wantErr)
+			}
+			want := proxy.Identity{Name: "team-a", Namespace: "team-a", Tenant: "team-a"}
+			if tt.wantErr == nil && id != want {
+				t.Errorf("identity = %+v, want %+v", id, want)
+			}
+		})
+	}
+}
+
+func TestLooksLikeJWT(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	for token, want := range map[string]bool{
+		header + ".e30.sig":          true,
+		"ci-job.1700000000.0123abcd": false,
+		"plain-api-key":              false,
+	} {
+		if got := looksLikeJWT(token); got != want {
+			t.Errorf("looksLikeJWT(%q) = %t, want %t", token, got, want)
+		}
+	}
+}
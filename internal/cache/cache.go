@@ -1,85 +1,168 @@
 package cache
 
 import (
+	"container/heap"
+	"context"
 	"log/slog"
+	"math/rand/v2"
+	"regexp"
 	"sync"
 	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
 )
 
 // Item represents a cached item with expiration
 type Item struct {
 	Value      []byte
 	Expiration int64
+	// Label is an optional human-readable description of the key
+	Label string
+}
+
+// expiryEntry records when a key expires
+type expiryEntry struct {
+	key        string
+	expiration int64
+}
+
+// expiryHeap is a min-heap of expiry entries ordered by expiration
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiration < h[j].expiration }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+	return entry
 }
 
-// Cache is a simple TTL cache for Prometheus query results
+// DefaultCleanupInterval is how often expired items are removed unless New
+// is given another interval
+const DefaultCleanupInterval = 10 * time.Second
+
+// Cache is a simple TTL cache for Prometheus query results. Each item has
+// its own TTL, the default TTL applies to items set without one.
 type Cache struct {
 	mu    sync.RWMutex
 	items map[string]Item
-	ttl   time.Duration
-	log   *slog.Logger
+	// expiries orders keys by expiration so cleanup only touches expired
+	// entries. Overwritten and deleted keys leave stale entries behind
+	// that are skipped when popped.
+	expiries expiryHeap
+	ttl      time.Duration
+	jitter   float64
+	log      *slog.Logger
+	metrics  *metrics.Metrics
 }
 
-// New creates a new cache with the specified TTL
-func New(ttl time.Duration, log *slog.Logger) *Cache {
+// New creates a new cache with the specified default TTL. Each entry's TTL
+// is shortened by a random fraction of up to jitter so entries stored at
+// the same moment don't all expire at once. Expired items are removed
+// every cleanupInterval, DefaultCleanupInterval if not positive; until
+// then they are only hidden from Get.
+func New(ttl time.Duration, jitter float64, cleanupInterval time.Duration, log *slog.Logger, m *metrics.Metrics) *Cache {
 	c := &Cache{
-		items: make(map[string]Item),
-		ttl:   ttl,
-		log:   log,
+		items:   make(map[string]Item),
+		ttl:     ttl,
+		jitter:  min(max(jitter, 0), 1),
+		log:     log,
+		metrics: m,
+	}
+	if cleanupInterval <= 0 {
+		cleanupInterval = DefaultCleanupInterval
 	}
 
 	// Start background cleanup
-	go c.startCleanup()
+	go c.startCleanup(cleanupInterval)
 
 	return c
 }
 
-// Get retrieves an item from the cache if it exists and has not expired
-func (c *Cache) Get(key string) ([]byte, bool) {
+// Get retrieves an item from the cache if it exists and has not expired.
+// Lookups never block; ctx only adds the request ID to debug logs.
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	c.log.Debug("Looking up cache key", "key", key)
+	c.log.DebugContext(ctx, "Looking up cache key", "key", key)
 
 	item, found := c.items[key]
 	if !found {
-		c.log.Debug("Cache key not found", "key", key)
+		c.log.DebugContext(ctx, "Cache key not found", "key", key)
 		return nil, false
 	}
 
 	// Check if the item has expired
 	if time.Now().UnixNano() > item.Expiration {
-		c.log.Debug("Cache item expired", "key", key)
+		c.log.DebugContext(ctx, "Cache item expired", "key", key)
 		return nil, false
 	}
 
-	c.log.Debug("Cache hit", "key", key)
+	c.log.DebugContext(ctx, "Cache hit", "key", key)
 	return item.Value, true
 }
 
-// Set adds an item to the cache with the default TTL
-func (c *Cache) Set(key string, value []byte) {
+// Set adds an item to the cache with the given TTL, the default TTL if
+// ttl is not positive
+func (c *Cache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.log.Debug("Caching response", "key", key)
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	if c.jitter > 0 {
+		ttl -= time.Duration(rand.Float64() * c.jitter * float64(ttl))
+	}
+
+	c.log.DebugContext(ctx, "Caching response", "key", key, "ttl", ttl)
+	expiration := time.Now().Add(ttl).UnixNano()
 	c.items[key] = Item{
 		Value:      value,
-		Expiration: time.Now().Add(c.ttl).UnixNano(),
+		Expiration: expiration,
 	}
+	heap.Push(&c.expiries, expiryEntry{key: key, expiration: expiration})
+	c.metrics.SetCacheSize(float64(len(c.items)))
 }
 
 // Delete removes an item from the cache
-func (c *Cache) Delete(key string) {
+func (c *Cache) Delete(ctx context.Context, key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	delete(c.items, key)
+	c.metrics.SetCacheSize(float64(len(c.items)))
+}
+
+// DeleteMatching removes all items whose key or label matches pattern and
+// returns their number
+func (c *Cache) DeleteMatching(pattern *regexp.Regexp) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted := 0
+	for k, v := range c.items {
+		if pattern.MatchString(k) || (v.Label != "" && pattern.MatchString(v.Label)) {
+			delete(c.items, k)
+			deleted++
+		}
+	}
+	c.metrics.SetCacheSize(float64(len(c.items)))
+	return deleted
 }
 
-// startCleanup periodically removes expired items from the cache
-func (c *Cache) startCleanup() {
-	ticker := time.NewTicker(c.ttl / 2)
+// startCleanup removes expired items from the cache every interval
+func (c *Cache) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -93,19 +176,58 @@ func (c *Cache) cleanup() {
 	defer c.mu.Unlock()
 
 	now := time.Now().UnixNano()
-	for k, v := range c.items {
-		if now > v.Expiration {
-			c.log.Debug("Removing expired item", "key", k)
-			delete(c.items, k)
+	for len(c.expiries) > 0 && now > c.expiries[0].expiration {
+		entry := heap.Pop(&c.expiries).(expiryEntry)
+
+		// Skip stale entries of keys that were overwritten or deleted
+		item, found := c.items[entry.key]
+		if !found || item.Expiration != entry.expiration {
+			continue
 		}
+
+		c.log.Debug("Removing expired item", "key", entry.key)
+		delete(c.items, entry.key)
 	}
+	c.metrics.SetCacheSize(float64(len(c.items)))
 }
 
-// TTL returns the cache TTL duration
+// TTL returns the default TTL of items
 func (c *Cache) TTL() time.Duration {
 	return c.ttl
 }
 
+// Label attaches a human-readable description to an existing item
+func (c *Cache) Label(key string, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, found := c.items[key]; found {
+		item.Label = label
+		c.items[key] = item
+	}
+}
+
+// Labels returns the labels of all labeled items by key
+func (c *Cache) Labels() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	labels := make(map[string]string)
+	for k, v := range c.items {
+		if v.Label != "" {
+			labels[k] = v.Label
+		}
+	}
+	return labels
+}
+
+// Len returns the number of entries in the cache
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.items)
+}
+
 // Keys returns all keys in the cache
 func (c *Cache) Keys() []string {
 	c.mu.RLock()
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+func newTestCache(ttl time.Duration) *Cache {
+	return New(ttl, 0, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New(nil, metrics.Options{}))
+}
+
+func TestCleanupRemovesExpiredItems(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(time.Hour)
+	c.Set(ctx, "short", []byte("1"), time.Nanosecond)
+	c.Set(ctx, "long", []byte("2"), time.Hour)
+	c.Set(ctx, "shorter", []byte("3"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	c.cleanup()
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len after cleanup = %d, want 1", n)
+	}
+	if _, ok := c.Get(ctx, "long"); !ok {
+		t.Error("unexpired item was removed")
+	}
+	if len(c.expiries) != 1 {
+		t.Errorf("expiry heap holds %d entries, want 1", len(c.expiries))
+	}
+}
+
+func TestCleanupSkipsStaleExpiries(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(time.Hour)
+
+	// The expiry of the first Set must not remove the overwritten item
+	c.Set(ctx, "overwritten", []byte("old"), time.Nanosecond)
+	c.Set(ctx, "overwritten", []byte("new"), time.Hour)
+	// Nor must that of a deleted item remove its successor
+	c.Set(ctx, "deleted", []byte("old"), time.Nanosecond)
+	c.Delete(ctx, "deleted")
+	c.Set(ctx, "deleted", []byte("new"), time.Hour)
+	time.Sleep(time.Millisecond)
+
+	c.cleanup()
+	for _, key := range []string{"overwritten", "deleted"} {
+		value, ok := c.Get(ctx, key)
+		if !ok || string(value) != "new" {
+			t.Errorf("Get(%q) = %q, %t, want new, true", key, value, ok)
+		}
+	}
+	if len(c.expiries) != 2 {
+		t.Errorf("expiry heap holds %d entries, want 2", len(c.expiries))
+	}
+}
+
+func TestSetDefaultsNonPositiveTTL(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(time.Hour)
+	c.Set(ctx, "zero", []byte("1"), 0)
+	c.Set(ctx, "negative", []byte("2"), -time.Second)
+	time.Sleep(time.Millisecond)
+
+	c.cleanup()
+	for _, key := range []string{"zero", "negative"} {
+		if _, ok := c.Get(ctx, key); !ok {
+			t.Errorf("item %q set without a TTL expired", key)
+		}
+	}
+}
+
+func TestGetHidesExpiredItems(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCache(time.Hour)
+	c.Set(ctx, "short", []byte("1"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if _, ok := c.Get(ctx, "short"); ok {
+		t.Error("Get returned an expired item")
+	}
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// snapshotVersion identifies the format of snapshot files
+const snapshotVersion = 1
+
+// snapshotEntry is a cache item as stored in snapshot files
+type snapshotEntry struct {
+	Key        string
+	Value      []byte
+	Expiration int64
+	Label      string
+}
+
+// Export writes the unexpired items whose key or label matches pattern,
+// all of them if pattern is nil, to w in the snapshot format. Returns the
+// number of written items.
+func (c *Cache) Export(w io.Writer, pattern *regexp.Regexp) (int, error) {
+	c.mu.RLock()
+	now := time.Now().UnixNano()
+	entries := make([]snapshotEntry, 0, len(c.items))
+	for k, v := range c.items {
+		if now > v.Expiration {
+			continue
+		}
+		if pattern != nil && !pattern.MatchString(k) && (v.Label == "" || !pattern.MatchString(v.Label)) {
+			continue
+		}
+		entries = append(entries, snapshotEntry{Key: k, Value: v.Value, Expiration: v.Expiration, Label: v.Label})
+	}
+	c.mu.RUnlock()
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotVersion); err != nil {
+		return 0, err
+	}
+	if err := enc.Encode(entries); err != nil {
+		return 0, fmt.Errorf("writing snapshot: %w", err)
+	}
+	return len(entries), nil
+}
+
+// Import adds the items of a snapshot read from r, replacing items with
+// the same key and discarding expired ones. Returns the number of added
+// items.
+func (c *Cache) Import(r io.Reader) (int, error) {
+	dec := gob.NewDecoder(r)
+	var version int
+	if err := dec.Decode(&version); err != nil {
+		return 0, fmt.Errorf("reading snapshot: %w", err)
+	}
+	if version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	var entries []snapshotEntry
+	if err := dec.Decode(&entries); err != nil {
+		return 0, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	imported := 0
+	for _, e := range entries {
+		if now > e.Expiration {
+			continue
+		}
+		c.items[e.Key] = Item{Value: e.Value, Expiration: e.Expiration, Label: e.Label}
+		heap.Push(&c.expiries, expiryEntry{key: e.Key, expiration: e.Expiration})
+		imported++
+	}
+	c.metrics.SetCacheSize(float64(len(c.items)))
+	return imported, nil
+}
+
+// SaveFile writes all unexpired items to the file at path. The file is
+// replaced atomically so a crash never leaves a truncated snapshot behind.
+func (c *Cache) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	saved, err := c.Export(w, nil)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	c.log.Info("Wrote cache snapshot", "path", path, "items", saved)
+	return nil
+}
+
+// LoadFile restores the items of a snapshot written by SaveFile, discarding
+// expired ones. A missing file is not an error. Returns the number of
+// restored items.
+func (c *Cache) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return c.Import(bufio.NewReader(f))
+}
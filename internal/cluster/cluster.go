@@ -0,0 +1,386 @@
+// Package cluster shares one cache across promcached replicas by storing
+// each entry only on the peer owning its key, groupcache-style
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+const (
+	// PathPrefix is the path prefix of requests between peers
+	PathPrefix = "/_promcache/peer/"
+	// cachePath is the path peers exchange cache entries on
+	cachePath = PathPrefix + "cache"
+	// pingPath answers peers checking this instance is reachable
+	pingPath = PathPrefix + "ping"
+	// secretHeader carries the shared secret of peer requests
+	secretHeader = "X-Promcache-Peer-Secret"
+	// ttlHeader carries the TTL of entries stored on the owning peer
+	ttlHeader = "X-Promcache-TTL"
+	// dnsRefreshInterval is how often DNS-discovered peers are re-resolved
+	dnsRefreshInterval = 30 * time.Second
+)
+
+// Config configures the cluster membership
+type Config struct {
+	// Self is the URL peers reach this instance at, it must match its
+	// entry in Peers or the DNS-discovered addresses
+	Self string
+	// Peers are the static peer URLs
+	Peers []string
+	// DNS is a host:port whose A/AAAA records are the peers, empty
+	// disables DNS discovery
+	DNS string
+	// Seeds are the URLs of peers to join the gossip membership through,
+	// empty disables gossip
+	Seeds []string
+	// GossipAllowed are the networks, as CIDRs, and domains, starting with
+	// a dot, of the members accepted from gossip besides the peers of the
+	// other discovery sources
+	GossipAllowed []string
+	// Secret authenticates peer requests, empty accepts any peer
+	Secret string
+	// Timeout bounds requests to peers
+	Timeout time.Duration
+	// Handoff is how long the previous owners of keys keep serving and
+	// receiving them after a membership change, zero disables the handoff
+	Handoff time.Duration
+}
+
+// Cluster routes cache entries to the peers owning their keys
+type Cluster struct {
+	self    string
+	static  []string
+	secret  string
+	handoff time.Duration
+	client  *http.Client
+	ring    atomic.Pointer[ring]
+	// previous is the ring replaced by the last membership change while
+	// its keys are handed off
+	previous atomic.Pointer[handoffRing]
+	log      *slog.Logger
+	metrics  *metrics.Metrics
+
+	// mu guards the discovered peers
+	mu sync.Mutex
+	// dnsPeers are the peers discovered through DNS
+	dnsPeers []string
+	// gossipPeers are the live members of the gossip membership
+	gossipPeers []string
+	// members is the gossip membership, nil if gossip is disabled
+	members *membership
+}
+
+// handoffRing is a replaced ring and when its handoff ends
+type handoffRing struct {
+	ring  *ring
+	until time.Time
+}
+
+// New creates a cluster of the configured peers. With DNS discovery the
+// peers are re-resolved in the background.
+func New(cfg Config, log *slog.Logger, m *metrics.Metrics) (*Cluster, error) {
+	if cfg.Self == "" {
+		return nil, fmt.Errorf("cluster: the URL of this instance must be set")
+	}
+
+	c := &Cluster{
+		self:    strings.TrimSuffix(cfg.Self, "/"),
+		secret:  cfg.Secret,
+		handoff: cfg.Handoff,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		log:     log,
+		metrics: m,
+	}
+	for _, peer := range cfg.Peers {
+		c.static = append(c.static, strings.TrimSuffix(peer, "/"))
+	}
+	c.updateRing()
+
+	if cfg.DNS != "" {
+		host, port, err := net.SplitHostPort(cfg.DNS)
+		if err != nil {
+			return nil, fmt.Errorf("cluster: invalid DNS address %q: %w", cfg.DNS, err)
+		}
+		c.resolve(host, port)
+		go func() {
+			ticker := time.NewTicker(dnsRefreshInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				c.resolve(host, port)
+			}
+		}()
+	}
+
+	if len(cfg.Seeds) > 0 {
+		allowed, err := parseAllowed(cfg.GossipAllowed)
+		if err != nil {
+			return nil, err
+		}
+		c.startGossip(cfg.Seeds, allowed)
+	}
+
+	return c, nil
+}
+
+// resolve replaces the DNS-discovered peers with the addresses of host
+func (c *Cluster) resolve(host string, port string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		c.log.Warn("Failed to resolve peers", "host", host, "error", err)
+		return
+	}
+
+	discovered := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		discovered = append(discovered, "http://"+net.JoinHostPort(addr, port))
+	}
+
+	c.mu.Lock()
+	c.dnsPeers = discovered
+	c.mu.Unlock()
+	c.updateRing()
+}
+
+// updateRing rebuilds the ring from the static and the discovered peers and
+// this instance. The replaced ring keeps being used alongside the new one
+// for the handoff, so moved keys are still found at their previous owner
+// while the new owner fills up.
+func (c *Cluster) updateRing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := append([]string{c.self}, c.static...)
+	peers = append(peers, c.dnsPeers...)
+	peers = append(peers, c.gossipPeers...)
+	slices.Sort(peers)
+	peers = slices.Compact(peers)
+
+	old := c.ring.Load()
+	if old != nil && slices.Equal(old.peers, peers) {
+		return
+	}
+	r := newRing(peers)
+	c.log.Info("Cluster peers changed", "peers", peers, "ring_version", r.version)
+	if old != nil && c.handoff > 0 {
+		c.previous.Store(&handoffRing{ring: old, until: time.Now().Add(c.handoff)})
+	}
+	c.ring.Store(r)
+	c.metrics.SetPeers(len(peers), r.version)
+}
+
+// Owner returns the peer owning key. remote is false if this instance owns
+// it.
+func (c *Cluster) Owner(key string) (peer string, remote bool) {
+	peer = c.ring.Load().owner(key)
+	return peer, peer != c.self
+}
+
+// PreviousOwner returns the peer that owned key before the last membership
+// change while it's handed off. ok is false if the handoff is over or the
+// owner didn't change.
+func (c *Cluster) PreviousOwner(key string) (peer string, remote bool, ok bool) {
+	previous := c.previous.Load()
+	if previous == nil || time.Now().After(previous.until) {
+		return "", false, false
+	}
+	peer = previous.ring.owner(key)
+	if peer == c.ring.Load().owner(key) {
+		return "", false, false
+	}
+	return peer, peer != c.self, true
+}
+
+// Get fetches the entry of key from peer
+func (c *Cluster) Get(ctx context.Context, peer string, key string) ([]byte, bool, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, entryURL(peer, key), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.metrics.RecordPeerRequest("get", "error")
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		value, err := io.ReadAll(resp.Body)
+		if err != nil {
+			c.metrics.RecordPeerRequest("get", "error")
+			return nil, false, err
+		}
+		c.metrics.RecordPeerRequest("get", "hit")
+		return value, true, nil
+	case http.StatusNotFound:
+		c.metrics.RecordPeerRequest("get", "miss")
+		return nil, false, nil
+	default:
+		c.metrics.RecordPeerRequest("get", "error")
+		return nil, false, fmt.Errorf("peer %s responded with %s", peer, resp.Status)
+	}
+}
+
+// Set stores the entry of key on peer
+func (c *Cluster) Set(ctx context.Context, peer string, key string, value []byte, ttl time.Duration) error {
+	req, err := c.newRequest(ctx, http.MethodPut, entryURL(peer, key), value)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ttlHeader, ttl.String())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.metrics.RecordPeerRequest("set", "error")
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		c.metrics.RecordPeerRequest("set", "error")
+		return fmt.Errorf("peer %s responded with %s", peer, resp.Status)
+	}
+	c.metrics.RecordPeerRequest("set", "ok")
+	return nil
+}
+
+// Check pings every other peer and returns the error of each, nil for
+// reachable peers
+func (c *Cluster) Check(ctx context.Context) map[string]error {
+	var peers []string
+	for _, peer := range c.ring.Load().peers {
+		if peer != c.self {
+			peers = append(peers, peer)
+		}
+	}
+
+	results := make(map[string]error, len(peers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.ping(ctx, peer)
+			mu.Lock()
+			results[peer] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// ping checks peer is reachable and accepts this instance's requests
+func (c *Cluster) ping(ctx context.Context, peer string) error {
+	req, err := c.newRequest(ctx, http.MethodGet, peer+pingPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer %s responded with %s", peer, resp.Status)
+	}
+	return nil
+}
+
+// newRequest creates a request to a peer
+func (c *Cluster) newRequest(ctx context.Context, method string, target string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.secret != "" {
+		req.Header.Set(secretHeader, c.secret)
+	}
+	return req, nil
+}
+
+// entryURL returns the URL of the entry of key on peer
+func entryURL(peer string, key string) string {
+	return peer + cachePath + "?key=" + url.QueryEscape(key)
+}
+
+// Handler serves the requests of peers: the entries of keys owned by this
+// instance, gossip and purges
+func (c *Cluster) Handler(store *cache.Cache) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(cachePath, c.cacheHandler(store))
+	mux.HandleFunc(membersPath, c.handleMembers)
+	mux.Handle(purgePath, c.purgeHandler(store))
+	mux.HandleFunc(pingPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(c.secret)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// cacheHandler serves the entries of keys owned by this instance to its
+// peers
+func (c *Cluster) cacheHandler(store *cache.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "Missing key", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			value, found := store.Get(r.Context(), key)
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(value)
+		case http.MethodPut:
+			ttl, err := time.ParseDuration(r.Header.Get(ttlHeader))
+			if err != nil || ttl <= 0 {
+				http.Error(w, "Invalid TTL", http.StatusBadRequest)
+				return
+			}
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "Failed to read entry", http.StatusBadRequest)
+				return
+			}
+			store.Set(r.Context(), key, value, ttl)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+// newTestCluster creates a cluster of self and the static peers
+func newTestCluster(t *testing.T, cfg Config) *Cluster {
+	t.Helper()
+	c, err := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New(nil, metrics.Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// addPeer adds peer to the cluster as if it had been discovered
+func addPeer(c *Cluster, peer string) {
+	c.mu.Lock()
+	c.dnsPeers = append(c.dnsPeers, peer)
+	c.mu.Unlock()
+	c.updateRing()
+}
+
+func TestClusterHandoff(t *testing.T) {
+	c := newTestCluster(t, Config{Self: "http://a:9091", Peers: []string{"http://b:9091"}, Handoff: time.Minute})
+	before := c.ring.Load()
+
+	// Keys are only handed off after a membership change
+	if _, _, ok := c.PreviousOwner("key"); ok {
+		t.Fatal("PreviousOwner is ok without a membership change")
+	}
+
+	addPeer(c, "http://c:9091")
+	if c.ring.Load().version == before.version {
+		t.Fatal("ring version didn't change with the membership")
+	}
+
+	moved, kept := 0, 0
+	for i := range 1000 {
+		key := "key" + strconv.Itoa(i)
+		owner, _ := c.Owner(key)
+		previous, remote, ok := c.PreviousOwner(key)
+		switch {
+		case owner == before.owner(key):
+			kept++
+			if ok {
+				t.Errorf("PreviousOwner(%s) is ok although its owner %s didn't change", key, owner)
+			}
+		case !ok || previous != before.owner(key):
+			t.Errorf("PreviousOwner(%s) = %s, %v, want %s", key, previous, ok, before.owner(key))
+		default:
+			moved++
+			if remote != (previous != "http://a:9091") {
+				t.Errorf("PreviousOwner(%s) remote = %v for %s", key, remote, previous)
+			}
+		}
+	}
+	if moved == 0 || kept == 0 {
+		t.Errorf("moved %d and kept %d keys, want both", moved, kept)
+	}
+
+	// The handoff ends after its window
+	c.previous.Load().until = time.Now().Add(-time.Second)
+	for i := range 1000 {
+		if _, _, ok := c.PreviousOwner("key" + strconv.Itoa(i)); ok {
+			t.Fatal("PreviousOwner is ok after the handoff")
+		}
+	}
+}
+
+func TestClusterHandoffDisabled(t *testing.T) {
+	c := newTestCluster(t, Config{Self: "http://a:9091", Peers: []string{"http://b:9091"}})
+	addPeer(c, "http://c:9091")
+	for i := range 1000 {
+		if _, _, ok := c.PreviousOwner("key" + strconv.Itoa(i)); ok {
+			t.Fatal("PreviousOwner is ok without a handoff")
+		}
+	}
+}
+
+func TestPeerHandlerSecret(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New(nil, metrics.Options{})
+	store := cache.New(time.Hour, 0, time.Hour, log, m)
+	owner := newTestCluster(t, Config{Self: "http://owner:9091", Secret: "secret", Timeout: time.Second})
+	server := httptest.NewServer(owner.Handler(store))
+	defer server.Close()
+
+	tests := []struct {
+		secret string
+		want   int
+	}{
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+		{"secret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+pingPath, nil)
+		if tt.secret != "" {
+			req.Header.Set(secretHeader, tt.secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("ping with secret %q = %d, want %d", tt.secret, resp.StatusCode, tt.want)
+		}
+	}
+
+	// Peers sharing the secret exchange entries
+	ctx := context.Background()
+	peer := newTestCluster(t, Config{Self: "http://peer:9091", Secret: "secret", Timeout: time.Second})
+	if err := peer.Set(ctx, server.URL, "key", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("Set on owner: %v", err)
+	}
+	if value, found, err := peer.Get(ctx, server.URL, "key"); err != nil || !found || string(value) != "value" {
+		t.Errorf("Get from owner = %q, %v, %v, want value", value, found, err)
+	}
+	if _, found, err := peer.Get(ctx, server.URL, "missing"); err != nil || found {
+		t.Errorf("Get of a missing key = %v, %v, want a miss", found, err)
+	}
+
+	// Other peers can neither read nor write
+	intruder := newTestCluster(t, Config{Self: "http://intruder:9091", Secret: "wrong", Timeout: time.Second})
+	if err := intruder.Set(ctx, server.URL, "key", []byte("planted"), time.Minute); err == nil {
+		t.Error("Set with the wrong secret succeeded")
+	}
+	if _, _, err := intruder.Get(ctx, server.URL, "key"); err == nil {
+		t.Error("Get with the wrong secret succeeded")
+	}
+	if value, _ := store.Get(ctx, "key"); string(value) != "value" {
+		t.Errorf("entry = %q after a rejected write, want value", value)
+	}
+}
@@ -0,0 +1,397 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+)
+
+const (
+	// membersPath is the path peers exchange their membership on
+	membersPath = PathPrefix + "members"
+	// purgePath is the path purges are broadcast to
+	purgePath = PathPrefix + "purge"
+	// gossipInterval is how often a random member is gossiped with
+	gossipInterval = time.Second
+	// memberTimeout is how long a member may go without a new heartbeat
+	// before it's considered dead
+	memberTimeout = 10 * time.Second
+	// seedProbability is the chance of gossiping with a seed instead of a
+	// member, so partitions heal
+	seedProbability = 0.1
+	// maxRejected caps the remembered rejected members
+	maxRejected = 1000
+)
+
+// member is the gossip state of a peer
+type member struct {
+	// heartbeat is increased by the peer itself every gossip round
+	heartbeat int64
+	// updated is when the heartbeat last increased
+	updated time.Time
+}
+
+// membership is the heartbeat table of the gossip protocol. Each member
+// increases its own heartbeat and exchanges the table with a random
+// member every round; members whose heartbeat stops increasing are dead.
+type membership struct {
+	mu      sync.Mutex
+	seeds   []string
+	members map[string]*member
+	// allowed are the members accepted besides the configured peers
+	allowed allowedMembers
+	// rejected are the members refused already, so they're logged once
+	rejected map[string]bool
+}
+
+// allowedMembers are the networks and domains of the members accepted from
+// gossip
+type allowedMembers struct {
+	networks []netip.Prefix
+	domains  []string
+}
+
+// parseAllowed parses the networks, as CIDRs, and domains, starting with a
+// dot, of the members accepted from gossip
+func parseAllowed(entries []string) (allowedMembers, error) {
+	var allowed allowedMembers
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, ".") {
+			allowed.domains = append(allowed.domains, strings.ToLower(entry))
+			continue
+		}
+		network, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return allowed, fmt.Errorf("cluster: invalid gossip network %q, expected a CIDR or a domain starting with a dot", entry)
+		}
+		allowed.networks = append(allowed.networks, network.Masked())
+	}
+	return allowed, nil
+}
+
+// contains reports whether host is in one of the networks or domains
+func (a allowedMembers) contains(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		return slices.ContainsFunc(a.networks, func(network netip.Prefix) bool {
+			return network.Contains(addr)
+		})
+	}
+	host = strings.ToLower(host)
+	return slices.ContainsFunc(a.domains, func(domain string) bool {
+		return strings.HasSuffix(host, domain)
+	})
+}
+
+// startGossip joins the gossip membership through the seeds
+func (c *Cluster) startGossip(seeds []string, allowed allowedMembers) {
+	m := &membership{members: make(map[string]*member), allowed: allowed, rejected: make(map[string]bool)}
+	for _, seed := range seeds {
+		if seed = strings.TrimSuffix(seed, "/"); seed != c.self {
+			m.seeds = append(m.seeds, seed)
+		}
+	}
+	// Start above the heartbeats of previous runs of this instance
+	m.members[c.self] = &member{heartbeat: time.Now().UnixNano(), updated: time.Now()}
+	c.members = m
+
+	go func() {
+		ticker := time.NewTicker(gossipInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			c.gossip()
+		}
+	}()
+}
+
+// gossip runs a gossip round, exchanging the heartbeat table with a random
+// member or seed
+func (c *Cluster) gossip() {
+	target, table := c.members.tick(c.self)
+	if target == "" {
+		return
+	}
+
+	body, err := json.Marshal(table)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gossipInterval)
+	defer cancel()
+
+	req, err := c.newRequest(ctx, http.MethodPost, target+membersPath, body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.log.Debug("Failed to gossip", "peer", target, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var remote map[string]int64
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&remote) != nil {
+		c.log.Debug("Invalid gossip response", "peer", target, "status", resp.Status)
+		return
+	}
+	c.merge(remote)
+}
+
+// handleMembers merges the heartbeat table of a peer and responds with
+// this instance's
+func (c *Cluster) handleMembers(w http.ResponseWriter, r *http.Request) {
+	if c.members == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var remote map[string]int64
+	if err := json.NewDecoder(r.Body).Decode(&remote); err != nil {
+		http.Error(w, "Invalid membership", http.StatusBadRequest)
+		return
+	}
+	c.merge(remote)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.members.table())
+}
+
+// merge takes over the heartbeat table of a peer. Members gossiped by peers
+// are only accepted if one of the discovery sources or the allowed
+// networks and domains vouch for them, so a peer can't point the others at
+// arbitrary addresses.
+func (c *Cluster) merge(remote map[string]int64) {
+	c.mu.Lock()
+	known := append(slices.Clone(c.static), c.dnsPeers...)
+	c.mu.Unlock()
+
+	for _, peer := range c.members.merge(c.self, remote, known) {
+		c.log.Warn("Ignoring gossiped member outside the allowed networks", "member", peer)
+	}
+	c.updateMembers()
+}
+
+// updateMembers puts the live members on the ring
+func (c *Cluster) updateMembers() {
+	live := c.members.live()
+
+	c.mu.Lock()
+	changed := !slices.Equal(c.gossipPeers, live)
+	c.gossipPeers = live
+	c.mu.Unlock()
+
+	if changed {
+		c.updateRing()
+	}
+}
+
+// tick increases the heartbeat of self, expires dead members and returns
+// the peer to gossip with and the table to send
+func (m *membership) tick(self string) (string, map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.members[self].heartbeat++
+	m.members[self].updated = now
+
+	// Dead members are kept a while so stale tables don't revive them
+	var alive []string
+	for peer, state := range m.members {
+		switch {
+		case peer == self:
+		case now.Sub(state.updated) > 3*memberTimeout:
+			delete(m.members, peer)
+		case now.Sub(state.updated) <= memberTimeout:
+			alive = append(alive, peer)
+		}
+	}
+
+	var target string
+	if len(m.seeds) > 0 && (len(alive) == 0 || rand.Float64() < seedProbability) {
+		target = m.seeds[rand.IntN(len(m.seeds))]
+	} else if len(alive) > 0 {
+		target = alive[rand.IntN(len(alive))]
+	}
+	return target, m.tableLocked(now)
+}
+
+// merge takes over the heartbeats of remote that are newer than the known
+// ones. Members that aren't seeds, known peers or in the allowed networks
+// and domains are ignored; those ignored for the first time are returned.
+func (m *membership) merge(self string, remote map[string]int64, known []string) (rejected []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for peer, heartbeat := range remote {
+		if peer == self {
+			continue
+		}
+		if !m.acceptLocked(peer, known) {
+			if !m.rejected[peer] && len(m.rejected) < maxRejected {
+				m.rejected[peer] = true
+				rejected = append(rejected, peer)
+			}
+			continue
+		}
+		state, found := m.members[peer]
+		if !found {
+			m.members[peer] = &member{heartbeat: heartbeat, updated: now}
+		} else if heartbeat > state.heartbeat {
+			state.heartbeat = heartbeat
+			state.updated = now
+		}
+	}
+	return rejected
+}
+
+// acceptLocked reports whether peer may join the membership: a plain
+// http(s)://host:port URL that is a seed, a known peer or in the allowed
+// networks and domains. m.mu must be held.
+func (m *membership) acceptLocked(peer string, known []string) bool {
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || u.Port() == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	if slices.Contains(m.seeds, peer) || slices.Contains(known, peer) {
+		return true
+	}
+	return m.allowed.contains(u.Hostname())
+}
+
+// table returns the heartbeats of the live members
+func (m *membership) table() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.tableLocked(time.Now())
+}
+
+// tableLocked returns the heartbeats of the live members, m.mu must be held
+func (m *membership) tableLocked(now time.Time) map[string]int64 {
+	table := make(map[string]int64, len(m.members))
+	for peer, state := range m.members {
+		if now.Sub(state.updated) <= memberTimeout {
+			table[peer] = state.heartbeat
+		}
+	}
+	return table
+}
+
+// live returns the sorted live members
+func (m *membership) live() []string {
+	table := m.table()
+	peers := make([]string, 0, len(table))
+	for peer := range table {
+		peers = append(peers, peer)
+	}
+	slices.Sort(peers)
+	return peers
+}
+
+// Purge broadcasts a purge of the entries matching pattern to all peers and
+// returns the number of entries they removed
+func (c *Cluster) Purge(ctx context.Context, pattern *regexp.Regexp) (int, error) {
+	peers := c.ring.Load().peers
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	total := 0
+	for _, peer := range peers {
+		if peer == c.self {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deleted, err := c.purgePeer(ctx, peer, pattern)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", peer, err))
+				return
+			}
+			total += deleted
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return total, fmt.Errorf("purging peers: %v", errs)
+	}
+	return total, nil
+}
+
+// purgePeer purges the entries matching pattern on peer
+func (c *Cluster) purgePeer(ctx context.Context, peer string, pattern *regexp.Regexp) (int, error) {
+	form := url.Values{"pattern": {pattern.String()}}
+	req, err := c.newRequest(ctx, http.MethodPost, peer+purgePath, []byte(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer responded with %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Deleted, nil
+}
+
+// purgeHandler removes the entries matching a pattern broadcast by a peer
+func (c *Cluster) purgeHandler(store *cache.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pattern, err := regexp.Compile(r.FormValue("pattern"))
+		if err != nil {
+			http.Error(w, "Invalid pattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		deleted := store.DeleteMatching(pattern)
+		c.log.Info("Purged cache entries on behalf of a peer",
+			"pattern", pattern.String(),
+			"deleted", deleted)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+	})
+}
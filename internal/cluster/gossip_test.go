@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseAllowed(t *testing.T) {
+	if _, err := parseAllowed([]string{"10.0.0.0/8", ".svc.cluster.local", "fd00::/8"}); err != nil {
+		t.Errorf("parseAllowed: %v", err)
+	}
+	if _, err := parseAllowed([]string{"promcache"}); err == nil {
+		t.Error("parseAllowed accepted a host name")
+	}
+}
+
+func TestMembershipMerge(t *testing.T) {
+	allowed, err := parseAllowed([]string{"10.0.0.0/24", ".promcache.svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &membership{
+		seeds:    []string{"http://seed:9091"},
+		members:  map[string]*member{"http://self:9091": {heartbeat: 1, updated: time.Now()}},
+		allowed:  allowed,
+		rejected: make(map[string]bool),
+	}
+
+	remote := map[string]int64{
+		"http://self:9091":               100,
+		"http://seed:9091":               1,
+		"http://static:9091":             1,
+		"http://10.0.0.5:9091":           1,
+		"https://a.promcache.svc:9091":   1,
+		"http://10.0.1.5:9091":           1,
+		"http://metadata.internal:80":    1,
+		"http://10.0.0.6":                1,
+		"http://user:pw@10.0.0.7:9091":   1,
+		"http://10.0.0.8:9091/api":       1,
+		"ftp://10.0.0.9:9091":            1,
+		"http://a.promcache.svc.evil:80": 1,
+	}
+	rejected := m.merge("http://self:9091", remote, []string{"http://static:9091"})
+
+	want := []string{"http://10.0.0.5:9091", "http://seed:9091", "http://self:9091", "http://static:9091", "https://a.promcache.svc:9091"}
+	if live := m.live(); !slices.Equal(live, want) {
+		t.Errorf("live members = %v, want %v", live, want)
+	}
+	if len(rejected) != 7 {
+		t.Errorf("rejected %d members, want 7: %v", len(rejected), rejected)
+	}
+	if m.members["http://self:9091"].heartbeat != 1 {
+		t.Error("heartbeat of self was taken from a peer")
+	}
+
+	// Rejected members are reported once
+	if rejected := m.merge("http://self:9091", remote, []string{"http://static:9091"}); len(rejected) != 0 {
+		t.Errorf("rejected members reported again: %v", rejected)
+	}
+}
+
+func TestMembershipHeartbeats(t *testing.T) {
+	m := &membership{
+		members:  map[string]*member{"http://self:9091": {heartbeat: 1, updated: time.Now()}},
+		rejected: make(map[string]bool),
+	}
+	m.merge("http://self:9091", map[string]int64{"http://peer:9091": 5}, []string{"http://peer:9091"})
+
+	// Older heartbeats don't refresh a member
+	m.members["http://peer:9091"].updated = time.Now().Add(-2 * memberTimeout)
+	m.merge("http://self:9091", map[string]int64{"http://peer:9091": 4}, []string{"http://peer:9091"})
+	if slices.Contains(m.live(), "http://peer:9091") {
+		t.Error("member without a new heartbeat is live")
+	}
+
+	// Newer ones do
+	m.merge("http://self:9091", map[string]int64{"http://peer:9091": 6}, []string{"http://peer:9091"})
+	if !slices.Contains(m.live(), "http://peer:9091") {
+		t.Error("member with a new heartbeat isn't live")
+	}
+
+	// Long dead members are dropped
+	m.members["http://peer:9091"].updated = time.Now().Add(-4 * memberTimeout)
+	m.tick("http://self:9091")
+	if _, found := m.members["http://peer:9091"]; found {
+		t.Error("dead member wasn't dropped")
+	}
+}
+
+func TestHandleMembersRejectsInjectedPeers(t *testing.T) {
+	c := newTestCluster(t, Config{Self: "http://10.0.0.1:9091", Seeds: []string{"http://10.0.0.2:9091"}, GossipAllowed: []string{"10.0.0.0/24"}})
+	body, _ := json.Marshal(map[string]int64{"http://10.0.0.3:9091": 1, "http://169.254.169.254:80": 1})
+	w := httptest.NewRecorder()
+	c.handleMembers(w, httptest.NewRequest(http.MethodPost, membersPath, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	peers := c.ring.Load().peers
+	if !slices.Contains(peers, "http://10.0.0.3:9091") {
+		t.Errorf("ring %v lacks the allowed member", peers)
+	}
+	if slices.Contains(peers, "http://169.254.169.254:80") {
+		t.Errorf("ring %v contains the injected member", peers)
+	}
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// replicas is the number of points each peer has on the ring, spreading
+// keys evenly even with few peers
+const replicas = 100
+
+// ring maps keys to peers by consistent hashing, so adding or removing a
+// peer only moves the keys of that peer
+type ring struct {
+	// peers are the sorted peers on the ring
+	peers []string
+	// version identifies the membership of the ring, peers agreeing on
+	// the membership have the same version
+	version uint32
+	hashes  []uint32
+	owners  map[uint32]string
+}
+
+// newRing creates a ring of the given peers
+func newRing(peers []string) *ring {
+	r := &ring{
+		peers:   peers,
+		version: crc32.ChecksumIEEE([]byte(strings.Join(peers, ","))),
+		owners:  make(map[uint32]string, len(peers)*replicas),
+	}
+	for _, peer := range peers {
+		for i := range replicas {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = peer
+		}
+	}
+	slices.Sort(r.hashes)
+	return r
+}
+
+// owner returns the peer owning key, empty if the ring has no peers
+func (r *ring) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearch(r.hashes, h)
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
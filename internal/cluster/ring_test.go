@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	if owner := newRing(nil).owner("key"); owner != "" {
+		t.Errorf("owner on an empty ring = %q, want none", owner)
+	}
+
+	peers := []string{"http://a:9091", "http://b:9091", "http://c:9091"}
+	r := newRing(peers)
+	counts := make(map[string]int)
+	for i := range 3000 {
+		key := "key" + strconv.Itoa(i)
+		owner := r.owner(key)
+		if owner != r.owner(key) {
+			t.Fatalf("owner of %s isn't stable", key)
+		}
+		counts[owner]++
+	}
+	for _, peer := range peers {
+		// Each peer should own roughly a third of the keys
+		if counts[peer] < 600 || counts[peer] > 1400 {
+			t.Errorf("%s owns %d of 3000 keys", peer, counts[peer])
+		}
+	}
+
+	if newRing(peers).version != r.version {
+		t.Error("rings of the same peers have different versions")
+	}
+	if newRing(peers[:2]).version == r.version {
+		t.Error("rings of different peers have the same version")
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	before := newRing([]string{"http://a:9091", "http://b:9091", "http://c:9091"})
+	added := newRing([]string{"http://a:9091", "http://b:9091", "http://c:9091", "http://d:9091"})
+	removed := newRing([]string{"http://a:9091", "http://c:9091"})
+
+	moved := 0
+	for i := range 3000 {
+		key := "key" + strconv.Itoa(i)
+		owner := before.owner(key)
+
+		// A new peer only takes over keys, the others keep theirs
+		if newOwner := added.owner(key); newOwner != owner {
+			moved++
+			if newOwner != "http://d:9091" {
+				t.Errorf("key %s moved from %s to %s, not to the added peer", key, owner, newOwner)
+			}
+		}
+
+		// Only the keys of a removed peer move
+		if newOwner := removed.owner(key); newOwner != owner && owner != "http://b:9091" {
+			t.Errorf("key %s moved from %s to %s, although its owner wasn't removed", key, owner, newOwner)
+		}
+	}
+	// The added peer should take over roughly a quarter of the keys
+	if moved < 400 || moved > 1100 {
+		t.Errorf("%d of 3000 keys moved to the added peer", moved)
+	}
+}
@@ -2,21 +2,251 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds the application configuration
 type Config struct {
+	// ConfigFile is the path to the optional JSON config file
+	ConfigFile string
+	// File holds the settings loaded from the config file
+	File File
+
 	// ListenAddr is the address where the server will listen for requests
 	ListenAddr string
+	// SocketMode is the file mode of Unix domain socket listeners
+	SocketMode uint
+	// AdminListenAddr is the address of the separate operational endpoints listener, empty serves them on ListenAddr
+	AdminListenAddr string
+	// AdminToken is the bearer token required by the endpoints that read or change the cache contents
+	AdminToken string
+	// ServerReadTimeout is the maximum duration for reading an entire request
+	ServerReadTimeout time.Duration
+	// ServerReadHeaderTimeout is the maximum duration for reading request headers
+	ServerReadHeaderTimeout time.Duration
+	// ServerWriteTimeout is the maximum duration before timing out writes of the response
+	ServerWriteTimeout time.Duration
+	// ServerIdleTimeout is the maximum time to wait for the next request on keep-alive connections
+	ServerIdleTimeout time.Duration
+	// ServerMaxHeaderBytes is the maximum size of request headers
+	ServerMaxHeaderBytes int
+	// HTTP2 enables HTTP/2, including cleartext h2c, on the listeners
+	HTTP2 bool
+	// ShutdownDrainTimeout bounds how long shutdown waits for in-flight requests
+	ShutdownDrainTimeout time.Duration
 	// UpstreamURL is the Prometheus server URL to forward requests to
 	UpstreamURL string
+	// LokiUpstream is the Grafana Loki server URL to forward /loki/api/ requests to, empty disables them
+	LokiUpstream string
+	// UpstreamTimeout is the overall upstream request timeout
+	UpstreamTimeout time.Duration
+	// UpstreamHedgeDelay is how long to wait for an upstream replica before sending the request to another one, 0 disables hedging
+	UpstreamHedgeDelay time.Duration
+	// UpstreamDialTimeout is the maximum time to establish upstream connections
+	UpstreamDialTimeout time.Duration
+	// UpstreamKeepAlive is the TCP keep-alive period of upstream connections
+	UpstreamKeepAlive time.Duration
+	// UpstreamTLSHandshakeTimeout is the maximum time to wait for upstream TLS handshakes
+	UpstreamTLSHandshakeTimeout time.Duration
+	// UpstreamMaxIdleConnsPerHost is the maximum number of idle upstream connections per host
+	UpstreamMaxIdleConnsPerHost int
+	// UpstreamIdleConnTimeout is how long idle upstream connections are kept open
+	UpstreamIdleConnTimeout time.Duration
+	// UpstreamDisableKeepAlives disables HTTP keep-alives to the upstream
+	UpstreamDisableKeepAlives bool
+	// UpstreamMaxInflight caps in-flight requests to the upstream, 0 means unlimited
+	UpstreamMaxInflight int
+	// GlobalMaxInflight caps in-flight upstream requests across all upstreams, 0 means unlimited
+	GlobalMaxInflight int
+	// UpstreamQueueTimeout is how long requests over the in-flight limits wait for a slot
+	UpstreamQueueTimeout time.Duration
 	// CacheTTL is the time-to-live for cached query results
 	CacheTTL time.Duration
+	// CacheTTLJitter is the maximum fraction by which entry TTLs are randomly shortened
+	CacheTTLJitter float64
+	// CacheCleanupInterval is how often expired entries are removed from memory
+	CacheCleanupInterval time.Duration
 	// LogLevel controls the logging verbosity
 	LogLevel slog.Level
+	// LogFormat is the log output format, text or json
+	LogFormat string
+	// LogDebugSampleRate is the fraction of debug log records written
+	LogDebugSampleRate float64
+	// LogDebugKeyLimit is the number of debug log records written per message and cache key and minute, 0 means unlimited
+	LogDebugKeyLimit int
+	// LogRedact replaces cache keys and query contents in logs by their hash
+	LogRedact bool
+	// NativeHistograms adds native histogram buckets to the latency and size metrics
+	NativeHistograms bool
+	// MetricsPushURL is where metrics are pushed to, statsd:// or an OTLP/HTTP endpoint, empty disables pushing
+	MetricsPushURL string
+	// MetricsPushInterval is the time between metrics pushes
+	MetricsPushInterval time.Duration
+	// MetricsPushHeaders are headers added to OTLP metrics pushes
+	MetricsPushHeaders map[string]string
+	// EnablePprof exposes net/http/pprof handlers on the admin endpoints
+	EnablePprof bool
+	// DebugTrace adds a JSON trace of internal request handling steps to every response
+	DebugTrace bool
+	// AutoMaxProcs sets GOMAXPROCS from the container CPU quota
+	AutoMaxProcs bool
+	// KeepWarmInterval is the interval between upstream keep-warm queries, 0 disables them
+	KeepWarmInterval time.Duration
+	// KeepWarmQuery is the PromQL expression sent upstream by the keep-warm pinger
+	KeepWarmQuery string
+	// CacheCompress enables gzip compression of cached response bodies
+	CacheCompress bool
+	// CacheCompressMinBytes is the minimum body size before cached bodies are compressed
+	CacheCompressMinBytes int
+	// CacheParseMatrix stores range query results decoded instead of as JSON
+	CacheParseMatrix bool
+	// CacheMaxObjectBytes is the maximum response body size that will be cached, 0 means unlimited
+	CacheMaxObjectBytes int
+	// CacheSnapshotFile is the file the cache is saved to on shutdown and restored from on startup, empty disables
+	CacheSnapshotFile string
+	// CacheKeyHash stores entries under a hash of the normalized cache key
+	CacheKeyHash bool
+	// CacheKeyDebug keeps the readable form of hashed cache keys for /debug/cache
+	CacheKeyDebug bool
+	// CacheKeyNamespace prefixes every cache key
+	CacheKeyNamespace string
+	// RateLimit is the per-client request rate in requests per second, 0 disables rate limiting
+	RateLimit float64
+	// RateLimitBurst is the number of requests a client may burst above the rate
+	RateLimitBurst int
+	// RateLimitKey identifies clients for rate limiting, "ip" or "header:<name>"
+	RateLimitKey string
+	// MaxQueryPoints is the maximum number of points per series of range queries, 0 means unlimited
+	MaxQueryPoints int
+	// MaxQueryRange is the maximum time range of queries, 0 means unlimited
+	MaxQueryRange time.Duration
+	// QueryLimitAction is what happens to queries exceeding the limits (reject, clamp)
+	QueryLimitAction string
+	// TenantHeader is the request header identifying the tenant
+	TenantHeader string
+	// EnforceLabel is a label matcher injected into every query, empty disables enforcement
+	EnforceLabel string
+	// EnforceLabelHeader is the request header holding the enforced label's value
+	EnforceLabelHeader string
+	// CORSAllowedOrigins are the origins allowed to query the API from browsers, empty disables CORS
+	CORSAllowedOrigins []string
+	// CORSAllowedMethods are the request methods allowed for cross-origin requests
+	CORSAllowedMethods []string
+	// CORSAllowedHeaders are the request headers allowed for cross-origin requests
+	CORSAllowedHeaders []string
+	// CORSAllowCredentials allows cross-origin requests with credentials
+	CORSAllowCredentials bool
+	// CORSMaxAge is how long browsers may cache preflight responses
+	CORSMaxAge time.Duration
+	// Peers are the URLs of the cluster peers sharing the cache
+	Peers []string
+	// PeersDNS is a host:port whose addresses are the cluster peers
+	PeersDNS string
+	// GossipSeeds are the URLs of peers to join the gossip membership through
+	GossipSeeds []string
+	// GossipAllowedNetworks are the CIDRs and domains of members accepted from gossip besides the seeds and configured peers
+	GossipAllowedNetworks []string
+	// PeerSelf is the URL peers reach this instance at
+	PeerSelf string
+	// PeerSecret authenticates requests between peers
+	PeerSecret string
+	// PeerTimeout bounds requests to peers
+	PeerTimeout time.Duration
+	// PeerHandoff is how long the previous owners of keys keep serving them after a membership change
+	PeerHandoff time.Duration
+	// PeerFailureMode is what happens to requests when the owning peer is unreachable (open, closed)
+	PeerFailureMode string
+	// CacheKeyExcludeParams are query parameters left out of cache keys
+	CacheKeyExcludeParams []string
+	// AllowedEndpoints are admin and write endpoint paths passed through to the upstream instead of being blocked
+	AllowedEndpoints []string
+	// GenericPaths are path prefixes outside the API served as a generic RFC 7234 HTTP cache
+	GenericPaths []string
+	// CacheSerializer is the encoding of cached values (binary, json, msgpack, protobuf, raw)
+	CacheSerializer string
+	// EmptyResultPolicy controls caching of empty query results (cache, skip, short)
+	EmptyResultPolicy string
+	// EmptyResultTTL is the TTL for empty query results under the short policy
+	EmptyResultTTL time.Duration
+	// FederateTTL is the cache TTL of /federate responses
+	FederateTTL time.Duration
+	// MetadataTTL is the cache TTL of metric metadata responses
+	MetadataTTL time.Duration
+	// RulesTTL is the cache TTL of rule and alert responses
+	RulesTTL time.Duration
+	// ValidateResponses only caches bodies that are valid Prometheus API responses
+	ValidateResponses bool
+	// MaxHops is the maximum number of promcached hops before a request is rejected as a loop
+	MaxHops int
+	// InstanceName identifies this instance in Via and X-Cache headers
+	InstanceName string
+	// UpstreamIsPromcache marks the upstream as a parent promcached tier
+	UpstreamIsPromcache bool
+	// ExactTime disables rounding of time parameters in favour of a freshness budget
+	ExactTime bool
+	// FreshnessBudget is the maximum distance between requested and cached evaluation times in exact-time mode
+	FreshnessBudget time.Duration
+	// RecentWindow splits range queries ending within this window of now into a cached head and a fresh tail, 0 disables splitting
+	RecentWindow time.Duration
+	// MinCacheableAge is how long before now the end or evaluation time of a query must be for it to be cached, 0 caches all
+	MinCacheableAge time.Duration
+	// MinCacheableAgeTTL caches queries within the minimum cacheable age for this long instead of not at all
+	MinCacheableAgeTTL time.Duration
+	// AdaptiveTTLThreshold is the upstream duration of queries cached for the cache TTL, faster ones are cached shorter and slower ones longer, 0 disables adaptive TTLs
+	AdaptiveTTLThreshold time.Duration
+	// AdaptiveTTLMin is the shortest adaptive TTL
+	AdaptiveTTLMin time.Duration
+	// AdaptiveTTLMax is the longest adaptive TTL
+	AdaptiveTTLMax time.Duration
+	// MinCacheDuration only caches queries the upstream took at least this long for, unless they exceed the sample threshold
+	MinCacheDuration time.Duration
+	// MinCacheSamples only caches queries costing at least this many samples, unless they exceed the duration threshold
+	MinCacheSamples int
+	// MaxHeaderTTL caps the TTL clients may request with the X-Promcache-TTL header, 0 ignores the header
+	MaxHeaderTTL time.Duration
+	// UpstreamTTLHints caches responses for the TTL set by the upstream's Cache-Control or Expires headers
+	UpstreamTTLHints bool
+	// Downsample is how range queries are answered from cached responses at a finer step (off, pick, avg)
+	Downsample string
+	// Shadow forwards every request to the upstream and only simulates caching
+	Shadow bool
+	// ServeStale serves stale entries of generic paths when the upstream fails
+	ServeStale bool
+	// Coalesce makes identical concurrent cache misses wait for the first one
+	Coalesce bool
+	// VerifyFraction is the fraction of cache hits compared against the upstream in the background
+	VerifyFraction float64
+	// QueryHitsMetricLimit is the number of query fingerprints exposed as promcache_query_hits_total labels
+	QueryHitsMetricLimit int
+	// QueryStatsLogInterval is how often the most expensive queries are logged, 0 disables the summary
+	QueryStatsLogInterval time.Duration
+	// QueryStatsLogTop is the number of queries in each summary
+	QueryStatsLogTop int
+	// DashboardMetricLimit is the number of Grafana dashboards exposed as promcache_dashboard_requests_total labels
+	DashboardMetricLimit int
+	// AuthMetricLimit is the number of API key and tenant names exposed as promcache_auth_requests_total labels
+	AuthMetricLimit int
+	// TenantMetricLimit is the number of tenants exposed as promcache_tenant_requests_total labels, 0 disables the metric
+	TenantMetricLimit int
+	// TenantMetricHash exposes tenants in metrics by a hash of their ID
+	TenantMetricHash bool
+	// RecordFile is the file requests are logged to for replay, empty disables recording
+	RecordFile string
+	// ThanosListenAddr is the address of the Thanos StoreAPI gRPC listener, empty disables it
+	ThanosListenAddr string
+	// ThanosUpstream is the URL of the Thanos StoreAPI endpoint to forward gRPC calls to
+	ThanosUpstream string
+	// ThanosParamDefaults are values of Thanos query parameters set on requests leaving them out
+	ThanosParamDefaults map[string]string
 }
 
 // Parse parses configuration from command-line flags and environment variables
@@ -24,30 +254,261 @@ func Parse() *Config {
 	cfg := &Config{}
 
 	// Command-line flags
-	flag.StringVar(&cfg.ListenAddr, "listen", ":9091", "Address to listen on")
-	flag.StringVar(&cfg.UpstreamURL, "upstream", "http://localhost:9090", "Prometheus upstream URL")
+	flag.StringVar(&cfg.ConfigFile, "config", "", "Path to the JSON config file")
+	flag.StringVar(&cfg.ListenAddr, "listen", ":9091", "Address to listen on, unix:///path for a Unix domain socket")
+	flag.UintVar(&cfg.SocketMode, "listen-socket-mode", 0o660, "File mode of unix:// socket listeners")
+	flag.StringVar(&cfg.AdminListenAddr, "admin-listen", "", "Address to serve /metrics, /health and /debug/* on (default: the main listener)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "Bearer token required by the cache purge, export and import endpoints and the runtime toggles")
+	flag.DurationVar(&cfg.ServerReadTimeout, "server-read-timeout", 30*time.Second, "Maximum duration for reading an entire request (0 disables)")
+	flag.DurationVar(&cfg.ServerReadHeaderTimeout, "server-read-header-timeout", 10*time.Second, "Maximum duration for reading request headers (0 disables)")
+	flag.DurationVar(&cfg.ServerWriteTimeout, "server-write-timeout", 5*time.Minute, "Maximum duration before timing out writes of the response (0 disables)")
+	flag.DurationVar(&cfg.ServerIdleTimeout, "server-idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on keep-alive connections (0 disables)")
+	flag.IntVar(&cfg.ServerMaxHeaderBytes, "server-max-header-bytes", 1<<20, "Maximum size of request headers in bytes")
+	flag.BoolVar(&cfg.HTTP2, "http2", true, "Serve HTTP/2, including cleartext h2c, on the listeners")
+	flag.DurationVar(&cfg.ShutdownDrainTimeout, "shutdown-drain-timeout", 30*time.Second, "Maximum time shutdown waits for in-flight requests to finish")
+	flag.StringVar(&cfg.UpstreamURL, "upstream", "http://localhost:9090", "Prometheus upstream URL, dns+http://host:port or k8s+http://service.namespace:port spreads requests across all addresses of host")
+	flag.DurationVar(&cfg.UpstreamTimeout, "upstream-timeout", 30*time.Second, "Overall upstream request timeout, shortened by a query's timeout parameter (0 disables)")
+	flag.StringVar(&cfg.LokiUpstream, "loki-upstream", "", "Grafana Loki server URL to forward and cache /loki/api/ requests to (empty disables)")
+	flag.DurationVar(&cfg.UpstreamHedgeDelay, "upstream-hedge-delay", 0, "How long to wait for a dns+ or k8s+ upstream replica before also sending the request to another one (0 disables)")
+	flag.DurationVar(&cfg.UpstreamDialTimeout, "upstream-dial-timeout", 30*time.Second, "Maximum time to establish upstream connections")
+	flag.DurationVar(&cfg.UpstreamKeepAlive, "upstream-keepalive", 30*time.Second, "TCP keep-alive period of upstream connections (negative disables)")
+	flag.DurationVar(&cfg.UpstreamTLSHandshakeTimeout, "upstream-tls-handshake-timeout", 10*time.Second, "Maximum time to wait for upstream TLS handshakes")
+	flag.IntVar(&cfg.UpstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", 100, "Maximum number of idle upstream connections per host")
+	flag.DurationVar(&cfg.UpstreamIdleConnTimeout, "upstream-idle-conn-timeout", 90*time.Second, "How long idle upstream connections are kept open")
+	flag.BoolVar(&cfg.UpstreamDisableKeepAlives, "upstream-disable-keepalives", false, "Disable HTTP keep-alives to the upstream")
+	flag.IntVar(&cfg.UpstreamMaxInflight, "upstream-max-inflight", 0, "Maximum in-flight requests to the upstream (0 means unlimited)")
+	flag.IntVar(&cfg.GlobalMaxInflight, "global-max-inflight", 0, "Maximum in-flight upstream requests across all upstreams (0 means unlimited)")
+	flag.DurationVar(&cfg.UpstreamQueueTimeout, "upstream-queue-timeout", 10*time.Second, "How long requests over the in-flight limits wait for a slot before failing with 503")
 	flag.DurationVar(&cfg.CacheTTL, "ttl", 5*time.Minute, "Cache TTL duration")
+	flag.Float64Var(&cfg.CacheTTLJitter, "ttl-jitter", 0, "Maximum fraction (0-1) by which entry TTLs are randomly shortened")
+	flag.DurationVar(&cfg.CacheCleanupInterval, "cache-cleanup-interval", 10*time.Second, "How often expired cache entries are removed from memory")
+	flag.BoolVar(&cfg.ExactTime, "exact-time", false, "Never rewrite time parameters; serve cached entries within the freshness budget instead")
+	flag.DurationVar(&cfg.FreshnessBudget, "freshness-budget", 30*time.Second, "Maximum distance between requested and cached evaluation times in exact-time mode")
+	flag.DurationVar(&cfg.MinCacheableAge, "min-cacheable-age", 0, "Don't cache queries whose end or evaluation time is less than this before now (default: cache all)")
+	flag.DurationVar(&cfg.MinCacheableAgeTTL, "min-cacheable-age-ttl", 0, "Cache queries within -min-cacheable-age for this long instead of not at all")
+	flag.DurationVar(&cfg.AdaptiveTTLThreshold, "adaptive-ttl-threshold", 0, "Cache queries the upstream took this long for -ttl, scaling the TTL of faster and slower queries by their upstream duration (default: disabled)")
+	flag.DurationVar(&cfg.AdaptiveTTLMin, "adaptive-ttl-min", 30*time.Second, "Shortest TTL of cheap queries with -adaptive-ttl-threshold")
+	flag.DurationVar(&cfg.AdaptiveTTLMax, "adaptive-ttl-max", time.Hour, "Longest TTL of expensive queries with -adaptive-ttl-threshold")
+	flag.DurationVar(&cfg.MinCacheDuration, "cache-min-duration", 0, "Only cache queries the upstream took at least this long for, unless they exceed -cache-min-samples (default: cache all)")
+	flag.IntVar(&cfg.MinCacheSamples, "cache-min-samples", 0, "Only cache queries costing at least this many samples, unless they exceed -cache-min-duration (default: cache all)")
+	flag.DurationVar(&cfg.MaxHeaderTTL, "ttl-header-max", 0, "Honor TTLs requested by clients with the X-Promcache-TTL header up to this long (default: ignore the header)")
+	flag.BoolVar(&cfg.UpstreamTTLHints, "upstream-ttl-hints", true, "Cache responses for the TTL set by the upstream's Cache-Control max-age or s-maxage or Expires headers instead of -ttl")
+	flag.DurationVar(&cfg.RecentWindow, "recent-window", 0, "Split range queries ending within this window of now into a cached head and a tail always fetched from the upstream (default: disabled)")
+	flag.StringVar(&cfg.Downsample, "downsample", "off", "Answer range queries from cached responses at a finer step that divides theirs (off, pick: latest sample per step, avg: average per step)")
+	flag.BoolVar(&cfg.Shadow, "shadow", false, "Forward every request to the upstream and only simulate caching, exposing the would-be hit ratio as metrics")
+	flag.BoolVar(&cfg.ServeStale, "serve-stale", true, "Serve stale entries of generic paths when the upstream fails")
+	flag.BoolVar(&cfg.Coalesce, "coalesce", false, "Make identical concurrent cache misses wait for the first one to fill the cache instead of all querying the upstream")
+	flag.Float64Var(&cfg.VerifyFraction, "verify-fraction", 0, "Fraction (0-1) of cache hits also sent to the upstream in the background to compare the responses")
+	flag.IntVar(&cfg.QueryHitsMetricLimit, "query-hits-metric-limit", 100, "Number of query fingerprints counted separately in promcache_query_hits_total, the rest are counted as other")
+	flag.DurationVar(&cfg.QueryStatsLogInterval, "query-stats-log-interval", 0, "Interval between logs of the queries that took the upstream the longest (0 disables)")
+	flag.IntVar(&cfg.QueryStatsLogTop, "query-stats-log-top", 10, "Number of queries logged every -query-stats-log-interval")
+	flag.IntVar(&cfg.DashboardMetricLimit, "dashboard-metric-limit", 100, "Number of Grafana dashboards counted separately in promcache_dashboard_requests_total, the rest are counted as other")
+	flag.IntVar(&cfg.AuthMetricLimit, "auth-metric-limit", 100, "Number of API key and token names counted separately in promcache_auth_requests_total, the rest are counted as other")
+	flag.IntVar(&cfg.TenantMetricLimit, "tenant-metric-limit", 0, "Number of tenants counted separately in promcache_tenant_requests_total, the rest are counted as other (0 disables the metric)")
+	flag.BoolVar(&cfg.TenantMetricHash, "tenant-metric-hash", false, "Label tenant metrics with a hash of the tenant ID instead of the ID")
+	flag.StringVar(&cfg.RecordFile, "record-file", "", "File to append a log of API requests to for promcached replay (default: disabled)")
+	flag.BoolVar(&cfg.NativeHistograms, "native-histograms", false, "Expose the latency and size histograms as native histograms too, for Prometheus scraping with native histograms enabled")
+	flag.BoolVar(&cfg.EnablePprof, "pprof", false, "Expose /debug/pprof/ profiling endpoints alongside the other operational endpoints")
+	flag.BoolVar(&cfg.DebugTrace, "debug-trace", false, "Add a JSON trace of internal request handling steps to every response")
+	flag.BoolVar(&cfg.AutoMaxProcs, "auto-maxprocs", true, "Set GOMAXPROCS from the container CPU quota unless GOMAXPROCS is set")
+	flag.DurationVar(&cfg.KeepWarmInterval, "keepwarm-interval", 0, "Interval between upstream keep-warm queries (0 disables)")
+	flag.StringVar(&cfg.KeepWarmQuery, "keepwarm-query", "vector(1)", "PromQL expression used by the upstream keep-warm pinger")
+	flag.BoolVar(&cfg.CacheCompress, "cache-compress", true, "Store cached response bodies gzip-compressed")
+	flag.IntVar(&cfg.CacheCompressMinBytes, "cache-compress-min-bytes", 1024, "Minimum body size in bytes before cached bodies are compressed")
+	flag.BoolVar(&cfg.CacheParseMatrix, "cache-parse-matrix", false, "Store range query results as decoded series and samples, re-encoded to JSON when served")
+	flag.StringVar(&cfg.EmptyResultPolicy, "empty-result-policy", "cache", "Caching policy for empty query results (cache, skip, short)")
+	flag.DurationVar(&cfg.EmptyResultTTL, "empty-result-ttl", 30*time.Second, "Cache TTL for empty query results with the short policy")
+	flag.DurationVar(&cfg.FederateTTL, "federate-ttl", 15*time.Second, "Cache TTL of /federate responses (0 uses -ttl)")
+	flag.DurationVar(&cfg.MetadataTTL, "metadata-ttl", 15*time.Minute, "Cache TTL of /api/v1/metadata and /api/v1/targets/metadata responses (0 uses -ttl)")
+	flag.DurationVar(&cfg.RulesTTL, "rules-ttl", 10*time.Second, "Cache TTL of /api/v1/rules and /api/v1/alerts responses (0 uses -ttl)")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&cfg.InstanceName, "instance-name", hostname, "Name identifying this instance in Via and X-Cache headers")
+	flag.BoolVar(&cfg.UpstreamIsPromcache, "upstream-promcache", false, "Upstream is a parent promcached tier (edge/regional deployment)")
+	flag.IntVar(&cfg.MaxHops, "max-hops", 8, "Maximum number of promcached hops before a request is rejected as a loop (0 disables)")
+	flag.BoolVar(&cfg.ValidateResponses, "validate-responses", true, "Only cache valid Prometheus API responses with status success")
+	flag.BoolVar(&cfg.CacheKeyHash, "cache-key-hash", true, "Store entries under a SHA-256 hash of the normalized cache key")
+	flag.BoolVar(&cfg.CacheKeyDebug, "cache-key-debug", false, "Keep the readable form of hashed cache keys for /debug/cache")
+	flag.StringVar(&cfg.CacheKeyNamespace, "cache-key-namespace", "", "Namespace prefixed to every cache key, for instances sharing a cache")
+	flag.StringVar(&cfg.CacheSerializer, "cache-serializer", "binary", "Encoding of cached values (binary, json, msgpack, protobuf, raw)")
+	flag.IntVar(&cfg.CacheMaxObjectBytes, "cache-max-object-bytes", 0, "Maximum response body size in bytes that will be cached (0 means unlimited)")
+	flag.StringVar(&cfg.CacheSnapshotFile, "cache-snapshot-file", "", "File the cache is saved to on shutdown and restored from on startup (empty disables)")
 
+	flag.Float64Var(&cfg.RateLimit, "ratelimit", 0, "Per-client request rate in requests per second (0 disables)")
+	flag.IntVar(&cfg.RateLimitBurst, "ratelimit-burst", 20, "Number of requests a client may burst above the rate")
+	flag.StringVar(&cfg.RateLimitKey, "ratelimit-key", "ip", "How clients are identified for rate limiting (ip, header:<name>)")
+	flag.IntVar(&cfg.MaxQueryPoints, "max-query-points", 0, "Maximum number of points per series of range queries (0 means unlimited)")
+	flag.DurationVar(&cfg.MaxQueryRange, "max-query-range", 0, "Maximum time range of queries (0 means unlimited)")
+	flag.StringVar(&cfg.QueryLimitAction, "query-limit-action", "reject", "What happens to queries exceeding the limits (reject, clamp)")
+	flag.StringVar(&cfg.TenantHeader, "tenant-header", "X-Scope-OrgID", "Request header identifying the tenant")
+	flag.StringVar(&cfg.EnforceLabel, "enforce-label", "", "Label matcher injected into every query, with its value taken from a request header (empty disables)")
+	flag.StringVar(&cfg.EnforceLabelHeader, "enforce-label-header", "", "Request header holding the enforced label's value (default: the tenant header)")
+	var corsOriginsStr, corsMethodsStr, corsHeadersStr string
+	flag.StringVar(&corsOriginsStr, "cors-allowed-origins", "", "Comma-separated origins allowed to query the API from browsers, * for any (empty disables CORS)")
+	flag.StringVar(&corsMethodsStr, "cors-allowed-methods", "GET,POST,OPTIONS", "Comma-separated request methods allowed for cross-origin requests")
+	flag.StringVar(&corsHeadersStr, "cors-allowed-headers", "Accept,Authorization,Content-Type,X-API-Key,X-Scope-OrgID", "Comma-separated request headers allowed for cross-origin requests")
+	flag.BoolVar(&cfg.CORSAllowCredentials, "cors-allow-credentials", false, "Allow cross-origin requests with credentials")
+	flag.DurationVar(&cfg.CORSMaxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache preflight responses")
+	var peersStr string
+	flag.StringVar(&peersStr, "peers", "", "Comma-separated URLs of cluster peers sharing the cache (empty disables clustering)")
+	flag.StringVar(&cfg.PeersDNS, "peers-dns", "", "host:port whose DNS addresses are the cluster peers")
+	var gossipSeedsStr string
+	flag.StringVar(&gossipSeedsStr, "gossip-seeds", "", "Comma-separated URLs of peers to discover the cluster through by gossip")
+	var gossipAllowedStr string
+	flag.StringVar(&gossipAllowedStr, "gossip-allowed-networks", "", "Comma-separated CIDRs and domains starting with a dot of the members accepted from gossip besides the seeds and configured peers")
+	flag.StringVar(&cfg.PeerSelf, "peer-self", "", "URL peers reach this instance at, required with -peers, -peers-dns or -gossip-seeds")
+	flag.StringVar(&cfg.PeerSecret, "peer-secret", "", "Shared secret authenticating requests between peers, required with -peers, -peers-dns or -gossip-seeds")
+	flag.DurationVar(&cfg.PeerTimeout, "peer-timeout", 2*time.Second, "Maximum duration of cache requests to peers")
+	flag.DurationVar(&cfg.PeerHandoff, "peer-handoff", 2*time.Minute, "How long the previous owners of keys keep serving and receiving them after a cluster membership change (0 disables)")
+	flag.StringVar(&cfg.PeerFailureMode, "peer-failure-mode", "open", "What happens to requests when the owning peer is unreachable (open: query the upstream, closed: fail with 503)")
+	flag.StringVar(&cfg.ThanosListenAddr, "thanos-listen", "", "Address to serve the cached Thanos StoreAPI over gRPC on (empty disables)")
+	flag.StringVar(&cfg.ThanosUpstream, "thanos-upstream", "", "URL of the Thanos StoreAPI endpoint, http:// for cleartext or https:// for TLS gRPC")
+	var allowedEndpointsStr, genericPathsStr string
+	flag.StringVar(&allowedEndpointsStr, "allow-endpoints", "", "Comma-separated admin and write endpoint paths to pass through to the upstream, e.g. /api/v1/admin/tsdb/snapshot (default: all blocked)")
+	flag.StringVar(&genericPathsStr, "generic-paths", "", "Comma-separated path prefixes outside the API to serve as a generic HTTP cache following the upstream's Cache-Control headers, e.g. /static/ (default: none)")
+	flag.StringVar(&cfg.MetricsPushURL, "metrics-push-url", "", "Push metrics to statsd (statsd://host:port) or an OTLP/HTTP endpoint (e.g. http://collector:4318/v1/metrics) too (empty disables)")
+	flag.DurationVar(&cfg.MetricsPushInterval, "metrics-push-interval", 15*time.Second, "Interval between metrics pushes")
+	var metricsPushHeadersStr string
+	flag.StringVar(&metricsPushHeadersStr, "metrics-push-headers", "", "Comma-separated name=value headers added to OTLP metrics pushes, e.g. Authorization=Bearer token")
+	var thanosDefaultsStr string
+	flag.StringVar(&thanosDefaultsStr, "thanos-param-defaults", "", "Comma-separated name=value defaults of Thanos query parameters (dedup, partial_response, max_source_resolution), e.g. dedup=true,partial_response=false")
+	var excludeParamsStr string
+	flag.StringVar(&excludeParamsStr, "cache-key-exclude-params", "timeout,_", "Comma-separated query parameters left out of cache keys")
 	var logLevelStr string
 	flag.StringVar(&logLevelStr, "log-level", "info", "Log level (debug, info, warn, error)")
+	flag.StringVar(&cfg.LogFormat, "log-format", "text", "Log output format (text, json)")
+	flag.Float64Var(&cfg.LogDebugSampleRate, "log-debug-sample-rate", 1, "Fraction (0-1) of debug log records written")
+	flag.IntVar(&cfg.LogDebugKeyLimit, "log-debug-key-limit", 0, "Debug log records written per message and cache key and minute (default: unlimited)")
+	flag.BoolVar(&cfg.LogRedact, "log-redact", false, "Replace cache keys and query contents in logs by their hash")
 
 	flag.Parse()
 
 	// Environment variables override flags
-	if addr := os.Getenv("PROMCACHE_LISTEN_ADDR"); addr != "" {
-		cfg.ListenAddr = addr
-	}
-	if url := os.Getenv("PROMCACHE_UPSTREAM_URL"); url != "" {
-		cfg.UpstreamURL = url
-	}
-	if ttl := os.Getenv("PROMCACHE_TTL"); ttl != "" {
-		if parsed, err := time.ParseDuration(ttl); err == nil {
-			cfg.CacheTTL = parsed
-		}
-	}
-	if level := os.Getenv("PROMCACHE_LOG_LEVEL"); level != "" {
-		logLevelStr = level
-	}
+	envString("PROMCACHE_CONFIG_FILE", &cfg.ConfigFile)
+	envString("PROMCACHE_LISTEN_ADDR", &cfg.ListenAddr)
+	envString("PROMCACHE_ADMIN_LISTEN_ADDR", &cfg.AdminListenAddr)
+	envString("PROMCACHE_ADMIN_TOKEN", &cfg.AdminToken)
+	envUint("PROMCACHE_LISTEN_SOCKET_MODE", &cfg.SocketMode)
+	envDuration("PROMCACHE_SERVER_READ_TIMEOUT", &cfg.ServerReadTimeout)
+	envDuration("PROMCACHE_SERVER_READ_HEADER_TIMEOUT", &cfg.ServerReadHeaderTimeout)
+	envDuration("PROMCACHE_SERVER_WRITE_TIMEOUT", &cfg.ServerWriteTimeout)
+	envDuration("PROMCACHE_SERVER_IDLE_TIMEOUT", &cfg.ServerIdleTimeout)
+	envInt("PROMCACHE_SERVER_MAX_HEADER_BYTES", &cfg.ServerMaxHeaderBytes)
+	envString("PROMCACHE_UPSTREAM_URL", &cfg.UpstreamURL)
+	envBool("PROMCACHE_HTTP2", &cfg.HTTP2)
+	envDuration("PROMCACHE_SHUTDOWN_DRAIN_TIMEOUT", &cfg.ShutdownDrainTimeout)
+	envDuration("PROMCACHE_UPSTREAM_TIMEOUT", &cfg.UpstreamTimeout)
+	envDuration("PROMCACHE_UPSTREAM_HEDGE_DELAY", &cfg.UpstreamHedgeDelay)
+	envString("PROMCACHE_LOKI_UPSTREAM", &cfg.LokiUpstream)
+	envDuration("PROMCACHE_UPSTREAM_DIAL_TIMEOUT", &cfg.UpstreamDialTimeout)
+	envDuration("PROMCACHE_UPSTREAM_KEEPALIVE", &cfg.UpstreamKeepAlive)
+	envDuration("PROMCACHE_UPSTREAM_TLS_HANDSHAKE_TIMEOUT", &cfg.UpstreamTLSHandshakeTimeout)
+	envInt("PROMCACHE_UPSTREAM_MAX_IDLE_CONNS_PER_HOST", &cfg.UpstreamMaxIdleConnsPerHost)
+	envDuration("PROMCACHE_UPSTREAM_IDLE_CONN_TIMEOUT", &cfg.UpstreamIdleConnTimeout)
+	envBool("PROMCACHE_UPSTREAM_DISABLE_KEEPALIVES", &cfg.UpstreamDisableKeepAlives)
+	envInt("PROMCACHE_UPSTREAM_MAX_INFLIGHT", &cfg.UpstreamMaxInflight)
+	envInt("PROMCACHE_GLOBAL_MAX_INFLIGHT", &cfg.GlobalMaxInflight)
+	envDuration("PROMCACHE_UPSTREAM_QUEUE_TIMEOUT", &cfg.UpstreamQueueTimeout)
+	envDuration("PROMCACHE_TTL", &cfg.CacheTTL)
+	envFloat("PROMCACHE_TTL_JITTER", &cfg.CacheTTLJitter)
+	envDuration("PROMCACHE_CACHE_CLEANUP_INTERVAL", &cfg.CacheCleanupInterval)
+	envString("PROMCACHE_LOG_LEVEL", &logLevelStr)
+	envString("PROMCACHE_LOG_FORMAT", &cfg.LogFormat)
+	envFloat("PROMCACHE_LOG_DEBUG_SAMPLE_RATE", &cfg.LogDebugSampleRate)
+	envInt("PROMCACHE_LOG_DEBUG_KEY_LIMIT", &cfg.LogDebugKeyLimit)
+	envBool("PROMCACHE_LOG_REDACT", &cfg.LogRedact)
+	envBool("PROMCACHE_EXACT_TIME", &cfg.ExactTime)
+	envDuration("PROMCACHE_FRESHNESS_BUDGET", &cfg.FreshnessBudget)
+	envDuration("PROMCACHE_RECENT_WINDOW", &cfg.RecentWindow)
+	envDuration("PROMCACHE_MIN_CACHEABLE_AGE", &cfg.MinCacheableAge)
+	envDuration("PROMCACHE_MIN_CACHEABLE_AGE_TTL", &cfg.MinCacheableAgeTTL)
+	envDuration("PROMCACHE_ADAPTIVE_TTL_THRESHOLD", &cfg.AdaptiveTTLThreshold)
+	envDuration("PROMCACHE_ADAPTIVE_TTL_MIN", &cfg.AdaptiveTTLMin)
+	envDuration("PROMCACHE_ADAPTIVE_TTL_MAX", &cfg.AdaptiveTTLMax)
+	envDuration("PROMCACHE_CACHE_MIN_DURATION", &cfg.MinCacheDuration)
+	envInt("PROMCACHE_CACHE_MIN_SAMPLES", &cfg.MinCacheSamples)
+	envDuration("PROMCACHE_TTL_HEADER_MAX", &cfg.MaxHeaderTTL)
+	envBool("PROMCACHE_UPSTREAM_TTL_HINTS", &cfg.UpstreamTTLHints)
+	envString("PROMCACHE_DOWNSAMPLE", &cfg.Downsample)
+	envBool("PROMCACHE_SHADOW", &cfg.Shadow)
+	envBool("PROMCACHE_SERVE_STALE", &cfg.ServeStale)
+	envBool("PROMCACHE_COALESCE", &cfg.Coalesce)
+	envFloat("PROMCACHE_VERIFY_FRACTION", &cfg.VerifyFraction)
+	envInt("PROMCACHE_QUERY_HITS_METRIC_LIMIT", &cfg.QueryHitsMetricLimit)
+	envDuration("PROMCACHE_QUERY_STATS_LOG_INTERVAL", &cfg.QueryStatsLogInterval)
+	envInt("PROMCACHE_QUERY_STATS_LOG_TOP", &cfg.QueryStatsLogTop)
+	envInt("PROMCACHE_DASHBOARD_METRIC_LIMIT", &cfg.DashboardMetricLimit)
+	envInt("PROMCACHE_AUTH_METRIC_LIMIT", &cfg.AuthMetricLimit)
+	envInt("PROMCACHE_TENANT_METRIC_LIMIT", &cfg.TenantMetricLimit)
+	envBool("PROMCACHE_TENANT_METRIC_HASH", &cfg.TenantMetricHash)
+	envString("PROMCACHE_RECORD_FILE", &cfg.RecordFile)
+	envBool("PROMCACHE_NATIVE_HISTOGRAMS", &cfg.NativeHistograms)
+	envBool("PROMCACHE_PPROF", &cfg.EnablePprof)
+	envBool("PROMCACHE_DEBUG_TRACE", &cfg.DebugTrace)
+	envBool("PROMCACHE_AUTO_MAXPROCS", &cfg.AutoMaxProcs)
+	envDuration("PROMCACHE_KEEPWARM_INTERVAL", &cfg.KeepWarmInterval)
+	envString("PROMCACHE_KEEPWARM_QUERY", &cfg.KeepWarmQuery)
+	envBool("PROMCACHE_CACHE_COMPRESS", &cfg.CacheCompress)
+	envInt("PROMCACHE_CACHE_COMPRESS_MIN_BYTES", &cfg.CacheCompressMinBytes)
+	envBool("PROMCACHE_CACHE_PARSE_MATRIX", &cfg.CacheParseMatrix)
+	envInt("PROMCACHE_CACHE_MAX_OBJECT_BYTES", &cfg.CacheMaxObjectBytes)
+	envString("PROMCACHE_CACHE_SNAPSHOT_FILE", &cfg.CacheSnapshotFile)
+	envString("PROMCACHE_CACHE_SERIALIZER", &cfg.CacheSerializer)
+	envBool("PROMCACHE_CACHE_KEY_HASH", &cfg.CacheKeyHash)
+	envBool("PROMCACHE_CACHE_KEY_DEBUG", &cfg.CacheKeyDebug)
+	envString("PROMCACHE_CACHE_KEY_NAMESPACE", &cfg.CacheKeyNamespace)
+	envString("PROMCACHE_CACHE_KEY_EXCLUDE_PARAMS", &excludeParamsStr)
+	envString("PROMCACHE_ALLOW_ENDPOINTS", &allowedEndpointsStr)
+	envString("PROMCACHE_GENERIC_PATHS", &genericPathsStr)
+	envString("PROMCACHE_THANOS_PARAM_DEFAULTS", &thanosDefaultsStr)
+	envString("PROMCACHE_METRICS_PUSH_URL", &cfg.MetricsPushURL)
+	envDuration("PROMCACHE_METRICS_PUSH_INTERVAL", &cfg.MetricsPushInterval)
+	envString("PROMCACHE_METRICS_PUSH_HEADERS", &metricsPushHeadersStr)
+	envInt("PROMCACHE_MAX_QUERY_POINTS", &cfg.MaxQueryPoints)
+	envDuration("PROMCACHE_MAX_QUERY_RANGE", &cfg.MaxQueryRange)
+	envString("PROMCACHE_QUERY_LIMIT_ACTION", &cfg.QueryLimitAction)
+	envString("PROMCACHE_TENANT_HEADER", &cfg.TenantHeader)
+	envString("PROMCACHE_ENFORCE_LABEL", &cfg.EnforceLabel)
+	envString("PROMCACHE_ENFORCE_LABEL_HEADER", &cfg.EnforceLabelHeader)
+	envString("PROMCACHE_CORS_ALLOWED_ORIGINS", &corsOriginsStr)
+	envString("PROMCACHE_CORS_ALLOWED_METHODS", &corsMethodsStr)
+	envString("PROMCACHE_CORS_ALLOWED_HEADERS", &corsHeadersStr)
+	envBool("PROMCACHE_CORS_ALLOW_CREDENTIALS", &cfg.CORSAllowCredentials)
+	envDuration("PROMCACHE_CORS_MAX_AGE", &cfg.CORSMaxAge)
+	envString("PROMCACHE_PEERS", &peersStr)
+	envString("PROMCACHE_PEERS_DNS", &cfg.PeersDNS)
+	envString("PROMCACHE_GOSSIP_SEEDS", &gossipSeedsStr)
+	envString("PROMCACHE_GOSSIP_ALLOWED_NETWORKS", &gossipAllowedStr)
+	envString("PROMCACHE_PEER_SELF", &cfg.PeerSelf)
+	envString("PROMCACHE_PEER_SECRET", &cfg.PeerSecret)
+	envDuration("PROMCACHE_PEER_TIMEOUT", &cfg.PeerTimeout)
+	envDuration("PROMCACHE_PEER_HANDOFF", &cfg.PeerHandoff)
+	envString("PROMCACHE_PEER_FAILURE_MODE", &cfg.PeerFailureMode)
+	envString("PROMCACHE_THANOS_LISTEN_ADDR", &cfg.ThanosListenAddr)
+	envString("PROMCACHE_THANOS_UPSTREAM", &cfg.ThanosUpstream)
+	envFloat("PROMCACHE_RATELIMIT", &cfg.RateLimit)
+	envInt("PROMCACHE_RATELIMIT_BURST", &cfg.RateLimitBurst)
+	envString("PROMCACHE_RATELIMIT_KEY", &cfg.RateLimitKey)
+	envString("PROMCACHE_EMPTY_RESULT_POLICY", &cfg.EmptyResultPolicy)
+	envBool("PROMCACHE_VALIDATE_RESPONSES", &cfg.ValidateResponses)
+	envInt("PROMCACHE_MAX_HOPS", &cfg.MaxHops)
+	envString("PROMCACHE_INSTANCE_NAME", &cfg.InstanceName)
+	envBool("PROMCACHE_UPSTREAM_PROMCACHE", &cfg.UpstreamIsPromcache)
+	envDuration("PROMCACHE_EMPTY_RESULT_TTL", &cfg.EmptyResultTTL)
+	envDuration("PROMCACHE_FEDERATE_TTL", &cfg.FederateTTL)
+	envDuration("PROMCACHE_METADATA_TTL", &cfg.MetadataTTL)
+	envDuration("PROMCACHE_RULES_TTL", &cfg.RulesTTL)
+
+	cfg.CacheKeyExcludeParams = splitList(excludeParamsStr)
+	cfg.AllowedEndpoints = splitList(allowedEndpointsStr)
+	cfg.GenericPaths = splitList(genericPathsStr)
+	cfg.ThanosParamDefaults = splitPairs(thanosDefaultsStr)
+	cfg.MetricsPushHeaders = splitPairs(metricsPushHeadersStr)
+	cfg.Peers = splitList(peersStr)
+	cfg.GossipSeeds = splitList(gossipSeedsStr)
+	cfg.GossipAllowedNetworks = splitList(gossipAllowedStr)
+	cfg.CORSAllowedOrigins = splitList(corsOriginsStr)
+	cfg.CORSAllowedMethods = splitList(corsMethodsStr)
+	cfg.CORSAllowedHeaders = splitList(corsHeadersStr)
 
 	// Parse log level
 	switch logLevelStr {
@@ -65,3 +526,329 @@ func Parse() *Config {
 
 	return cfg
 }
+
+// splitList splits a comma-separated list, dropping empty elements
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// splitPairs splits a comma-separated list of name=value pairs. Elements
+// without a value map to an empty string.
+func splitPairs(s string) map[string]string {
+	pairs := make(map[string]string)
+	for _, item := range splitList(s) {
+		name, value, _ := strings.Cut(item, "=")
+		pairs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return pairs
+}
+
+// envString overrides dst with the value of the environment variable if set
+func envString(name string, dst *string) {
+	if value := os.Getenv(name); value != "" {
+		*dst = value
+	}
+}
+
+// envDuration overrides dst with the parsed value of the environment variable
+// if set and valid
+func envDuration(name string, dst *time.Duration) {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			*dst = parsed
+		}
+	}
+}
+
+// envBool overrides dst with the parsed value of the environment variable
+// if set and valid
+func envBool(name string, dst *bool) {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			*dst = parsed
+		}
+	}
+}
+
+// envUint overrides dst with the parsed value of the environment variable
+// if set and valid, accepting octal values with a leading 0
+func envUint(name string, dst *uint) {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.ParseUint(value, 0, strconv.IntSize); err == nil {
+			*dst = uint(parsed)
+		}
+	}
+}
+
+// envInt overrides dst with the parsed value of the environment variable
+// if set and valid
+func envInt(name string, dst *int) {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			*dst = parsed
+		}
+	}
+}
+
+// envFloat overrides dst with the parsed value of the environment variable
+// if set and valid
+func envFloat(name string, dst *float64) {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			*dst = parsed
+		}
+	}
+}
+
+// operationalPaths are the operational endpoints served by promcached
+// itself
+var operationalPaths = []string{"/metrics", "/health", "/-/healthy", "/-/ready", "/version"}
+
+// isOperationalPath reports whether path is served by an operational
+// endpoint
+func isOperationalPath(path string) bool {
+	return slices.Contains(operationalPaths, path) || strings.HasPrefix(path, "/debug/")
+}
+
+// PathPolicies returns the policies of paths outside the API, those of the
+// config file and the generic paths, which are cached
+func (c *Config) PathPolicies() []PathPolicy {
+	policies := make([]PathPolicy, 0, len(c.GenericPaths)+len(c.File.Paths))
+	for _, prefix := range c.GenericPaths {
+		policies = append(policies, PathPolicy{Prefix: prefix, Policy: "cache"})
+	}
+	return append(policies, c.File.Paths...)
+}
+
+// Validate checks the configuration for invalid combinations of settings
+func (c *Config) Validate() error {
+	upstream, err := url.Parse(c.UpstreamURL)
+	if err != nil {
+		return fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if isSelfAddress(upstream, c.ListenAddr) {
+		return fmt.Errorf("upstream %s points at the proxy's own listen address %s", c.UpstreamURL, c.ListenAddr)
+	}
+	if c.AdminListenAddr != "" && isSelfAddress(upstream, c.AdminListenAddr) {
+		return fmt.Errorf("upstream %s points at the proxy's own admin listen address %s", c.UpstreamURL, c.AdminListenAddr)
+	}
+	for _, route := range c.File.Routes {
+		routeUpstream, err := url.Parse(route.Upstream)
+		if err != nil {
+			return fmt.Errorf("invalid upstream URL of route %s: %w", route.Path, err)
+		}
+		if isSelfAddress(routeUpstream, c.ListenAddr) {
+			return fmt.Errorf("upstream %s of route %s points at the proxy's own listen address %s", route.Upstream, route.Path, c.ListenAddr)
+		}
+	}
+	if c.LokiUpstream != "" {
+		lokiUpstream, err := url.Parse(c.LokiUpstream)
+		if err != nil {
+			return fmt.Errorf("invalid Loki upstream URL: %w", err)
+		}
+		if isSelfAddress(lokiUpstream, c.ListenAddr) {
+			return fmt.Errorf("Loki upstream %s points at the proxy's own listen address %s", c.LokiUpstream, c.ListenAddr)
+		}
+	}
+	if c.QueryLimitAction != "reject" && c.QueryLimitAction != "clamp" {
+		return fmt.Errorf("invalid query limit action %q, expected reject or clamp", c.QueryLimitAction)
+	}
+	if c.Clustered() && c.PeerSelf == "" {
+		return fmt.Errorf("clustering requires -peer-self")
+	}
+	// Peers accept entries on the main listener, so without a secret
+	// anyone reaching it could write to the cache
+	if c.Clustered() && c.PeerSecret == "" {
+		return fmt.Errorf("clustering requires -peer-secret")
+	}
+	// Label enforcement rejects queries without a tenant, so warm queries
+	// without one would never reach the cache
+	if c.EnforceLabel != "" {
+		for i, q := range c.File.Warmer.Queries {
+			if q.Tenant == "" {
+				return fmt.Errorf("warmer query %d: tenant is required with -enforce-label", i)
+			}
+		}
+		if g := c.File.Warmer.Grafana; (g.URL != "" || len(g.Files) > 0) && g.Tenant == "" {
+			return fmt.Errorf("warmer grafana: tenant is required with -enforce-label")
+		}
+	}
+	for _, network := range c.GossipAllowedNetworks {
+		if _, err := netip.ParsePrefix(network); err != nil && !strings.HasPrefix(network, ".") {
+			return fmt.Errorf("invalid gossip allowed network %q, expected a CIDR or a domain starting with a dot", network)
+		}
+	}
+	if c.PeerHandoff < 0 {
+		return fmt.Errorf("peer handoff must not be negative, got %s", c.PeerHandoff)
+	}
+	if c.PeerFailureMode != "open" && c.PeerFailureMode != "closed" {
+		return fmt.Errorf("invalid peer failure mode %q, expected open or closed", c.PeerFailureMode)
+	}
+	for _, path := range c.AllowedEndpoints {
+		if !strings.HasPrefix(path, "/api/") {
+			return fmt.Errorf("invalid allowed endpoint %q, expected an /api/ path", path)
+		}
+	}
+	seenPaths := make(map[string]bool)
+	for _, path := range c.PathPolicies() {
+		if !strings.HasPrefix(path.Prefix, "/") || path.Prefix == "/" || strings.HasPrefix(path.Prefix, "/api/") ||
+			strings.HasPrefix(path.Prefix, "/loki/api/") || strings.HasPrefix(path.Prefix, "/_promcache/") || path.Prefix == "/federate" {
+			return fmt.Errorf("invalid path %q, expected a path outside the API", path.Prefix)
+		}
+		if seenPaths[path.Prefix] {
+			return fmt.Errorf("invalid path %q, it has more than one policy", path.Prefix)
+		}
+		seenPaths[path.Prefix] = true
+		if c.AdminListenAddr == "" && isOperationalPath(path.Prefix) {
+			return fmt.Errorf("invalid path %q, it is an operational endpoint unless -admin-listen is set", path.Prefix)
+		}
+	}
+	for name, value := range c.ThanosParamDefaults {
+		switch name {
+		case "dedup", "partial_response", "max_source_resolution":
+		default:
+			return fmt.Errorf("invalid Thanos parameter default %s=%s, expected dedup, partial_response or max_source_resolution", name, value)
+		}
+	}
+	if c.MinCacheableAge < 0 || c.MinCacheableAgeTTL < 0 {
+		return fmt.Errorf("invalid minimum cacheable age %s with TTL %s", c.MinCacheableAge, c.MinCacheableAgeTTL)
+	}
+	if c.AdaptiveTTLThreshold < 0 {
+		return fmt.Errorf("invalid adaptive TTL threshold %s", c.AdaptiveTTLThreshold)
+	}
+	if c.AdaptiveTTLThreshold > 0 && (c.AdaptiveTTLMin <= 0 || c.AdaptiveTTLMax < c.AdaptiveTTLMin) {
+		return fmt.Errorf("invalid adaptive TTL bounds %s to %s", c.AdaptiveTTLMin, c.AdaptiveTTLMax)
+	}
+	if c.MinCacheDuration < 0 || c.MinCacheSamples < 0 {
+		return fmt.Errorf("invalid cache cost thresholds %s and %d samples", c.MinCacheDuration, c.MinCacheSamples)
+	}
+	if c.MaxHeaderTTL < 0 {
+		return fmt.Errorf("invalid maximum header TTL %s", c.MaxHeaderTTL)
+	}
+	if c.RecentWindow < 0 {
+		return fmt.Errorf("invalid recent window %s", c.RecentWindow)
+	}
+	if c.LogDebugSampleRate < 0 || c.LogDebugSampleRate > 1 {
+		return fmt.Errorf("invalid debug log sample rate %g, expected 0-1", c.LogDebugSampleRate)
+	}
+	if c.LogDebugKeyLimit < 0 {
+		return fmt.Errorf("invalid debug log key limit %d", c.LogDebugKeyLimit)
+	}
+	if c.VerifyFraction < 0 || c.VerifyFraction > 1 {
+		return fmt.Errorf("invalid verify fraction %g, expected 0-1", c.VerifyFraction)
+	}
+	if c.QueryHitsMetricLimit < 0 {
+		return fmt.Errorf("invalid query hits metric limit %d", c.QueryHitsMetricLimit)
+	}
+	if c.QueryStatsLogInterval < 0 {
+		return fmt.Errorf("query stats log interval must not be negative, got %s", c.QueryStatsLogInterval)
+	}
+	if c.QueryStatsLogInterval > 0 && c.QueryStatsLogTop <= 0 {
+		return fmt.Errorf("invalid query stats log top %d", c.QueryStatsLogTop)
+	}
+	if c.DashboardMetricLimit < 0 {
+		return fmt.Errorf("invalid dashboard metric limit %d", c.DashboardMetricLimit)
+	}
+	if c.AuthMetricLimit < 0 {
+		return fmt.Errorf("invalid auth metric limit %d", c.AuthMetricLimit)
+	}
+	if c.TenantMetricLimit < 0 {
+		return fmt.Errorf("invalid tenant metric limit %d", c.TenantMetricLimit)
+	}
+	switch c.EmptyResultPolicy {
+	case "cache", "skip", "short":
+	default:
+		return fmt.Errorf("invalid empty result policy %q, expected cache, skip or short", c.EmptyResultPolicy)
+	}
+	if c.EmptyResultPolicy == "short" && c.EmptyResultTTL <= 0 {
+		return fmt.Errorf("empty result TTL must be positive with the short policy, got %s", c.EmptyResultTTL)
+	}
+	switch c.Downsample {
+	case "off", "pick", "avg":
+	default:
+		return fmt.Errorf("invalid downsample mode %q, expected off, pick or avg", c.Downsample)
+	}
+	// Browsers refuse credentialed responses to a wildcard origin, so the
+	// combination would echo every origin back with credentials instead
+	if c.CORSAllowCredentials && slices.Contains(c.CORSAllowedOrigins, "*") {
+		return fmt.Errorf("-cors-allow-credentials requires explicit origins, not *")
+	}
+	if c.ThanosListenAddr != "" && c.ThanosUpstream == "" {
+		return fmt.Errorf("-thanos-listen requires -thanos-upstream")
+	}
+	if c.MetricsPushURL != "" && c.MetricsPushInterval <= 0 {
+		return fmt.Errorf("metrics push interval must be positive, got %s", c.MetricsPushInterval)
+	}
+	if c.CacheCleanupInterval <= 0 {
+		return fmt.Errorf("cache cleanup interval must be positive, got %s", c.CacheCleanupInterval)
+	}
+	if c.ShutdownDrainTimeout <= 0 {
+		return fmt.Errorf("shutdown drain timeout must be positive, got %s", c.ShutdownDrainTimeout)
+	}
+
+	return nil
+}
+
+// Clustered reports whether the cache is shared with cluster peers
+func (c *Config) Clustered() bool {
+	return len(c.Peers) > 0 || c.PeersDNS != "" || len(c.GossipSeeds) > 0
+}
+
+// isSelfAddress reports whether the upstream URL resolves to the local
+// listen address, which would make every request loop through the proxy
+func isSelfAddress(upstream *url.URL, listenAddr string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+
+	upstreamPort := upstream.Port()
+	if upstreamPort == "" {
+		switch upstream.Scheme {
+		case "https":
+			upstreamPort = "443"
+		default:
+			upstreamPort = "80"
+		}
+	}
+	if upstreamPort != listenPort {
+		return false
+	}
+
+	upstreamHost := upstream.Hostname()
+	if strings.EqualFold(upstreamHost, listenHost) || strings.EqualFold(upstreamHost, "localhost") {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && strings.EqualFold(upstreamHost, hostname) {
+		return true
+	}
+
+	ip := net.ParseIP(upstreamHost)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	// A wildcard listener accepts connections on every local address
+	if listenHost == "" || net.ParseIP(listenHost).IsUnspecified() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
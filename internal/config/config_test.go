@@ -0,0 +1,62 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+// validConfig returns a configuration passing validation
+func validConfig() *Config {
+	return &Config{
+		UpstreamURL:          "http://prometheus:9090",
+		ListenAddr:           ":8080",
+		QueryLimitAction:     "reject",
+		PeerFailureMode:      "open",
+		EmptyResultPolicy:    "cache",
+		EmptyResultTTL:       30 * time.Second,
+		Downsample:           "off",
+		CacheCleanupInterval: time.Minute,
+		ShutdownDrainTimeout: time.Second,
+	}
+}
+
+func TestValidateEmptyResultPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{"cache", 0, false},
+		{"skip", 0, false},
+		{"short", 30 * time.Second, false},
+		{"short", 0, true},
+		{"", 30 * time.Second, true},
+		{"never", 30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.EmptyResultPolicy = tt.policy
+		cfg.EmptyResultTTL = tt.ttl
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with policy %q and TTL %s = %v, want error %v", tt.policy, tt.ttl, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateGossipAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		networks []string
+		wantErr  bool
+	}{
+		{[]string{"10.0.0.0/8", ".svc.cluster.local"}, false},
+		{[]string{"10.0.0.1"}, true},
+		{[]string{"promcache"}, true},
+	}
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.GossipAllowedNetworks = tt.networks
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with gossip networks %v = %v, want error %v", tt.networks, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that unmarshals from a Go duration string
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "5m" or "1h30m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON formats the duration as a Go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// File holds the settings that can only be provided through the config file
+type File struct {
+	// Warmer configures cache warming
+	Warmer WarmerConfig `json:"warmer"`
+	// QueryRules allow or deny queries, the first matching rule decides
+	QueryRules []QueryRule `json:"query_rules"`
+	// CacheRules override the caching of queries, the first matching rule decides
+	CacheRules []CacheRule `json:"cache_rules"`
+	// Views are queries evaluated on a schedule whose results answer matching requests
+	Views []View `json:"materialized_views"`
+	// TenantLimits overrides the query limits per tenant
+	TenantLimits map[string]QueryLimits `json:"tenant_limits"`
+	// Auth configures client authentication
+	Auth AuthConfig `json:"auth"`
+	// Routes send API paths to other upstreams than the default one
+	Routes []Route `json:"routes"`
+	// Paths are the policies of paths outside the API
+	Paths []PathPolicy `json:"paths"`
+}
+
+// PathPolicy decides how requests for a path outside the API are handled
+type PathPolicy struct {
+	// Prefix is the exact path, or with a trailing slash a path prefix
+	Prefix string `json:"prefix"`
+	// Policy is "cache", "proxy" or "block"
+	Policy string `json:"policy"`
+}
+
+// Route sends requests for an API path to an upstream
+type Route struct {
+	// Path is the exact API path, or with a trailing slash a path prefix
+	Path string `json:"path"`
+	// Upstream is the URL of the upstream serving the path
+	Upstream string `json:"upstream"`
+}
+
+// AuthConfig configures client authentication. Authentication is enabled
+// if any keys or a token secret are configured.
+type AuthConfig struct {
+	// Keys are the accepted static API keys
+	Keys []APIKey `json:"keys"`
+	// HMACSecret verifies signed tokens, empty disables tokens
+	HMACSecret string `json:"hmac_secret"`
+	// OIDC validates JWTs issued by an OpenID Connect provider
+	OIDC *OIDCConfig `json:"oidc"`
+}
+
+// OIDCConfig configures validation of JWTs issued by an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer is the expected iss claim and the base URL of the discovery document
+	Issuer string `json:"issuer"`
+	// JWKSURL is the URL of the signing keys, discovered from the issuer if empty
+	JWKSURL string `json:"jwks_url"`
+	// Audience is the expected aud claim, empty accepts any audience
+	Audience string `json:"audience"`
+	// TenantClaim is the claim holding the tenant, e.g. "tenant" or "groups"
+	TenantClaim string `json:"tenant_claim"`
+	// Tenants maps claim values to tenant IDs, empty uses claim values as-is
+	Tenants map[string]string `json:"tenants"`
+	// Refresh is how often the signing keys are reloaded, defaults to 1h
+	Refresh Duration `json:"refresh"`
+}
+
+// APIKey is a static API key
+type APIKey struct {
+	// Name identifies the key in metrics and logs
+	Name string `json:"name"`
+	// Key is the secret presented by clients
+	Key string `json:"key"`
+	// Namespace is the cache namespace of the key, defaults to its name
+	Namespace string `json:"namespace,omitempty"`
+	// Tenant is the tenant of the key's clients, taking precedence over the
+	// tenant header for limits and label enforcement
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// QueryLimits bounds the cost of range queries
+type QueryLimits struct {
+	// MaxPoints is the maximum number of points per series, 0 means unlimited
+	MaxPoints int `json:"max_points"`
+	// MaxRange is the maximum time range, 0 means unlimited
+	MaxRange Duration `json:"max_range"`
+}
+
+// QueryRule allows or denies queries matching all of its patterns
+type QueryRule struct {
+	// Name identifies the rule in responses and logs
+	Name string `json:"name"`
+	// Action is either "allow" or "deny"
+	Action string `json:"action"`
+	// Query is a regular expression searched for in PromQL expressions and series selectors
+	Query string `json:"query,omitempty"`
+	// Metric is a regular expression matched against the referenced metric names
+	Metric string `json:"metric,omitempty"`
+}
+
+// CacheRule overrides the caching of queries matching all of its patterns
+type CacheRule struct {
+	// Name identifies the rule in logs
+	Name string `json:"name"`
+	// Action is either "cache" or "skip"
+	Action string `json:"action"`
+	// Query is a regular expression searched for in normalized PromQL expressions and series selectors
+	Query string `json:"query,omitempty"`
+	// Metric is a regular expression matched against the referenced metric names
+	Metric string `json:"metric,omitempty"`
+	// Client is a regular expression matched against the name of the authenticated client
+	Client string `json:"client,omitempty"`
+	// TTL is the TTL of responses cached by the rule
+	TTL Duration `json:"ttl,omitempty"`
+}
+
+// View is a query evaluated on a schedule, like a recording rule
+type View struct {
+	// Name identifies the view
+	Name string `json:"name"`
+	// Query is the PromQL expression
+	Query string `json:"query"`
+	// Interval is the time between evaluations
+	Interval Duration `json:"interval"`
+	// Range makes the view a range query over the duration ending at the evaluation, empty for an instant query
+	Range Duration `json:"range,omitempty"`
+	// Step is the resolution of range views, defaults to range/250
+	Step Duration `json:"step,omitempty"`
+}
+
+// WarmerConfig holds the cache warmer settings
+type WarmerConfig struct {
+	// Interval is how often all queries are re-issued, defaults to half the cache TTL
+	Interval Duration `json:"interval"`
+	// Queries are the queries kept warm in the cache
+	Queries []WarmQuery `json:"queries"`
+	// Grafana extracts additional queries from Grafana dashboards
+	Grafana GrafanaConfig `json:"grafana"`
+}
+
+// GrafanaConfig configures extraction of warm queries from Grafana dashboards
+type GrafanaConfig struct {
+	// URL is the Grafana base URL, empty disables the Grafana API
+	URL string `json:"url"`
+	// Token is the service account token used to access the Grafana API
+	Token string `json:"token"`
+	// Dashboards are the UIDs of dashboards to warm, empty means all dashboards
+	Dashboards []string `json:"dashboards"`
+	// Files are glob patterns of exported dashboard JSON files
+	Files []string `json:"files"`
+	// Refresh is how often dashboards are reloaded, defaults to 10m
+	Refresh Duration `json:"refresh"`
+	// Namespace is the cache namespace the dashboard queries are warmed in
+	Namespace string `json:"namespace,omitempty"`
+	// Tenant is the tenant the dashboard queries are issued as
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// WarmQuery is a single query kept warm in the cache. Queries without a
+// range are issued as instant queries.
+type WarmQuery struct {
+	// Query is the PromQL expression
+	Query string `json:"query"`
+	// Range is the time range of a range query ending now
+	Range Duration `json:"range,omitempty"`
+	// Step is the resolution of a range query, defaults to Range/250
+	Step Duration `json:"step,omitempty"`
+	// Namespace is the cache namespace the query is warmed in, defaults
+	// to Tenant
+	Namespace string `json:"namespace,omitempty"`
+	// Tenant is the tenant the query is issued as, as if it came from a
+	// client authenticated for it
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// LoadFile reads the JSON config file into the configuration
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &c.File); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for i, q := range c.File.Warmer.Queries {
+		if q.Query == "" {
+			return fmt.Errorf("warmer query %d: query must not be empty", i)
+		}
+	}
+	for i, rule := range c.File.QueryRules {
+		if rule.Name == "" {
+			return fmt.Errorf("query rule %d: name must not be empty", i)
+		}
+	}
+	for i, rule := range c.File.CacheRules {
+		if rule.Name == "" {
+			return fmt.Errorf("cache rule %d: name must not be empty", i)
+		}
+	}
+	viewNames := make(map[string]bool, len(c.File.Views))
+	for i, v := range c.File.Views {
+		if v.Name == "" || v.Query == "" {
+			return fmt.Errorf("materialized view %d: name and query must not be empty", i)
+		}
+		if viewNames[v.Name] {
+			return fmt.Errorf("materialized view %d: name %q is used twice", i, v.Name)
+		}
+		viewNames[v.Name] = true
+		if v.Interval <= 0 {
+			return fmt.Errorf("materialized view %q: interval must be positive", v.Name)
+		}
+	}
+	routed := make(map[string]bool, len(c.File.Routes))
+	for i, route := range c.File.Routes {
+		if routed[route.Path] {
+			return fmt.Errorf("route %d: path %s is routed twice", i, route.Path)
+		}
+		routed[route.Path] = true
+		if !strings.HasPrefix(route.Path, "/api/") {
+			return fmt.Errorf("route %d: path %q must start with /api/", i, route.Path)
+		}
+		if route.Upstream == "" {
+			return fmt.Errorf("route %d: upstream must not be empty", i)
+		}
+	}
+	for i, path := range c.File.Paths {
+		if path.Policy == "" {
+			return fmt.Errorf("path %d: policy must not be empty", i)
+		}
+	}
+
+	return nil
+}
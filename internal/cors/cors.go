@@ -0,0 +1,79 @@
+// Package cors answers CORS preflight requests and adds CORS headers to
+// responses for browser-based clients
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config configures the allowed cross-origin requests
+type Config struct {
+	// AllowedOrigins are the allowed origins, "*" allows any origin
+	AllowedOrigins []string
+	// AllowedMethods are the allowed request methods
+	AllowedMethods []string
+	// AllowedHeaders are the allowed request headers
+	AllowedHeaders []string
+	// AllowCredentials allows requests with cookies or Authorization headers,
+	// only from explicitly listed origins
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache preflight responses
+	MaxAge time.Duration
+}
+
+// Middleware adds CORS headers to responses to allowed origins and answers
+// their preflight requests. Requests from other origins are served without
+// CORS headers, so browsers block the response.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	allowAny := false
+	origins := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		// Reflecting any origin with credentials would let every site
+		// read responses with the user's cookies
+		if origin == "*" {
+			allowAny = !cfg.AllowCredentials
+			continue
+		}
+		origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !(allowAny || origins[strings.ToLower(origin)]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowAny {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		// Answer preflight requests without passing them on
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			if cfg.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", "X-Cache, X-Cache-Age, Age, ETag")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,38 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareOrigins(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         Config
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{"wildcard", Config{AllowedOrigins: []string{"*"}}, "https://a.example", "*", ""},
+		{"listed", Config{AllowedOrigins: []string{"https://a.example/"}}, "https://a.example", "https://a.example", ""},
+		{"unlisted", Config{AllowedOrigins: []string{"https://a.example"}}, "https://b.example", "", ""},
+		{"credentials listed", Config{AllowedOrigins: []string{"https://a.example"}, AllowCredentials: true}, "https://a.example", "https://a.example", "true"},
+		{"credentials wildcard", Config{AllowedOrigins: []string{"*"}, AllowCredentials: true}, "https://b.example", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Middleware(tt.cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			req.Header.Set("Origin", tt.origin)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.credentials)
+			}
+		})
+	}
+}
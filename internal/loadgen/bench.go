@@ -0,0 +1,227 @@
+package loadgen
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// upstreamRequestsMetric counts the requests a promcached instance sent to
+// its upstreams
+const upstreamRequestsMetric = "promcache_upstream_request_duration_seconds_count"
+
+// WeightedRange is a query time range picked with the given weight
+type WeightedRange struct {
+	Range  time.Duration
+	Weight float64
+}
+
+// BenchConfig holds the benchmark settings
+type BenchConfig struct {
+	// Target is the base URL of the promcached instance to benchmark
+	Target string
+	// MetricsURL is the target's metrics endpoint the upstream requests
+	// are counted from, empty skips counting them
+	MetricsURL string
+	// Queries are the PromQL query templates to issue
+	Queries []string
+	// Ranges are the query time ranges with their weights
+	Ranges []WeightedRange
+	// EndSpread is how far into the past query end times are randomly
+	// moved, 0 ends every query now
+	EndSpread time.Duration
+	// Points is the number of points per range query used to derive the step
+	Points int
+	// InstantRatio is the fraction of queries issued as instant queries
+	InstantRatio float64
+	// Concurrency is the number of workers sending requests back to back
+	Concurrency int
+	// Duration is how long to run the benchmark for
+	Duration time.Duration
+	// Requests stops the benchmark after this many requests, 0 runs for
+	// the whole duration
+	Requests int
+	// Timeout is the per-request timeout
+	Timeout time.Duration
+}
+
+// ParseRanges parses a comma-separated list of Prometheus durations with
+// optional weights, e.g. "1h=3,1d=1". Ranges without a weight weigh 1.
+func ParseRanges(s string) ([]WeightedRange, error) {
+	var ranges []WeightedRange
+	for _, item := range strings.Split(s, ",") {
+		rangeStr, weightStr, hasWeight := strings.Cut(strings.TrimSpace(item), "=")
+		d, err := model.ParseDuration(rangeStr)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid range %q", rangeStr)
+		}
+		weight := 1.0
+		if hasWeight {
+			if weight, err = strconv.ParseFloat(weightStr, 64); err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid weight %q of range %s", weightStr, rangeStr)
+			}
+		}
+		ranges = append(ranges, WeightedRange{Range: time.Duration(d), Weight: weight})
+	}
+	return ranges, nil
+}
+
+// Bench sends requests back to back from every worker until the duration
+// elapses, the request count is reached or ctx is cancelled
+func Bench(ctx context.Context, cfg BenchConfig, log *slog.Logger) (*Report, error) {
+	target, err := url.Parse(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if len(cfg.Queries) == 0 {
+		cfg.Queries = DefaultQueries
+	}
+	if len(cfg.Ranges) == 0 {
+		cfg.Ranges = []WeightedRange{{Range: time.Hour, Weight: 1}}
+	}
+	if cfg.Points <= 0 {
+		cfg.Points = 250
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	report := &Report{Statuses: make(map[int]int), UpstreamRequests: -1}
+
+	upstreamBefore, scrapeErr := scrapeCounter(client, cfg.MetricsURL, upstreamRequestsMetric)
+	if scrapeErr != nil {
+		log.Warn("Not counting upstream requests", "error", scrapeErr)
+	}
+
+	log.Info("Starting benchmark",
+		"target", cfg.Target,
+		"queries", len(cfg.Queries),
+		"ranges", len(cfg.Ranges),
+		"concurrency", cfg.Concurrency,
+		"duration", cfg.Duration)
+
+	// Workers take tickets until the request count is reached
+	var tickets chan struct{}
+	if cfg.Requests > 0 {
+		tickets = make(chan struct{}, cfg.Requests)
+		for range cfg.Requests {
+			tickets <- struct{}{}
+		}
+		close(tickets)
+	}
+
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if tickets != nil {
+					if _, ok := <-tickets; !ok {
+						return
+					}
+				}
+				issue(ctx, Config{}, client, benchURL(cfg, target), report)
+			}
+		}()
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(startTime)
+
+	if scrapeErr == nil {
+		upstreamAfter, err := scrapeCounter(client, cfg.MetricsURL, upstreamRequestsMetric)
+		if err != nil {
+			log.Warn("Not counting upstream requests", "error", err)
+		} else {
+			report.UpstreamRequests = int(upstreamAfter - upstreamBefore)
+		}
+	}
+
+	return report, nil
+}
+
+// benchURL builds a random query URL from the benchmark's templates and
+// time range distribution
+func benchURL(cfg BenchConfig, target *url.URL) string {
+	query := cfg.Queries[rand.IntN(len(cfg.Queries))]
+
+	total := 0.0
+	for _, r := range cfg.Ranges {
+		total += r.Weight
+	}
+	pick := rand.Float64() * total
+	dashboardRange := cfg.Ranges[len(cfg.Ranges)-1].Range
+	for _, r := range cfg.Ranges {
+		if pick < r.Weight {
+			dashboardRange = r.Range
+			break
+		}
+		pick -= r.Weight
+	}
+
+	end := time.Now()
+	if cfg.EndSpread > 0 {
+		end = end.Add(-rand.N(cfg.EndSpread))
+	}
+	return queryURL(target, query, dashboardRange, end, cfg.Points, rand.Float64() < cfg.InstantRatio)
+}
+
+// scrapeCounter returns the sum of all series of a counter exposed at a
+// metrics endpoint in the Prometheus text format
+func scrapeCounter(client *http.Client, metricsURL string, name string) (float64, error) {
+	if metricsURL == "" {
+		return 0, fmt.Errorf("no metrics URL")
+	}
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("metrics endpoint returned %s", resp.Status)
+	}
+
+	total := 0.0
+	found := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		rest, ok := strings.CutPrefix(line, name)
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '{') {
+			continue
+		}
+		fields := strings.Fields(rest[strings.LastIndexByte(rest, '}')+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		total += value
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("metric %s not found at %s", name, metricsURL)
+	}
+	return total, nil
+}
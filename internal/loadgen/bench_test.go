@@ -0,0 +1,101 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRanges(t *testing.T) {
+	ranges, err := ParseRanges("1h=3, 1d,30m=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WeightedRange{{time.Hour, 3}, {24 * time.Hour, 1}, {30 * time.Minute, 0.5}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ParseRanges = %v, want %v", ranges, want)
+	}
+
+	for _, s := range []string{"", "1x", "0s", "1h=0", "1h=-1", "1h=heavy"} {
+		if _, err := ParseRanges(s); err == nil {
+			t.Errorf("ParseRanges(%q) succeeded", s)
+		}
+	}
+}
+
+func TestScrapeCounter(t *testing.T) {
+	metrics := `# TYPE promcache_upstream_request_duration_seconds histogram
+promcache_upstream_request_duration_seconds_bucket{le="+Inf"} 7
+promcache_upstream_request_duration_seconds_count{upstream="a"} 5
+promcache_upstream_request_duration_seconds_count{upstream="b"} 2
+promcache_upstream_request_duration_seconds_count_other 100
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, metrics)
+	}))
+	defer server.Close()
+
+	if got, err := scrapeCounter(server.Client(), server.URL+"/metrics", upstreamRequestsMetric); err != nil || got != 7 {
+		t.Errorf("scrapeCounter = %g, %v, want 7", got, err)
+	}
+	if _, err := scrapeCounter(server.Client(), server.URL+"/metrics", "promcache_missing_total"); err == nil {
+		t.Error("scrapeCounter of a missing metric succeeded")
+	}
+	if _, err := scrapeCounter(server.Client(), server.URL+"/other", upstreamRequestsMetric); err == nil {
+		t.Error("scrapeCounter of a failing endpoint succeeded")
+	}
+	if _, err := scrapeCounter(server.Client(), "", upstreamRequestsMetric); err == nil {
+		t.Error("scrapeCounter without a URL succeeded")
+	}
+}
+
+func TestBench(t *testing.T) {
+	var requests, upstream atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			fmt.Fprintf(w, "%s %d\n", upstreamRequestsMetric, upstream.Load())
+			return
+		}
+		// Every third request misses
+		if requests.Add(1)%3 == 0 {
+			upstream.Add(1)
+			w.Header().Set("X-Cache", "MISS")
+		} else {
+			w.Header().Set("X-Cache", "HIT")
+		}
+	}))
+	defer target.Close()
+
+	report, err := Bench(context.Background(), BenchConfig{
+		Target:      target.URL,
+		MetricsURL:  target.URL + "/metrics",
+		Queries:     []string{"up"},
+		Ranges:      []WeightedRange{{time.Hour, 1}, {24 * time.Hour, 1}},
+		EndSpread:   time.Hour,
+		Concurrency: 3,
+		Duration:    10 * time.Second,
+		Requests:    30,
+		Timeout:     time.Second,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 30 {
+		t.Errorf("requests = %d, want 30", report.Requests)
+	}
+	if report.CacheHits+report.CacheMisses != 30 || report.UpstreamRequests != report.CacheMisses {
+		t.Errorf("report = %d hits, %d misses, %d upstream requests, want the misses counted upstream",
+			report.CacheHits, report.CacheMisses, report.UpstreamRequests)
+	}
+}
@@ -0,0 +1,291 @@
+// Package loadgen generates synthetic Prometheus query traffic
+package loadgen
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// DefaultQueries are used when no query templates are configured
+var DefaultQueries = []string{
+	`up`,
+	`sum by (job) (up)`,
+	`sum(rate(prometheus_http_requests_total[5m])) by (handler)`,
+	`histogram_quantile(0.99, sum(rate(prometheus_http_request_duration_seconds_bucket[5m])) by (le))`,
+	`process_resident_memory_bytes`,
+	`rate(process_cpu_seconds_total[5m])`,
+}
+
+// Config holds the load generator settings
+type Config struct {
+	// Target is the base URL of the Prometheus-compatible endpoint to query
+	Target string
+	// Queries are the PromQL query templates to issue
+	Queries []string
+	// Ranges are the dashboard time ranges clients pick from
+	Ranges []time.Duration
+	// Points is the number of points per range query used to derive the step
+	Points int
+	// Concurrency is the number of simulated dashboard clients
+	Concurrency int
+	// RefreshInterval is how often each client reloads its dashboard
+	RefreshInterval time.Duration
+	// InstantRatio is the fraction of queries issued as instant queries
+	InstantRatio float64
+	// Duration is how long to generate load for
+	Duration time.Duration
+	// Timeout is the per-request timeout
+	Timeout time.Duration
+}
+
+// Report summarizes the generated load
+type Report struct {
+	Requests    int
+	Errors      int
+	Statuses    map[int]int
+	CacheHits   int
+	CacheMisses int
+	Latencies   []time.Duration
+	Elapsed     time.Duration
+	// UpstreamRequests is the number of requests the target sent to its
+	// upstream, -1 if unknown
+	UpstreamRequests int
+	mu               sync.Mutex
+	latencySum       time.Duration
+}
+
+// LoadQueries reads query templates from a file, one per line. Empty lines
+// and lines starting with # are ignored.
+func LoadQueries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		queries = append(queries, line)
+	}
+	return queries, scanner.Err()
+}
+
+// Run generates load until the configured duration elapses or ctx is cancelled
+func Run(ctx context.Context, cfg Config, log *slog.Logger) (*Report, error) {
+	target, err := url.Parse(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if len(cfg.Queries) == 0 {
+		cfg.Queries = DefaultQueries
+	}
+	if len(cfg.Ranges) == 0 {
+		cfg.Ranges = []time.Duration{time.Hour}
+	}
+	if cfg.Points <= 0 {
+		cfg.Points = 250
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	report := &Report{Statuses: make(map[int]int), UpstreamRequests: -1}
+
+	log.Info("Starting load generation",
+		"target", cfg.Target,
+		"queries", len(cfg.Queries),
+		"concurrency", cfg.Concurrency,
+		"refresh", cfg.RefreshInterval,
+		"duration", cfg.Duration)
+
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runClient(ctx, cfg, client, target, report)
+		}()
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(startTime)
+
+	return report, nil
+}
+
+// runClient simulates a single dashboard viewer reloading all queries on
+// every refresh interval
+func runClient(ctx context.Context, cfg Config, client *http.Client, target *url.URL, report *Report) {
+	// Each viewer sticks to one dashboard time range
+	dashboardRange := cfg.Ranges[rand.IntN(len(cfg.Ranges))]
+
+	for {
+		for _, query := range cfg.Queries {
+			if ctx.Err() != nil {
+				return
+			}
+			issue(ctx, cfg, client, buildURL(cfg, target, query, dashboardRange), report)
+		}
+
+		if cfg.RefreshInterval <= 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.RefreshInterval):
+		}
+	}
+}
+
+// buildURL builds an instant or range query URL ending now
+func buildURL(cfg Config, target *url.URL, query string, dashboardRange time.Duration) string {
+	return queryURL(target, query, dashboardRange, time.Now(), cfg.Points, rand.Float64() < cfg.InstantRatio)
+}
+
+// queryURL builds an instant query URL at end or a range query URL over
+// the range ending at end with the given number of points. The query
+// template's $__range and $__interval variables are replaced like Grafana
+// does.
+func queryURL(target *url.URL, query string, dashboardRange time.Duration, end time.Time, points int, instant bool) string {
+	u := *target
+
+	step := dashboardRange / time.Duration(points)
+	if step < time.Second {
+		step = time.Second
+	}
+	query = strings.NewReplacer(
+		"$__range", model.Duration(dashboardRange).String(),
+		"$__interval", model.Duration(step.Truncate(time.Second)).String(),
+	).Replace(query)
+
+	params := url.Values{"query": {query}}
+	if instant {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/query"
+		params.Set("time", strconv.FormatInt(end.Unix(), 10))
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/query_range"
+		params.Set("start", strconv.FormatInt(end.Add(-dashboardRange).Unix(), 10))
+		params.Set("end", strconv.FormatInt(end.Unix(), 10))
+		params.Set("step", strconv.FormatInt(int64(step.Seconds()), 10))
+	}
+	u.RawQuery = params.Encode()
+
+	return u.String()
+}
+
+// issue sends a single request and records its outcome
+func issue(ctx context.Context, cfg Config, client *http.Client, target string, report *Report) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		report.record(0, "", 0, err)
+		return
+	}
+
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		report.record(0, "", time.Since(startTime), err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	report.record(resp.StatusCode, resp.Header.Get("X-Cache"), time.Since(startTime), nil)
+}
+
+// record adds a single request outcome to the report
+func (r *Report) record(status int, cacheStatus string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Requests++
+	if err != nil {
+		r.Errors++
+		return
+	}
+
+	r.Statuses[status]++
+	switch {
+	case strings.HasPrefix(cacheStatus, "HIT"):
+		r.CacheHits++
+	case strings.HasPrefix(cacheStatus, "MISS"):
+		r.CacheMisses++
+	}
+	r.Latencies = append(r.Latencies, latency)
+	r.latencySum += latency
+}
+
+// Percentile returns the latency at the given percentile (0-100)
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), r.Latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
+
+// WriteTo writes a human-readable summary of the report
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Requests:     %d (%.1f req/s)\n", r.Requests, float64(r.Requests)/r.Elapsed.Seconds())
+	fmt.Fprintf(&b, "Errors:       %d\n", r.Errors)
+
+	statuses := make([]int, 0, len(r.Statuses))
+	for status := range r.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "Status %d:   %d\n", status, r.Statuses[status])
+	}
+
+	if total := r.CacheHits + r.CacheMisses; total > 0 {
+		fmt.Fprintf(&b, "Cache hits:   %d (%.1f%%)\n", r.CacheHits, 100*float64(r.CacheHits)/float64(total))
+		fmt.Fprintf(&b, "Cache misses: %d\n", r.CacheMisses)
+	}
+	if r.UpstreamRequests >= 0 {
+		fmt.Fprintf(&b, "Upstream:     %d requests\n", r.UpstreamRequests)
+	}
+
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(&b, "Latency avg:  %s\n", r.latencySum/time.Duration(len(r.Latencies)))
+		fmt.Fprintf(&b, "Latency p50:  %s\n", r.Percentile(50))
+		fmt.Fprintf(&b, "Latency p90:  %s\n", r.Percentile(90))
+		fmt.Fprintf(&b, "Latency p99:  %s\n", r.Percentile(99))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,138 @@
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryURL(t *testing.T) {
+	target, _ := url.Parse("http://promcache:9090/prometheus/")
+	end := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		query   string
+		rng     time.Duration
+		points  int
+		instant bool
+		want    string
+	}{
+		{
+			name: "range", query: "rate(up[$__interval])", rng: time.Hour, points: 240,
+			want: "http://promcache:9090/prometheus/api/v1/query_range?end=1700000000&query=rate%28up%5B15s%5D%29&start=1699996400&step=15",
+		},
+		{
+			name: "instant", query: "increase(up[$__range])", rng: 24 * time.Hour, points: 240, instant: true,
+			want: "http://promcache:9090/prometheus/api/v1/query?query=increase%28up%5B1d%5D%29&time=1700000000",
+		},
+		{
+			// Steps are at least a second
+			name: "short range", query: "up", rng: time.Minute, points: 250,
+			want: "http://promcache:9090/prometheus/api/v1/query_range?end=1700000000&query=up&start=1699999940&step=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryURL(target, tt.query, tt.rng, end, tt.points, tt.instant); got != tt.want {
+				t.Errorf("queryURL =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadQueries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.txt")
+	os.WriteFile(path, []byte("# dashboards\nup\n\n  sum(up) by (job)  \n#rate(x[5m])\n"), 0o644)
+
+	queries, err := LoadQueries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"up", "sum(up) by (job)"}; !slices.Equal(queries, want) {
+		t.Errorf("LoadQueries = %q, want %q", queries, want)
+	}
+	if _, err := LoadQueries(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("LoadQueries of a missing file succeeded")
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := &Report{Statuses: make(map[int]int), UpstreamRequests: -1}
+	for i, cache := range []string{"HIT", "HIT instance-a", "MISS", ""} {
+		report.record(http.StatusOK, cache, time.Duration(i+1)*time.Millisecond, nil)
+	}
+	report.record(http.StatusServiceUnavailable, "", 10*time.Millisecond, nil)
+	report.record(0, "", 0, errors.New("connection refused"))
+
+	if report.Requests != 6 || report.Errors != 1 || report.CacheHits != 2 || report.CacheMisses != 1 {
+		t.Errorf("report = %d requests, %d errors, %d hits, %d misses, want 6, 1, 2, 1",
+			report.Requests, report.Errors, report.CacheHits, report.CacheMisses)
+	}
+	if report.Statuses[http.StatusOK] != 4 || report.Statuses[http.StatusServiceUnavailable] != 1 {
+		t.Errorf("statuses = %v, want 4 200s and one 503", report.Statuses)
+	}
+	for p, want := range map[float64]time.Duration{0: time.Millisecond, 50: 3 * time.Millisecond, 100: 10 * time.Millisecond} {
+		if got := report.Percentile(p); got != want {
+			t.Errorf("Percentile(%g) = %v, want %v", p, got, want)
+		}
+	}
+
+	report.Elapsed = time.Second
+	var b strings.Builder
+	if _, err := report.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Requests:     6 (6.0 req/s)", "Status 503:   1", "Cache hits:   2 (66.7%)", "Latency avg:  4ms"} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("report doesn't contain %q:\n%s", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "Upstream:") {
+		t.Errorf("report of unknown upstream requests contains them:\n%s", b.String())
+	}
+}
+
+func TestRun(t *testing.T) {
+	paths := make(chan string, 1024)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case paths <- r.URL.Path:
+		default:
+		}
+		w.Header().Set("X-Cache", "HIT")
+	}))
+	defer target.Close()
+
+	report, err := Run(context.Background(), Config{
+		Target:          target.URL,
+		Queries:         []string{"up"},
+		Concurrency:     2,
+		RefreshInterval: 10 * time.Millisecond,
+		InstantRatio:    1,
+		Duration:        100 * time.Millisecond,
+		Timeout:         time.Second,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests == 0 || report.CacheHits != report.Requests || report.Errors != 0 {
+		t.Errorf("report = %d requests, %d hits, %d errors, want only hits", report.Requests, report.CacheHits, report.Errors)
+	}
+	for len(paths) > 0 {
+		if path := <-paths; path != "/api/v1/query" {
+			t.Errorf("request to %s, want instant queries only", path)
+			break
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/internal/recorder"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// timeParams are the query parameters holding evaluation times
+var timeParams = []string{"time", "start", "end"}
+
+// ReplayConfig holds the replay settings
+type ReplayConfig struct {
+	// Target is the base URL to send the recorded requests to
+	Target string
+	// Entries are the recorded requests in the order they were received
+	Entries []recorder.Entry
+	// Speed scales the recorded pace, 2 replays twice as fast; 0 sends
+	// the requests as fast as the concurrency allows
+	Speed float64
+	// Concurrency is the maximum number of requests in flight
+	Concurrency int
+	// ShiftTimes moves the time parameters by the time passed since the
+	// recording, so queries ask for recent data as they originally did
+	ShiftTimes bool
+	// Timeout is the per-request timeout
+	Timeout time.Duration
+}
+
+// Replay sends recorded requests to the target and reports their outcome
+func Replay(ctx context.Context, cfg ReplayConfig, log *slog.Logger) (*Report, error) {
+	target, err := url.Parse(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if len(cfg.Entries) == 0 {
+		return nil, fmt.Errorf("no requests to replay")
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	report := &Report{Statuses: make(map[int]int), UpstreamRequests: -1}
+
+	log.Info("Replaying requests",
+		"target", cfg.Target,
+		"requests", len(cfg.Entries),
+		"speed", cfg.Speed,
+		"concurrency", cfg.Concurrency)
+
+	startTime := time.Now()
+	recordedStart := cfg.Entries[0].Time
+
+	requests := make(chan *http.Request)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				send(ctx, client, req, report)
+			}
+		}()
+	}
+
+dispatch:
+	for _, entry := range cfg.Entries {
+		// Keep the recorded gaps between requests, scaled by the speed
+		sendAt := startTime
+		if cfg.Speed > 0 {
+			sendAt = startTime.Add(time.Duration(float64(entry.Time.Sub(recordedStart)) / cfg.Speed))
+			select {
+			case <-ctx.Done():
+				break dispatch
+			case <-time.After(time.Until(sendAt)):
+			}
+		}
+
+		params := cloneParams(entry.Params)
+		if cfg.ShiftTimes {
+			shiftTimes(params, sendAt.Sub(entry.Time))
+		}
+		req, err := replayRequest(ctx, target, entry, params)
+		if err != nil {
+			report.record(0, "", 0, err)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case requests <- req:
+		}
+	}
+	close(requests)
+	wg.Wait()
+	report.Elapsed = time.Since(startTime)
+
+	return report, nil
+}
+
+// replayRequest builds the request replaying entry with params
+func replayRequest(ctx context.Context, target *url.URL, entry recorder.Entry, params url.Values) (*http.Request, error) {
+	u := *target
+	u.Path = strings.TrimSuffix(u.Path, "/") + entry.Path
+
+	var req *http.Request
+	var err error
+	if entry.Method == http.MethodPost {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(params.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = params.Encode()
+		if req, err = http.NewRequestWithContext(ctx, entry.Method, u.String(), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the requests attributed to their Grafana panels
+	if entry.Dashboard != "" {
+		req.Header.Set(proxy.DashboardHeader, entry.Dashboard)
+	}
+	if entry.Panel != "" {
+		req.Header.Set(proxy.PanelHeader, entry.Panel)
+	}
+	return req, nil
+}
+
+// send sends a single request and records its outcome
+func send(ctx context.Context, client *http.Client, req *http.Request, report *Report) {
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		report.record(0, "", time.Since(startTime), err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	report.record(resp.StatusCode, resp.Header.Get("X-Cache"), time.Since(startTime), nil)
+}
+
+// cloneParams returns a copy of params that can be modified
+func cloneParams(params url.Values) url.Values {
+	clone := make(url.Values, len(params))
+	for name, values := range params {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// shiftTimes moves the time parameters by offset. Times are written as
+// Unix seconds; unparsable ones are left alone.
+func shiftTimes(params url.Values, offset time.Duration) {
+	for _, name := range timeParams {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		t, ok := parseTime(value)
+		if !ok {
+			continue
+		}
+		shifted := float64(t.Add(offset).UnixMilli()) / 1000
+		params.Set(name, strconv.FormatFloat(shifted, 'f', -1, 64))
+	}
+}
+
+// parseTime parses a time parameter as Unix seconds or RFC 3339, like
+// Prometheus does
+func parseTime(s string) (time.Time, bool) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(seconds, 0) && !math.IsNaN(seconds) {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*1e9)), true
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
@@ -0,0 +1,119 @@
+package loadgen
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/recorder"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+func TestShiftTimes(t *testing.T) {
+	params := url.Values{
+		"time":  {"1700000000"},
+		"start": {"2023-11-14T22:13:20.5Z"},
+		"end":   {"now"},
+		"step":  {"15"},
+	}
+	shiftTimes(params, 90*time.Second)
+	want := url.Values{
+		"time":  {"1700000090"},
+		"start": {"1700000090.5"},
+		"end":   {"now"},
+		"step":  {"15"},
+	}
+	if params.Encode() != want.Encode() {
+		t.Errorf("shiftTimes = %s, want %s", params.Encode(), want.Encode())
+	}
+}
+
+func TestReplayRequest(t *testing.T) {
+	target, _ := url.Parse("http://promcache:9090/prefix/")
+	params := url.Values{"query": {"up"}}
+
+	get, err := replayRequest(context.Background(), target, recorder.Entry{Method: http.MethodGet, Path: "/api/v1/query", Dashboard: "abc", Panel: "2"}, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get.URL.String(); got != "http://promcache:9090/prefix/api/v1/query?query=up" {
+		t.Errorf("URL = %s, want the path below the target's", got)
+	}
+	if get.Header.Get(proxy.DashboardHeader) != "abc" || get.Header.Get(proxy.PanelHeader) != "2" {
+		t.Errorf("headers = %v, want the dashboard and panel", get.Header)
+	}
+
+	post, err := replayRequest(context.Background(), target, recorder.Entry{Method: http.MethodPost, Path: "/api/v1/query"}, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(post.Body)
+	if post.URL.RawQuery != "" || string(body) != "query=up" || post.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Errorf("POST = %s with %q (%s), want the parameters as a form", post.URL, body, post.Header.Get("Content-Type"))
+	}
+	if post.Header.Get(proxy.DashboardHeader) != "" {
+		t.Errorf("dashboard header = %q, want none", post.Header.Get(proxy.DashboardHeader))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	var times []int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ts, _ := strconv.ParseFloat(r.Form.Get("time"), 64)
+		mu.Lock()
+		times = append(times, int64(ts))
+		mu.Unlock()
+		w.Header().Set("X-Cache", "HIT")
+	}))
+	defer target.Close()
+
+	recorded := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var entries []recorder.Entry
+	for i := range 3 {
+		at := recorded.Add(time.Duration(i) * 20 * time.Millisecond)
+		entries = append(entries, recorder.Entry{
+			Time:   at,
+			Method: http.MethodGet,
+			Path:   "/api/v1/query",
+			Params: url.Values{"query": {"up"}, "time": {strconv.FormatInt(at.Unix(), 10)}},
+		})
+	}
+
+	start := time.Now()
+	report, err := Replay(context.Background(), ReplayConfig{
+		Target:     target.URL,
+		Entries:    entries,
+		Speed:      1,
+		ShiftTimes: true,
+		Timeout:    time.Second,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 3 || report.CacheHits != 3 {
+		t.Errorf("report = %d requests, %d hits, want 3 hits", report.Requests, report.CacheHits)
+	}
+	// The recorded pace is kept
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("replay took %v, want at least the recorded 40ms", elapsed)
+	}
+	// Times ask for data as recent as they originally did
+	for _, ts := range times {
+		if d := time.Since(time.Unix(ts, 0)); d < 0 || d > time.Minute {
+			t.Errorf("replayed time %d is %v ago, want shifted to now", ts, d)
+		}
+	}
+
+	if _, err := Replay(context.Background(), ReplayConfig{Target: target.URL}, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Error("Replay without entries succeeded")
+	}
+}
@@ -0,0 +1,183 @@
+// Package logging sets up structured logging and logs API requests with
+// consistent fields for log pipelines such as Loki or ELK
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// RequestIDHeader carries the ID of a request. Clients and load balancers
+// may set it; requests without one get a random ID.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds client provided request IDs
+const maxRequestIDLength = 128
+
+// redactedAttrs are the attributes holding cache keys or query contents
+var redactedAttrs = map[string]bool{
+	"key":         true,
+	"storage_key": true,
+	"query":       true,
+	"diff":        true,
+}
+
+// requestIDContextKey is the context key of the request ID
+type requestIDContextKey struct{}
+
+// Options configure the logger
+type Options struct {
+	// Format is the output format, text or json
+	Format string
+	Level  slog.Level
+	// DebugSampleRate is the fraction of debug records written
+	DebugSampleRate float64
+	// DebugKeyLimit is the number of debug records written per message
+	// and cache key and minute, 0 writes all
+	DebugKeyLimit int
+	// Redact replaces cache keys and query contents by their hash
+	Redact bool
+	// Metrics count the dropped debug records
+	Metrics *metrics.Metrics
+}
+
+// New creates a logger writing to w. Records logged with a request's
+// context get its request_id.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+	if opts.Redact {
+		handlerOpts.ReplaceAttr = redact
+	}
+
+	var handler slog.Handler
+	switch opts.Format {
+	case "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", opts.Format)
+	}
+	if opts.DebugSampleRate < 1 || opts.DebugKeyLimit > 0 {
+		handler = samplingHandler{handler, &sampler{rate: opts.DebugSampleRate, keyLimit: opts.DebugKeyLimit, metrics: opts.Metrics}}
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// redact replaces the values of redacted attributes by a hash, so log
+// lines of the same key or query can still be correlated
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if !redactedAttrs[a.Key] {
+		return a
+	}
+	sum := sha256.Sum256([]byte(a.Value.String()))
+	return slog.String(a.Key, "sha256:"+hex.EncodeToString(sum[:6]))
+}
+
+// contextHandler adds the request ID of the context to records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestID returns the request ID of a context, empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// RequestIDMiddleware assigns every request an ID, taken from its
+// X-Request-Id header if set. The ID is added to the request's context,
+// passed on to the upstream and returned to the client.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+// AccessLogMiddleware logs every request passed to next once answered.
+// The tenant is taken from the client identity, or tenantHeader for
+// unauthenticated requests.
+func AccessLogMiddleware(next http.Handler, log *slog.Logger, tenantHeader string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		tenant := r.Header.Get(tenantHeader)
+		if id, ok := proxy.IdentityFrom(r); ok && id.Tenant != "" {
+			tenant = id.Tenant
+		}
+		// X-Cache reads e.g. "HIT from host", keep the status only
+		cacheStatus, _, _ := strings.Cut(w.Header().Get("X-Cache"), " ")
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration_seconds", time.Since(startTime).Seconds(),
+			"bytes", sw.size,
+			"cache_status", cacheStatus,
+			"tenant", tenant,
+		}
+		if dashboard := r.Header.Get(proxy.DashboardHeader); dashboard != "" {
+			attrs = append(attrs, "dashboard", dashboard, "panel", r.Header.Get(proxy.PanelHeader))
+		}
+		log.InfoContext(r.Context(), "Request", attrs...)
+	})
+}
+
+// statusWriter records the status and body size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
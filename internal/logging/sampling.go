@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+// keyLimitWindow is the window the per-key debug record limit applies to
+const keyLimitWindow = time.Minute
+
+// maxLimitedKeys bounds the keys counted per window; records of further
+// keys are dropped until the window ends
+const maxLimitedKeys = 100000
+
+// sampler decides which debug records are written. It is shared by all
+// handlers derived from the same logger.
+type sampler struct {
+	// rate is the fraction of debug records kept
+	rate float64
+	// keyLimit is the number of debug records kept per message and cache
+	// key and window, 0 keeps all
+	keyLimit int
+	metrics  *metrics.Metrics
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+}
+
+// keep reports whether a debug record is written, counting it against its
+// key's limit
+func (s *sampler) keep(record slog.Record) bool {
+	if s.rate < 1 && rand.Float64() >= s.rate {
+		s.metrics.RecordLogDropped("sampled")
+		return false
+	}
+	if s.keyLimit <= 0 {
+		return true
+	}
+
+	key := record.Message
+	record.Attrs(func(a slog.Attr) bool {
+		if a.Key == "key" {
+			key += "\x00" + a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.Sub(s.windowStart) >= keyLimitWindow {
+		s.windowStart = now
+		s.counts = make(map[string]int)
+	}
+	count, found := s.counts[key]
+	if count >= s.keyLimit || (!found && len(s.counts) >= maxLimitedKeys) {
+		s.metrics.RecordLogDropped("rate_limited")
+		return false
+	}
+	s.counts[key] = count + 1
+	return true
+}
+
+// samplingHandler drops debug records not kept by its sampler; records of
+// other levels are always written
+type samplingHandler struct {
+	slog.Handler
+	sampler *sampler
+}
+
+func (h samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelInfo && !h.sampler.keep(record) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return samplingHandler{h.Handler.WithAttrs(attrs), h.sampler}
+}
+
+func (h samplingHandler) WithGroup(name string) slog.Handler {
+	return samplingHandler{h.Handler.WithGroup(name), h.sampler}
+}
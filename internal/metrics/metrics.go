@@ -1,57 +1,454 @@
 package metrics
 
 import (
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Options of the latency and size histograms, extended by histogramOpts
 var (
-	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "promcache_cache_hits_total",
-		Help: "The total number of cache hits",
-	})
-
-	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "promcache_cache_misses_total",
-		Help: "The total number of cache misses",
-	})
-
-	upstreamLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	upstreamLatencyOpts = prometheus.HistogramOpts{
 		Name:    "promcache_upstream_request_duration_seconds",
-		Help:    "Upstream request latency in seconds",
+		Help:    "Upstream request latency in seconds by upstream, endpoint and status class",
 		Buckets: prometheus.DefBuckets,
-	})
+	}
+
+	responseDurationOpts = prometheus.HistogramOpts{
+		Name:    "promcache_response_duration_seconds",
+		Help:    "Time taken to answer API requests in seconds by cache result",
+		Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}
 
-	cacheSize = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "promcache_cache_size",
-		Help: "Current number of items in the cache",
-	})
+	responseSizeOpts = prometheus.HistogramOpts{
+		Name:    "promcache_response_size_bytes",
+		Help:    "Size of API response bodies in bytes by cache result",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 9),
+	}
 )
 
+// Metrics are the metrics of the cache. Each component records to the
+// Metrics it was created with, so several caches can run in one process.
+type Metrics struct {
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
+
+	cacheHits            prometheus.Counter
+	cacheMisses          prometheus.Counter
+	upstreamLatency      *prometheus.HistogramVec
+	responseDuration     *prometheus.HistogramVec
+	responseSize         *prometheus.HistogramVec
+	cacheSize            prometheus.Gauge
+	cacheSkippedTooLarge prometheus.Counter
+	cacheSkippedInvalid  prometheus.Counter
+	cacheSkippedCheap    prometheus.Counter
+	hierarchyRequests    *prometheus.CounterVec
+	roundingDelta        *prometheus.HistogramVec
+	gomaxprocs           prometheus.Gauge
+	cpuQuota             prometheus.Gauge
+	memoryLimit          prometheus.Gauge
+	keepWarmLatency      prometheus.Gauge
+	keepWarmFailures     prometheus.Counter
+	rateLimited          prometheus.Counter
+	authRequests         *prometheus.CounterVec
+	authFailures         *prometheus.CounterVec
+	upstreamInflight     prometheus.Gauge
+	upstreamOverloaded   prometheus.Counter
+	hedgedRequests       *prometheus.CounterVec
+	pushFailures         prometheus.Counter
+	upstreamFailovers    *prometheus.CounterVec
+	peerRequests         *prometheus.CounterVec
+	peers                prometheus.Gauge
+	ringVersion          prometheus.Gauge
+	thanosRequests       *prometheus.CounterVec
+	shadowRequests       *prometheus.CounterVec
+	shadowBytesSaved     prometheus.Counter
+	verifyResults        *prometheus.CounterVec
+	queryHits            *prometheus.CounterVec
+	recentSplits         *prometheus.CounterVec
+	buildInfo            *prometheus.GaugeVec
+	logDropped           *prometheus.CounterVec
+	dashboardRequests    *prometheus.CounterVec
+	tenantRequests       *prometheus.CounterVec
+}
+
+// Options configure the metrics
+type Options struct {
+	// NativeHistograms adds native histogram buckets to the latency and
+	// size histograms, next to their classic buckets. Scrapers negotiating
+	// the protobuf format get both.
+	NativeHistograms bool
+}
+
+// New creates the metrics and registers them with reg. Metrics reg already
+// has, e.g. from another Metrics, are shared rather than registered twice.
+// A nil reg leaves the metrics unregistered. Handler and Pusher expose reg
+// if it is a prometheus.Gatherer too, like a *prometheus.Registry.
+func New(reg prometheus.Registerer, opts Options) *Metrics {
+	gatherer, _ := reg.(prometheus.Gatherer)
+	if gatherer == nil {
+		gatherer = prometheus.Gatherers{}
+	}
+	return &Metrics{
+		registerer: reg,
+		gatherer:   gatherer,
+
+		cacheHits: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_cache_hits_total",
+			Help: "The total number of cache hits",
+		})),
+		cacheMisses: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_cache_misses_total",
+			Help: "The total number of cache misses",
+		})),
+		upstreamLatency:  register(reg, prometheus.NewHistogramVec(histogramOpts(upstreamLatencyOpts, opts.NativeHistograms), []string{"upstream", "endpoint", "status"})),
+		responseDuration: register(reg, prometheus.NewHistogramVec(histogramOpts(responseDurationOpts, opts.NativeHistograms), []string{"result"})),
+		responseSize:     register(reg, prometheus.NewHistogramVec(histogramOpts(responseSizeOpts, opts.NativeHistograms), []string{"result"})),
+		cacheSize: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_cache_size",
+			Help: "Current number of items in the cache",
+		})),
+		cacheSkippedTooLarge: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_cache_skipped_too_large_total",
+			Help: "The total number of responses not cached because they exceeded the maximum object size",
+		})),
+		cacheSkippedInvalid: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_cache_skipped_invalid_total",
+			Help: "The total number of responses not cached because they failed validation",
+		})),
+		cacheSkippedCheap: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_cache_skipped_cheap_total",
+			Help: "The total number of query responses not cached because they were below the cost thresholds",
+		})),
+		hierarchyRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_hierarchy_requests_total",
+			Help: "The total number of cacheable requests by the tier that served them (local, parent, origin)",
+		}, []string{"served_by"})),
+		roundingDelta: register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "promcache_time_rounding_delta_seconds",
+			Help:    "How far time parameters were shifted by rounding to TTL boundaries in seconds",
+			Buckets: []float64{0, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}, []string{"param"})),
+		gomaxprocs: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_gomaxprocs",
+			Help: "The effective GOMAXPROCS setting",
+		})),
+		cpuQuota: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_cpu_quota_cores",
+			Help: "The container CPU quota in cores, 0 if unlimited",
+		})),
+		memoryLimit: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_memory_limit_bytes",
+			Help: "The container memory limit in bytes, 0 if unlimited",
+		})),
+		keepWarmLatency: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_upstream_keepwarm_duration_seconds",
+			Help: "Latency of the most recent successful upstream keep-warm query in seconds",
+		})),
+		keepWarmFailures: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_upstream_keepwarm_failures_total",
+			Help: "The total number of failed upstream keep-warm queries",
+		})),
+		rateLimited: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_ratelimited_requests_total",
+			Help: "The total number of requests rejected by per-client rate limiting",
+		})),
+		authRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_auth_requests_total",
+			Help: "The total number of authenticated requests by API key or token name",
+		}, []string{"key"})),
+		authFailures: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_auth_failures_total",
+			Help: "The total number of rejected unauthenticated requests by reason",
+		}, []string{"reason"})),
+		upstreamInflight: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_upstream_inflight_requests",
+			Help: "Current number of in-flight upstream requests",
+		})),
+		upstreamOverloaded: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_upstream_overloaded_total",
+			Help: "The total number of requests rejected because no upstream slot became available in time",
+		})),
+		hedgedRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_upstream_hedged_requests_total",
+			Help: "The total number of hedged upstream requests by the attempt that responded first",
+		}, []string{"winner"})),
+		pushFailures: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_metrics_push_failures_total",
+			Help: "The total number of failed pushes of these metrics to statsd or OTLP",
+		})),
+		upstreamFailovers: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_upstream_failovers_total",
+			Help: "The total number of upstream requests answered by another replica after the first one failed",
+		}, []string{"upstream"})),
+		peerRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_peer_requests_total",
+			Help: "The total number of cache requests to owning peers by operation and result",
+		}, []string{"op", "result"})),
+		peers: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_peers",
+			Help: "The current number of cluster peers, including this instance",
+		})),
+		ringVersion: register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promcache_peer_ring_version",
+			Help: "The version of the cluster hash ring, equal on peers agreeing on the membership",
+		})),
+		thanosRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_thanos_requests_total",
+			Help: "The total number of Thanos StoreAPI gRPC requests by method and cache result",
+		}, []string{"method", "result"})),
+		shadowRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_shadow_requests_total",
+			Help: "The total number of requests in shadow mode by simulated cache result",
+		}, []string{"result"})),
+		shadowBytesSaved: register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "promcache_shadow_bytes_saved_total",
+			Help: "The total number of response bytes simulated cache hits would have served from the cache",
+		})),
+		verifyResults: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_verify_results_total",
+			Help: "The total number of cache hits compared against the upstream by result",
+		}, []string{"result"})),
+		queryHits: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_query_hits_total",
+			Help: "The total number of cache hits by query fingerprint, queries beyond the label limit counted as other",
+		}, []string{"fingerprint"})),
+		recentSplits: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_recent_split_requests_total",
+			Help: "The total number of range queries split into a cached head and a fresh tail by head cache result",
+		}, []string{"head"})),
+		buildInfo: register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promcache_build_info",
+			Help: "Always 1, labeled with the version, commit and Go version promcached was built from",
+		}, []string{"version", "commit", "goversion"})),
+		logDropped: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_log_records_dropped_total",
+			Help: "The total number of debug log records dropped by reason",
+		}, []string{"reason"})),
+		dashboardRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_dashboard_requests_total",
+			Help: "The total number of cacheable requests by Grafana dashboard and cache result",
+		}, []string{"dashboard", "result"})),
+		tenantRequests: register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promcache_tenant_requests_total",
+			Help: "The total number of requests by tenant and cache result",
+		}, []string{"tenant", "result"})),
+	}
+}
+
+// register registers c with reg and returns it, or the equal collector
+// reg already has
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) C {
+	if reg == nil {
+		return c
+	}
+	if err := reg.Register(c); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return c
+}
+
+// histogramOpts returns opts with native histogram buckets if native is set
+func histogramOpts(opts prometheus.HistogramOpts, native bool) prometheus.HistogramOpts {
+	if native {
+		opts.NativeHistogramBucketFactor = 1.1
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
 // RecordCacheHit increments the cache hit counter
-func RecordCacheHit() {
-	cacheHits.Inc()
+func (m *Metrics) RecordCacheHit() {
+	m.cacheHits.Inc()
 }
 
 // RecordCacheMiss increments the cache miss counter
-func RecordCacheMiss() {
-	cacheMisses.Inc()
+func (m *Metrics) RecordCacheMiss() {
+	m.cacheMisses.Inc()
+}
+
+// RecordUpstreamLatency records the latency of an upstream request by
+// upstream, endpoint and status class, with the trace ID as exemplar if the
+// request was traced
+func (m *Metrics) RecordUpstreamLatency(upstream string, endpoint string, status string, seconds float64, traceID string) {
+	observer := m.upstreamLatency.WithLabelValues(upstream, endpoint, status)
+	if traceID == "" {
+		observer.Observe(seconds)
+		return
+	}
+	observer.(prometheus.ExemplarObserver).ObserveWithExemplar(seconds, prometheus.Labels{"trace_id": traceID})
 }
 
-// RecordUpstreamLatency records the latency of an upstream request
-func RecordUpstreamLatency(seconds float64) {
-	upstreamLatency.Observe(seconds)
+// RecordResponse records the time taken to answer an API request and the
+// size of its body by cache result
+func (m *Metrics) RecordResponse(result string, seconds float64, bytes int) {
+	m.responseDuration.WithLabelValues(result).Observe(seconds)
+	m.responseSize.WithLabelValues(result).Observe(float64(bytes))
 }
 
 // SetCacheSize updates the cache size gauge
-func SetCacheSize(size float64) {
-	cacheSize.Set(size)
+func (m *Metrics) SetCacheSize(size float64) {
+	m.cacheSize.Set(size)
+}
+
+// RecordCacheSkippedTooLarge increments the skipped-too-large counter
+func (m *Metrics) RecordCacheSkippedTooLarge() {
+	m.cacheSkippedTooLarge.Inc()
+}
+
+// RecordCacheSkippedInvalid increments the skipped-invalid counter
+func (m *Metrics) RecordCacheSkippedInvalid() {
+	m.cacheSkippedInvalid.Inc()
+}
+
+// RecordCacheSkippedCheap increments the skipped-cheap counter
+func (m *Metrics) RecordCacheSkippedCheap() {
+	m.cacheSkippedCheap.Inc()
+}
+
+// RecordHierarchyRequest increments the request counter of the tier that
+// served a cacheable request
+func (m *Metrics) RecordHierarchyRequest(servedBy string) {
+	m.hierarchyRequests.WithLabelValues(servedBy).Inc()
+}
+
+// RecordRoundingDelta records the shift applied to a time parameter by rounding
+func (m *Metrics) RecordRoundingDelta(param string, seconds float64) {
+	m.roundingDelta.WithLabelValues(param).Observe(seconds)
+}
+
+// RecordKeepWarmLatency records the latency of a successful keep-warm query
+func (m *Metrics) RecordKeepWarmLatency(seconds float64) {
+	m.keepWarmLatency.Set(seconds)
+}
+
+// RecordKeepWarmFailure increments the keep-warm failure counter
+func (m *Metrics) RecordKeepWarmFailure() {
+	m.keepWarmFailures.Inc()
+}
+
+// RecordRateLimited increments the rate limited request counter
+func (m *Metrics) RecordRateLimited() {
+	m.rateLimited.Inc()
+}
+
+// RecordAuthRequest increments the authenticated request counter of a key
+func (m *Metrics) RecordAuthRequest(key string) {
+	m.authRequests.WithLabelValues(key).Inc()
+}
+
+// RecordAuthFailure increments the authentication failure counter
+func (m *Metrics) RecordAuthFailure(reason string) {
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+// AddUpstreamInflight adjusts the in-flight upstream request gauge
+func (m *Metrics) AddUpstreamInflight(delta float64) {
+	m.upstreamInflight.Add(delta)
+}
+
+// RecordUpstreamOverloaded increments the upstream overload rejection counter
+func (m *Metrics) RecordUpstreamOverloaded() {
+	m.upstreamOverloaded.Inc()
+}
+
+// RecordHedgedRequest increments the hedged request counter of the winning
+// attempt
+func (m *Metrics) RecordHedgedRequest(winner string) {
+	m.hedgedRequests.WithLabelValues(winner).Inc()
+}
+
+// RecordUpstreamFailover increments the failover counter of an upstream
+func (m *Metrics) RecordUpstreamFailover(upstream string) {
+	m.upstreamFailovers.WithLabelValues(upstream).Inc()
+}
+
+// RecordPeerRequest increments the peer cache request counter
+func (m *Metrics) RecordPeerRequest(op string, result string) {
+	m.peerRequests.WithLabelValues(op, result).Inc()
+}
+
+// SetPeers records the current number of cluster peers and the version of
+// their ring
+func (m *Metrics) SetPeers(n int, version uint32) {
+	m.peers.Set(float64(n))
+	m.ringVersion.Set(float64(version))
+}
+
+// RecordThanosRequest increments the Thanos StoreAPI request counter
+func (m *Metrics) RecordThanosRequest(method string, result string) {
+	m.thanosRequests.WithLabelValues(method, result).Inc()
+}
+
+// RecordShadowRequest increments the shadow mode request counter
+func (m *Metrics) RecordShadowRequest(result string) {
+	m.shadowRequests.WithLabelValues(result).Inc()
+}
+
+// RecordShadowBytesSaved adds the size of a simulated cache hit
+func (m *Metrics) RecordShadowBytesSaved(bytes int) {
+	m.shadowBytesSaved.Add(float64(bytes))
+}
+
+// RecordVerifyResult increments the consistency verification counter
+func (m *Metrics) RecordVerifyResult(result string) {
+	m.verifyResults.WithLabelValues(result).Inc()
+}
+
+// RecordQueryHit increments the cache hit counter of a query fingerprint
+func (m *Metrics) RecordQueryHit(fingerprint string) {
+	m.queryHits.WithLabelValues(fingerprint).Inc()
+}
+
+// RecordRecentSplit increments the split range query counter
+func (m *Metrics) RecordRecentSplit(head string) {
+	m.recentSplits.WithLabelValues(strings.ToLower(head)).Inc()
+}
+
+// SetBuildInfo records the build of the running binary
+func (m *Metrics) SetBuildInfo(version string, commit string, goVersion string) {
+	m.buildInfo.WithLabelValues(version, commit, goVersion).Set(1)
+}
+
+// RecordLogDropped increments the dropped debug log record counter
+func (m *Metrics) RecordLogDropped(reason string) {
+	m.logDropped.WithLabelValues(reason).Inc()
+}
+
+// RecordDashboardRequest increments the request counter of a Grafana dashboard
+func (m *Metrics) RecordDashboardRequest(dashboard string, result string) {
+	m.dashboardRequests.WithLabelValues(dashboard, result).Inc()
+}
+
+// RecordTenantRequest increments the request counter of a tenant
+func (m *Metrics) RecordTenantRequest(tenant string, result string) {
+	m.tenantRequests.WithLabelValues(tenant, result).Inc()
+}
+
+// SetResourceLimits records the effective CPU and memory limits
+func (m *Metrics) SetResourceLimits(procs int, quota float64, memLimit int64) {
+	m.gomaxprocs.Set(float64(procs))
+	m.cpuQuota.Set(quota)
+	m.memoryLimit.Set(float64(memLimit))
 }
 
-// Handler returns an HTTP handler for metrics
-func Handler() http.Handler {
-	return promhttp.Handler()
+// Handler returns an HTTP handler exposing the registry of the metrics
+func (m *Metrics) Handler() http.Handler {
+	// Exemplars are only exposed in the OpenMetrics format
+	handler := promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	if m.registerer == nil {
+		return handler
+	}
+	return promhttp.InstrumentMetricHandler(m.registerer, handler)
 }
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewSharesRegisteredMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a := New(reg, Options{})
+	b := New(reg, Options{})
+
+	a.RecordCacheHit()
+	b.RecordCacheHit()
+	if got := testutil.ToFloat64(a.cacheHits); got != 2 {
+		t.Errorf("cache hits = %g, want 2 shared between both Metrics", got)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() == "promcache_cache_hits_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("cache hits aren't registered with the registry")
+	}
+}
+
+func TestNewWithoutRegisterer(t *testing.T) {
+	m := New(nil, Options{})
+	m.RecordCacheHit()
+	if got := testutil.ToFloat64(m.cacheHits); got != 1 {
+		t.Errorf("cache hits = %g, want 1", got)
+	}
+
+	// Unregistered metrics stay off the default registry
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "promcache_cache_hits_total" {
+			t.Error("cache hits are registered with the default registry")
+		}
+	}
+}
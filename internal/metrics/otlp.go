@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the OTLP metrics messages, from
+// opentelemetry/proto/collector/metrics/v1/metrics_service.proto and
+// opentelemetry/proto/metrics/v1/metrics.proto
+const (
+	otlpRequestResourceMetrics protowire.Number = 1
+
+	otlpResourceMetricsResource protowire.Number = 1
+	otlpResourceMetricsScope    protowire.Number = 2
+	otlpResourceAttributes      protowire.Number = 1
+
+	otlpScopeMetricsScope   protowire.Number = 1
+	otlpScopeMetricsMetrics protowire.Number = 2
+	otlpScopeName           protowire.Number = 1
+
+	otlpKeyValueKey     protowire.Number = 1
+	otlpKeyValueValue   protowire.Number = 2
+	otlpAnyValueString  protowire.Number = 1
+	otlpMetricName      protowire.Number = 1
+	otlpMetricDesc      protowire.Number = 2
+	otlpMetricGauge     protowire.Number = 5
+	otlpMetricSum       protowire.Number = 7
+	otlpMetricHistogram protowire.Number = 9
+	otlpMetricSummary   protowire.Number = 11
+	otlpDataPoints      protowire.Number = 1
+	otlpTemporality     protowire.Number = 2
+	otlpSumMonotonic    protowire.Number = 3
+
+	otlpPointStart         protowire.Number = 2
+	otlpPointTime          protowire.Number = 3
+	otlpNumberAsDouble     protowire.Number = 4
+	otlpNumberAttributes   protowire.Number = 7
+	otlpHistogramCount     protowire.Number = 4
+	otlpHistogramSum       protowire.Number = 5
+	otlpHistogramBuckets   protowire.Number = 6
+	otlpHistogramBounds    protowire.Number = 7
+	otlpHistogramAttribute protowire.Number = 9
+	otlpSummaryCount       protowire.Number = 4
+	otlpSummarySum         protowire.Number = 5
+	otlpSummaryQuantiles   protowire.Number = 6
+	otlpSummaryAttributes  protowire.Number = 7
+	otlpQuantileQuantile   protowire.Number = 1
+	otlpQuantileValue      protowire.Number = 2
+)
+
+// otlpTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpTemporalityCumulative = 2
+
+// otlpTarget pushes metrics to an OTLP/HTTP endpoint as protobuf. Values
+// are cumulative since the pusher was created.
+type otlpTarget struct {
+	url      string
+	headers  map[string]string
+	resource []byte
+	start    uint64
+	client   *http.Client
+}
+
+// newOTLPTarget creates an OTLP target posting to url
+func newOTLPTarget(url string, headers map[string]string, resource map[string]string) *otlpTarget {
+	var res []byte
+	names := make([]string, 0, len(resource))
+	for name := range resource {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = appendMessage(res, otlpResourceAttributes, appendKeyValue(nil, name, resource[name]))
+	}
+
+	return &otlpTarget{
+		url:      url,
+		headers:  headers,
+		resource: res,
+		start:    uint64(time.Now().UnixNano()),
+		client:   &http.Client{},
+	}
+}
+
+func (t *otlpTarget) push(ctx context.Context, families []*dto.MetricFamily, now time.Time) error {
+	var scope []byte
+	scope = appendMessage(scope, otlpScopeMetricsScope, protowire.AppendString(protowire.AppendTag(nil, otlpScopeName, protowire.BytesType), "promcache"))
+	for _, family := range families {
+		if metric := t.appendMetric(nil, family, uint64(now.UnixNano())); metric != nil {
+			scope = appendMessage(scope, otlpScopeMetricsMetrics, metric)
+		}
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, otlpResourceMetricsResource, t.resource)
+	resourceMetrics = appendMessage(resourceMetrics, otlpResourceMetricsScope, scope)
+	body := appendMessage(nil, otlpRequestResourceMetrics, resourceMetrics)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("OTLP endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// appendMetric appends the OTLP Metric of a metric family to b, nothing
+// for families without metrics
+func (t *otlpTarget) appendMetric(b []byte, family *dto.MetricFamily, now uint64) []byte {
+	if len(family.GetMetric()) == 0 {
+		return nil
+	}
+
+	var points []byte
+	for _, m := range family.GetMetric() {
+		var point []byte
+		point = protowire.AppendTag(point, otlpPointStart, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, t.start)
+		point = protowire.AppendTag(point, otlpPointTime, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, now)
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			point = appendDouble(point, otlpNumberAsDouble, m.GetCounter().GetValue())
+			point = appendAttributes(point, otlpNumberAttributes, m.GetLabel())
+		case dto.MetricType_GAUGE:
+			point = appendDouble(point, otlpNumberAsDouble, m.GetGauge().GetValue())
+			point = appendAttributes(point, otlpNumberAttributes, m.GetLabel())
+		case dto.MetricType_UNTYPED:
+			point = appendDouble(point, otlpNumberAsDouble, m.GetUntyped().GetValue())
+			point = appendAttributes(point, otlpNumberAttributes, m.GetLabel())
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			point = appendHistogramPoint(point, m.GetHistogram())
+			point = appendAttributes(point, otlpHistogramAttribute, m.GetLabel())
+		case dto.MetricType_SUMMARY:
+			point = appendSummaryPoint(point, m.GetSummary())
+			point = appendAttributes(point, otlpSummaryAttributes, m.GetLabel())
+		}
+		points = appendMessage(points, otlpDataPoints, point)
+	}
+
+	b = protowire.AppendTag(b, otlpMetricName, protowire.BytesType)
+	b = protowire.AppendString(b, family.GetName())
+	b = protowire.AppendTag(b, otlpMetricDesc, protowire.BytesType)
+	b = protowire.AppendString(b, family.GetHelp())
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		points = protowire.AppendTag(points, otlpTemporality, protowire.VarintType)
+		points = protowire.AppendVarint(points, otlpTemporalityCumulative)
+		points = protowire.AppendTag(points, otlpSumMonotonic, protowire.VarintType)
+		points = protowire.AppendVarint(points, 1)
+		return appendMessage(b, otlpMetricSum, points)
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		points = protowire.AppendTag(points, otlpTemporality, protowire.VarintType)
+		points = protowire.AppendVarint(points, otlpTemporalityCumulative)
+		return appendMessage(b, otlpMetricHistogram, points)
+	case dto.MetricType_SUMMARY:
+		return appendMessage(b, otlpMetricSummary, points)
+	default:
+		return appendMessage(b, otlpMetricGauge, points)
+	}
+}
+
+// appendHistogramPoint appends the fields of a HistogramDataPoint. OTLP
+// bucket counts aren't cumulative like Prometheus', and the +Inf bucket is
+// implied by the bounds.
+func appendHistogramPoint(b []byte, h *dto.Histogram) []byte {
+	b = protowire.AppendTag(b, otlpHistogramCount, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, h.GetSampleCount())
+	b = appendDouble(b, otlpHistogramSum, h.GetSampleSum())
+
+	var counts, bounds []byte
+	var cumulative uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		counts = protowire.AppendFixed64(counts, bucket.GetCumulativeCount()-cumulative)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bucket.GetUpperBound()))
+		cumulative = bucket.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, h.GetSampleCount()-cumulative)
+	b = appendMessage(b, otlpHistogramBuckets, counts)
+	if len(bounds) > 0 {
+		b = appendMessage(b, otlpHistogramBounds, bounds)
+	}
+	return b
+}
+
+// appendSummaryPoint appends the fields of a SummaryDataPoint
+func appendSummaryPoint(b []byte, s *dto.Summary) []byte {
+	b = protowire.AppendTag(b, otlpSummaryCount, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, s.GetSampleCount())
+	b = appendDouble(b, otlpSummarySum, s.GetSampleSum())
+	for _, q := range s.GetQuantile() {
+		var quantile []byte
+		quantile = appendDouble(quantile, otlpQuantileQuantile, q.GetQuantile())
+		quantile = appendDouble(quantile, otlpQuantileValue, q.GetValue())
+		b = appendMessage(b, otlpSummaryQuantiles, quantile)
+	}
+	return b
+}
+
+// appendAttributes appends labels as KeyValue attributes in field num
+func appendAttributes(b []byte, num protowire.Number, labels []*dto.LabelPair) []byte {
+	for _, l := range labels {
+		b = appendMessage(b, num, appendKeyValue(nil, l.GetName(), l.GetValue()))
+	}
+	return b
+}
+
+// appendKeyValue appends the fields of a KeyValue with a string value
+func appendKeyValue(b []byte, key string, value string) []byte {
+	b = protowire.AppendTag(b, otlpKeyValueKey, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	anyValue := protowire.AppendString(protowire.AppendTag(nil, otlpAnyValueString, protowire.BytesType), value)
+	return appendMessage(b, otlpKeyValueValue, anyValue)
+}
+
+// appendDouble appends a double field
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// appendMessage appends an embedded message, or packed repeated field, in
+// field num
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
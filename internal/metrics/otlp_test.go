@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a decoded protobuf field, bytes for length-delimited
+// fields and value for the others
+type protoField struct {
+	num   protowire.Number
+	bytes []byte
+	value uint64
+}
+
+// protoMessage is a decoded protobuf message
+type protoMessage []protoField
+
+// decodeProto decodes the fields of a protobuf message
+func decodeProto(t *testing.T, b []byte) protoMessage {
+	t.Helper()
+	var m protoMessage
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := protoField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		m = append(m, f)
+	}
+	return m
+}
+
+// all returns the fields numbered num
+func (m protoMessage) all(num protowire.Number) []protoField {
+	var fields []protoField
+	for _, f := range m {
+		if f.num == num {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// one returns the only field numbered num
+func (m protoMessage) one(t *testing.T, num protowire.Number) protoField {
+	t.Helper()
+	fields := m.all(num)
+	if len(fields) != 1 {
+		t.Fatalf("got %d fields %d, want 1", len(fields), num)
+	}
+	return fields[0]
+}
+
+// attributes returns the KeyValue attributes in field num as key=value
+func (m protoMessage) attributes(t *testing.T, num protowire.Number) []string {
+	t.Helper()
+	var attrs []string
+	for _, f := range m.all(num) {
+		kv := decodeProto(t, f.bytes)
+		value := decodeProto(t, kv.one(t, otlpKeyValueValue).bytes).one(t, otlpAnyValueString)
+		attrs = append(attrs, string(kv.one(t, otlpKeyValueKey).bytes)+"="+string(value.bytes))
+	}
+	return attrs
+}
+
+// packedFixed64 decodes a packed repeated fixed64 field
+func packedFixed64(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var values []uint64
+	for len(b) > 0 {
+		v, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			t.Fatalf("invalid packed field: %v", protowire.ParseError(n))
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values
+}
+
+func TestOTLPPush(t *testing.T) {
+	var body []byte
+	var header http.Header
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"path"})
+	entries := prometheus.NewGauge(prometheus.GaugeOpts{Name: "entries", Help: "Entries."})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds", Help: "Duration.", Buckets: []float64{0.1, 1}})
+	requests.WithLabelValues("/api/v1/query").Add(3)
+	entries.Set(42)
+	for _, v := range []float64{0.05, 0.5, 0.7, 5} {
+		duration.Observe(v)
+	}
+
+	target := newOTLPTarget(collector.URL, map[string]string{"Authorization": "Bearer secret"}, map[string]string{"service.name": "promcache", "host.name": "a"})
+	now := time.Unix(1700000000, 0)
+	if err := target.push(context.Background(), gather(t, requests, entries, duration), now); err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("Content-Type"); got != "application/x-protobuf" {
+		t.Errorf("Content-Type = %q, want application/x-protobuf", got)
+	}
+	if got := header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+
+	resourceMetrics := decodeProto(t, decodeProto(t, body).one(t, otlpRequestResourceMetrics).bytes)
+	resource := decodeProto(t, resourceMetrics.one(t, otlpResourceMetricsResource).bytes)
+	if got, want := resource.attributes(t, otlpResourceAttributes), []string{"host.name=a", "service.name=promcache"}; !slices.Equal(got, want) {
+		t.Errorf("resource attributes = %v, want %v", got, want)
+	}
+	scope := decodeProto(t, resourceMetrics.one(t, otlpResourceMetricsScope).bytes)
+	if name := decodeProto(t, scope.one(t, otlpScopeMetricsScope).bytes).one(t, otlpScopeName); string(name.bytes) != "promcache" {
+		t.Errorf("scope name = %q, want promcache", name.bytes)
+	}
+
+	metrics := make(map[string]protoMessage)
+	for _, f := range scope.all(otlpScopeMetricsMetrics) {
+		metric := decodeProto(t, f.bytes)
+		metrics[string(metric.one(t, otlpMetricName).bytes)] = metric
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(metrics))
+	}
+
+	// Counters are cumulative monotonic sums
+	sum := decodeProto(t, metrics["requests_total"].one(t, otlpMetricSum).bytes)
+	if got := sum.one(t, otlpTemporality).value; got != otlpTemporalityCumulative {
+		t.Errorf("counter temporality = %d, want cumulative", got)
+	}
+	if got := sum.one(t, otlpSumMonotonic).value; got != 1 {
+		t.Errorf("counter monotonic = %d, want 1", got)
+	}
+	point := decodeProto(t, sum.one(t, otlpDataPoints).bytes)
+	if got := math.Float64frombits(point.one(t, otlpNumberAsDouble).value); got != 3 {
+		t.Errorf("counter value = %g, want 3", got)
+	}
+	if got := point.one(t, otlpPointTime).value; got != uint64(now.UnixNano()) {
+		t.Errorf("time = %d, want %d", got, now.UnixNano())
+	}
+	if got := point.one(t, otlpPointStart).value; got != target.start {
+		t.Errorf("start time = %d, want the pusher's start %d", got, target.start)
+	}
+	if got := point.attributes(t, otlpNumberAttributes); !slices.Equal(got, []string{"path=/api/v1/query"}) {
+		t.Errorf("counter attributes = %v, want path=/api/v1/query", got)
+	}
+	if got := string(metrics["requests_total"].one(t, otlpMetricDesc).bytes); got != "Requests." {
+		t.Errorf("description = %q, want the help", got)
+	}
+
+	gauge := decodeProto(t, metrics["entries"].one(t, otlpMetricGauge).bytes)
+	point = decodeProto(t, gauge.one(t, otlpDataPoints).bytes)
+	if got := math.Float64frombits(point.one(t, otlpNumberAsDouble).value); got != 42 {
+		t.Errorf("gauge value = %g, want 42", got)
+	}
+
+	// Histogram buckets are counts per bucket, with an implied +Inf bound
+	histogram := decodeProto(t, metrics["duration_seconds"].one(t, otlpMetricHistogram).bytes)
+	point = decodeProto(t, histogram.one(t, otlpDataPoints).bytes)
+	if got := point.one(t, otlpHistogramCount).value; got != 4 {
+		t.Errorf("histogram count = %d, want 4", got)
+	}
+	if got := math.Float64frombits(point.one(t, otlpHistogramSum).value); got != 6.25 {
+		t.Errorf("histogram sum = %g, want 6.25", got)
+	}
+	if got := packedFixed64(t, point.one(t, otlpHistogramBuckets).bytes); !slices.Equal(got, []uint64{1, 2, 1}) {
+		t.Errorf("bucket counts = %v, want [1 2 1]", got)
+	}
+	var bounds []float64
+	for _, bits := range packedFixed64(t, point.one(t, otlpHistogramBounds).bytes) {
+		bounds = append(bounds, math.Float64frombits(bits))
+	}
+	if !slices.Equal(bounds, []float64{0.1, 1}) {
+		t.Errorf("bounds = %v, want [0.1 1]", bounds)
+	}
+}
+
+func TestOTLPPushError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+	}))
+	defer collector.Close()
+
+	target := newOTLPTarget(collector.URL, nil, nil)
+	err := target.push(context.Background(), nil, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "429") || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("push error = %v, want the status and message", err)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PushOptions configures pushing metrics to a monitoring system
+type PushOptions struct {
+	// URL is where metrics are pushed: statsd://host:port for statsd over
+	// UDP, http:// or https:// for an OTLP/HTTP metrics endpoint such as
+	// http://collector:4318/v1/metrics
+	URL string
+	// Interval is the time between pushes
+	Interval time.Duration
+	// Headers are added to OTLP requests, e.g. for authentication
+	Headers map[string]string
+	// Resource are the OTLP resource attributes, e.g. service.name
+	Resource map[string]string
+}
+
+// pushTarget sends the gathered metric families to a monitoring system
+type pushTarget interface {
+	push(ctx context.Context, families []*dto.MetricFamily, now time.Time) error
+}
+
+// Pusher periodically pushes the metrics of a registry, so the cache can
+// be monitored without scraping it from the Prometheus it fronts
+type Pusher struct {
+	target   pushTarget
+	metrics  *Metrics
+	interval time.Duration
+	log      *slog.Logger
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewPusher creates a pusher of the registry of m for opts.URL, Start
+// starts pushing
+func NewPusher(opts PushOptions, m *Metrics, log *slog.Logger) (*Pusher, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics push URL: %w", err)
+	}
+
+	var target pushTarget
+	switch u.Scheme {
+	case "statsd":
+		if target, err = newStatsdTarget(u.Host); err != nil {
+			return nil, err
+		}
+	case "http", "https":
+		target = newOTLPTarget(opts.URL, opts.Headers, opts.Resource)
+	default:
+		return nil, fmt.Errorf("unsupported metrics push URL scheme %q, use statsd, http or https", u.Scheme)
+	}
+
+	return &Pusher{
+		target:   target,
+		metrics:  m,
+		interval: opts.Interval,
+		log:      log,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start pushes metrics every interval until Stop is called
+func (p *Pusher) Start() {
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+				p.push(ctx)
+				cancel()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops pushing and pushes the final values of the metrics
+func (p *Pusher) Stop(ctx context.Context) {
+	close(p.stop)
+	<-p.done
+	p.push(ctx)
+}
+
+// push gathers and pushes the metrics once
+func (p *Pusher) push(ctx context.Context) {
+	families, err := p.metrics.gatherer.Gather()
+	if err != nil {
+		// Gather returns what it could gather along with the error
+		p.log.Warn("Failed to gather some metrics for pushing", "error", err)
+	}
+	if err := p.target.push(ctx, families, time.Now()); err != nil {
+		p.metrics.pushFailures.Inc()
+		p.log.Warn("Failed to push metrics", "error", err)
+	}
+}
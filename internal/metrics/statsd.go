@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMaxPacket keeps statsd packets within the payload of a single
+// Ethernet frame
+const statsdMaxPacket = 1432
+
+// statsdTarget pushes metrics as statsd lines with DogStatsD tags over UDP.
+// Counters, and the counts and sums of histograms and summaries, are sent
+// as the increase since the previous push, gauges as their value.
+type statsdTarget struct {
+	conn net.Conn
+	// last holds the previous value of each counter line
+	last map[string]float64
+}
+
+// newStatsdTarget creates a statsd target sending to addr
+func newStatsdTarget(addr string) (*statsdTarget, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	return &statsdTarget{conn: conn, last: make(map[string]float64)}, nil
+}
+
+func (t *statsdTarget) push(ctx context.Context, families []*dto.MetricFamily, now time.Time) error {
+	var packet bytes.Buffer
+	var err error
+	send := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if _, writeErr := t.conn.Write(packet.Bytes()); writeErr != nil && err == nil {
+				err = writeErr
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			tags := statsdTags(m.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				t.sendCounter(send, name, tags, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				send(statsdLine(name, m.GetGauge().GetValue(), "g", tags))
+			case dto.MetricType_UNTYPED:
+				send(statsdLine(name, m.GetUntyped().GetValue(), "g", tags))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				t.sendCounter(send, name+"_count", tags, float64(m.GetHistogram().GetSampleCount()))
+				t.sendCounter(send, name+"_sum", tags, m.GetHistogram().GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				t.sendCounter(send, name+"_count", tags, float64(m.GetSummary().GetSampleCount()))
+				t.sendCounter(send, name+"_sum", tags, m.GetSummary().GetSampleSum())
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		if _, writeErr := t.conn.Write(packet.Bytes()); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// sendCounter sends the increase of a cumulative value since the previous
+// push. A value below the previous one means the counter was reset, its
+// whole value is the increase.
+func (t *statsdTarget) sendCounter(send func(string), name string, tags string, value float64) {
+	id := name + tags
+	last, seen := t.last[id]
+	t.last[id] = value
+	delta := value - last
+	if delta < 0 {
+		delta = value
+	}
+	if seen && delta == 0 {
+		return
+	}
+	send(statsdLine(name, delta, "c", tags))
+}
+
+// statsdLine formats a statsd line
+func statsdLine(name string, value float64, kind string, tags string) string {
+	return name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + kind + tags
+}
+
+// statsdTags formats labels as DogStatsD tags, sorted by name
+func statsdTags(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for _, l := range labels {
+		tags = append(tags, l.GetName()+":"+statsdEscaper.Replace(l.GetValue()))
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+// statsdEscaper replaces the separators of the statsd line format in tag
+// values
+var statsdEscaper = strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_")
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdListener returns a UDP socket to push to and a function returning
+// the packets received by it
+func statsdListener(t *testing.T) (string, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	receive := func() []string {
+		t.Helper()
+		var packets []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return packets
+			}
+			packets = append(packets, string(buf[:n]))
+		}
+	}
+	return conn.LocalAddr().String(), receive
+}
+
+// gather returns the metric families of collectors
+func gather(t *testing.T, collectors ...prometheus.Collector) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors...)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+func TestStatsdPush(t *testing.T) {
+	addr, receive := statsdListener(t)
+	target, err := newStatsdTarget(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"path", "status"})
+	entries := prometheus.NewGauge(prometheus.GaugeOpts{Name: "entries"})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds", Buckets: []float64{1}})
+	push := func() []string {
+		t.Helper()
+		if err := target.push(context.Background(), gather(t, requests, entries, duration), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, packet := range receive() {
+			lines = append(lines, strings.Split(packet, "\n")...)
+		}
+		slices.Sort(lines)
+		return lines
+	}
+
+	requests.WithLabelValues("/api/v1/query", "2xx|#,").Add(3)
+	entries.Set(42)
+	duration.Observe(0.5)
+	want := []string{
+		"duration_seconds_count:1|c",
+		"duration_seconds_sum:0.5|c",
+		"entries:42|g",
+		"requests_total:3|c|#path:/api/v1/query,status:2xx___",
+	}
+	if got := push(); !slices.Equal(got, want) {
+		t.Errorf("first push = %q, want %q", got, want)
+	}
+
+	// Counters send their increase, unchanged ones nothing; gauges always
+	requests.WithLabelValues("/api/v1/query", "2xx|#,").Add(2)
+	want = []string{
+		"entries:42|g",
+		"requests_total:2|c|#path:/api/v1/query,status:2xx___",
+	}
+	if got := push(); !slices.Equal(got, want) {
+		t.Errorf("second push = %q, want %q", got, want)
+	}
+
+	// A counter below its previous value was reset
+	requests.Reset()
+	requests.WithLabelValues("/api/v1/query", "2xx|#,").Add(1)
+	want = []string{
+		"entries:42|g",
+		"requests_total:1|c|#path:/api/v1/query,status:2xx___",
+	}
+	if got := push(); !slices.Equal(got, want) {
+		t.Errorf("push after a reset = %q, want %q", got, want)
+	}
+}
+
+func TestStatsdPacketSize(t *testing.T) {
+	addr, receive := statsdListener(t)
+	target, err := newStatsdTarget(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauges := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "size_bytes"}, []string{"key"})
+	for i := range 200 {
+		gauges.WithLabelValues(strings.Repeat("k", 20) + string(rune('a'+i%26)) + strings.Repeat("x", i/26)).Set(float64(i))
+	}
+	if err := target.push(context.Background(), gather(t, gauges), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := receive()
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want the lines split across several", len(packets))
+	}
+	lines := 0
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket {
+			t.Errorf("packet of %d bytes, want at most %d", len(packet), statsdMaxPacket)
+		}
+		lines += len(strings.Split(packet, "\n"))
+	}
+	if lines != 200 {
+		t.Errorf("got %d lines, want 200", lines)
+	}
+}
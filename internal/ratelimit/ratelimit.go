@@ -0,0 +1,136 @@
+// Package ratelimit limits the request rate of individual clients
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+// idleExpiry is how long a client's bucket is kept after its last request
+const idleExpiry = 10 * time.Minute
+
+// bucket is a token bucket of a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter keyed by client
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rate    float64
+	burst   float64
+	// header identifies clients by a request header instead of their IP
+	header  string
+	metrics *metrics.Metrics
+}
+
+// New creates a limiter allowing rate requests per second with the given
+// burst per client. Clients are identified by key, either "ip" or
+// "header:<name>" to use a tenant or API key header; requests without the
+// header fall back to their IP.
+func New(rate float64, burst int, key string, m *metrics.Metrics) (*Limiter, error) {
+	l := &Limiter{
+		buckets: make(map[string]*bucket),
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		metrics: m,
+	}
+
+	switch {
+	case key == "ip":
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		l.header = strings.TrimPrefix(key, "header:")
+	default:
+		return nil, fmt.Errorf("invalid rate limit key %q, expected ip or header:<name>", key)
+	}
+
+	go l.startCleanup()
+
+	return l, nil
+}
+
+// Middleware rejects requests of clients exceeding their rate with 429 Too
+// Many Requests
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := l.allow(l.clientKey(r)); !ok {
+			l.metrics.RecordRateLimited()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey returns the key identifying the client of r
+func (l *Limiter) clientKey(r *http.Request) string {
+	if l.header != "" {
+		if value := r.Header.Get(l.header); value != "" {
+			return "header:" + value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allow takes a token from the client's bucket. If none is available it
+// returns how long until the next token becomes available.
+func (l *Limiter) allow(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill tokens for the time since the last request
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.burst)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// startCleanup periodically forgets clients that have been idle
+func (l *Limiter) startCleanup() {
+	ticker := time.NewTicker(idleExpiry / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.cleanup()
+	}
+}
+
+// cleanup removes buckets of clients idle for longer than idleExpiry
+func (l *Limiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-idleExpiry)
+	for key, b := range l.buckets {
+		if b.last.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
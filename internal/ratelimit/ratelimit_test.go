@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+func newTestLimiter(t *testing.T, rate float64, burst int, key string) *Limiter {
+	t.Helper()
+	l, err := New(rate, burst, key, metrics.New(nil, metrics.Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestNewKey(t *testing.T) {
+	for _, key := range []string{"ip", "header:X-Scope-OrgID"} {
+		if _, err := New(1, 1, key, metrics.New(nil, metrics.Options{})); err != nil {
+			t.Errorf("New(%q) error = %v", key, err)
+		}
+	}
+	for _, key := range []string{"", "header:", "tenant"} {
+		if _, err := New(1, 1, key, metrics.New(nil, metrics.Options{})); err == nil {
+			t.Errorf("New(%q) succeeded", key)
+		}
+	}
+}
+
+func TestAllowBurstAndRefill(t *testing.T) {
+	l := newTestLimiter(t, 2, 3, "ip")
+
+	// The burst is available at once, then the bucket is empty
+	for i := range 3 {
+		if _, ok := l.allow("a"); !ok {
+			t.Fatalf("request %d of the burst rejected", i+1)
+		}
+	}
+	wait, ok := l.allow("a")
+	if ok {
+		t.Fatal("request beyond the burst allowed")
+	}
+	if wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("wait = %v, want up to 500ms at 2 requests per second", wait)
+	}
+
+	// Other clients have their own buckets
+	if _, ok := l.allow("b"); !ok {
+		t.Error("request of another client rejected")
+	}
+
+	// A second refills two tokens, never more than the burst
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+	for i := range 2 {
+		if _, ok := l.allow("a"); !ok {
+			t.Fatalf("request %d after refilling rejected", i+1)
+		}
+	}
+	if _, ok := l.allow("a"); ok {
+		t.Error("request beyond the refill allowed")
+	}
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+	l.allow("a")
+	if tokens := l.buckets["a"].tokens; tokens != 2 {
+		t.Errorf("tokens after an hour = %v, want the burst less one", tokens)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := newTestLimiter(t, 0.5, 1, "header:X-Scope-OrgID")
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(tenant string, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.RemoteAddr = remoteAddr
+		if tenant != "" {
+			r.Header.Set("X-Scope-OrgID", tenant)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		tenant     string
+		remoteAddr string
+		status     int
+	}{
+		{"first request", "team-a", "10.0.0.1:1234", http.StatusOK},
+		{"same tenant from another IP", "team-a", "10.0.0.2:1234", http.StatusTooManyRequests},
+		{"other tenant", "team-b", "10.0.0.1:1234", http.StatusOK},
+		{"no header falls back to the IP", "", "10.0.0.1:1234", http.StatusOK},
+		{"same IP on another port", "", "10.0.0.1:5678", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		w := serve(tt.tenant, tt.remoteAddr)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		// A token takes two seconds at half a request per second
+		if retry := w.Header().Get("Retry-After"); tt.status == http.StatusTooManyRequests && retry != "2" {
+			t.Errorf("%s: Retry-After = %q, want 2", tt.name, retry)
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l := newTestLimiter(t, 1, 1, "ip")
+	l.allow("idle")
+	l.allow("active")
+	l.buckets["idle"].last = time.Now().Add(-idleExpiry - time.Second)
+
+	l.cleanup()
+	if _, found := l.buckets["idle"]; found {
+		t.Error("idle client kept")
+	}
+	if _, found := l.buckets["active"]; !found {
+		t.Error("active client removed")
+	}
+}
@@ -0,0 +1,218 @@
+// Package recorder writes request logs that promcached replay can send
+// again
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// bufferSize is the number of entries waiting to be written before new
+// ones are dropped
+const bufferSize = 4096
+
+// Entry is a recorded request. Only the method, path and parameters are
+// kept; headers, cookies and other bodies, which may carry credentials,
+// never are.
+type Entry struct {
+	// Time is when the request was received
+	Time time.Time `json:"time"`
+	// Method is the HTTP method
+	Method string `json:"method"`
+	// Path is the URL path
+	Path string `json:"path"`
+	// Params are the query string and form parameters
+	Params url.Values `json:"params,omitempty"`
+	// Status is the response status code
+	Status int `json:"status"`
+	// Duration is the time taken to answer in seconds
+	Duration float64 `json:"duration_seconds"`
+	// Cache is the X-Cache header of the response
+	Cache string `json:"cache,omitempty"`
+	// Dashboard and Panel identify the Grafana panel the request was sent
+	// for
+	Dashboard string `json:"dashboard,omitempty"`
+	Panel     string `json:"panel,omitempty"`
+}
+
+// Recorder writes an entry per request to a file as JSON lines
+type Recorder struct {
+	f       *os.File
+	entries chan Entry
+	done    chan struct{}
+	log     *slog.Logger
+	// mu guards closed
+	mu     sync.Mutex
+	closed bool
+}
+
+// New creates a recorder appending to the file at path
+func New(path string, log *slog.Logger) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		f:       f,
+		entries: make(chan Entry, bufferSize),
+		done:    make(chan struct{}),
+		log:     log,
+	}
+	go r.run()
+	return r, nil
+}
+
+// run writes entries until the recorder is closed
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	w := bufio.NewWriter(r.f)
+	enc := json.NewEncoder(w)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case entry, ok := <-r.entries:
+			if !ok {
+				w.Flush()
+				return
+			}
+			if err := enc.Encode(entry); err != nil {
+				r.log.Warn("Failed to record request", "error", err)
+			}
+		case <-flush.C:
+			if err := w.Flush(); err != nil {
+				r.log.Warn("Failed to write request log", "error", err)
+			}
+		}
+	}
+}
+
+// Middleware records every request passed to next. Requests are never
+// slowed down by the recorder; entries are dropped while it falls behind.
+func (r *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		entry := Entry{
+			Time:      time.Now(),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Params:    requestParams(req),
+			Dashboard: req.Header.Get(proxy.DashboardHeader),
+			Panel:     req.Header.Get(proxy.PanelHeader),
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+
+		entry.Status = sw.status
+		entry.Duration = time.Since(entry.Time).Seconds()
+		entry.Cache = w.Header().Get("X-Cache")
+		r.record(entry)
+	})
+}
+
+// record queues an entry unless the recorder is closed or full
+func (r *Recorder) record(entry Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.entries <- entry:
+	default:
+	}
+}
+
+// Close writes the queued entries and closes the file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.entries)
+	}
+	r.mu.Unlock()
+
+	<-r.done
+	return r.f.Close()
+}
+
+// requestParams returns the query string and form parameters of a
+// request, leaving the body readable for the handler
+func requestParams(req *http.Request) url.Values {
+	params := req.URL.Query()
+	if req.Method != http.MethodPost || req.Body == nil {
+		return params
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/x-www-form-urlencoded" {
+		return params
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return params
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return params
+	}
+	for name, values := range form {
+		params[name] = append(params[name], values...)
+	}
+	return params
+}
+
+// statusWriter captures the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFile reads the entries recorded in the file at path
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	dec := json.NewDecoder(f)
+	for {
+		var entry Entry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
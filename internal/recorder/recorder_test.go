@@ -0,0 +1,105 @@
+package recorder
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	r, err := New(path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	h := r.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Forms stay readable for the handler
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		w.Header().Set("X-Cache", "MISS")
+		if req.URL.Path == "/api/v1/labels" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte("{}"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	get := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1700000000", nil)
+	get.Header.Set("Authorization", "Bearer secret")
+	get.Header.Set(proxy.DashboardHeader, "abc")
+	get.Header.Set(proxy.PanelHeader, "2")
+	h.ServeHTTP(httptest.NewRecorder(), get)
+
+	post := httptest.NewRequest(http.MethodPost, "/api/v1/query_range?step=15", strings.NewReader("query=up&start=1&end=2"))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	h.ServeHTTP(httptest.NewRecorder(), post)
+
+	// Other bodies aren't recorded
+	other := httptest.NewRequest(http.MethodPost, "/api/v1/labels", strings.NewReader(`{"password":"secret"}`))
+	other.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), other)
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Requests after closing are dropped
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=late", nil))
+
+	if want := []string{"", "query=up&start=1&end=2", `{"password":"secret"}`}; !reflect.DeepEqual(bodies[:3], want) {
+		t.Errorf("handler read bodies %q, want %q", bodies[:3], want)
+	}
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "secret") {
+		t.Errorf("recorded requests contain credentials:\n%s", raw)
+	}
+
+	entries, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Time.IsZero() || entry.Duration < 0 || entry.Cache != "MISS" {
+			t.Errorf("entry %+v lacks its time, duration or cache status", entry)
+		}
+	}
+	tests := []struct {
+		method, path string
+		params       url.Values
+		status       int
+		dashboard    string
+		panel        string
+	}{
+		{http.MethodGet, "/api/v1/query", url.Values{"query": {"up"}, "time": {"1700000000"}}, http.StatusOK, "abc", "2"},
+		{http.MethodPost, "/api/v1/query_range", url.Values{"query": {"up"}, "start": {"1"}, "end": {"2"}, "step": {"15"}}, http.StatusOK, "", ""},
+		{http.MethodPost, "/api/v1/labels", nil, http.StatusBadRequest, "", ""},
+	}
+	for i, tt := range tests {
+		entry := entries[i]
+		if entry.Method != tt.method || entry.Path != tt.path || !reflect.DeepEqual(entry.Params, tt.params) ||
+			entry.Status != tt.status || entry.Dashboard != tt.dashboard || entry.Panel != tt.panel {
+			t.Errorf("entry %d = %+v, want %s %s %v with status %d", i, entry, tt.method, tt.path, tt.params, tt.status)
+		}
+	}
+}
+
+func TestReadFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	os.WriteFile(path, []byte("{\"method\":\"GET\"}\nnot json\n"), 0o600)
+	if _, err := ReadFile(path); err == nil {
+		t.Error("ReadFile of an invalid log succeeded")
+	}
+}
@@ -0,0 +1,164 @@
+// Package resources detects container CPU and memory limits
+package resources
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Limits describes the effective resource limits of the process
+type Limits struct {
+	// CPUQuota is the CPU quota in cores, 0 if unlimited
+	CPUQuota float64
+	// MemoryLimit is the memory limit in bytes, 0 if unlimited
+	MemoryLimit int64
+	// GOMAXPROCS is the effective GOMAXPROCS setting
+	GOMAXPROCS int
+	// NumCPU is the number of logical CPUs visible to the process
+	NumCPU int
+}
+
+// Detect reads the cgroup CPU and memory limits of the process
+func Detect() Limits {
+	return Limits{
+		CPUQuota:    cpuQuota(),
+		MemoryLimit: memoryLimit(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		NumCPU:      runtime.NumCPU(),
+	}
+}
+
+// AdjustMaxProcs sets GOMAXPROCS to the CPU quota rounded down (but at least
+// 1) unless GOMAXPROCS was set explicitly through the environment. Returns
+// the updated limits.
+func AdjustMaxProcs(limits Limits) Limits {
+	if os.Getenv("GOMAXPROCS") != "" || limits.CPUQuota <= 0 {
+		return limits
+	}
+
+	procs := max(int(math.Floor(limits.CPUQuota)), 1)
+	if procs < limits.GOMAXPROCS {
+		runtime.GOMAXPROCS(procs)
+		limits.GOMAXPROCS = procs
+	}
+	return limits
+}
+
+// cpuQuota returns the CPU quota in cores from cgroup v2 or v1, 0 if none
+func cpuQuota() float64 {
+	// cgroup v2: "<quota> <period>" or "max <period>"
+	if data, ok := readCgroupFile("", "cpu.max"); ok {
+		fields := strings.Fields(data)
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				return quota / period
+			}
+		}
+		return 0
+	}
+
+	// cgroup v1: quota of -1 means unlimited
+	quotaData, ok1 := readCgroupFile("cpu", "cpu.cfs_quota_us")
+	periodData, ok2 := readCgroupFile("cpu", "cpu.cfs_period_us")
+	if !ok1 || !ok2 {
+		return 0
+	}
+	quota, err1 := strconv.ParseFloat(strings.TrimSpace(quotaData), 64)
+	period, err2 := strconv.ParseFloat(strings.TrimSpace(periodData), 64)
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// memoryLimit returns the memory limit in bytes from cgroup v2 or v1, 0 if
+// none
+func memoryLimit() int64 {
+	if data, ok := readCgroupFile("", "memory.max"); ok {
+		limit, err := strconv.ParseInt(strings.TrimSpace(data), 10, 64)
+		if err != nil {
+			return 0
+		}
+		return limit
+	}
+
+	data, ok := readCgroupFile("memory", "memory.limit_in_bytes")
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(data), 10, 64)
+	// cgroup v1 reports a huge page-aligned number when unlimited
+	if err != nil || limit >= math.MaxInt64/2 {
+		return 0
+	}
+	return limit
+}
+
+// readCgroupFile reads a file of the process's cgroup. An empty controller
+// selects the cgroup v2 unified hierarchy.
+func readCgroupFile(controller string, name string) (string, bool) {
+	for _, dir := range cgroupDirs(controller) {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			return string(data), true
+		}
+	}
+	return "", false
+}
+
+// cgroupDirs returns the candidate directories of the process's cgroup for
+// the given controller, most specific first
+func cgroupDirs(controller string) []string {
+	var dirs []string
+
+	f, err := os.Open("/proc/self/cgroup")
+	if err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// Lines look like "hierarchy-ID:controller-list:cgroup-path"
+			parts := strings.SplitN(scanner.Text(), ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+
+			switch {
+			case controller == "" && parts[0] == "0" && parts[1] == "":
+				dirs = append(dirs, filepath.Join(cgroupRoot, parts[2]))
+			case controller != "" && hasController(parts[1], controller):
+				for _, mount := range []string{parts[1], controller} {
+					dirs = append(dirs, filepath.Join(cgroupRoot, mount, parts[2]))
+				}
+			}
+		}
+	}
+
+	// Inside a container the process's cgroup is usually mounted as the root
+	if controller == "" {
+		dirs = append(dirs, cgroupRoot)
+	} else {
+		dirs = append(dirs, filepath.Join(cgroupRoot, controller))
+	}
+	return dirs
+}
+
+// hasController reports whether a comma-separated controller list contains
+// the controller
+func hasController(list string, controller string) bool {
+	for _, c := range strings.Split(list, ",") {
+		if c == controller {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/cluster"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// readyTimeout bounds the checks of a readiness request
+const readyTimeout = 5 * time.Second
+
+// componentStatus is the outcome of checking a component
+type componentStatus struct {
+	Status         string  `json:"status"`
+	Error          string  `json:"error,omitempty"`
+	LatencySeconds float64 `json:"latency_seconds,omitempty"`
+}
+
+// cacheStatus is the state of the cache
+type cacheStatus struct {
+	Status  string `json:"status"`
+	Entries int    `json:"entries"`
+}
+
+// readiness is the response of the readiness endpoint
+type readiness struct {
+	Status    string                     `json:"status"`
+	Cache     cacheStatus                `json:"cache"`
+	Upstreams map[string]componentStatus `json:"upstreams"`
+	Peers     map[string]componentStatus `json:"peers,omitempty"`
+}
+
+// healthyHandler reports the process is alive. It checks nothing else, so
+// a failing upstream never gets instances restarted.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// readyHandler reports whether the instance can answer queries: the cache
+// is usable and every upstream answers. Unreachable peers are reported but
+// only make the instance unready if peer failures fail requests.
+func readyHandler(proxies []*proxy.HTTPCacheProxy, peerCluster *cluster.Cluster, store *cache.Cache, peerFailClosed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		result := readiness{
+			Status:    "ready",
+			Cache:     cacheStatus{Status: "ok", Entries: store.Len()},
+			Upstreams: make(map[string]componentStatus, len(proxies)),
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, p := range proxies {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				startTime := time.Now()
+				status := checkStatus(p.CheckUpstream(ctx))
+				status.LatencySeconds = time.Since(startTime).Seconds()
+
+				mu.Lock()
+				defer mu.Unlock()
+				result.Upstreams[p.Upstream()] = status
+				if status.Error != "" {
+					result.Status = "not_ready"
+				}
+			}()
+		}
+		if peerCluster != nil {
+			checks := peerCluster.Check(ctx)
+			mu.Lock()
+			result.Peers = make(map[string]componentStatus, len(checks))
+			for peer, err := range checks {
+				result.Peers[peer] = checkStatus(err)
+				if err != nil && peerFailClosed {
+					result.Status = "not_ready"
+				}
+			}
+			mu.Unlock()
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		if result.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// checkStatus returns the status of a component checked with err
+func checkStatus(err error) componentStatus {
+	if err != nil {
+		return componentStatus{Status: "error", Error: err.Error()}
+	}
+	return componentStatus{Status: "ok"}
+}
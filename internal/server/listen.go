@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixPrefix marks listen addresses of Unix domain sockets
+const unixPrefix = "unix://"
+
+// listen opens a TCP listener or, for unix:// addresses, a Unix domain
+// socket with the given file mode
+func listen(addr string, mode fs.FileMode) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, unixPrefix)
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting permissions of %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes a socket file left behind by an unclean
+// shutdown. Sockets another process still accepts connections on are left
+// alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
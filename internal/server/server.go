@@ -2,75 +2,775 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/f0o/promcache/internal/auth"
 	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/cluster"
+	"github.com/f0o/promcache/internal/config"
+	"github.com/f0o/promcache/internal/cors"
+	"github.com/f0o/promcache/internal/logging"
 	"github.com/f0o/promcache/internal/metrics"
+	"github.com/f0o/promcache/internal/ratelimit"
+	"github.com/f0o/promcache/internal/recorder"
+	"github.com/f0o/promcache/internal/thanos"
+	"github.com/f0o/promcache/internal/version"
+	"github.com/f0o/promcache/internal/warmer"
 	"github.com/f0o/promcache/pkg/proxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Server represents the HTTP server for the Prometheus cache
 type Server struct {
 	server *http.Server
+	// admin serves operational endpoints on a separate listener, nil if
+	// they are served by the main server
+	admin *http.Server
+	// thanos serves the Thanos StoreAPI over gRPC, nil if disabled
+	thanos *http.Server
+	// recorder logs API requests for replay, nil if disabled
+	recorder *recorder.Recorder
+	// pusher pushes metrics to statsd or OTLP, nil if disabled
+	pusher *metrics.Pusher
 	log    *slog.Logger
+	// proxies are drained of in-flight upstream requests on shutdown
+	proxies []*proxy.HTTPCacheProxy
+	// socketMode is the file mode of Unix domain sockets
+	socketMode fs.FileMode
+
+	// mu guards listeners
+	mu sync.Mutex
+	// listeners are the listeners of the running servers, handed over to
+	// the new process on upgrades
+	listeners map[*http.Server]net.Listener
 }
 
 // New creates a new HTTP server
-func New(listenAddr string, upstreamURL string, cache *cache.Cache, log *slog.Logger) *Server {
-	// Create proxy
-	promProxy := proxy.New(upstreamURL, cache, log)
+func New(cfg *config.Config, cache *cache.Cache, log *slog.Logger, m *metrics.Metrics) (*Server, error) {
+	serializer, err := proxy.NewSerializer(cfg.CacheSerializer)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules *proxy.RuleSet
+	if len(cfg.File.QueryRules) > 0 {
+		list := make([]proxy.Rule, 0, len(cfg.File.QueryRules))
+		for _, rule := range cfg.File.QueryRules {
+			list = append(list, proxy.Rule{
+				Name:   rule.Name,
+				Action: rule.Action,
+				Query:  rule.Query,
+				Metric: rule.Metric,
+			})
+		}
+		if rules, err = proxy.NewRuleSet(list); err != nil {
+			return nil, err
+		}
+	}
 
-	// Create router
+	var cacheRules *proxy.CacheRuleSet
+	if len(cfg.File.CacheRules) > 0 {
+		list := make([]proxy.CacheRule, 0, len(cfg.File.CacheRules))
+		for _, rule := range cfg.File.CacheRules {
+			list = append(list, proxy.CacheRule{
+				Name:   rule.Name,
+				Action: rule.Action,
+				Query:  rule.Query,
+				Metric: rule.Metric,
+				Client: rule.Client,
+				TTL:    time.Duration(rule.TTL),
+			})
+		}
+		if cacheRules, err = proxy.NewCacheRuleSet(list); err != nil {
+			return nil, err
+		}
+	}
+
+	tenantLimits := make(map[string]proxy.QueryLimits, len(cfg.File.TenantLimits))
+	for tenant, limits := range cfg.File.TenantLimits {
+		tenantLimits[tenant] = proxy.QueryLimits{
+			MaxPoints: limits.MaxPoints,
+			MaxRange:  time.Duration(limits.MaxRange),
+		}
+	}
+
+	downsample := cfg.Downsample
+	if downsample == "off" {
+		downsample = ""
+	}
+
+	// Share the cache with cluster peers
+	var peers proxy.Peers
+	var peerCluster *cluster.Cluster
+	if cfg.Clustered() {
+		peerCluster, err = cluster.New(cluster.Config{
+			Self:          cfg.PeerSelf,
+			Peers:         cfg.Peers,
+			DNS:           cfg.PeersDNS,
+			Seeds:         cfg.GossipSeeds,
+			GossipAllowed: cfg.GossipAllowedNetworks,
+			Secret:        cfg.PeerSecret,
+			Timeout:       cfg.PeerTimeout,
+			Handoff:       cfg.PeerHandoff,
+		}, log, m)
+		if err != nil {
+			return nil, err
+		}
+		peers = peerCluster
+	}
+
+	// Create proxies, one per upstream sharing the cache, the global
+	// in-flight limit and the hit, dashboard and tenant counts
+	hitTracker := proxy.NewHitTracker(cfg.QueryHitsMetricLimit)
+	queryStats := proxy.NewQueryStats()
+	if cfg.QueryStatsLogInterval > 0 {
+		queryStats.StartSummaryLog(cfg.QueryStatsLogInterval, cfg.QueryStatsLogTop, log)
+	}
+	var tenantLabels *proxy.LabelLimiter
+	if cfg.TenantMetricLimit > 0 {
+		tenantLabels = proxy.NewLabelLimiter(cfg.TenantMetricLimit)
+	}
+	toggles := proxy.NewToggles(proxy.ToggleState{
+		ServeStale: cfg.ServeStale,
+		Coalesce:   cfg.Coalesce,
+		Shadow:     cfg.Shadow,
+	})
+	opts := proxy.Options{
+		Transport: proxy.TransportOptions{
+			Timeout:             cfg.UpstreamTimeout,
+			DialTimeout:         cfg.UpstreamDialTimeout,
+			KeepAlive:           cfg.UpstreamKeepAlive,
+			TLSHandshakeTimeout: cfg.UpstreamTLSHandshakeTimeout,
+			MaxIdleConnsPerHost: cfg.UpstreamMaxIdleConnsPerHost,
+			IdleConnTimeout:     cfg.UpstreamIdleConnTimeout,
+			DisableKeepAlives:   cfg.UpstreamDisableKeepAlives,
+		},
+		HedgeDelay:           cfg.UpstreamHedgeDelay,
+		Compress:             cfg.CacheCompress,
+		CompressMinBytes:     cfg.CacheCompressMinBytes,
+		ParseMatrix:          cfg.CacheParseMatrix,
+		MaxObjectBytes:       cfg.CacheMaxObjectBytes,
+		EmptyResultPolicy:    cfg.EmptyResultPolicy,
+		EmptyResultTTL:       cfg.EmptyResultTTL,
+		FederateTTL:          cfg.FederateTTL,
+		MetadataTTL:          cfg.MetadataTTL,
+		RulesTTL:             cfg.RulesTTL,
+		ValidateResponses:    cfg.ValidateResponses,
+		MaxHops:              cfg.MaxHops,
+		InstanceName:         cfg.InstanceName,
+		UpstreamIsPromcache:  cfg.UpstreamIsPromcache,
+		ExactTime:            cfg.ExactTime,
+		FreshnessBudget:      cfg.FreshnessBudget,
+		RecentWindow:         cfg.RecentWindow,
+		MinCacheableAge:      cfg.MinCacheableAge,
+		MinCacheableAgeTTL:   cfg.MinCacheableAgeTTL,
+		AdaptiveTTLThreshold: cfg.AdaptiveTTLThreshold,
+		AdaptiveTTLMin:       cfg.AdaptiveTTLMin,
+		AdaptiveTTLMax:       cfg.AdaptiveTTLMax,
+		MinCacheDuration:     cfg.MinCacheDuration,
+		MinCacheSamples:      cfg.MinCacheSamples,
+		MaxHeaderTTL:         cfg.MaxHeaderTTL,
+		UpstreamTTLHints:     cfg.UpstreamTTLHints,
+		Downsample:           downsample,
+		Serializer:           serializer,
+		DebugTrace:           cfg.DebugTrace,
+		HashKeys:             cfg.CacheKeyHash,
+		KeepReadableKeys:     cfg.CacheKeyDebug,
+		KeyExcludeParams:     cfg.CacheKeyExcludeParams,
+		KeyNamespace:         cfg.CacheKeyNamespace,
+		MaxUpstreamRequests:  cfg.UpstreamMaxInflight,
+		UpstreamQueueTimeout: cfg.UpstreamQueueTimeout,
+		GlobalSemaphore:      proxy.NewSemaphore(cfg.GlobalMaxInflight, cfg.UpstreamQueueTimeout),
+		Rules:                rules,
+		CacheRules:           cacheRules,
+		Limits: proxy.QueryLimits{
+			MaxPoints: cfg.MaxQueryPoints,
+			MaxRange:  cfg.MaxQueryRange,
+		},
+		TenantLimits:       tenantLimits,
+		TenantHeader:       cfg.TenantHeader,
+		LimitAction:        cfg.QueryLimitAction,
+		EnforceLabel:       cfg.EnforceLabel,
+		EnforceLabelHeader: cfg.EnforceLabelHeader,
+		Peers:              peers,
+		PeerFailClosed:     cfg.PeerFailureMode == "closed",
+		AllowedEndpoints:   cfg.AllowedEndpoints,
+		ThanosDefaults:     cfg.ThanosParamDefaults,
+		Toggles:            toggles,
+		VerifyFraction:     cfg.VerifyFraction,
+		HitTracker:         hitTracker,
+		QueryStats:         queryStats,
+		DashboardLabels:    proxy.NewLabelLimiter(cfg.DashboardMetricLimit),
+		TenantLabels:       tenantLabels,
+		TenantLabelHash:    cfg.TenantMetricHash,
+		Metrics:            m,
+	}
+	promProxy := proxy.New(cfg.UpstreamURL, cache, log, opts)
+	proxies := []*proxy.HTTPCacheProxy{promProxy}
+
+	// Route API paths to their upstreams, the default upstream serves the
+	// rest
+	router := http.NewServeMux()
+	router.HandleFunc("/", promProxy.HandleRequest)
+	routeProxies := map[string]*proxy.HTTPCacheProxy{cfg.UpstreamURL: promProxy}
+	for _, route := range cfg.File.Routes {
+		routeProxy, found := routeProxies[route.Upstream]
+		if !found {
+			routeProxy = proxy.New(route.Upstream, cache, log, opts)
+			routeProxies[route.Upstream] = routeProxy
+			proxies = append(proxies, routeProxy)
+		}
+		router.HandleFunc(route.Path, routeProxy.HandleRequest)
+		log.Info("Routing API path", "path", route.Path, "upstream", route.Upstream)
+	}
+
+	// Paths outside the API are handled by their policy
+	pathPolicies := cfg.PathPolicies()
+	for _, path := range pathPolicies {
+		handler, err := promProxy.PathHandler(path.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %w", path.Prefix, err)
+		}
+		router.HandleFunc(path.Prefix, handler)
+	}
+
+	// Keep-warm probes are PromQL queries, so Loki is left out
+	for _, p := range proxies {
+		p.StartKeepWarm(cfg.KeepWarmInterval, cfg.KeepWarmQuery)
+	}
+
+	// Materialized views are evaluated by the proxy serving their path
+	views := make(map[*proxy.HTTPCacheProxy][]proxy.View)
+	for _, v := range cfg.File.Views {
+		pv := proxy.View{
+			Name:     v.Name,
+			Query:    v.Query,
+			Interval: time.Duration(v.Interval),
+			Range:    time.Duration(v.Range),
+			Step:     time.Duration(v.Step),
+		}
+		path := "/api/v1/query"
+		if pv.Range > 0 {
+			path = "/api/v1/query_range"
+		}
+		viewProxy := routedProxy(cfg.File.Routes, routeProxies, path)
+		if viewProxy == nil {
+			viewProxy = promProxy
+		}
+		views[viewProxy] = append(views[viewProxy], pv)
+	}
+	for p, list := range views {
+		p.StartViews(list)
+	}
+
+	// Loki's API has its own upstream
+	if cfg.LokiUpstream != "" {
+		lokiProxy, found := routeProxies[cfg.LokiUpstream]
+		if !found {
+			lokiProxy = proxy.New(cfg.LokiUpstream, cache, log, opts)
+			routeProxies[cfg.LokiUpstream] = lokiProxy
+			proxies = append(proxies, lokiProxy)
+		}
+		router.HandleFunc(proxy.LokiPathPrefix, lokiProxy.HandleRequest)
+		log.Info("Routing Loki API", "path", proxy.LokiPathPrefix, "upstream", cfg.LokiUpstream)
+	}
+
+	// Keep configured queries warm
+	warmer.New(router, cfg.File.Warmer, cfg.CacheTTL/2, log).Start()
+
+	// Create routers; operational endpoints share the data path router
+	// unless a separate admin listener is configured
 	mux := http.NewServeMux()
+	adminMux := mux
+	if cfg.AdminListenAddr != "" {
+		adminMux = http.NewServeMux()
+	}
 
 	// Prometheus API endpoints
-	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
-		promProxy.HandleRequest(w, r)
-	})
+	var apiHandler http.Handler = logging.AccessLogMiddleware(router, log, cfg.TenantHeader)
+	if cfg.RateLimit > 0 {
+		limiter, err := ratelimit.New(cfg.RateLimit, cfg.RateLimitBurst, cfg.RateLimitKey, m)
+		if err != nil {
+			return nil, err
+		}
+		apiHandler = limiter.Middleware(apiHandler)
+	}
+	if authCfg := cfg.File.Auth; len(authCfg.Keys) > 0 || authCfg.HMACSecret != "" || authCfg.OIDC != nil {
+		authConfig := auth.Config{HMACSecret: authCfg.HMACSecret, MetricLimit: cfg.AuthMetricLimit}
+		for _, key := range authCfg.Keys {
+			authConfig.Keys = append(authConfig.Keys, auth.Key{Name: key.Name, Key: key.Key, Namespace: key.Namespace, Tenant: key.Tenant})
+		}
+		if oidc := authCfg.OIDC; oidc != nil {
+			refresh := time.Duration(oidc.Refresh)
+			if refresh == 0 {
+				refresh = time.Hour
+			}
+			authConfig.OIDC = &auth.OIDCConfig{
+				Issuer:      oidc.Issuer,
+				JWKSURL:     oidc.JWKSURL,
+				Audience:    oidc.Audience,
+				TenantClaim: oidc.TenantClaim,
+				Tenants:     oidc.Tenants,
+				Refresh:     refresh,
+			}
+		}
+		authenticator, err := auth.New(authConfig, log, m)
+		if err != nil {
+			return nil, err
+		}
+		apiHandler = authenticator.Middleware(apiHandler)
+	}
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		apiHandler = cors.Middleware(cors.Config{
+			AllowedOrigins:   cfg.CORSAllowedOrigins,
+			AllowedMethods:   cfg.CORSAllowedMethods,
+			AllowedHeaders:   cfg.CORSAllowedHeaders,
+			AllowCredentials: cfg.CORSAllowCredentials,
+			MaxAge:           cfg.CORSMaxAge,
+		}, apiHandler)
+	}
+	var rec *recorder.Recorder
+	if cfg.RecordFile != "" {
+		if rec, err = recorder.New(cfg.RecordFile, log); err != nil {
+			return nil, err
+		}
+		apiHandler = rec.Middleware(apiHandler)
+		log.Info("Recording requests", "path", cfg.RecordFile)
+	}
+	apiHandler = logging.RequestIDMiddleware(apiHandler)
+	mux.Handle("/api/", apiHandler)
+	mux.Handle("/federate", apiHandler)
+	for _, path := range pathPolicies {
+		mux.Handle(path.Prefix, apiHandler)
+	}
+	if cfg.LokiUpstream != "" {
+		mux.Handle(proxy.LokiPathPrefix, apiHandler)
+	}
+
+	// Requests of cluster peers
+	if peerCluster != nil {
+		mux.Handle(cluster.PathPrefix, peerCluster.Handler(cache))
+	}
 
 	// Metrics endpoint
-	mux.Handle("/metrics", metrics.Handler())
+	adminMux.Handle("/metrics", m.Handler())
 
-	// Health check
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	// Health check, /health is kept for existing probes
+	adminMux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	adminMux.HandleFunc("/-/healthy", healthyHandler)
+
+	// Build of the running binary
+	adminMux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(version.Get())
+	})
+	adminMux.HandleFunc("/-/ready", readyHandler(proxies, peerCluster, cache, cfg.PeerFailureMode == "closed"))
 
 	// Debug cache endpoint
-	mux.HandleFunc("/debug/cache", func(w http.ResponseWriter, r *http.Request) {
+	adminMux.HandleFunc("/debug/cache", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			keys := cache.Keys()
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"num_keys": len(keys),
 				"keys":     keys,
+				"labels":   cache.Labels(),
 			})
 		}
 	})
 
-	// Create server
-	srv := &http.Server{
-		Addr:    listenAddr,
-		Handler: mux,
+	// Most hit queries and entries
+	adminMux.HandleFunc("/debug/cache/top", func(w http.ResponseWriter, r *http.Request) {
+		n := 20
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 0 {
+				http.Error(w, "Invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hitTracker.Top(n))
+	})
+
+	// Statistics per query, like pg_stat_statements
+	adminMux.HandleFunc("/debug/queries", func(w http.ResponseWriter, r *http.Request) {
+		n := 20
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 0 {
+				http.Error(w, "Invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		order := r.URL.Query().Get("order")
+		if order == "" {
+			order = proxy.QueryStatsOrders[0]
+		} else if !slices.Contains(proxy.QueryStatsOrders, order) {
+			http.Error(w, "Invalid order, expected one of "+strings.Join(proxy.QueryStatsOrders, ", "), http.StatusBadRequest)
+			return
+		}
+
+		queries, since := queryStats.Top(n, order)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"since_seconds": since.Seconds(),
+			"queries":       queries,
+		})
+	})
+	adminMux.HandleFunc("/debug/queries/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		queryStats.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Endpoints exposing or changing the cache contents or behavior are
+	// only served away from the data path or behind the admin token
+	var gated []string
+	handleGated := func(pattern string, handler http.HandlerFunc) {
+		if cfg.AdminListenAddr == "" && cfg.AdminToken == "" {
+			gated = append(gated, pattern)
+			return
+		}
+		adminMux.Handle(pattern, requireToken(cfg.AdminToken, handler))
+	}
+
+	// Purge endpoint, broadcast to all cluster peers
+	handleGated("/debug/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pattern, err := regexp.Compile(r.FormValue("pattern"))
+		if err != nil {
+			http.Error(w, "Invalid pattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		deleted := cache.DeleteMatching(pattern)
+		result := map[string]interface{}{"deleted": deleted}
+		if peerCluster != nil {
+			peerDeleted, err := peerCluster.Purge(r.Context(), pattern)
+			result["peers_deleted"] = peerDeleted
+			if err != nil {
+				log.Warn("Failed to purge peers", "pattern", pattern.String(), "error", err)
+				result["error"] = err.Error()
+			}
+		}
+		log.Info("Purged cache entries", "pattern", pattern.String(), "deleted", deleted)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// Export of the cache, or the entries matching pattern, for import
+	// into another instance
+	handleGated("/debug/cache/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var pattern *regexp.Regexp
+		if s := r.URL.Query().Get("pattern"); s != "" {
+			var err error
+			if pattern, err = regexp.Compile(s); err != nil {
+				http.Error(w, "Invalid pattern: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="promcache.dump"`)
+		exported, err := cache.Export(w, pattern)
+		if err != nil {
+			log.Warn("Failed to export cache", "error", err)
+			return
+		}
+		log.Info("Exported cache entries", "pattern", r.URL.Query().Get("pattern"), "exported", exported)
+	})
+
+	// Import of an export, adding its unexpired entries to this instance
+	handleGated("/debug/cache/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		imported, err := cache.Import(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid dump: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("Imported cache entries", "imported", imported)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"imported": imported})
+	})
+
+	// Runtime toggles, switched with form parameters named after them
+	handleGated("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Check every toggle before switching any
+			switched := make(map[string]bool, len(r.PostForm))
+			for name, values := range r.PostForm {
+				if !slices.Contains(proxy.ToggleNames, name) {
+					http.Error(w, "Unknown toggle "+name+", expected one of "+strings.Join(proxy.ToggleNames, ", "), http.StatusBadRequest)
+					return
+				}
+				enabled, err := strconv.ParseBool(values[len(values)-1])
+				if err != nil {
+					http.Error(w, "Invalid value of "+name+": "+values[len(values)-1], http.StatusBadRequest)
+					return
+				}
+				switched[name] = enabled
+			}
+			for name, enabled := range switched {
+				toggles.Set(name, enabled)
+				log.Info("Switched runtime toggle", "toggle", name, "enabled", enabled)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"toggles": toggles.State()})
+	})
+
+	if len(gated) > 0 {
+		log.Warn("Admin endpoints disabled on the main listener, set -admin-listen or -admin-token to serve them", "endpoints", gated)
+	}
+
+	// Profiling endpoints
+	if cfg.EnablePprof {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// Metrics pushed besides /metrics
+	var pusher *metrics.Pusher
+	if cfg.MetricsPushURL != "" {
+		resource := map[string]string{"service.name": "promcached", "service.version": version.Get().Version}
+		if cfg.InstanceName != "" {
+			resource["service.instance.id"] = cfg.InstanceName
+		}
+		pusher, err = metrics.NewPusher(metrics.PushOptions{
+			URL:      cfg.MetricsPushURL,
+			Interval: cfg.MetricsPushInterval,
+			Headers:  cfg.MetricsPushHeaders,
+			Resource: resource,
+		}, m, log)
+		if err != nil {
+			return nil, err
+		}
+		pusher.Start()
 	}
 
-	return &Server{
-		server: srv,
-		log:    log,
+	// Create servers
+	s := &Server{
+		server:     newHTTPServer(cfg, cfg.ListenAddr, mux),
+		log:        log,
+		proxies:    proxies,
+		recorder:   rec,
+		pusher:     pusher,
+		socketMode: fs.FileMode(cfg.SocketMode),
 	}
+	if cfg.AdminListenAddr != "" {
+		s.admin = newHTTPServer(cfg, cfg.AdminListenAddr, adminMux)
+	}
+	if cfg.ThanosListenAddr != "" {
+		storeProxy, err := thanos.New(thanos.Config{Upstream: cfg.ThanosUpstream, TTL: cfg.CacheTTL}, cache, log, m)
+		if err != nil {
+			return nil, err
+		}
+		// gRPC requires HTTP/2 regardless of -http2, and its streams
+		// outlive the HTTP read and write timeouts
+		s.thanos = &http.Server{
+			Addr:              cfg.ThanosListenAddr,
+			Handler:           h2c.NewHandler(storeProxy, &http2.Server{IdleTimeout: cfg.ServerIdleTimeout}),
+			ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+			IdleTimeout:       cfg.ServerIdleTimeout,
+		}
+	}
+
+	return s, nil
 }
 
-// Start starts the HTTP server
+// routedProxy returns the proxy of the route matching path like
+// http.ServeMux would, nil if no route matches
+func routedProxy(routes []config.Route, proxies map[string]*proxy.HTTPCacheProxy, path string) *proxy.HTTPCacheProxy {
+	var match config.Route
+	for _, route := range routes {
+		if route.Path == path {
+			return proxies[route.Upstream]
+		}
+		if strings.HasSuffix(route.Path, "/") && strings.HasPrefix(path, route.Path) && len(route.Path) > len(match.Path) {
+			match = route
+		}
+	}
+	if match.Path == "" {
+		return nil
+	}
+	return proxies[match.Upstream]
+}
+
+// requireToken rejects requests to next without the bearer token, or
+// passes them all if token is empty
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="promcache"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newHTTPServer creates an http.Server with the configured timeouts and
+// limits
+func newHTTPServer(cfg *config.Config, addr string, handler http.Handler) *http.Server {
+	// Serve cleartext HTTP/2 so clients can multiplex queries over a single
+	// connection without TLS
+	if cfg.HTTP2 {
+		handler = h2c.NewHandler(handler, &http2.Server{
+			IdleTimeout: cfg.ServerIdleTimeout,
+		})
+	}
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ServerReadTimeout,
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+		MaxHeaderBytes:    cfg.ServerMaxHeaderBytes,
+	}
+}
+
+// Start starts the HTTP server and the admin server if configured. It
+// blocks until either of them stops.
 func (s *Server) Start() error {
-	s.log.Info("Starting server", "addr", s.server.Addr)
-	return s.server.ListenAndServe()
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.listeners = make(map[*http.Server]net.Listener, 3)
+	for _, srv := range s.servers() {
+		l, found := inherited[srv.Addr]
+		if !found {
+			if l, err = listen(srv.Addr, s.socketMode); err != nil {
+				s.mu.Unlock()
+				return err
+			}
+		}
+		s.listeners[srv] = l
+	}
+	s.mu.Unlock()
+
+	errCh := make(chan error, 3)
+	for _, srv := range s.servers() {
+		switch srv {
+		case s.admin:
+			s.log.Info("Starting admin server", "addr", srv.Addr, "inherited", inherited[srv.Addr] != nil)
+		case s.thanos:
+			s.log.Info("Starting Thanos StoreAPI server", "addr", srv.Addr, "inherited", inherited[srv.Addr] != nil)
+		default:
+			s.log.Info("Starting server", "addr", srv.Addr, "inherited", inherited[srv.Addr] != nil)
+		}
+		go func(srv *http.Server, l net.Listener) {
+			errCh <- srv.Serve(l)
+		}(srv, s.listeners[srv])
+	}
+
+	// All listeners are open, the previous process may stop accepting
+	notifyReady()
+
+	return <-errCh
 }
 
-// Shutdown gracefully shuts down the server
+// servers returns the running HTTP servers
+func (s *Server) servers() []*http.Server {
+	servers := []*http.Server{s.server}
+	if s.admin != nil {
+		servers = append([]*http.Server{s.admin}, servers...)
+	}
+	if s.thanos != nil {
+		servers = append(servers, s.thanos)
+	}
+	return servers
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting requests
+// and waits until in-flight requests, including upstream requests of the
+// cache warmer, finished or ctx is done.
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.log.Info("Shutting down server")
-	return s.server.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+
+	if s.admin != nil {
+		if adminErr := s.admin.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+	if s.thanos != nil {
+		if thanosErr := s.thanos.Shutdown(ctx); err == nil {
+			err = thanosErr
+		}
+	}
+
+	for _, p := range s.proxies {
+		if drainErr := p.Drain(ctx); err == nil {
+			err = drainErr
+		}
+	}
+	if s.recorder != nil {
+		if recordErr := s.recorder.Close(); err == nil {
+			err = recordErr
+		}
+	}
+	if s.pusher != nil {
+		s.pusher.Stop(ctx)
+	}
+	return err
 }
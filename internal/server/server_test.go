@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"no token configured", "", "", http.StatusNoContent},
+		{"matching token", "s3cr3t", "Bearer s3cr3t", http.StatusNoContent},
+		{"missing header", "s3cr3t", "", http.StatusUnauthorized},
+		{"wrong token", "s3cr3t", "Bearer guess", http.StatusUnauthorized},
+		{"prefix of token", "s3cr3t", "Bearer s3cr", http.StatusUnauthorized},
+		{"basic credentials", "s3cr3t", "Basic s3cr3t", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/cache/export", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			requireToken(tt.token, ok).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
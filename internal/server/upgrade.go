@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// envInheritedListeners lists the addresses of listeners handed over by
+	// the previous process, in the order of their file descriptors starting
+	// at 3
+	envInheritedListeners = "PROMCACHE_INHERITED_LISTENERS"
+	// envReadyFD is the file descriptor the new process reports readiness on
+	envReadyFD = "PROMCACHE_UPGRADE_READY_FD"
+	// upgradeTimeout bounds how long the new process may take to start
+	upgradeTimeout = 30 * time.Second
+)
+
+// fileListener is a listener that can be handed over as a file
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// inheritedListeners returns the listeners handed over by the previous
+// process by address
+func inheritedListeners() (map[string]net.Listener, error) {
+	value := os.Getenv(envInheritedListeners)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envInheritedListeners)
+
+	listeners := make(map[string]net.Listener)
+	for i, addr := range strings.Split(value, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener for %s: %w", addr, err)
+		}
+		listeners[addr] = l
+	}
+	return listeners, nil
+}
+
+// notifyReady tells the previous process that this one took over
+func notifyReady() {
+	value := os.Getenv(envReadyFD)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// Upgrade starts a new process of the current executable with the same
+// arguments, handing over the listening sockets so no connection is
+// refused. It returns once the new process is serving; the caller should
+// then shut down gracefully. If the new process fails to start, this one
+// keeps serving.
+func (s *Server) Upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if s.listeners == nil {
+		return errors.New("server is not running")
+	}
+	for _, srv := range s.servers() {
+		l, ok := s.listeners[srv].(fileListener)
+		if !ok {
+			return fmt.Errorf("listener for %s can't be handed over", srv.Addr)
+		}
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, srv.Addr)
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	env := append(os.Environ(),
+		envInheritedListeners+"="+strings.Join(addrs, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(addrs)),
+	)
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+	if err != nil {
+		return err
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	s.log.Info("Started new process, waiting for it to take over", "pid", process.Pid)
+
+	// Reading fails once the new process exits without reporting readiness
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			process.Wait()
+			return errors.New("new process exited before taking over")
+		}
+	case <-time.After(upgradeTimeout):
+		process.Kill()
+		process.Wait()
+		return errors.New("timed out waiting for the new process to take over")
+	}
+	process.Release()
+
+	// The socket files now belong to the new process
+	for _, l := range s.listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
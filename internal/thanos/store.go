@@ -0,0 +1,275 @@
+// Package thanos caches Thanos StoreAPI responses. It speaks the gRPC wire
+// protocol over HTTP/2 and treats request and response messages as opaque
+// bytes, so it doesn't depend on the Thanos protobuf definitions.
+package thanos
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/metrics"
+	"golang.org/x/net/http2"
+)
+
+// keyPrefix prefixes the cache keys of StoreAPI responses so they never
+// collide with HTTP API responses
+const keyPrefix = "thanos:"
+
+// cacheableMethods are the StoreAPI methods whose responses are cached, by
+// their metric label
+var cacheableMethods = map[string]string{
+	"/thanos.Store/Series":      "series",
+	"/thanos.Store/LabelNames":  "label_names",
+	"/thanos.Store/LabelValues": "label_values",
+}
+
+// keyMetadata is the request metadata that changes the response and is part
+// of cache keys
+var keyMetadata = []string{"Grpc-Accept-Encoding", "Grpc-Encoding", "Thanos-Tenant"}
+
+// statusMetadata is the response metadata carrying the gRPC status, which
+// must be sent as trailers
+var statusMetadata = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// hopHeaders are connection-specific headers that are never forwarded
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// Config configures the StoreAPI proxy
+type Config struct {
+	// Upstream is the URL of the Thanos StoreAPI endpoint, http:// for
+	// cleartext HTTP/2 and https:// for TLS
+	Upstream string
+	// TTL is the time-to-live of cached responses
+	TTL time.Duration
+}
+
+// Proxy forwards StoreAPI gRPC calls to a Thanos endpoint and caches the
+// responses of Series, LabelNames and LabelValues calls
+type Proxy struct {
+	upstream *url.URL
+	client   *http.Client
+	cache    *cache.Cache
+	ttl      time.Duration
+	log      *slog.Logger
+	metrics  *metrics.Metrics
+}
+
+// entry is a cached StoreAPI response
+type entry struct {
+	// ContentType is the content type of the response, e.g.
+	// application/grpc+proto
+	ContentType string `json:"content_type"`
+	// Encoding is the compression of the response messages
+	Encoding string `json:"encoding,omitempty"`
+	// Body are the length-prefixed response messages
+	Body []byte `json:"body"`
+}
+
+// New creates a StoreAPI proxy forwarding to cfg.Upstream
+func New(cfg Config, c *cache.Cache, log *slog.Logger, m *metrics.Metrics) (*Proxy, error) {
+	upstream, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Thanos upstream URL: %w", err)
+	}
+
+	transport := &http2.Transport{}
+	switch upstream.Scheme {
+	case "http":
+		// gRPC without TLS is cleartext HTTP/2 with prior knowledge
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	case "https":
+	default:
+		return nil, fmt.Errorf("invalid Thanos upstream URL %s: scheme must be http or https", cfg.Upstream)
+	}
+
+	return &Proxy{
+		upstream: upstream,
+		client:   &http.Client{Transport: transport},
+		cache:    c,
+		ttl:      cfg.TTL,
+		log:      log,
+		metrics:  m,
+	}, nil
+}
+
+// ServeHTTP handles a gRPC call
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Unsupported Media Type: expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	method, cacheable := cacheableMethods[r.URL.Path]
+	if !cacheable {
+		p.metrics.RecordThanosRequest("other", "bypass")
+		p.forward(w, r, body, "")
+		return
+	}
+
+	key := cacheKey(r, body)
+	if data, found := p.cache.Get(r.Context(), key); found {
+		var e entry
+		if err := json.Unmarshal(data, &e); err == nil {
+			p.metrics.RecordThanosRequest(method, "hit")
+			p.log.Debug("Thanos cache hit", "method", r.URL.Path)
+			writeEntry(w, e)
+			return
+		}
+		p.cache.Delete(r.Context(), key)
+	}
+
+	p.metrics.RecordThanosRequest(method, "miss")
+	p.log.Debug("Thanos cache miss", "method", r.URL.Path)
+	p.forward(w, r, body, key)
+}
+
+// cacheKey returns the cache key of a StoreAPI call, the method and a hash
+// of the request message and the metadata changing the response
+func cacheKey(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write(body)
+	for _, name := range keyMetadata {
+		fmt.Fprintf(h, "\x00%s=%s", name, r.Header.Get(name))
+	}
+	return keyPrefix + r.URL.Path + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// forward sends the call upstream and streams the response to the client.
+// Successful responses are cached under key unless it is empty.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, body []byte, key string) {
+	target := *p.upstream
+	target.Path = r.URL.Path
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		writeStatus(w, codeInternal, "failed to create upstream request")
+		return
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	req.ContentLength = int64(len(body))
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.log.Warn("Thanos upstream request failed", "method", r.URL.Path, "error", err)
+		writeStatus(w, codeUnavailable, "upstream request failed: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, name := range hopHeaders {
+		w.Header().Del(name)
+	}
+	// Status metadata of trailers-only responses arrives in the headers,
+	// clients expect it after the messages
+	status := http.Header{}
+	for _, name := range statusMetadata {
+		if values, found := w.Header()[name]; found {
+			status[name] = values
+			w.Header().Del(name)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Stream the messages of server-streaming calls while buffering them
+	// for the cache
+	var buf bytes.Buffer
+	var src io.Reader = resp.Body
+	if key != "" {
+		src = io.TeeReader(resp.Body, &buf)
+	}
+	if _, err := io.Copy(flushWriter{w}, src); err != nil {
+		p.log.Warn("Failed to stream Thanos response", "method", r.URL.Path, "error", err)
+		return
+	}
+
+	for name, values := range resp.Trailer {
+		status[name] = values
+	}
+	for name, values := range status {
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+
+	p.log.Debug("Thanos upstream request", "method", r.URL.Path, "status", status.Get("Grpc-Status"), "duration", time.Since(start))
+	if key == "" || resp.StatusCode != http.StatusOK || status.Get("Grpc-Status") != "0" {
+		return
+	}
+	data, err := json.Marshal(entry{
+		ContentType: resp.Header.Get("Content-Type"),
+		Encoding:    resp.Header.Get("Grpc-Encoding"),
+		Body:        buf.Bytes(),
+	})
+	if err != nil {
+		return
+	}
+	p.cache.Set(r.Context(), key, data, p.ttl)
+	p.cache.Label(key, r.URL.Path)
+}
+
+// writeEntry writes a cached response
+func writeEntry(w http.ResponseWriter, e entry) {
+	w.Header().Set("Content-Type", e.ContentType)
+	if e.Encoding != "" {
+		w.Header().Set("Grpc-Encoding", e.Encoding)
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.Body)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+// gRPC status codes of errors raised by the proxy
+const (
+	codeInternal    = 13
+	codeUnavailable = 14
+)
+
+// writeStatus answers a call with a trailers-only gRPC error
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// flushWriter flushes after every write so streamed messages reach the
+// client right away
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
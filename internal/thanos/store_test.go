@@ -0,0 +1,146 @@
+package thanos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/metrics"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame returns a length-prefixed, uncompressed gRPC message
+func grpcFrame(message string) []byte {
+	frame := []byte{0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(message)))
+	return append(frame, message...)
+}
+
+// newTestProxy creates a proxy in front of an h2c StoreAPI upstream that
+// streams two messages echoing the request, or fails with status if set
+func newTestProxy(t *testing.T, status string) (*Proxy, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		if status != "" {
+			// Trailers-only response
+			w.Header().Set("Grpc-Status", status)
+			w.Header().Set("Grpc-Message", "failed")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write(grpcFrame("series of " + string(body)))
+		w.Write(grpcFrame(r.Header.Get("Thanos-Tenant")))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	t.Cleanup(upstream.Close)
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := metrics.New(nil, metrics.Options{})
+	p, err := New(Config{Upstream: upstream.URL, TTL: time.Minute}, cache.New(time.Minute, 0, time.Hour, log, m), log, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &calls
+}
+
+// call makes a gRPC call of method through p
+func call(p *Proxy, method string, message string, tenant string) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, method, bytes.NewReader([]byte(message)))
+	r.ProtoMajor = 2
+	r.Header.Set("Content-Type", "application/grpc")
+	if tenant != "" {
+		r.Header.Set("Thanos-Tenant", tenant)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	p, calls := newTestProxy(t, "")
+	want := append(grpcFrame("series of request"), grpcFrame("team-a")...)
+
+	for i, cacheStatus := range []string{"", "HIT"} {
+		resp := call(p, "/thanos.Store/Series", "request", "team-a")
+		body, _ := io.ReadAll(resp.Body)
+		if !bytes.Equal(body, want) {
+			t.Errorf("call %d: body = %q, want %q", i, body, want)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("call %d: Grpc-Status trailer = %q, want 0", i, got)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "application/grpc" {
+			t.Errorf("call %d: Content-Type = %q", i, got)
+		}
+		if got := resp.Header.Get("X-Cache"); got != cacheStatus {
+			t.Errorf("call %d: X-Cache = %q, want %q", i, got, cacheStatus)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream calls = %d, want 1", n)
+	}
+
+	// Other messages and tenants have their own entries
+	call(p, "/thanos.Store/Series", "other request", "team-a")
+	call(p, "/thanos.Store/Series", "request", "team-b")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("upstream calls = %d, want 3", n)
+	}
+}
+
+func TestStoreBypass(t *testing.T) {
+	p, calls := newTestProxy(t, "")
+	for range 2 {
+		resp := call(p, "/thanos.Store/Info", "", "")
+		io.ReadAll(resp.Body)
+		if resp.Header.Get("X-Cache") != "" {
+			t.Error("Info call was answered from the cache")
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream calls = %d, want 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/thanos.Store/Series", nil))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status of an HTTP/1 request = %d, want 415", w.Code)
+	}
+}
+
+func TestStoreErrorsAreNotCached(t *testing.T) {
+	p, calls := newTestProxy(t, "2")
+	for range 2 {
+		resp := call(p, "/thanos.Store/Series", "request", "")
+		io.ReadAll(resp.Body)
+		if got := resp.Trailer.Get("Grpc-Status"); got != "2" {
+			t.Errorf("Grpc-Status trailer = %q, want 2", got)
+		}
+		if got := resp.Header.Get("Grpc-Status"); got != "" {
+			t.Errorf("Grpc-Status header = %q, want it as trailer only", got)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream calls = %d, want 2", n)
+	}
+}
+
+func TestNewRejectsScheme(t *testing.T) {
+	if _, err := New(Config{Upstream: "grpc://thanos:10901"}, nil, nil, nil); err == nil {
+		t.Error("New accepted a grpc:// upstream")
+	}
+}
@@ -0,0 +1,60 @@
+// Package version describes the running build of promcached. Release
+// builds set it through the linker:
+//
+//	go build -ldflags "-X github.com/f0o/promcache/internal/version.Version=v1.2.3 -X github.com/f0o/promcache/internal/version.Commit=$(git rev-parse HEAD)"
+//
+// Otherwise it is taken from the build information Go embeds.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set at build time through -ldflags -X
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes a build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build of the running binary. Fields neither set at
+// build time nor embedded by Go are "unknown".
+var Get = sync.OnceValue(func() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	// go install and builds in a VCS checkout embed the module version
+	// and revision
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" && info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+})
@@ -0,0 +1,422 @@
+package warmer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/f0o/promcache/internal/config"
+)
+
+// defaultMaxDataPoints approximates the number of points Grafana requests
+// for a panel when it doesn't set maxDataPoints explicitly
+const defaultMaxDataPoints = 1000
+
+// defaultScrapeInterval is Grafana's default Prometheus scrape interval used
+// to compute $__rate_interval
+const defaultScrapeInterval = 15 * time.Second
+
+// variablePattern matches Grafana template variables in $var, ${var} and
+// [[var]] notation
+var variablePattern = regexp.MustCompile(`\$\{(\w+)(?::\w+)?\}|\$(\w+)|\[\[(\w+)\]\]`)
+
+// grafanaSource extracts panel queries from Grafana dashboards
+type grafanaSource struct {
+	cfg     config.GrafanaConfig
+	client  *http.Client
+	log     *slog.Logger
+	queries []config.WarmQuery
+	loaded  time.Time
+}
+
+// dashboard is the subset of the Grafana dashboard model we need
+type dashboard struct {
+	Title  string  `json:"title"`
+	Panels []panel `json:"panels"`
+	Time   struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"time"`
+	Templating struct {
+		List []struct {
+			Name    string `json:"name"`
+			Current struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"current"`
+		} `json:"list"`
+	} `json:"templating"`
+}
+
+// panel is the subset of a Grafana panel we need
+type panel struct {
+	Title         string        `json:"title"`
+	TimeFrom      string        `json:"timeFrom"`
+	MaxDataPoints int           `json:"maxDataPoints"`
+	Interval      string        `json:"interval"`
+	Datasource    datasourceRef `json:"datasource"`
+	Panels        []panel       `json:"panels"`
+	Targets       []target      `json:"targets"`
+}
+
+// target is a single panel query
+type target struct {
+	Expr       string        `json:"expr"`
+	Instant    bool          `json:"instant"`
+	Hide       bool          `json:"hide"`
+	Datasource datasourceRef `json:"datasource"`
+}
+
+// datasourceRef references a panel's or target's data source, either as
+// an object with its plugin type or, in older dashboards, by name
+type datasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+	Name string `json:"-"`
+}
+
+func (d *datasourceRef) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.Name); err == nil {
+		return nil
+	}
+	type plain datasourceRef
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// set reports whether the reference names a data source at all
+func (d datasourceRef) set() bool {
+	return d.Type != "" || d.UID != "" || d.Name != ""
+}
+
+// isPrometheus reports whether a query of the data source may be PromQL.
+// Data sources referenced by name or not at all can't be told apart and
+// are assumed to be Prometheus.
+func (d datasourceRef) isPrometheus() bool {
+	switch {
+	case d.Type != "":
+		return d.Type == "prometheus"
+	case d.Name == "-- Grafana --", d.Name == "-- Dashboard --":
+		return false
+	}
+	return true
+}
+
+// newGrafanaSource creates a dashboard query source, or nil when Grafana
+// warming isn't configured
+func newGrafanaSource(cfg config.GrafanaConfig, log *slog.Logger) *grafanaSource {
+	if cfg.URL == "" && len(cfg.Files) == 0 {
+		return nil
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = config.Duration(10 * time.Minute)
+	}
+
+	return &grafanaSource{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log:    log,
+	}
+}
+
+// Queries returns the queries extracted from all dashboards, reloading the
+// dashboards when the refresh interval elapsed
+func (g *grafanaSource) Queries() []config.WarmQuery {
+	if time.Since(g.loaded) < time.Duration(g.cfg.Refresh) {
+		return g.queries
+	}
+
+	g.loaded = time.Now()
+
+	// Keep the previous queries if nothing could be loaded
+	dashboards, err := g.load()
+	if err != nil {
+		g.log.Error("Failed to load Grafana dashboards", "error", err)
+		if len(dashboards) == 0 {
+			return g.queries
+		}
+	}
+
+	var queries []config.WarmQuery
+	for _, d := range dashboards {
+		for _, q := range extractQueries(d) {
+			q.Namespace, q.Tenant = g.cfg.Namespace, g.cfg.Tenant
+			queries = append(queries, q)
+		}
+	}
+	g.queries = queries
+
+	g.log.Info("Loaded Grafana dashboards",
+		"dashboards", len(dashboards),
+		"queries", len(g.queries))
+	return g.queries
+}
+
+// load fetches dashboards from the Grafana API and reads exported files
+func (g *grafanaSource) load() ([]dashboard, error) {
+	var dashboards []dashboard
+
+	for _, pattern := range g.cfg.Files {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return dashboards, err
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return dashboards, err
+			}
+			d, err := parseDashboard(data)
+			if err != nil {
+				return dashboards, fmt.Errorf("%s: %w", path, err)
+			}
+			dashboards = append(dashboards, d)
+		}
+	}
+
+	if g.cfg.URL == "" {
+		return dashboards, nil
+	}
+
+	uids := g.cfg.Dashboards
+	if len(uids) == 0 {
+		var err error
+		if uids, err = g.searchDashboards(); err != nil {
+			return dashboards, err
+		}
+	}
+
+	for _, uid := range uids {
+		data, err := g.get("/api/dashboards/uid/" + url.PathEscape(uid))
+		if err != nil {
+			return dashboards, err
+		}
+		d, err := parseDashboard(data)
+		if err != nil {
+			return dashboards, fmt.Errorf("dashboard %s: %w", uid, err)
+		}
+		dashboards = append(dashboards, d)
+	}
+
+	return dashboards, nil
+}
+
+// searchDashboards returns the UIDs of all dashboards visible to the token
+func (g *grafanaSource) searchDashboards() ([]string, error) {
+	data, err := g.get("/api/search?type=dash-db")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		UID string `json:"uid"`
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, err
+	}
+
+	uids := make([]string, 0, len(results))
+	for _, result := range results {
+		uids = append(uids, result.UID)
+	}
+	return uids, nil
+}
+
+// get performs an authenticated GET request against the Grafana API
+func (g *grafanaSource) get(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.cfg.URL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.cfg.Token)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("grafana returned %s for %s", resp.Status, path)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// parseDashboard parses either an API response wrapping the dashboard or a
+// raw exported dashboard
+func parseDashboard(data []byte) (dashboard, error) {
+	var wrapped struct {
+		Dashboard *dashboard `json:"dashboard"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return dashboard{}, err
+	}
+	if wrapped.Dashboard != nil {
+		return *wrapped.Dashboard, nil
+	}
+
+	var d dashboard
+	err := json.Unmarshal(data, &d)
+	return d, err
+}
+
+// extractQueries returns the warm queries of all panels of a dashboard
+func extractQueries(d dashboard) []config.WarmQuery {
+	variables := make(map[string]string)
+	for _, v := range d.Templating.List {
+		if value, ok := variableValue(v.Current.Value); ok {
+			variables[v.Name] = value
+		}
+	}
+
+	dashboardRange := parseRelativeTime(d.Time.From)
+
+	var queries []config.WarmQuery
+	var walk func(panels []panel)
+	walk = func(panels []panel) {
+		for _, p := range panels {
+			walk(p.Panels)
+
+			queryRange := dashboardRange
+			if r := parseRelativeTime(p.TimeFrom); r > 0 {
+				queryRange = r
+			}
+
+			maxDataPoints := p.MaxDataPoints
+			if maxDataPoints <= 0 {
+				maxDataPoints = defaultMaxDataPoints
+			}
+			step := max(queryRange/time.Duration(maxDataPoints), time.Second)
+			if minInterval, err := time.ParseDuration(p.Interval); err == nil && minInterval > step {
+				step = minInterval
+			}
+
+			for _, t := range p.Targets {
+				if t.Expr == "" || t.Hide {
+					continue
+				}
+				// Targets name their data source in mixed panels, other
+				// expressions such as LogQL aren't for the upstream
+				ds := t.Datasource
+				if !ds.set() {
+					ds = p.Datasource
+				}
+				if !ds.isPrometheus() {
+					continue
+				}
+				expr, ok := interpolate(t.Expr, variables, step)
+				if !ok {
+					continue
+				}
+
+				q := config.WarmQuery{Query: expr}
+				if !t.Instant && queryRange > 0 {
+					q.Range = config.Duration(queryRange)
+					q.Step = config.Duration(step)
+				}
+				queries = append(queries, q)
+			}
+		}
+	}
+	walk(d.Panels)
+
+	return queries
+}
+
+// interpolate substitutes Grafana's built-in interval variables and the
+// dashboard's current template variable values. Returns false if the
+// expression references a variable without a usable value.
+func interpolate(expr string, variables map[string]string, step time.Duration) (string, bool) {
+	rateInterval := max(step+defaultScrapeInterval, 4*defaultScrapeInterval)
+	builtins := map[string]string{
+		"__interval":      formatDuration(step),
+		"__interval_ms":   strconv.FormatInt(step.Milliseconds(), 10),
+		"__rate_interval": formatDuration(rateInterval),
+		"__range":         "",
+	}
+
+	ok := true
+	result := variablePattern.ReplaceAllStringFunc(expr, func(match string) string {
+		groups := variablePattern.FindStringSubmatch(match)
+		name := groups[1] + groups[2] + groups[3]
+
+		if value, found := builtins[name]; found && value != "" {
+			return value
+		}
+		if value, found := variables[name]; found {
+			return value
+		}
+		ok = false
+		return match
+	})
+	return result, ok
+}
+
+// variableValue returns the current value of a template variable, skipping
+// multi-value and "All" selections that can't be reproduced reliably
+func variableValue(raw json.RawMessage) (string, bool) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", false
+	}
+	if value == "$__all" {
+		return "", false
+	}
+	return value, true
+}
+
+// parseRelativeTime parses Grafana relative times like "now-6h" into the
+// duration before now
+func parseRelativeTime(s string) time.Duration {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "now-")
+	if s == "" {
+		return 0
+	}
+
+	// Grafana supports day and week units that time.ParseDuration lacks
+	multiplier := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		multiplier = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		multiplier = 7 * 24 * time.Hour
+	}
+	if multiplier > 0 {
+		n, err := strconv.Atoi(strings.TrimRight(s, "dw"))
+		if err != nil {
+			return 0
+		}
+		return time.Duration(n) * multiplier
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// formatDuration formats a duration in PromQL notation
+func formatDuration(d time.Duration) string {
+	if d%time.Second != 0 {
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+	return strconv.FormatInt(int64(d.Seconds()), 10) + "s"
+}
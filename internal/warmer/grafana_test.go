@@ -0,0 +1,42 @@
+package warmer
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestExtractQueriesDatasources(t *testing.T) {
+	data := `{
+		"time": {"from": "now-1h", "to": "now"},
+		"panels": [
+			{"datasource": {"type": "prometheus", "uid": "prom"}, "targets": [{"expr": "prometheus_panel"}]},
+			{"datasource": {"type": "loki", "uid": "logs"}, "targets": [{"expr": "sum(rate({app=\"api\"}[5m]))"}]},
+			{"datasource": "Prometheus", "targets": [{"expr": "legacy_name"}]},
+			{"datasource": null, "targets": [{"expr": "default_datasource"}]},
+			{"datasource": "-- Grafana --", "targets": [{"expr": "builtin"}]},
+			{"datasource": {"type": "datasource", "uid": "-- Mixed --"}, "targets": [
+				{"expr": "mixed_prometheus", "datasource": {"type": "prometheus", "uid": "prom"}},
+				{"expr": "{app=\"api\"} |= \"error\"", "datasource": {"type": "loki", "uid": "logs"}}
+			]},
+			{"type": "row", "panels": [
+				{"datasource": {"type": "loki"}, "targets": [{"expr": "count_over_time({app=\"api\"}[1m])"}]},
+				{"datasource": {"uid": "${ds}"}, "targets": [{"expr": "variable_datasource"}]}
+			]}
+		]
+	}`
+	var d dashboard
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, q := range extractQueries(d) {
+		got = append(got, q.Query)
+	}
+	slices.Sort(got)
+	want := []string{"default_datasource", "legacy_name", "mixed_prometheus", "prometheus_panel", "variable_datasource"}
+	if !slices.Equal(got, want) {
+		t.Errorf("queries = %q, want %q", got, want)
+	}
+}
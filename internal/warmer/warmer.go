@@ -0,0 +1,139 @@
+// Package warmer keeps configured queries pre-populated in the cache
+package warmer
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/f0o/promcache/internal/config"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// Warmer periodically issues configured queries through the caching proxy
+// so the first dashboard viewer doesn't pay the cold-cache penalty
+type Warmer struct {
+	handler  http.Handler
+	queries  []config.WarmQuery
+	grafana  *grafanaSource
+	interval time.Duration
+	log      *slog.Logger
+}
+
+// New creates a new warmer issuing queries against the given handler
+func New(handler http.Handler, cfg config.WarmerConfig, interval time.Duration, log *slog.Logger) *Warmer {
+	if cfg.Interval > 0 {
+		interval = time.Duration(cfg.Interval)
+	}
+
+	return &Warmer{
+		handler:  handler,
+		queries:  cfg.Queries,
+		grafana:  newGrafanaSource(cfg.Grafana, log),
+		interval: interval,
+		log:      log,
+	}
+}
+
+// Start starts warming the cache in the background
+func (w *Warmer) Start() {
+	if (len(w.queries) == 0 && w.grafana == nil) || w.interval <= 0 {
+		return
+	}
+
+	w.log.Info("Starting cache warmer",
+		"queries", len(w.queries),
+		"grafana", w.grafana != nil,
+		"interval", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			w.warm()
+			<-ticker.C
+		}
+	}()
+}
+
+// warm issues every configured query once
+func (w *Warmer) warm() {
+	queries := w.queries
+	if w.grafana != nil {
+		queries = append(queries[:len(queries):len(queries)], w.grafana.Queries()...)
+	}
+
+	for _, q := range queries {
+		req, err := http.NewRequest(http.MethodGet, requestURL(q, time.Now()), nil)
+		if err != nil {
+			w.log.Error("Failed to create warm request", "query", q.Query, "error", err)
+			continue
+		}
+		// Re-fetch queries that are still cached so their entries are
+		// replaced before they expire
+		req = proxy.WithRefresh(req)
+		if q.Namespace != "" || q.Tenant != "" {
+			req = proxy.WithIdentity(req, identity(q))
+		}
+
+		rw := &responseRecorder{header: make(http.Header)}
+		w.handler.ServeHTTP(rw, req)
+
+		w.log.Debug("Warmed query",
+			"query", q.Query,
+			"status", rw.status,
+			"cache", rw.header.Get("X-Cache"))
+	}
+}
+
+// identity returns the client identity a warm query is issued as
+func identity(q config.WarmQuery) proxy.Identity {
+	namespace := q.Namespace
+	if namespace == "" {
+		namespace = q.Tenant
+	}
+	return proxy.Identity{Name: "warmer", Namespace: namespace, Tenant: q.Tenant}
+}
+
+// requestURL builds the instant or range query URL for a warm query
+func requestURL(q config.WarmQuery, now time.Time) string {
+	params := url.Values{"query": {q.Query}}
+
+	if q.Range <= 0 {
+		params.Set("time", strconv.FormatInt(now.Unix(), 10))
+		return "/api/v1/query?" + params.Encode()
+	}
+
+	step := time.Duration(q.Step)
+	if step <= 0 {
+		step = max(time.Duration(q.Range)/250, time.Second)
+	}
+	params.Set("start", strconv.FormatInt(now.Add(-time.Duration(q.Range)).Unix(), 10))
+	params.Set("end", strconv.FormatInt(now.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+	return "/api/v1/query_range?" + params.Encode()
+}
+
+// responseRecorder discards the response body of warm requests
+type responseRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
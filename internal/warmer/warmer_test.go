@@ -0,0 +1,37 @@
+package warmer
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/f0o/promcache/internal/config"
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+func TestWarmIdentity(t *testing.T) {
+	identities := make(map[string]proxy.Identity)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := proxy.IdentityFrom(r)
+		identities[r.URL.Query().Get("query")] = id
+	})
+
+	cfg := config.WarmerConfig{Queries: []config.WarmQuery{
+		{Query: "shared"},
+		{Query: "tenant", Tenant: "team-a"},
+		{Query: "namespaced", Tenant: "team-a", Namespace: "dashboards"},
+	}}
+	New(handler, cfg, 0, slog.New(slog.NewTextHandler(io.Discard, nil))).warm()
+
+	want := map[string]proxy.Identity{
+		"shared":     {},
+		"tenant":     {Name: "warmer", Namespace: "team-a", Tenant: "team-a"},
+		"namespaced": {Name: "warmer", Namespace: "dashboards", Tenant: "team-a"},
+	}
+	for query, id := range want {
+		if got := identities[query]; got != id {
+			t.Errorf("identity of %q = %+v, want %+v", query, got, id)
+		}
+	}
+}
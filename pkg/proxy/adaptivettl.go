@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// adaptiveTTL returns the TTL of a query response that took the upstream
+// upstreamDuration to compute: the cache TTL scaled by how far the
+// duration is from the threshold, within the adaptive TTL bounds. Queries
+// taking the threshold are cached for the cache TTL, twice as long ones
+// twice as long.
+func (p *HTTPCacheProxy) adaptiveTTL(upstreamDuration time.Duration) time.Duration {
+	scaled := time.Duration(float64(p.cacheTTL) * float64(upstreamDuration) / float64(p.opts.AdaptiveTTLThreshold))
+	return min(max(scaled, p.opts.AdaptiveTTLMin), p.opts.AdaptiveTTLMax)
+}
+
+// adaptsTTL reports whether the TTL of the response to r depends on its
+// upstream duration. Only query endpoints cached with the cache TTL do,
+// endpoints and cache rules with their own TTL keep it.
+func (p *HTTPCacheProxy) adaptsTTL(r *http.Request, upstreamDuration time.Duration) bool {
+	return p.opts.AdaptiveTTLThreshold > 0 && upstreamDuration > 0 && (isQueryEndpoint(r.URL.Path) || isLoki(r.URL.Path))
+}
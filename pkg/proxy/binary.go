@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errBinaryTruncated is returned when a binary-encoded value is truncated
+var errBinaryTruncated = errors.New("binary: unexpected end of data")
+
+// Flags of the binary encoding
+const (
+	binaryFlagCompressed byte = 1 << iota
+	binaryFlagMatrix
+)
+
+// binarySerializer encodes responses in a compact length-prefixed framing:
+//
+//	uvarint status code
+//	byte    flags
+//	varint  stored-at unix nanoseconds
+//	uvarint header count, then per header:
+//	        uvarint name length, name,
+//	        uvarint value count, then per value: uvarint length, value
+//	        remaining bytes are the body
+//
+// The body is neither escaped nor copied on decode, which keeps the hit path
+// cheap for megabyte-sized range query responses.
+type binarySerializer struct{}
+
+func (binarySerializer) Name() string {
+	return "binary"
+}
+
+func (binarySerializer) Marshal(resp *Response) ([]byte, error) {
+	size := len(resp.Body) + 2*binary.MaxVarintLen64 + 1
+	for name, values := range resp.Headers {
+		size += len(name) + 2*binary.MaxVarintLen64
+		for _, value := range values {
+			size += len(value) + binary.MaxVarintLen64
+		}
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.AppendUvarint(b, uint64(resp.StatusCode))
+
+	var flags byte
+	if resp.Compressed {
+		flags |= binaryFlagCompressed
+	}
+	if resp.Matrix {
+		flags |= binaryFlagMatrix
+	}
+	b = append(b, flags)
+
+	b = binary.AppendVarint(b, resp.StoredAt.UnixNano())
+
+	b = binary.AppendUvarint(b, uint64(len(resp.Headers)))
+	for _, name := range sortedHeaderNames(resp.Headers) {
+		values := resp.Headers[name]
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+		b = binary.AppendUvarint(b, uint64(len(values)))
+		for _, value := range values {
+			b = binary.AppendUvarint(b, uint64(len(value)))
+			b = append(b, value...)
+		}
+	}
+
+	return append(b, resp.Body...), nil
+}
+
+func (binarySerializer) Unmarshal(data []byte, resp *Response) error {
+	d := binaryDecoder{data: data}
+
+	status := d.uvarint()
+	flags := d.byte()
+	storedAt := d.varint()
+
+	headerCount := d.uvarint()
+	if d.err == nil && headerCount > uint64(len(data)) {
+		return errBinaryTruncated
+	}
+	headers := make(http.Header, headerCount)
+	for i := uint64(0); i < headerCount && d.err == nil; i++ {
+		name := d.string()
+		valueCount := d.uvarint()
+		if d.err == nil && valueCount > uint64(len(data)) {
+			return errBinaryTruncated
+		}
+		values := make([]string, 0, valueCount)
+		for j := uint64(0); j < valueCount && d.err == nil; j++ {
+			values = append(values, d.string())
+		}
+		headers[name] = values
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	*resp = Response{
+		Headers:    headers,
+		StatusCode: int(status),
+		Body:       data[d.pos:],
+		Compressed: flags&binaryFlagCompressed != 0,
+		Matrix:     flags&binaryFlagMatrix != 0,
+		StoredAt:   time.Unix(0, storedAt),
+	}
+	return nil
+}
+
+// binaryDecoder reads binary-encoded values, remembering the first error
+type binaryDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *binaryDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos >= len(d.data) {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *binaryDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		d.err = errBinaryTruncated
+		return ""
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s
+}
+
+func (d *binaryDecoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data)-d.pos < 8 {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.data[d.pos:])
+	d.pos += 8
+	return v
+}
+
+// count reads an element count, which can't exceed the remaining bytes
+func (d *binaryDecoder) count() uint64 {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.data)-d.pos) {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	return n
+}
+
+// bytes reads a length-prefixed byte string without copying it
+func (d *binaryDecoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	b := d.data[d.pos : d.pos+int(n) : d.pos+int(n)]
+	d.pos += int(n)
+	return b
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Cache rule actions
+const (
+	// CacheRuleCache caches responses to matching queries with the rule's
+	// TTL
+	CacheRuleCache = "cache"
+	// CacheRuleSkip never caches responses to matching queries
+	CacheRuleSkip = "skip"
+)
+
+// CacheRule overrides the caching of queries. A rule matches if all of its
+// patterns match; empty patterns are ignored.
+type CacheRule struct {
+	// Name identifies the rule in logs
+	Name string
+	// Action is CacheRuleCache or CacheRuleSkip
+	Action string
+	// Query is a regular expression searched for in the normalized PromQL
+	// expression
+	Query string
+	// Metric is a regular expression matched against the metric names
+	// referenced by the expression, anchored like PromQL regex matchers.
+	// Skip rules match if any name matches, cache rules only if all do.
+	Metric string
+	// Client is a regular expression matched against the name of the
+	// client's identity, anchored like Metric. Rules with only a client
+	// pattern match all queries of the client.
+	Client string
+	// TTL is the TTL of responses cached by a cache rule
+	TTL time.Duration
+}
+
+// CacheRuleSet is an ordered list of cache rules. The first matching rule
+// decides; queries matching no rule are cached with the endpoint's TTL.
+type CacheRuleSet struct {
+	rules RuleSet
+}
+
+// NewCacheRuleSet compiles the given cache rules
+func NewCacheRuleSet(rules []CacheRule) (*CacheRuleSet, error) {
+	cs := &CacheRuleSet{}
+	for _, rule := range rules {
+		switch rule.Action {
+		case CacheRuleSkip:
+		case CacheRuleCache:
+			if rule.TTL <= 0 {
+				return nil, fmt.Errorf("cache rule %q: needs a positive ttl", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("cache rule %q: unknown action %q", rule.Name, rule.Action)
+		}
+		cr := compiledRule{name: rule.Name, action: rule.Action}
+		if rule.Query != "" || rule.Metric != "" || rule.Client == "" {
+			var err error
+			if cr, err = compileRule(rule.Name, rule.Action, rule.Query, rule.Metric); err != nil {
+				return nil, err
+			}
+		}
+		if rule.Client != "" {
+			re, err := regexp.Compile("^(?:" + rule.Client + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("cache rule %q: %w", rule.Name, err)
+			}
+			cr.client = re
+		}
+		cr.anyMetric = rule.Action == CacheRuleSkip
+		cr.ttl = rule.TTL
+		cs.rules.rules = append(cs.rules.rules, cr)
+	}
+	return cs, nil
+}
+
+// match returns the rule deciding the caching of a request of client with
+// the given expressions, nil if no rule matches. A skip rule matching any
+// expression takes precedence.
+func (cs *CacheRuleSet) match(exprs []string, client string) *compiledRule {
+	var first *compiledRule
+	for _, expr := range exprs {
+		rule := cs.rules.match(expr, client)
+		if rule != nil && rule.action == CacheRuleSkip {
+			return rule
+		}
+		if first == nil {
+			first = rule
+		}
+	}
+	return first
+}
+
+// cacheRule returns the cache rule matching the normalized expressions of
+// r, nil if none does
+func (p *HTTPCacheProxy) cacheRule(r *http.Request) *compiledRule {
+	if p.opts.CacheRules == nil {
+		return nil
+	}
+	id, _ := IdentityFrom(r)
+	return p.opts.CacheRules.match(queryExpressions(p.normalizedQuery(r)), id.Name)
+}
+
+// entryTTL returns the TTL of the upstream response resp to r: the TTL
+// requested by the client if allowed, else the TTL of its cache rule if
+// any, else the TTL set by the upstream if honored and the endpoint's TTL
+// otherwise, adapted to the upstream duration of queries. The TTL of
+// recent queries is capped. A nil resp and an upstreamDuration of 0 are
+// unknown.
+func (p *HTTPCacheProxy) entryTTL(r *http.Request, resp *http.Response, upstreamDuration time.Duration) time.Duration {
+	ttl := p.endpointTTL(r.URL.Path)
+	if requested, ok := p.headerTTL(r); ok {
+		ttl = requested
+		traceStep(r, "header_ttl", ttl.String())
+	} else if rule := p.cacheRule(r); rule != nil && rule.action == CacheRuleCache {
+		ttl = rule.ttl
+	} else if hint, ok := upstreamTTL(resp); ok && p.opts.UpstreamTTLHints {
+		ttl = hint
+		traceStep(r, "upstream_ttl", ttl.String())
+	} else if p.adaptsTTL(r, upstreamDuration) {
+		ttl = p.adaptiveTTL(upstreamDuration)
+		traceStep(r, "adaptive_ttl", ttl.String())
+	}
+	if p.opts.MinCacheableAgeTTL > 0 && p.isRecent(r) {
+		ttl = min(ttl, p.opts.MinCacheableAgeTTL)
+	}
+	return ttl
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// queryStats is the part of the stats Prometheus adds to query results
+// when asked for them with stats=all
+type queryStats struct {
+	Samples struct {
+		TotalQueryableSamples int64 `json:"totalQueryableSamples"`
+	} `json:"samples"`
+}
+
+// resultSamples are the sample fields of vector and matrix series
+type resultSamples struct {
+	Value      json.RawMessage   `json:"value"`
+	Histogram  json.RawMessage   `json:"histogram"`
+	Values     []json.RawMessage `json:"values"`
+	Histograms []json.RawMessage `json:"histograms"`
+}
+
+// responseSamples returns the number of samples a query response cost the
+// upstream: the queryable samples of its stats if present, otherwise the
+// samples of its result. Returns false for bodies that aren't query
+// results.
+func responseSamples(body []byte) (int64, bool) {
+	var envelope struct {
+		Data struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+			Stats      *queryStats     `json:"stats"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return 0, false
+	}
+	if stats := envelope.Data.Stats; stats != nil && stats.Samples.TotalQueryableSamples > 0 {
+		return stats.Samples.TotalQueryableSamples, true
+	}
+
+	switch envelope.Data.ResultType {
+	case "scalar", "string":
+		return 1, true
+	case "vector", "matrix", "streams":
+	default:
+		return 0, false
+	}
+	var series []resultSamples
+	if err := json.Unmarshal(envelope.Data.Result, &series); err != nil {
+		return 0, false
+	}
+	var samples int64
+	for _, s := range series {
+		if s.Value != nil || s.Histogram != nil {
+			samples++
+		}
+		samples += int64(len(s.Values) + len(s.Histograms))
+	}
+	return samples, true
+}
+
+// isCheap reports whether a query response the upstream took
+// upstreamDuration to compute is below all cost thresholds and not worth
+// caching. Responses of other endpoints are never cheap.
+func (p *HTTPCacheProxy) isCheap(path string, upstreamDuration time.Duration, body []byte) bool {
+	if p.opts.MinCacheDuration <= 0 && p.opts.MinCacheSamples <= 0 {
+		return false
+	}
+	if !isQueryEndpoint(path) && !isLoki(path) {
+		return false
+	}
+	if p.opts.MinCacheDuration > 0 && upstreamDuration >= p.opts.MinCacheDuration {
+		return false
+	}
+	if p.opts.MinCacheSamples > 0 {
+		if samples, ok := responseSamples(body); !ok || samples >= int64(p.opts.MinCacheSamples) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import "sync"
+
+// coalescer lets identical concurrent cache misses wait for the first one,
+// which fills the cache for the others
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]chan struct{}
+}
+
+// join registers a miss of key. The first miss gets done, which it must
+// call once it stored its response; the others get wait, which is closed
+// then.
+func (c *coalescer) join(key string) (done func(), wait <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, found := c.calls[key]; found {
+		return nil, call
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]chan struct{})
+	}
+	call := make(chan struct{})
+	c.calls[key] = call
+	return func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call)
+	}, nil
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions for queries exceeding their limits
+const (
+	// LimitReject rejects queries exceeding their limits with 400 Bad Request
+	LimitReject = "reject"
+	// LimitClamp raises the step and shortens the range to fit the limits
+	LimitClamp = "clamp"
+)
+
+// QueryLimits bounds the cost of range queries
+type QueryLimits struct {
+	// MaxPoints is the maximum number of points per series of a range
+	// query, (end-start)/step, 0 means unlimited
+	MaxPoints int
+	// MaxRange is the maximum time range between start and end, 0 means
+	// unlimited
+	MaxRange time.Duration
+}
+
+// queryLimits returns the limits applying to r, the tenant's overrides if
+// any and the default limits otherwise
+func (p *HTTPCacheProxy) queryLimits(r *http.Request) QueryLimits {
+	if tenant := p.tenantID(r); tenant != "" {
+		if limits, found := p.opts.TenantLimits[tenant]; found {
+			return limits
+		}
+	}
+	return p.opts.Limits
+}
+
+// tenantID returns the tenant a request belongs to, empty if unknown. The
+// tenant of an authenticated identity takes precedence over the header.
+func (p *HTTPCacheProxy) tenantID(r *http.Request) string {
+	if id, ok := IdentityFrom(r); ok && id.Tenant != "" {
+		return id.Tenant
+	}
+	if p.opts.TenantHeader == "" {
+		return ""
+	}
+	return r.Header.Get(p.opts.TenantHeader)
+}
+
+// recordTenantRequest counts a request by tenant and how it was answered.
+// Requests without a tenant are counted as none.
+func (p *HTTPCacheProxy) recordTenantRequest(r *http.Request, result string) {
+	if p.opts.TenantLabels == nil {
+		return
+	}
+	tenant := p.tenantID(r)
+	switch {
+	case tenant == "":
+		tenant = "none"
+	case p.opts.TenantLabelHash:
+		sum := sha256.Sum256([]byte(tenant))
+		tenant = p.opts.TenantLabels.Label(hex.EncodeToString(sum[:8]))
+	default:
+		tenant = p.opts.TenantLabels.Label(tenant)
+	}
+	p.metrics.RecordTenantRequest(tenant, result)
+}
+
+// checkCost rejects or clamps requests exceeding their query limits before
+// the cache key is computed. Returns true if the request was rejected.
+func (p *HTTPCacheProxy) checkCost(w http.ResponseWriter, r *http.Request) bool {
+	// Limits apply to PromQL queries, Loki enforces its own
+	limits := p.queryLimits(r)
+	if isLoki(r.URL.Path) || limits.MaxPoints <= 0 && limits.MaxRange <= 0 {
+		return false
+	}
+
+	params, err := requestParams(r)
+	if err != nil {
+		writeParamsError(w, err)
+		return true
+	}
+	start, hasStart := parseTime(params.Get("start"))
+	end, hasEnd := parseTime(params.Get("end"))
+	if !hasStart || !hasEnd || end < start {
+		return false
+	}
+
+	changes := url.Values{}
+	if maxRange := limits.MaxRange.Seconds(); maxRange > 0 && end-start > maxRange {
+		if p.opts.LimitAction != LimitClamp {
+			p.rejectCost(w, r, fmt.Sprintf("query range %s exceeds the limit of %s",
+				time.Duration((end-start)*float64(time.Second)), limits.MaxRange))
+			return true
+		}
+		start = end - maxRange
+		changes.Set("start", formatTime(start))
+	}
+
+	step, hasStep := parseDuration(params.Get("step"))
+	if limits.MaxPoints > 0 && hasStep && r.URL.Path == "/api/v1/query_range" {
+		points := math.Floor((end-start)/step.Seconds()) + 1
+		if points > float64(limits.MaxPoints) {
+			if p.opts.LimitAction != LimitClamp {
+				p.rejectCost(w, r, fmt.Sprintf("query resolution of %.0f points per series exceeds the limit of %d, increase the step",
+					points, limits.MaxPoints))
+				return true
+			}
+			seconds := math.Ceil((end - start) / float64(max(limits.MaxPoints-1, 1)))
+			changes.Set("step", strconv.FormatFloat(seconds, 'f', -1, 64))
+		}
+	}
+
+	if len(changes) > 0 {
+		traceStep(r, "cost_clamped", changes.Encode())
+		p.log.DebugContext(r.Context(), "Clamped query to limits",
+			"path", r.URL.Path,
+			"changes", changes.Encode())
+		if err := rewriteParams(r, changes); err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return true
+		}
+	}
+	return false
+}
+
+// rejectCost responds to a request exceeding its limits
+func (p *HTTPCacheProxy) rejectCost(w http.ResponseWriter, r *http.Request, reason string) {
+	p.log.InfoContext(r.Context(), "Query rejected by limits",
+		"path", r.URL.Path,
+		"tenant", p.tenantID(r),
+		"reason", reason)
+	traceStep(r, "cost_rejected", reason)
+	http.Error(w, "Query exceeds limits: "+reason, http.StatusBadRequest)
+}
+
+// rewriteParams replaces the given parameters of r in its query string and,
+// for form posts, in its body
+func rewriteParams(r *http.Request, changes url.Values) error {
+	query := r.URL.Query()
+	form := url.Values{}
+	isForm := false
+	if isFormPost(r) {
+		params, err := requestParams(r)
+		if err != nil {
+			return err
+		}
+		isForm = true
+		for k, v := range params {
+			if _, inQuery := query[k]; !inQuery {
+				form[k] = v
+			}
+		}
+	}
+
+	for k, v := range changes {
+		if _, inForm := form[k]; inForm {
+			form[k] = v
+		} else {
+			query[k] = v
+		}
+	}
+
+	r.URL.RawQuery = query.Encode()
+	if isForm {
+		body := form.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return nil
+}
+
+// parseTime parses a time parameter the way the Prometheus API does, either
+// as a Unix timestamp or in RFC 3339 format, into Unix seconds
+func parseTime(s string) (float64, bool) {
+	if value, err := strconv.ParseFloat(s, 64); err == nil {
+		return value, true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return float64(t.UnixNano()) / 1e9, true
+	}
+	return 0, false
+}
+
+// formatTime formats Unix seconds as a time parameter
+func formatTime(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', -1, 64)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/f0o/promcache/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRecordTenantRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    bool
+		tenants []string
+		want    map[string]float64
+	}{
+		{
+			name:    "limit",
+			tenants: []string{"team-a", "team-b", "team-c", "", "team-a"},
+			want:    map[string]float64{"team-a": 2, "team-b": 1, "other": 1, "none": 1},
+		},
+		{
+			name:    "hashed",
+			hash:    true,
+			tenants: []string{"team-a", "team-a"},
+			want:    map[string]float64{"96c2886c51d1dfb4": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			p := &HTTPCacheProxy{
+				opts: Options{
+					TenantHeader:    "X-Scope-OrgID",
+					TenantLabels:    NewLabelLimiter(2),
+					TenantLabelHash: tt.hash,
+				},
+				metrics: metrics.New(reg, metrics.Options{}),
+			}
+			for _, tenant := range tt.tenants {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+				if tenant != "" {
+					r.Header.Set("X-Scope-OrgID", tenant)
+				}
+				p.recordTenantRequest(r, "hit")
+			}
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]float64)
+			for _, family := range families {
+				if family.GetName() != "promcache_tenant_requests_total" {
+					continue
+				}
+				for _, metric := range family.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						if label.GetName() == "tenant" {
+							got[label.GetValue()] = metric.GetCounter().GetValue()
+						}
+					}
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("promcache_tenant_requests_total = %v, want %v", got, tt.want)
+			}
+			for tenant, n := range tt.want {
+				if got[tenant] != n {
+					t.Errorf("promcache_tenant_requests_total = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dnsPrefix marks upstream URLs whose host is re-resolved periodically,
+	// e.g. dns+http://prometheus.monitoring.svc:9090
+	dnsPrefix = "dns+"
+	// kubernetesPrefix marks upstream URLs whose host names a Kubernetes
+	// service whose endpoints are watched, e.g.
+	// k8s+http://prometheus-operated.monitoring:9090
+	kubernetesPrefix = "k8s+"
+	// dnsRefreshInterval is how often discovered upstream hosts are
+	// re-resolved
+	dnsRefreshInterval = 30 * time.Second
+)
+
+// cutDiscoveryPrefix removes the discovery prefix of an upstream URL and
+// returns the discovery mechanism, empty if none
+func cutDiscoveryPrefix(upstreamURL string) (string, string) {
+	for _, prefix := range []string{dnsPrefix, kubernetesPrefix} {
+		if rest, found := strings.CutPrefix(upstreamURL, prefix); found {
+			return rest, strings.TrimSuffix(prefix, "+")
+		}
+	}
+	return upstreamURL, ""
+}
+
+// upstreamResolver tracks the addresses of an upstream host and hands them
+// out round-robin
+type upstreamResolver struct {
+	host      string
+	addrs     atomic.Pointer[[]string]
+	next      atomic.Uint64
+	transport *http.Transport
+	log       *slog.Logger
+}
+
+// discoverUpstream makes client spread its connections to the host of
+// upstreamURL across all of the host's addresses, discovered through DNS
+// or the Kubernetes API. Idle connections are closed when the addresses
+// change, so scaling events are picked up without restarts. Returns nil if
+// discovery couldn't be set up.
+func discoverUpstream(client *http.Client, upstreamURL string, mechanism string, log *slog.Logger) *upstreamResolver {
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil || upstream.Hostname() == "" {
+		log.Error("Invalid upstream URL for discovery", "upstream", upstreamURL)
+		return nil
+	}
+
+	r := &upstreamResolver{
+		host:      upstream.Hostname(),
+		transport: client.Transport.(*http.Transport),
+		log:       log,
+	}
+	switch mechanism {
+	case "dns":
+		r.resolve()
+		go func() {
+			ticker := time.NewTicker(dnsRefreshInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				r.resolve()
+			}
+		}()
+	case "k8s":
+		watcher, err := newKubernetesWatcher(r.host, log)
+		if err != nil {
+			log.Error("Failed to set up Kubernetes discovery", "upstream", upstreamURL, "error", err)
+			return nil
+		}
+		go watcher.run(r.update)
+	}
+
+	dial := r.transport.DialContext
+	r.transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil && host == r.host {
+			if ip, ok := r.pick(); ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+	return r
+}
+
+// resolve resolves the host again, keeping the known addresses on errors
+func (r *upstreamResolver) resolve() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, r.host)
+	if err != nil {
+		r.log.Warn("Failed to resolve upstream", "host", r.host, "error", err)
+		return
+	}
+	r.update(addrs)
+}
+
+// update replaces the addresses, closing idle connections to the previous
+// ones if they changed
+func (r *upstreamResolver) update(addrs []string) {
+	addrs = slices.Clone(addrs)
+	slices.Sort(addrs)
+
+	old := r.addrs.Load()
+	if old != nil && slices.Equal(*old, addrs) {
+		return
+	}
+	r.addrs.Store(&addrs)
+	r.log.Info("Upstream addresses changed", "host", r.host, "addrs", addrs)
+	if old != nil {
+		r.transport.CloseIdleConnections()
+	}
+}
+
+// pick returns the next address, false if none is known
+func (r *upstreamResolver) pick() (string, bool) {
+	addrs := r.addrs.Load()
+	if addrs == nil || len(*addrs) == 0 {
+		return "", false
+	}
+	return (*addrs)[r.next.Add(1)%uint64(len(*addrs))], true
+}
+
+// pickPair returns the next address and the one after it, false if fewer
+// than two addresses are known
+func (r *upstreamResolver) pickPair() (string, string, bool) {
+	addrs := r.addrs.Load()
+	if addrs == nil || len(*addrs) < 2 {
+		return "", "", false
+	}
+	i := r.next.Add(1)
+	n := uint64(len(*addrs))
+	return (*addrs)[i%n], (*addrs)[(i+1)%n], true
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCutDiscoveryPrefix(t *testing.T) {
+	tests := []struct {
+		upstream  string
+		url       string
+		mechanism string
+	}{
+		{"dns+http://prometheus.monitoring.svc:9090", "http://prometheus.monitoring.svc:9090", "dns"},
+		{"k8s+https://prometheus-operated.monitoring:9090", "https://prometheus-operated.monitoring:9090", "k8s"},
+		{"http://prometheus:9090", "http://prometheus:9090", ""},
+	}
+	for _, tt := range tests {
+		url, mechanism := cutDiscoveryPrefix(tt.upstream)
+		if url != tt.url || mechanism != tt.mechanism {
+			t.Errorf("cutDiscoveryPrefix(%q) = %q, %q, want %q, %q", tt.upstream, url, mechanism, tt.url, tt.mechanism)
+		}
+	}
+}
+
+func TestResolverPick(t *testing.T) {
+	r := &upstreamResolver{host: "prometheus", transport: &http.Transport{}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if _, ok := r.pick(); ok {
+		t.Error("pick without addresses succeeded")
+	}
+	if _, _, ok := r.pickPair(); ok {
+		t.Error("pickPair without addresses succeeded")
+	}
+	r.update([]string{"10.0.0.2", "10.0.0.1"})
+
+	// Addresses are handed out round-robin
+	var picked []string
+	for range 4 {
+		addr, _ := r.pick()
+		picked = append(picked, addr)
+	}
+	if picked[0] == picked[1] || picked[0] != picked[2] || picked[1] != picked[3] {
+		t.Errorf("picked %v, want alternating addresses", picked)
+	}
+	if first, second, ok := r.pickPair(); !ok || first == second {
+		t.Errorf("pickPair = %q, %q, %v, want two different addresses", first, second, ok)
+	}
+}
+
+func TestResolverResolve(t *testing.T) {
+	r := &upstreamResolver{host: "localhost", transport: &http.Transport{}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	r.update([]string{"10.0.0.1"})
+
+	// Re-resolving replaces stale addresses
+	r.resolve()
+	if addrs := *r.addrs.Load(); !slices.Contains(addrs, "127.0.0.1") || slices.Contains(addrs, "10.0.0.1") {
+		t.Errorf("addresses after resolving = %v, want those of localhost", addrs)
+	}
+
+	// Failed lookups keep the known addresses
+	r.host = "promcache-test.invalid"
+	before := *r.addrs.Load()
+	r.resolve()
+	if addrs := *r.addrs.Load(); !slices.Equal(addrs, before) {
+		t.Errorf("addresses after a failed lookup = %v, want %v", addrs, before)
+	}
+}
+
+func TestDiscoverUpstream(t *testing.T) {
+	// Listen on all interfaces, so every loopback address reaches the server
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns atomic.Int64
+	remotes := make(chan string, 16)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		local, _, _ := strings.Cut(r.Context().Value(http.LocalAddrContextKey).(net.Addr).String(), ":")
+		if host != "prometheus.test" {
+			t.Errorf("Host = %q, want the upstream's host", r.Host)
+		}
+		remotes <- local
+	}))
+	upstream.Listener = listener
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	r := discoverUpstream(client, "http://prometheus.test:"+port, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if r == nil {
+		t.Fatal("discoverUpstream failed")
+	}
+	get := func() string {
+		t.Helper()
+		resp, err := client.Get("http://prometheus.test:" + port + "/api/v1/status/buildinfo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return <-remotes
+	}
+
+	r.update([]string{"127.0.0.1"})
+	if addr := get(); addr != "127.0.0.1" {
+		t.Errorf("connected to %s, want 127.0.0.1", addr)
+	}
+	// Unchanged addresses keep their connections
+	r.update([]string{"127.0.0.1"})
+	get()
+	if n := conns.Load(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+
+	// Scaling closes idle connections, new ones go to the new addresses
+	r.update([]string{"127.0.0.2"})
+	if addr := get(); addr != "127.0.0.2" {
+		t.Errorf("connected to %s after scaling, want 127.0.0.2", addr)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("connections = %d, want 2", n)
+	}
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Downsampling modes
+const (
+	// DownsamplePick takes the latest sample of each step
+	DownsamplePick = "pick"
+	// DownsampleAvg averages the samples of each step
+	DownsampleAvg = "avg"
+)
+
+// resolutionBucket returns the key grouping the cached range query
+// responses that only differ in their step
+func (p *HTTPCacheProxy) resolutionBucket(r *http.Request) string {
+	u := *r.URL
+	query := u.Query()
+	query.Del("step")
+	u.RawQuery = query.Encode()
+	stepless := *r
+	stepless.URL = &u
+	return p.storageKey("resolution:" + p.generateCacheKey(&stepless))
+}
+
+// indexResolution remembers the step of a cached range query response so
+// coarser requests can be downsampled from it
+func (p *HTTPCacheProxy) indexResolution(r *http.Request, cacheKey string) {
+	if p.opts.Downsample == "" || r.URL.Path != "/api/v1/query_range" {
+		return
+	}
+	step, ok := parseDuration(r.URL.Query().Get("step"))
+	if !ok {
+		return
+	}
+	p.resolutionIndex.add(p.resolutionBucket(r), cacheKey, map[string]float64{"step": step.Seconds()})
+}
+
+// tryServeDownsampled answers a range query from a cached response to the
+// same query at a finer step that evenly divides the requested one.
+// Returns true if the request was answered.
+func (p *HTTPCacheProxy) tryServeDownsampled(w http.ResponseWriter, r *http.Request) bool {
+	if p.opts.Downsample == "" || r.URL.Path != "/api/v1/query_range" {
+		return false
+	}
+	query := r.URL.Query()
+	step, hasStep := parseDuration(query.Get("step"))
+	start, hasStart := parseTime(query.Get("start"))
+	end, hasEnd := parseTime(query.Get("end"))
+	if !hasStep || !hasStart || !hasEnd || end < start {
+		return false
+	}
+	stepMs := step.Milliseconds()
+
+	// Prefer the coarsest usable resolution, it has the fewest samples
+	bucket := p.resolutionBucket(r)
+	entries := p.resolutionIndex.entries(bucket)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].times["step"] > entries[j].times["step"] })
+
+	for _, entry := range entries {
+		cachedMs := int64(math.Round(entry.times["step"] * 1000))
+		if cachedMs <= 0 || cachedMs >= stepMs || stepMs%cachedMs != 0 {
+			continue
+		}
+
+		data, found, _ := p.cacheGet(r.Context(), entry.key)
+		if !found {
+			p.resolutionIndex.remove(bucket, entry.key)
+			continue
+		}
+		var cachedResp Response
+		if err := decodeResponse(data, &cachedResp); err != nil {
+			continue
+		}
+		m, err := cachedMatrix(&cachedResp)
+		if err != nil {
+			continue
+		}
+		m.downsample(int64(math.Round(start*1000)), int64(math.Round(end*1000)), stepMs, p.opts.Downsample)
+		body, err := m.encode()
+		if err != nil {
+			continue
+		}
+
+		traceStep(r, "downsampled", time.Duration(cachedMs*int64(time.Millisecond)).String())
+		p.log.DebugContext(r.Context(), "Serving downsampled response",
+			"path", r.URL.Path,
+			"cached_step", cachedMs,
+			"step", stepMs)
+		p.metrics.RecordCacheHit()
+		p.metrics.RecordHierarchyRequest("local")
+		p.recordHit(r, entry.key)
+		p.recordDashboardRequest(r, "hit")
+
+		for name, values := range cachedResp.Headers {
+			if name != "Content-Length" && name != "Etag" {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("ETag", computeETag(body))
+		w.Header().Add("Via", p.viaValue(r))
+		p.setCacheStatus(w, "HIT", "")
+		if !cachedResp.StoredAt.IsZero() {
+			age := strconv.FormatInt(int64(max(time.Since(cachedResp.StoredAt), 0).Seconds()), 10)
+			w.Header().Set("Age", age)
+			w.Header().Set("X-Cache-Age", age)
+		}
+		if writeNotModified(w, r) {
+			return true
+		}
+		writeBody(w, r, cachedResp.StatusCode, body)
+		return true
+	}
+	return false
+}
+
+// downsample resamples every series at the given step from start to end,
+// all in milliseconds. Each output point summarizes the samples after the
+// previous point up to and including its own timestamp; points without
+// samples are left out, like Prometheus leaves out evaluations without
+// data.
+func (m *matrix) downsample(start, end, step int64, mode string) {
+	kept := m.series[:0]
+	for _, s := range m.series {
+		s.Values = downsampleValues(s.Values, start, end, step, mode)
+		s.Histograms = downsampleHistograms(s.Histograms, start, end, step, mode)
+		if len(s.Values) > 0 || len(s.Histograms) > 0 {
+			kept = append(kept, s)
+		}
+	}
+	m.series = kept
+}
+
+// downsampleValues resamples float samples
+func downsampleValues(samples []matrixSample, start, end, step int64, mode string) []matrixSample {
+	var out []matrixSample
+	i := 0
+	for t := start; t <= end; t += step {
+		// Skip samples before the window (t-step, t]
+		for i < len(samples) && samples[i].T <= t-step {
+			i++
+		}
+		j := i
+		for j < len(samples) && samples[j].T <= t {
+			j++
+		}
+		if j == i {
+			continue
+		}
+
+		window := samples[i:j]
+		if mode != DownsampleAvg {
+			out = append(out, matrixSample{T: t, V: window[len(window)-1].V})
+			continue
+		}
+		sum := 0.0
+		for _, sample := range window {
+			sum += sample.V
+		}
+		out = append(out, matrixSample{T: t, V: sum / float64(len(window))})
+	}
+	return out
+}
+
+// downsampleHistograms resamples native histogram samples. Histograms are
+// averaged bucket by bucket when their layouts allow it and picked
+// otherwise.
+func downsampleHistograms(samples []histogramSample, start, end, step int64, mode string) []histogramSample {
+	var out []histogramSample
+	i := 0
+	for t := start; t <= end; t += step {
+		for i < len(samples) && samples[i].T <= t-step {
+			i++
+		}
+		j := i
+		for j < len(samples) && samples[j].T <= t {
+			j++
+		}
+		if j == i {
+			continue
+		}
+
+		h := samples[j-1].H
+		if mode == DownsampleAvg && j-i > 1 {
+			if avg, ok := averageHistograms(samples[i:j]); ok {
+				h = avg
+			}
+		}
+		out = append(out, histogramSample{T: t, H: h})
+	}
+	return out
+}
+
+// formatSampleValue formats a sample value the way Prometheus does
+func formatSampleValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownsampleValues(t *testing.T) {
+	// Samples every 15s valued by their index
+	var samples []matrixSample
+	for i := range 9 {
+		samples = append(samples, matrixSample{T: int64(i) * 15000, V: float64(i)})
+	}
+	gappy := []matrixSample{{T: 0, V: 1}, {T: 120000, V: 2}}
+
+	tests := []struct {
+		name             string
+		samples          []matrixSample
+		start, end, step int64
+		mode             string
+		want             []matrixSample
+	}{
+		{
+			name: "pick", samples: samples, start: 0, end: 120000, step: 60000, mode: DownsamplePick,
+			want: []matrixSample{{T: 0, V: 0}, {T: 60000, V: 4}, {T: 120000, V: 8}},
+		},
+		{
+			name: "avg", samples: samples, start: 0, end: 120000, step: 60000, mode: DownsampleAvg,
+			want: []matrixSample{{T: 0, V: 0}, {T: 60000, V: 2.5}, {T: 120000, V: 6.5}},
+		},
+		{
+			// Each sample still lands in exactly one window
+			name: "misaligned pick", samples: samples, start: 10000, end: 130000, step: 60000, mode: DownsamplePick,
+			want: []matrixSample{{T: 10000, V: 0}, {T: 70000, V: 4}, {T: 130000, V: 8}},
+		},
+		{
+			name: "misaligned avg", samples: samples, start: 10000, end: 130000, step: 60000, mode: DownsampleAvg,
+			want: []matrixSample{{T: 10000, V: 0}, {T: 70000, V: 2.5}, {T: 130000, V: 6.5}},
+		},
+		{
+			name: "uneven step", samples: samples, start: 0, end: 120000, step: 45000, mode: DownsamplePick,
+			want: []matrixSample{{T: 0, V: 0}, {T: 45000, V: 3}, {T: 90000, V: 6}},
+		},
+		{
+			name: "gap", samples: gappy, start: 0, end: 120000, step: 60000, mode: DownsampleAvg,
+			want: []matrixSample{{T: 0, V: 1}, {T: 120000, V: 2}},
+		},
+		{
+			name: "outside range", samples: samples, start: 300000, end: 360000, step: 60000, mode: DownsamplePick,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := downsampleValues(tt.samples, tt.start, tt.end, tt.step, tt.mode)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("downsampleValues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeDownsampled(t *testing.T) {
+	// A start divisible by the test's TTL, so time alignment is a no-op
+	const base = 1699999980
+	var values []string
+	for i := range 9 {
+		values = append(values, fmt.Sprintf(`[%d,"%d"]`, base+15*i, i))
+	}
+	fine := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[` +
+		strings.Join(values, ",") + `]}]}}`
+
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, fine)
+	}))
+	defer upstream.Close()
+
+	p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{Downsample: DownsamplePick})
+	get := func(start, end int64, step string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		target := fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=%s", start, end, step)
+		p.HandleRequest(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	matrixBody := func(samples ...string) string {
+		return `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[` +
+			strings.Join(samples, ",") + `]}]}}`
+	}
+
+	if w := get(base, base+120, "15"); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("X-Cache of the fine step = %q, want MISS", w.Header().Get("X-Cache"))
+	}
+
+	tests := []struct {
+		name       string
+		start, end int64
+		step       string
+		body       string
+	}{
+		{
+			name: "aligned", start: base, end: base + 120, step: "60",
+			body: matrixBody(fmt.Sprintf(`[%d,"0"]`, base), fmt.Sprintf(`[%d,"4"]`, base+60), fmt.Sprintf(`[%d,"8"]`, base+120)),
+		},
+		{
+			// Within the TTL boundaries of the cached range, so in its bucket
+			name: "misaligned", start: base + 10, end: base + 110, step: "1m",
+			body: matrixBody(fmt.Sprintf(`[%d,"0"]`, base+10), fmt.Sprintf(`[%d,"4"]`, base+70)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.start, tt.end, tt.step)
+			if got := w.Header().Get("X-Cache"); got != "HIT" {
+				t.Errorf("X-Cache = %q, want HIT", got)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body =\n%s\nwant\n%s", w.Body.String(), tt.body)
+			}
+			if etag := w.Header().Get("ETag"); etag != computeETag(w.Body.Bytes()) {
+				t.Errorf("ETag = %s, want the ETag of the downsampled body", etag)
+			}
+		})
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+
+	// Steps the cached step doesn't divide go upstream
+	if w := get(base, base+120, "20"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache of an indivisible step = %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// decodeBody returns the identity-encoded form of an upstream response body.
+// Gzip-encoded bodies are decompressed and the encoding headers are removed
+// from the given header so the canonical body can be cached and re-encoded
+// per client later on. Snappy-encoded remote read responses are kept as-is
+// since clients always expect them snappy-encoded.
+func decodeBody(header http.Header, body []byte) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		header.Del("Content-Encoding")
+		return body, nil
+	case "gzip", "x-gzip":
+		decoded, err := decompressBody(body)
+		if err != nil {
+			return nil, err
+		}
+
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		return decoded, nil
+	case "snappy":
+		return body, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// compressBody returns the gzip-compressed form of body
+func compressBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBody returns the decompressed form of a gzip-compressed body
+func decompressBody(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// acceptsGzip reports whether the client advertised gzip support in its
+// Accept-Encoding header with a non-zero quality value
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+
+			q := 1.0
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+			if q > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeBody writes the status code and body to the client, compressing the
+// body on the fly when the client accepts gzip
+func writeBody(w http.ResponseWriter, r *http.Request, statusCode int, body []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// HEAD responses carry the headers of the identity-encoded body only
+	if r.Method == http.MethodHead {
+		w.Header().Del("Content-Encoding")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	// Bodies in their own encoding such as snappy are passed through
+	if len(body) == 0 || !acceptsGzip(r) || w.Header().Get("Content-Encoding") != "" {
+		w.WriteHeader(statusCode)
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	setGzipETag(w.Header())
+	w.WriteHeader(statusCode)
+
+	zw := gzip.NewWriter(w)
+	zw.Write(body)
+	zw.Close()
+}
+
+// writeCompressedBody writes an already gzip-compressed body to the client,
+// passing it through as-is when the client accepts gzip and decompressing it
+// otherwise
+func writeCompressedBody(w http.ResponseWriter, r *http.Request, statusCode int, body []byte) {
+	if !acceptsGzip(r) || r.Method == http.MethodHead {
+		decoded, err := decompressBody(body)
+		if err != nil {
+			http.Error(w, "Failed to decompress cached response", http.StatusInternalServerError)
+			return
+		}
+		writeBody(w, r, statusCode, decoded)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	setGzipETag(w.Header())
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
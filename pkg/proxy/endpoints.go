@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// federatePath is the path of Prometheus' federation endpoint
+const federatePath = "/federate"
+
+// isFederate reports whether path is the federation endpoint, which serves
+// the text exposition format rather than API JSON
+func isFederate(path string) bool {
+	return path == federatePath
+}
+
+// isMetadataEndpoint reports whether path is an endpoint returning metric
+// metadata, which changes far less often than the samples
+func isMetadataEndpoint(path string) bool {
+	return path == "/api/v1/metadata" || path == "/api/v1/targets/metadata"
+}
+
+// metadataParams are the filter parameters of the metadata endpoints, for
+// which an empty value is the same as leaving them out
+var metadataParams = []string{"metric", "match_target", "limit", "limit_per_metric"}
+
+// isRulesEndpoint reports whether path is an endpoint returning rule or
+// alert state, which changes with every rule evaluation
+func isRulesEndpoint(path string) bool {
+	return path == "/api/v1/rules" || path == "/api/v1/alerts"
+}
+
+// ruleListParams are the list filter parameters of the rules endpoint, which
+// match in any order
+var ruleListParams = []string{"rule_name[]", "rule_group[]", "file[]", "match[]"}
+
+// endpointTTL returns the TTL of responses of the endpoint at path, the
+// cache TTL unless the endpoint has its own
+func (p *HTTPCacheProxy) endpointTTL(path string) time.Duration {
+	switch {
+	case isFederate(path) && p.opts.FederateTTL > 0:
+		return p.opts.FederateTTL
+	case isMetadataEndpoint(path) && p.opts.MetadataTTL > 0:
+		return p.opts.MetadataTTL
+	case isRulesEndpoint(path) && p.opts.RulesTTL > 0:
+		return p.opts.RulesTTL
+	}
+	return p.cacheTTL
+}
+
+// normalizeEndpointParams rewrites endpoint-specific parameters of query
+// into a canonical form so equivalent requests share a cache key
+func normalizeEndpointParams(path string, query url.Values) {
+	if isLoki(path) {
+		normalizeLokiParams(query)
+		return
+	}
+	normalizeThanosParams(query)
+
+	if isFederate(path) {
+		// Federation scrapers list the same selectors in arbitrary order,
+		// and duplicates select nothing more
+		if matches, found := query["match[]"]; found {
+			query["match[]"] = uniqueTrimmed(matches)
+		}
+	}
+
+	if isMetadataEndpoint(path) {
+		for _, name := range metadataParams {
+			if value := strings.TrimSpace(query.Get(name)); value != "" {
+				query.Set(name, value)
+			} else {
+				query.Del(name)
+			}
+		}
+	}
+
+	if isRulesEndpoint(path) {
+		for _, name := range ruleListParams {
+			if values, found := query[name]; found {
+				query[name] = uniqueTrimmed(values)
+			}
+		}
+		// Prometheus matches the rule type case-insensitively
+		if ruleType := strings.ToLower(strings.TrimSpace(query.Get("type"))); ruleType != "" {
+			query.Set("type", ruleType)
+		} else {
+			query.Del("type")
+		}
+	}
+
+	// Grafana's query builder sends the expression of exemplar queries
+	// as typed, surrounding whitespace included
+	if path == "/api/v1/query_exemplars" {
+		if expr := query.Get("query"); expr != "" {
+			query.Set("query", strings.TrimSpace(expr))
+		}
+	}
+}
+
+// uniqueTrimmed returns the sorted distinct values with surrounding
+// whitespace removed
+func uniqueTrimmed(values []string) []string {
+	unique := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
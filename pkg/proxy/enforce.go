@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// enforceLabel injects the required label matcher into every expression and
+// series selector of the request, the way prom-label-proxy does. Requests
+// without a label value are rejected. Returns true if the request was
+// rejected.
+func (p *HTTPCacheProxy) enforceLabel(w http.ResponseWriter, r *http.Request) bool {
+	if p.opts.EnforceLabel == "" {
+		return false
+	}
+
+	// Endpoints that can't be scoped to the label would leak other
+	// tenants' data
+	if !isQueryEndpoint(r.URL.Path) && !isSeriesEndpoint(r.URL.Path) {
+		http.Error(w, "Endpoint not available with label enforcement", http.StatusForbidden)
+		return true
+	}
+
+	value := p.enforcedLabelValue(r)
+	if value == "" {
+		p.log.InfoContext(r.Context(), "Rejecting request without label value",
+			"path", r.URL.Path,
+			"label", p.opts.EnforceLabel)
+		http.Error(w, "Missing value for label "+strconv.Quote(p.opts.EnforceLabel), http.StatusForbidden)
+		return true
+	}
+
+	params, err := requestParams(r)
+	if err != nil {
+		writeParamsError(w, err)
+		return true
+	}
+
+	changes := url.Values{}
+	if queries, found := params["query"]; found {
+		changes["query"] = injectAll(queries, p.opts.EnforceLabel, value)
+	}
+
+	// Metadata endpoints are scoped through series selectors, which are
+	// added when the client didn't send any
+	matches := params["match[]"]
+	if len(matches) == 0 && isSeriesEndpoint(r.URL.Path) {
+		matches = []string{"{}"}
+	}
+	if len(matches) > 0 {
+		changes["match[]"] = injectAll(matches, p.opts.EnforceLabel, value)
+	}
+
+	if len(changes) == 0 {
+		return false
+	}
+	traceStep(r, "label_enforced", p.opts.EnforceLabel+"="+value)
+	if err := rewriteParams(r, changes); err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+// enforcedLabelValue returns the value of the enforced label for r, the
+// authenticated tenant if any
+func (p *HTTPCacheProxy) enforcedLabelValue(r *http.Request) string {
+	if id, ok := IdentityFrom(r); ok && id.Tenant != "" {
+		return id.Tenant
+	}
+	if p.opts.EnforceLabelHeader != "" {
+		return r.Header.Get(p.opts.EnforceLabelHeader)
+	}
+	return p.tenantID(r)
+}
+
+// injectAll injects the label matcher into each of exprs
+func injectAll(exprs []string, name string, value string) []string {
+	injected := make([]string, len(exprs))
+	for i, expr := range exprs {
+		injected[i] = injectMatcher(expr, name, value)
+	}
+	return injected
+}
+
+// isQueryEndpoint reports whether path is an API endpoint evaluating a
+// PromQL expression passed in the query parameter
+func isQueryEndpoint(path string) bool {
+	switch path {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/query_exemplars":
+		return true
+	}
+	return false
+}
+
+// isSeriesEndpoint reports whether path is an API endpoint selecting series
+// through match[] parameters
+func isSeriesEndpoint(path string) bool {
+	switch path {
+	case "/api/v1/series", "/api/v1/labels":
+		return true
+	}
+	return strings.HasPrefix(path, "/api/v1/label/") && strings.HasSuffix(path, "/values")
+}
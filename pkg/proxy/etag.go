@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// computeETag returns a strong ETag for the identity-encoded body
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// gzipETagSuffix marks the strong ETag of a body the proxy gzip-compressed,
+// which is a different representation than the identity-encoded body
+const gzipETagSuffix = "-gzip"
+
+// setGzipETag rewrites a strong ETag to the one of the gzip-encoded
+// representation. Weak ETags already allow other encodings.
+func setGzipETag(h http.Header) {
+	etag := h.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return
+	}
+	h.Set("ETag", strings.TrimSuffix(etag, `"`)+gzipETagSuffix+`"`)
+}
+
+// weakenETag rewrites a strong ETag to a weak one, for bodies that are
+// served semantically equivalent but not byte for byte identical
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// etagMatches reports whether the request's If-None-Match header matches
+// the given ETag. Per RFC 7232 the weak comparison function is used, and the
+// ETags of the identity and gzip-encoded representations match each other.
+func etagMatches(r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = stripGzipETag(strings.TrimPrefix(etag, "W/"))
+
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || stripGzipETag(strings.TrimPrefix(candidate, "W/")) == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripGzipETag returns the identity ETag of a gzip-encoded representation
+func stripGzipETag(etag string) string {
+	if trimmed, ok := strings.CutSuffix(etag, gzipETagSuffix+`"`); ok {
+		return trimmed + `"`
+	}
+	return etag
+}
+
+// writeNotModified responds with 304 Not Modified if the client already has
+// the current representation. Returns true if the response was written.
+func writeNotModified(w http.ResponseWriter, r *http.Request) bool {
+	if !etagMatches(r, w.Header().Get("ETag")) {
+		return false
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteBodyETagPerEncoding(t *testing.T) {
+	body := []byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	etag := computeETag(body)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{"identity", "", etag},
+		{"gzip", "gzip", etag[:len(etag)-1] + `-gzip"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set("ETag", etag)
+			writeBody(w, r, http.StatusOK, body)
+			if got := w.Header().Get("ETag"); got != tt.want {
+				t.Errorf("ETag = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := `"abc"`
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{`"abc"`, true},
+		{`"abc-gzip"`, true},
+		{`W/"abc"`, true},
+		{`"other", "abc-gzip"`, true},
+		{`*`, true},
+		{`"abcd"`, false},
+		{`"other-gzip"`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set("If-None-Match", tt.ifNoneMatch)
+		if got := etagMatches(r, etag); got != tt.want {
+			t.Errorf("etagMatches(%s) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// timeParameters are the query parameters holding evaluation times
+var timeParameters = []string{"time", "start", "end"}
+
+// maxEntriesPerBucket bounds the number of evaluation times remembered per
+// query in exact-time mode
+const maxEntriesPerBucket = 32
+
+// timedEntry is a cache key together with the evaluation times it was
+// stored for
+type timedEntry struct {
+	key    string
+	times  map[string]float64
+	stored time.Time
+}
+
+// timeIndex maps queries, keyed without their time parameters, to the
+// cache keys stored for concrete evaluation times. It lets exact-time mode
+// find a cached response evaluated close enough to the requested time.
+type timeIndex struct {
+	mu      sync.Mutex
+	buckets map[string][]timedEntry
+	maxAge  time.Duration
+}
+
+// newTimeIndex creates an empty time index whose entries are forgotten after
+// maxAge, matching the lifetime of the cache entries they point to
+func newTimeIndex(maxAge time.Duration) *timeIndex {
+	return &timeIndex{
+		buckets: make(map[string][]timedEntry),
+		maxAge:  maxAge,
+	}
+}
+
+// startCleanup periodically removes entries older than maxAge
+func (t *timeIndex) startCleanup() {
+	if t.maxAge <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(t.maxAge)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.cleanup()
+	}
+}
+
+// cleanup removes entries older than maxAge
+func (t *timeIndex) cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.maxAge)
+	for bucket, entries := range t.buckets {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.stored.After(cutoff) {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.buckets, bucket)
+		} else {
+			t.buckets[bucket] = kept
+		}
+	}
+}
+
+// add remembers the cache key stored for the given evaluation times
+func (t *timeIndex) add(bucket string, key string, times map[string]float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := t.buckets[bucket]
+	for i, entry := range entries {
+		if entry.key == key {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	entries = append(entries, timedEntry{key: key, times: times, stored: time.Now()})
+	if len(entries) > maxEntriesPerBucket {
+		entries = entries[len(entries)-maxEntriesPerBucket:]
+	}
+	t.buckets[bucket] = entries
+}
+
+// entries returns a copy of the entries of a bucket
+func (t *timeIndex) entries(bucket string) []timedEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]timedEntry(nil), t.buckets[bucket]...)
+}
+
+// remove forgets a cache key, typically because its entry expired
+func (t *timeIndex) remove(bucket string, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := t.buckets[bucket]
+	for i, entry := range entries {
+		if entry.key == key {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(t.buckets, bucket)
+		return
+	}
+	t.buckets[bucket] = entries
+}
+
+// find returns the cache keys whose evaluation times are all within budget
+// of the requested times, closest first
+func (t *timeIndex) find(bucket string, times map[string]float64, budget time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	type candidate struct {
+		key      string
+		distance float64
+	}
+	var candidates []candidate
+
+	for _, entry := range t.buckets[bucket] {
+		if len(entry.times) != len(times) {
+			continue
+		}
+
+		distance := 0.0
+		matches := true
+		for param, requested := range times {
+			stored, ok := entry.times[param]
+			delta := math.Abs(stored - requested)
+			if !ok || delta > budget.Seconds() {
+				matches = false
+				break
+			}
+			distance = max(distance, delta)
+		}
+		if matches {
+			candidates = append(candidates, candidate{key: entry.key, distance: distance})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	keys := make([]string, len(candidates))
+	for i, c := range candidates {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// requestTimes returns the evaluation time parameters of a request. The
+// current time is used for instant queries without an explicit time.
+func requestTimes(query url.Values, path string) map[string]float64 {
+	times := make(map[string]float64)
+	for _, param := range timeParameters {
+		if value, ok := parseTime(query.Get(param)); ok {
+			times[param] = value
+		}
+	}
+
+	if len(times) == 0 && path == "/api/v1/query" {
+		times["time"] = float64(time.Now().UnixNano()) / 1e9
+	}
+	return times
+}
+
+// bucketKey creates a cache key for the request that ignores its time
+// parameters, grouping all evaluations of the same query
+func (p *HTTPCacheProxy) bucketKey(r *http.Request) string {
+	query := r.URL.Query()
+	for _, param := range timeParameters {
+		query.Del(param)
+	}
+	return p.storageKey(keyNamespace(r) + cacheMethod(r) + ":" + r.URL.Path + ":" + p.normalizeQueryString(query))
+}
+
+// tryServeWithinBudget serves a cached response evaluated within the
+// freshness budget of the requested times. Returns true if successful.
+func (p *HTTPCacheProxy) tryServeWithinBudget(w http.ResponseWriter, r *http.Request) bool {
+	bucket := p.bucketKey(r)
+	times := requestTimes(r.URL.Query(), r.URL.Path)
+
+	for _, key := range p.timeIndex.find(bucket, times, p.opts.FreshnessBudget) {
+		if p.tryServeCachedResponse(w, r, key) {
+			return true
+		}
+		p.timeIndex.remove(bucket, key)
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// isRecent reports whether a query asks for data within the minimum
+// cacheable age: its end or evaluation time lies less than that before
+// now. Instant queries without a time are evaluated now.
+func (p *HTTPCacheProxy) isRecent(r *http.Request) bool {
+	if p.opts.MinCacheableAge <= 0 || isLoki(r.URL.Path) {
+		return false
+	}
+	query := r.URL.Query()
+	param := query.Get("end")
+	if r.URL.Path == "/api/v1/query" {
+		if param = query.Get("time"); param == "" {
+			return true
+		}
+	}
+	t, ok := parseTime(param)
+	if !ok {
+		return false
+	}
+	return time.Since(time.UnixMilli(int64(t*1000))) < p.opts.MinCacheableAge
+}
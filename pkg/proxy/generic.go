@@ -0,0 +1,449 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// genericVaryPrefix prefixes the stored values of the request headers a
+// cached generic response varies on. They are never sent to clients.
+const genericVaryPrefix = "X-Promcache-Vary-"
+
+// heuristicFraction is the share of the time since a response was last
+// modified it stays fresh when the upstream sets no lifetime
+const heuristicFraction = 0.1
+
+// heuristicStatus are the status codes cacheable without an explicit
+// lifetime
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// HandleGeneric serves requests to arbitrary read-only upstream paths as an
+// RFC 7234 HTTP cache, unlike HandleRequest which knows the Prometheus API.
+// Freshness is taken from the upstream's headers, stale entries are
+// revalidated with their validators, responses are matched on their Vary
+// headers and clients may bypass the cache with Cache-Control.
+func (p *HTTPCacheProxy) HandleGeneric(w http.ResponseWriter, r *http.Request) {
+	// Record internal steps in a response header when debugging
+	if p.opts.DebugTrace {
+		var trace *Trace
+		r, trace = withTrace(r)
+		w = &traceWriter{ResponseWriter: w, trace: trace}
+	}
+
+	// Reject requests looping back through promcached
+	if p.checkLoop(w, r) {
+		return
+	}
+
+	// Time and size responses by how they were answered
+	startTime := time.Now()
+	sw := &sizeWriter{ResponseWriter: w}
+	w = sw
+	result := "uncacheable"
+	defer func() {
+		p.metrics.RecordResponse(result, time.Since(startTime).Seconds(), sw.size)
+	}()
+
+	key := p.storageKey(keyNamespace(r) + "GENERIC:" + r.URL.Path + ":" + r.URL.RawQuery)
+	traceStep(r, "cache_key", key)
+
+	// Unsafe methods invalidate the entry of their URL once they succeeded
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		resp, body, err := p.fetchGeneric(r, nil)
+		if err != nil {
+			p.writeGenericError(w, r, err)
+			return
+		}
+		if resp.StatusCode < http.StatusBadRequest {
+			traceStep(r, "cache_invalidate", key)
+			p.cache.Delete(r.Context(), key)
+		}
+		p.writeGeneric(w, r, resp.StatusCode, resp.Header, body, false, "MISS")
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header)
+	noCache := reqCC.has("no-cache") || (r.Header.Get("Cache-Control") == "" && r.Header.Get("Pragma") == "no-cache")
+	maxAge, hasMaxAge := reqCC.seconds("max-age")
+
+	cached, found := p.lookupGeneric(r, key)
+	if found {
+		age := cached.age()
+		fresh := age < cached.lifetime() && !parseCacheControl(cached.Headers).has("no-cache")
+		if fresh && !noCache && (!hasMaxAge || age <= maxAge) {
+			result = "hit"
+			p.metrics.RecordCacheHit()
+			traceStep(r, "cache_hit", key)
+			p.serveGeneric(w, r, cached, "HIT")
+			return
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		traceStep(r, "cache_miss", "only-if-cached")
+		http.Error(w, "Not cached", http.StatusGatewayTimeout)
+		return
+	}
+
+	// Revalidate stale entries instead of fetching them again
+	var validators http.Header
+	if found {
+		validators = cached.validators()
+	}
+	resp, body, err := p.fetchGeneric(r, validators)
+	if found && (err != nil || resp.StatusCode >= http.StatusInternalServerError) && !cached.mustRevalidate() && p.toggles.ServeStale() {
+		p.log.WarnContext(r.Context(), "Upstream failed, serving stale response",
+			"path", r.URL.Path,
+			"key", key)
+		result = "hit"
+		p.metrics.RecordCacheHit()
+		traceStep(r, "cache_stale", key)
+		p.serveGeneric(w, r, cached, "STALE")
+		return
+	}
+	if err != nil {
+		p.writeGenericError(w, r, err)
+		return
+	}
+	if found && validators != nil && resp.StatusCode == http.StatusNotModified {
+		cached.update(resp.Header)
+		if !reqCC.has("no-store") {
+			p.storeGeneric(r, key, cached)
+		}
+		result = "revalidated"
+		p.metrics.RecordCacheHit()
+		traceStep(r, "cache_revalidated", key)
+		p.serveGeneric(w, r, cached, "REVALIDATED")
+		return
+	}
+
+	result = "miss"
+	p.metrics.RecordCacheMiss()
+	traceStep(r, "cache_miss", key)
+	entry := &genericEntry{Response: Response{
+		Headers:    make(http.Header),
+		StatusCode: resp.StatusCode,
+		Body:       body,
+		StoredAt:   time.Now(),
+	}}
+	for name, values := range resp.Header {
+		entry.Headers[name] = values
+	}
+	if !reqCC.has("no-store") && p.isStorable(r, resp) {
+		for _, name := range varyHeaders(resp.Header) {
+			entry.Headers.Set(genericVaryPrefix+name, strings.Join(r.Header.Values(name), ", "))
+		}
+		traceStep(r, "cache_store", strconv.FormatBool(p.storeGeneric(r, key, entry)))
+	}
+	p.writeGeneric(w, r, resp.StatusCode, resp.Header, body, false, "MISS")
+}
+
+// genericEntry is a cached generic response
+type genericEntry struct {
+	Response
+}
+
+// age returns the current age of the entry: the age it had when received
+// plus the time since
+func (e *genericEntry) age() time.Duration {
+	return initialAge(e.Headers) + max(time.Since(e.StoredAt), 0)
+}
+
+// lifetime returns how long the entry is fresh after its Date: the
+// lifetime set by the upstream, or a share of the time since its last
+// modification for status codes cacheable by default
+func (e *genericEntry) lifetime() time.Duration {
+	if lifetime, ok := explicitLifetime(e.Headers); ok {
+		return lifetime
+	}
+	if !heuristicStatus[e.StatusCode] {
+		return 0
+	}
+	lastModified, err := http.ParseTime(e.Headers.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	date := e.StoredAt
+	if parsed, err := http.ParseTime(e.Headers.Get("Date")); err == nil {
+		date = parsed
+	}
+	return time.Duration(float64(max(date.Sub(lastModified), 0)) * heuristicFraction)
+}
+
+// mustRevalidate reports whether the entry must not be served stale
+func (e *genericEntry) mustRevalidate() bool {
+	cc := parseCacheControl(e.Headers)
+	return cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage") || cc.has("no-cache")
+}
+
+// validators returns the conditional request headers revalidating the
+// entry, nil if it has no validators
+func (e *genericEntry) validators() http.Header {
+	validators := make(http.Header)
+	if etag := e.Headers.Get("ETag"); etag != "" {
+		validators.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Headers.Get("Last-Modified"); lastModified != "" {
+		validators.Set("If-Modified-Since", lastModified)
+	}
+	if len(validators) == 0 {
+		return nil
+	}
+	return validators
+}
+
+// update replaces the headers of the entry by those of a 304 Not Modified
+// response revalidating it and restarts its age
+func (e *genericEntry) update(h http.Header) {
+	for name, values := range h {
+		switch name {
+		case "Content-Length", "Content-Encoding", "X-Cache":
+			continue
+		}
+		e.Headers[name] = values
+	}
+	if h.Get("Age") == "" {
+		e.Headers.Del("Age")
+	}
+	e.StoredAt = time.Now()
+}
+
+// varyHeaders returns the request headers named by the Vary headers of a
+// response. Accept-Encoding is left out, promcached encodes responses for
+// each client itself.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && name != "Accept-Encoding" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// isStorable reports whether the upstream response to r may be cached
+func (p *HTTPCacheProxy) isStorable(r *http.Request, resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") || resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if p.opts.MaxObjectBytes > 0 && resp.ContentLength > int64(p.opts.MaxObjectBytes) {
+		return false
+	}
+	for _, value := range resp.Header.Values("Vary") {
+		if strings.TrimSpace(value) == "*" {
+			return false
+		}
+	}
+
+	// Responses to authorized requests are private unless marked otherwise
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	_, explicit := explicitLifetime(resp.Header)
+	return explicit || cc.has("public") || heuristicStatus[resp.StatusCode]
+}
+
+// lookupGeneric returns the entry stored under key if it was stored for a
+// request with the same values of the headers it varies on
+func (p *HTTPCacheProxy) lookupGeneric(r *http.Request, key string) (*genericEntry, bool) {
+	data, found, _ := p.cacheGet(r.Context(), key)
+	if !found {
+		return nil, false
+	}
+	entry := &genericEntry{}
+	if err := decodeResponse(data, &entry.Response); err != nil {
+		p.log.ErrorContext(r.Context(), "Failed to unmarshal cached response",
+			"error", err,
+			"key", key)
+		return nil, false
+	}
+	for _, name := range varyHeaders(entry.Headers) {
+		if entry.Headers.Get(genericVaryPrefix+name) != strings.Join(r.Header.Values(name), ", ") {
+			traceStep(r, "cache_vary_mismatch", name)
+			return nil, false
+		}
+	}
+	return entry, true
+}
+
+// storeGeneric caches an entry for as long as it is fresh and the cache
+// TTL beyond, to revalidate it or answer with it while the upstream fails.
+// Returns true if it was stored.
+func (p *HTTPCacheProxy) storeGeneric(r *http.Request, key string, entry *genericEntry) bool {
+	fresh := entry.lifetime() - initialAge(entry.Headers)
+	if fresh <= 0 && entry.validators() == nil {
+		return false
+	}
+	ttl := max(fresh, 0) + p.cacheTTL
+	if p.opts.MaxObjectBytes > 0 && len(entry.Body) > p.opts.MaxObjectBytes {
+		p.metrics.RecordCacheSkippedTooLarge()
+		return false
+	}
+
+	stored := entry.Response
+	if p.opts.Compress && !entry.Compressed && len(entry.Body) >= p.opts.CompressMinBytes {
+		if compressed, err := compressBody(entry.Body); err == nil {
+			stored.Body = compressed
+			stored.Compressed = true
+		}
+	}
+	stored.Headers = make(http.Header, len(entry.Headers))
+	for name, values := range entry.Headers {
+		stored.Headers[name] = values
+	}
+	for _, name := range skipCacheHeaders {
+		if name != "Date" {
+			stored.Headers.Del(name)
+		}
+	}
+
+	data, err := encodeResponse(p.serializer, &stored)
+	if err != nil {
+		p.log.ErrorContext(r.Context(), "Failed to marshal response for caching",
+			"error", err,
+			"key", key)
+		return false
+	}
+	p.log.DebugContext(r.Context(), "Caching generic response",
+		"key", key,
+		"status", entry.StatusCode,
+		"size", len(entry.Body),
+		"ttl", ttl)
+	p.cacheSet(r.Context(), key, data, ttl)
+	return true
+}
+
+// serveGeneric answers r from a cached entry
+func (p *HTTPCacheProxy) serveGeneric(w http.ResponseWriter, r *http.Request, entry *genericEntry, status string) {
+	w.Header().Set("Age", strconv.FormatInt(int64(entry.age().Seconds()), 10))
+	p.writeGeneric(w, r, entry.StatusCode, entry.Headers, entry.Body, entry.Compressed, status)
+}
+
+// writeGeneric sends a generic response to the client, or 304 Not
+// Modified if the client's validators match it
+func (p *HTTPCacheProxy) writeGeneric(w http.ResponseWriter, r *http.Request, statusCode int, header http.Header, body []byte, compressed bool, status string) {
+	for name, values := range header {
+		if strings.HasPrefix(name, genericVaryPrefix) || (name == "Age" && w.Header().Get("Age") != "") {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Add("Via", p.viaValue(r))
+	p.setCacheStatus(w, status, header.Get("X-Cache"))
+
+	if statusCode == http.StatusOK && (r.Method == http.MethodGet || r.Method == http.MethodHead) && writeGenericNotModified(w, r) {
+		return
+	}
+	if compressed {
+		writeCompressedBody(w, r, statusCode, body)
+		return
+	}
+	writeBody(w, r, statusCode, body)
+}
+
+// writeGenericNotModified responds with 304 Not Modified if the client's
+// If-None-Match, or without one its If-Modified-Since, header matches the
+// response. Returns true if the response was written.
+func writeGenericNotModified(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("If-None-Match") != "" {
+		return writeNotModified(w, r)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil || lastModified.After(since) {
+		return false
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeGenericError responds to a failed upstream request
+func (p *HTTPCacheProxy) writeGenericError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errOverloaded) {
+		traceStep(r, "upstream_overloaded", err.Error())
+		p.writeOverloaded(w, 0)
+		return
+	}
+	p.log.ErrorContext(r.Context(), "Failed to forward request to upstream",
+		"error", err,
+		"path", r.URL.Path)
+	traceStep(r, "upstream_error", err.Error())
+	http.Error(w, "Failed to reach upstream server", http.StatusBadGateway)
+}
+
+// fetchGeneric sends r to the upstream with the given validators and
+// returns its response with the body read and decoded. Bodies in encodings
+// other than gzip are returned as sent, with their Content-Encoding.
+func (p *HTTPCacheProxy) fetchGeneric(r *http.Request, validators http.Header) (*http.Response, []byte, error) {
+	p.inflight.Add(1)
+	defer p.inflight.Done()
+
+	upstreamReq, err := p.prepareUpstreamRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Parameters of generic paths have no known meaning, never rewrite them
+	upstreamReq.URL.RawQuery = r.URL.RawQuery
+	for name, values := range validators {
+		upstreamReq.Header[name] = values
+	}
+
+	upstreamReq, cancel := p.withUpstreamTimeout(upstreamReq, r)
+	defer cancel()
+	release, _, err := p.acquireUpstream(upstreamReq.Context())
+	if err != nil && !errors.Is(err, errOverloaded) {
+		err = fmt.Errorf("%w: %w", errOverloaded, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	traceStep(r, "upstream_request", upstreamReq.URL.Redacted())
+	startTime := time.Now()
+	resp, err := p.client.Do(upstreamReq)
+	p.recordUpstreamLatency(r, resp, err, time.Since(startTime))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	release()
+	traceStep(r, "upstream_response", resp.Status)
+
+	if decoded, err := decodeBody(resp.Header, body); err == nil {
+		body = decoded
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGenericLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		want    time.Duration
+	}{
+		{"max-age", 200, map[string]string{"Cache-Control": "max-age=60"}, time.Minute},
+		{"s-maxage over max-age", 200, map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}, 2 * time.Minute},
+		{"expires", 200, map[string]string{"Date": date.Format(http.TimeFormat), "Expires": date.Add(time.Hour).Format(http.TimeFormat)}, time.Hour},
+		{"invalid expires", 200, map[string]string{"Expires": "0"}, 0},
+		{"heuristic", 200, map[string]string{"Date": date.Format(http.TimeFormat), "Last-Modified": date.Add(-10 * time.Hour).Format(http.TimeFormat)}, time.Hour},
+		{"heuristic of uncacheable status", 500, map[string]string{"Date": date.Format(http.TimeFormat), "Last-Modified": date.Add(-10 * time.Hour).Format(http.TimeFormat)}, 0},
+		{"no freshness", 200, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &genericEntry{Response{Headers: make(http.Header), StatusCode: tt.status, StoredAt: date}}
+			for name, value := range tt.headers {
+				e.Headers.Set(name, value)
+			}
+			if got := e.lifetime(); got != tt.want {
+				t.Errorf("lifetime() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenericAge(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      string
+		storedAt time.Duration
+		want     time.Duration
+	}{
+		{"fresh", "", 0, 0},
+		{"stored", "", -10 * time.Second, 10 * time.Second},
+		{"initial age", "30", -10 * time.Second, 40 * time.Second},
+		{"invalid age", "-5", 0, 0},
+		{"stored in the future", "", time.Minute, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &genericEntry{Response{Headers: make(http.Header), StoredAt: time.Now().Add(tt.storedAt)}}
+			if tt.age != "" {
+				e.Headers.Set("Age", tt.age)
+			}
+			if got := e.age().Round(time.Second); got != tt.want {
+				t.Errorf("age() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// genericUpstream is an upstream of generic paths whose responses the test
+// changes between requests
+type genericUpstream struct {
+	requests atomic.Int64
+	handler  atomic.Pointer[http.HandlerFunc]
+}
+
+func (u *genericUpstream) set(handler http.HandlerFunc) {
+	u.handler.Store(&handler)
+}
+
+func (u *genericUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.requests.Add(1)
+	(*u.handler.Load())(w, r)
+}
+
+// newGenericTest creates a proxy in front of a generic upstream and returns
+// a function making requests through HandleGeneric
+func newGenericTest(t *testing.T) (*genericUpstream, func(method string, headers ...string) *httptest.ResponseRecorder) {
+	t.Helper()
+	u := &genericUpstream{}
+	server := httptest.NewServer(u)
+	t.Cleanup(server.Close)
+
+	p := New(server.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	return u, func(method string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/static/app.js", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		p.HandleGeneric(w, r)
+		return w
+	}
+}
+
+func TestGenericRevalidation(t *testing.T) {
+	u, get := newGenericTest(t)
+	u.set(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "body")
+	})
+
+	if w := get(http.MethodGet); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request X-Cache = %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	w := get(http.MethodGet)
+	if w.Header().Get("X-Cache") != "REVALIDATED" || w.Body.String() != "body" {
+		t.Errorf("stale request X-Cache = %q with body %q, want REVALIDATED with the cached body", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if n := u.requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+}
+
+func TestGenericStaleOnError(t *testing.T) {
+	for _, cacheControl := range []string{"max-age=0", "max-age=0, must-revalidate"} {
+		t.Run(cacheControl, func(t *testing.T) {
+			u, get := newGenericTest(t)
+			u.set(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", cacheControl)
+				w.Header().Set("ETag", `"v1"`)
+				io.WriteString(w, "body")
+			})
+			get(http.MethodGet)
+
+			u.set(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "down", http.StatusBadGateway)
+			})
+			w := get(http.MethodGet)
+			mustRevalidate := strings.Contains(cacheControl, "must-revalidate")
+			if !mustRevalidate && (w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "body") {
+				t.Errorf("X-Cache = %q with body %q, want the STALE entry", w.Header().Get("X-Cache"), w.Body.String())
+			}
+			if mustRevalidate && w.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want the upstream's 502", w.Code)
+			}
+		})
+	}
+}
+
+func TestGenericVary(t *testing.T) {
+	u, get := newGenericTest(t)
+	u.set(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "X-Scope-OrgID, Accept-Encoding")
+		io.WriteString(w, "body of "+r.Header.Get("X-Scope-OrgID"))
+	})
+
+	tests := []struct {
+		tenant string
+		status string
+	}{
+		{"team-a", "MISS"},
+		{"team-a", "HIT"},
+		// The entry of the other tenant doesn't match
+		{"team-b", "MISS"},
+		{"team-b", "HIT"},
+	}
+	for i, tt := range tests {
+		w := get(http.MethodGet, "X-Scope-OrgID", tt.tenant)
+		if w.Header().Get("X-Cache") != tt.status || w.Body.String() != "body of "+tt.tenant {
+			t.Errorf("request %d X-Cache = %q with body %q, want %s for %s", i, w.Header().Get("X-Cache"), w.Body.String(), tt.status, tt.tenant)
+		}
+		if w.Header().Get(genericVaryPrefix+"X-Scope-Orgid") != "" {
+			t.Errorf("request %d exposes the stored Vary values", i)
+		}
+	}
+}
+
+func TestGenericOnlyIfCachedAndInvalidation(t *testing.T) {
+	u, get := newGenericTest(t)
+	u.set(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "body")
+	})
+
+	if w := get(http.MethodGet, "Cache-Control", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached miss status = %d, want 504", w.Code)
+	}
+	get(http.MethodGet)
+	if w := get(http.MethodGet, "Cache-Control", "only-if-cached"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("only-if-cached X-Cache = %q, want HIT", w.Header().Get("X-Cache"))
+	}
+
+	// A successful unsafe request invalidates the entry
+	get(http.MethodPost)
+	if w := get(http.MethodGet); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache after POST = %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	if n := u.requests.Load(); n != 3 {
+		t.Errorf("upstream requests = %d, want 3", n)
+	}
+}
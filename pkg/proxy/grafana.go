@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Headers Grafana sets on the data source requests of dashboard panels
+const (
+	DashboardHeader = "X-Dashboard-Uid"
+	PanelHeader     = "X-Panel-Id"
+)
+
+// otherLabel is the metric label of values beyond a label limit
+const otherLabel = "other"
+
+// LabelLimiter caps the number of distinct values of a metric label.
+// Values seen first keep their own series, the rest share "other". It can
+// be shared by several proxies.
+type LabelLimiter struct {
+	mu     sync.Mutex
+	values map[string]bool
+	limit  int
+}
+
+// NewLabelLimiter creates a limiter allowing up to limit label values
+func NewLabelLimiter(limit int) *LabelLimiter {
+	return &LabelLimiter{values: make(map[string]bool), limit: limit}
+}
+
+// Label returns the label to expose value as. Values, once allowed, are
+// kept so series don't come and go.
+func (l *LabelLimiter) Label(value string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.values[value] && len(l.values) < l.limit {
+		l.values[value] = true
+	}
+	if l.values[value] {
+		return value
+	}
+	return otherLabel
+}
+
+// grafanaPanel returns the Grafana dashboard UID and panel ID a request
+// was sent for, empty for requests from elsewhere. They never take part
+// in the cache key, so panels showing the same query share entries.
+func grafanaPanel(r *http.Request) (dashboard string, panel string) {
+	return r.Header.Get(DashboardHeader), r.Header.Get(PanelHeader)
+}
+
+// recordDashboardRequest counts a cacheable request by its Grafana
+// dashboard and cache result
+func (p *HTTPCacheProxy) recordDashboardRequest(r *http.Request, result string) {
+	if p.opts.DashboardLabels == nil {
+		return
+	}
+	dashboard, _ := grafanaPanel(r)
+	if dashboard == "" {
+		dashboard = "none"
+	} else {
+		dashboard = p.opts.DashboardLabels.Label(dashboard)
+	}
+	p.metrics.RecordDashboardRequest(dashboard, result)
+}
+
+// grafanaAttrs returns the log attributes attributing a request to its
+// Grafana dashboard and panel, if any
+func grafanaAttrs(r *http.Request) []any {
+	dashboard, panel := grafanaPanel(r)
+	var attrs []any
+	if dashboard != "" {
+		attrs = append(attrs, "dashboard", dashboard)
+	}
+	if panel != "" {
+		attrs = append(attrs, "panel", panel)
+	}
+	return attrs
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1 that are
+// meaningful for a single connection only and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers from h, including any headers
+// listed in its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders adds the standard proxy headers identifying the
+// client of r to an upstream request header
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		h.Set("X-Forwarded-For", clientIP)
+	}
+
+	// Keep the values of a proxy in front of us, they describe the
+	// original request
+	if h.Get("X-Forwarded-Proto") == "" {
+		if r.TLS != nil {
+			h.Set("X-Forwarded-Proto", "https")
+		} else {
+			h.Set("X-Forwarded-Proto", "http")
+		}
+	}
+	if h.Get("X-Forwarded-Host") == "" && r.Host != "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+// hedgedTransport sends a second request to another upstream replica when
+// the first one hasn't responded within the hedge delay, and uses
+// whichever response arrives first
+type hedgedTransport struct {
+	next     http.RoundTripper
+	resolver *upstreamResolver
+	delay    time.Duration
+	// upstream labels the failover metric
+	upstream string
+	metrics  *metrics.Metrics
+	// limits are the in-flight limits hedges take a slot of like any other
+	// upstream request
+	limits []*Semaphore
+}
+
+// attempt is the outcome of a request to one replica
+type attempt struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+	hedge  bool
+}
+
+// newHedgedTransport wraps transport with hedging across the replicas of
+// resolver. Hedges are only sent while each of limits has a free slot.
+func newHedgedTransport(transport *http.Transport, resolver *upstreamResolver, delay time.Duration, upstream string, m *metrics.Metrics, limits ...*Semaphore) *hedgedTransport {
+	// Requests are sent to replica addresses, TLS still has to verify the
+	// upstream's host name
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.ServerName = resolver.host
+
+	return &hedgedTransport{next: transport, resolver: resolver, delay: delay, upstream: upstream, metrics: m, limits: limits}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests whose body can't be replayed aren't hedged
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return t.next.RoundTrip(req)
+	}
+	primary, hedge, ok := t.resolver.pickPair()
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	results := make(chan attempt, 2)
+	send := func(addr string, isHedge bool, release func()) error {
+		attemptReq, cancel, err := t.replicaRequest(req, addr)
+		if err != nil {
+			release()
+			return err
+		}
+		// The slot is held until the attempt is discarded or its
+		// response body closed, both of which cancel it
+		cancel = releaseOnCancel(cancel, release)
+		go func() {
+			resp, err := t.next.RoundTrip(attemptReq)
+			results <- attempt{resp: resp, err: err, cancel: cancel, hedge: isHedge}
+		}()
+		return nil
+	}
+
+	if err := send(primary, false, func() {}); err != nil {
+		return nil, err
+	}
+	pending := 1
+	hedged := false
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	var failed *attempt
+	for {
+		select {
+		case <-timer.C:
+			// Hedges only use spare capacity, they never wait for a slot
+			release, ok := t.acquire()
+			if !ok {
+				continue
+			}
+			if err := send(hedge, true, release); err == nil {
+				pending++
+				hedged = true
+			}
+		case result := <-results:
+			pending--
+			// Wait for the other attempt before giving up on a failed one
+			if result.failed() && pending > 0 {
+				failed = &result
+				continue
+			}
+			if failed != nil {
+				failed.discard()
+				if !result.failed() {
+					t.metrics.RecordUpstreamFailover(t.upstream)
+				}
+			}
+			if pending > 0 {
+				go func() {
+					(<-results).discard()
+				}()
+			}
+
+			if hedged {
+				if result.hedge {
+					t.metrics.RecordHedgedRequest("hedge")
+				} else {
+					t.metrics.RecordHedgedRequest("primary")
+				}
+			}
+			if result.err != nil {
+				result.cancel()
+				return nil, result.err
+			}
+			result.resp.Body = &cancelBody{ReadCloser: result.resp.Body, cancel: result.cancel}
+			return result.resp, nil
+		}
+	}
+}
+
+// acquire takes a slot of every limit if all have one free
+func (t *hedgedTransport) acquire() (func(), bool) {
+	releases := make([]func(), 0, len(t.limits))
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, limit := range t.limits {
+		r, ok := limit.tryAcquire()
+		if !ok {
+			release()
+			return nil, false
+		}
+		releases = append(releases, r)
+	}
+	return release, true
+}
+
+// releaseOnCancel returns a cancel function also calling release
+func releaseOnCancel(cancel context.CancelFunc, release func()) context.CancelFunc {
+	return func() {
+		cancel()
+		release()
+	}
+}
+
+// replicaRequest returns a copy of req sent to the replica at addr
+func (t *hedgedTransport) replicaRequest(req *http.Request, addr string) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	attemptReq := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		attemptReq.Body = body
+	}
+
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	attemptReq.URL.Host = net.JoinHostPort(addr, port)
+	if attemptReq.Host == "" {
+		attemptReq.Host = req.URL.Host
+	}
+	return attemptReq, cancel, nil
+}
+
+// failed reports whether the attempt failed or the replica responded with
+// a server error
+func (a attempt) failed() bool {
+	return a.err != nil || a.resp.StatusCode >= http.StatusInternalServerError
+}
+
+// discard releases the resources of an attempt that isn't used
+func (a attempt) discard() {
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+	a.cancel()
+}
+
+// cancelBody cancels the request context of a response once its body is
+// closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
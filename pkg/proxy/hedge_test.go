@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+func TestHedgeLimits(t *testing.T) {
+	// The replica at 127.0.0.1 is slow, the one at 127.0.0.2 fast
+	var requests atomic.Int64
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Skipf("listening on all addresses: %v", err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		local := r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+		if strings.HasPrefix(local, "127.0.0.1:") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, local)
+	}))
+	upstream.Listener.Close()
+	upstream.Listener = listener
+	upstream.Start()
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name         string
+		held         bool
+		wantRequests int64
+	}{
+		{"free slot", false, 2},
+		{"no free slot", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			limit := NewSemaphore(1, time.Second)
+			if tt.held {
+				release, _ := limit.tryAcquire()
+				defer release()
+			}
+
+			resolver := &upstreamResolver{host: "upstream"}
+			resolver.addrs.Store(&[]string{"127.0.0.2", "127.0.0.1"})
+			transport := newHedgedTransport(&http.Transport{}, resolver, 20*time.Millisecond, "upstream",
+				metrics.New(nil, metrics.Options{}), nil, limit)
+
+			req, _ := http.NewRequest(http.MethodGet, "http://upstream:"+port+"/api/v1/query", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// Let the losing attempt finish before counting
+			time.Sleep(250 * time.Millisecond)
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("upstream requests = %d, want %d", n, tt.wantRequests)
+			}
+			if !tt.held {
+				release, ok := limit.tryAcquire()
+				if !ok {
+					t.Fatal("hedge kept its slot")
+				}
+				release()
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// histogramBucket is a bucket of a native histogram sample
+type histogramBucket struct {
+	// Boundaries is Prometheus' boundary rule telling which of the bounds
+	// are inclusive: 0 upper, 1 lower, 2 neither, 3 both
+	Boundaries int
+	Lower      float64
+	Upper      float64
+	Count      float64
+}
+
+// nativeHistogram is a native histogram sample value
+type nativeHistogram struct {
+	Count   float64
+	Sum     float64
+	Buckets []histogramBucket
+}
+
+// UnmarshalJSON decodes a histogram formatted like Prometheus does, e.g.
+// {"count":"3","sum":"1.5","buckets":[[0,"0.5","1","3"]]}. Histograms that
+// wouldn't be written back unchanged are rejected.
+func (h *nativeHistogram) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Count   string               `json:"count"`
+		Sum     string               `json:"sum"`
+		Buckets [][4]json.RawMessage `json:"buckets"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	if h.Count, err = strconv.ParseFloat(raw.Count, 64); err != nil {
+		return err
+	}
+	if h.Sum, err = strconv.ParseFloat(raw.Sum, 64); err != nil {
+		return err
+	}
+	h.Buckets = make([]histogramBucket, 0, len(raw.Buckets))
+	for _, fields := range raw.Buckets {
+		var bucket histogramBucket
+		if err := json.Unmarshal(fields[0], &bucket.Boundaries); err != nil {
+			return err
+		}
+		for i, v := range []*float64{&bucket.Lower, &bucket.Upper, &bucket.Count} {
+			var s string
+			if err := json.Unmarshal(fields[i+1], &s); err != nil {
+				return err
+			}
+			if *v, err = strconv.ParseFloat(s, 64); err != nil {
+				return err
+			}
+		}
+		h.Buckets = append(h.Buckets, bucket)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, b); err != nil {
+		return err
+	}
+	if !bytes.Equal(compact.Bytes(), h.appendJSON(nil)) {
+		return errNotCanonical
+	}
+	return nil
+}
+
+// appendJSON appends the histogram in Prometheus' JSON format
+func (h *nativeHistogram) appendJSON(b []byte) []byte {
+	b = append(b, `{"count":"`...)
+	b = append(b, formatSampleValue(h.Count)...)
+	b = append(b, `","sum":"`...)
+	b = append(b, formatSampleValue(h.Sum)...)
+	b = append(b, '"')
+	if len(h.Buckets) > 0 {
+		b = append(b, `,"buckets":[`...)
+		for i, bucket := range h.Buckets {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, '[')
+			b = strconv.AppendInt(b, int64(bucket.Boundaries), 10)
+			for _, v := range []float64{bucket.Lower, bucket.Upper, bucket.Count} {
+				b = append(b, ',', '"')
+				b = append(b, formatSampleValue(v)...)
+				b = append(b, '"')
+			}
+			b = append(b, ']')
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// appendBinary appends the histogram in the parsed matrix encoding:
+// 8 byte count, 8 byte sum, uvarint bucket count, then per bucket the
+// boundary rule byte and 8 byte lower bound, upper bound and count
+func (h *nativeHistogram) appendBinary(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(h.Count))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(h.Sum))
+	b = binary.AppendUvarint(b, uint64(len(h.Buckets)))
+	for _, bucket := range h.Buckets {
+		b = append(b, byte(bucket.Boundaries))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(bucket.Lower))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(bucket.Upper))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(bucket.Count))
+	}
+	return b
+}
+
+// histogram reads a histogram in the parsed matrix encoding
+func (d *binaryDecoder) histogram() nativeHistogram {
+	h := nativeHistogram{
+		Count: math.Float64frombits(d.uint64()),
+		Sum:   math.Float64frombits(d.uint64()),
+	}
+	count := d.count()
+	h.Buckets = make([]histogramBucket, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		h.Buckets = append(h.Buckets, histogramBucket{
+			Boundaries: int(d.byte()),
+			Lower:      math.Float64frombits(d.uint64()),
+			Upper:      math.Float64frombits(d.uint64()),
+			Count:      math.Float64frombits(d.uint64()),
+		})
+	}
+	return h
+}
+
+// averageHistograms averages native histograms bucket by bucket. Returns
+// false when their bucket layouts overlap without matching, e.g. across a
+// schema change, so the histograms can't be combined.
+func averageHistograms(samples []histogramSample) (nativeHistogram, bool) {
+	type bucketKey struct {
+		boundaries   int
+		lower, upper float64
+	}
+	n := float64(len(samples))
+	counts := make(map[bucketKey]float64)
+	var avg nativeHistogram
+	for _, sample := range samples {
+		avg.Count += sample.H.Count / n
+		avg.Sum += sample.H.Sum / n
+		for _, bucket := range sample.H.Buckets {
+			counts[bucketKey{bucket.Boundaries, bucket.Lower, bucket.Upper}] += bucket.Count / n
+		}
+	}
+
+	avg.Buckets = make([]histogramBucket, 0, len(counts))
+	for key, count := range counts {
+		avg.Buckets = append(avg.Buckets, histogramBucket{
+			Boundaries: key.boundaries,
+			Lower:      key.lower,
+			Upper:      key.upper,
+			Count:      count,
+		})
+	}
+	sort.Slice(avg.Buckets, func(i, j int) bool {
+		if avg.Buckets[i].Lower != avg.Buckets[j].Lower {
+			return avg.Buckets[i].Lower < avg.Buckets[j].Lower
+		}
+		return avg.Buckets[i].Upper < avg.Buckets[j].Upper
+	})
+	for i := 1; i < len(avg.Buckets); i++ {
+		if avg.Buckets[i].Lower < avg.Buckets[i-1].Upper {
+			return nativeHistogram{}, false
+		}
+	}
+	return avg, true
+}
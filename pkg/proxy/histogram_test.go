@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const testHistogramBody = `{"status":"success","data":{"resultType":"matrix","result":[` +
+	`{"metric":{"__name__":"rpc_duration_seconds"},"histograms":[` +
+	`[1700000000,{"count":"3","sum":"1.5","buckets":[[0,"0.25","0.5","1"],[0,"0.5","1","2"]]}],` +
+	`[1700000015,{"count":"0","sum":"0"}]]}` +
+	`]}}`
+
+func TestMatrixHistogramRoundTrip(t *testing.T) {
+	m, err := parseMatrix([]byte(testHistogramBody))
+	if err != nil {
+		t.Fatalf("parseMatrix: %v", err)
+	}
+	encoded, err := m.encode()
+	if err != nil || string(encoded) != testHistogramBody {
+		t.Errorf("encode =\n%s (%v)\nwant\n%s", encoded, err, testHistogramBody)
+	}
+
+	data, err := m.marshalBinary()
+	if err != nil {
+		t.Fatalf("marshalBinary: %v", err)
+	}
+	decoded, err := unmarshalMatrix(data)
+	if err != nil {
+		t.Fatalf("unmarshalMatrix: %v", err)
+	}
+	if encoded, err = decoded.encode(); err != nil || string(encoded) != testHistogramBody {
+		t.Errorf("binary round trip =\n%s (%v)\nwant\n%s", encoded, err, testHistogramBody)
+	}
+}
+
+func TestNativeHistogramRejectsNonCanonical(t *testing.T) {
+	var h nativeHistogram
+	if err := json.Unmarshal([]byte(`{"count":"3.0","sum":"1.5"}`), &h); !errors.Is(err, errNotCanonical) {
+		t.Errorf("Unmarshal = %v, want %v", err, errNotCanonical)
+	}
+}
+
+func TestMatrixPrependHistograms(t *testing.T) {
+	histograms := func(times ...int64) matrixSeries {
+		s := matrixSeries{Metric: json.RawMessage(`{"job":"histogram"}`)}
+		for _, ts := range times {
+			s.Histograms = append(s.Histograms, histogramSample{T: ts})
+		}
+		return s
+	}
+
+	tail := &matrix{series: []matrixSeries{histograms(2000, 3000)}}
+	tail.prepend(&matrix{series: []matrixSeries{histograms(1000, 2000)}})
+	if want := []matrixSeries{histograms(1000, 2000, 3000)}; !reflect.DeepEqual(tail.series, want) {
+		t.Errorf("prepend =\n%+v\nwant\n%+v", tail.series, want)
+	}
+}
+
+func TestAverageHistograms(t *testing.T) {
+	bucket := func(lower, upper, count float64) histogramBucket {
+		return histogramBucket{Lower: lower, Upper: upper, Count: count}
+	}
+	samples := []histogramSample{
+		{H: nativeHistogram{Count: 4, Sum: 2, Buckets: []histogramBucket{bucket(0.5, 1, 4)}}},
+		{H: nativeHistogram{Count: 2, Sum: 1, Buckets: []histogramBucket{bucket(0.25, 0.5, 2)}}},
+	}
+	avg, ok := averageHistograms(samples)
+	want := nativeHistogram{Count: 3, Sum: 1.5, Buckets: []histogramBucket{bucket(0.25, 0.5, 1), bucket(0.5, 1, 2)}}
+	if !ok || !reflect.DeepEqual(avg, want) {
+		t.Errorf("averageHistograms = %+v, %v, want %+v", avg, ok, want)
+	}
+
+	// Overlapping layouts, e.g. across a schema change, can't be averaged
+	samples[1].H.Buckets = []histogramBucket{bucket(0.75, 1.5, 2)}
+	if _, ok := averageHistograms(samples); ok {
+		t.Error("averageHistograms of overlapping buckets succeeded")
+	}
+}
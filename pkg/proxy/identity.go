@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// identityContextKey is the context key of the client identity
+type identityContextKey struct{}
+
+// Identity describes the authenticated client of a request
+type Identity struct {
+	// Name identifies the client, e.g. the name of its API key
+	Name string
+	// Namespace partitions the cache, clients in different namespaces
+	// never share cache entries
+	Namespace string
+	// Tenant is the tenant granted by the client's credentials. It takes
+	// precedence over the tenant header for limits and label enforcement.
+	Tenant string
+}
+
+// WithIdentity returns a request carrying the client identity
+func WithIdentity(r *http.Request, id Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id))
+}
+
+// IdentityFrom returns the client identity of a request, if any
+func IdentityFrom(r *http.Request) (Identity, bool) {
+	id, ok := r.Context().Value(identityContextKey{}).(Identity)
+	return id, ok
+}
+
+// keyNamespace returns the prefix of the request's cache keys
+func keyNamespace(r *http.Request) string {
+	if id, ok := IdentityFrom(r); ok && id.Namespace != "" {
+		return id.Namespace + "/"
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// StartKeepWarm periodically sends a tiny instant query to the upstream to
+// keep connections, DNS and upstream caches warm. The latency of each probe
+// is exported as a baseline that is independent of user traffic.
+func (p *HTTPCacheProxy) StartKeepWarm(interval time.Duration, query string) {
+	if interval <= 0 {
+		return
+	}
+
+	p.log.Info("Starting upstream keep-warm pinger",
+		"interval", interval,
+		"query", query)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			p.keepWarm(interval, query)
+		}
+	}()
+}
+
+// keepWarm sends a single keep-warm query to the upstream
+func (p *HTTPCacheProxy) keepWarm(timeout time.Duration, query string) {
+	upstream, err := url.Parse(p.upstreamURL)
+	if err != nil {
+		p.log.Error("Failed to parse upstream URL for keep-warm", "error", err)
+		return
+	}
+	upstream.Path = "/api/v1/query"
+	upstream.RawQuery = url.Values{"query": {query}}.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.String(), nil)
+	if err != nil {
+		p.log.Error("Failed to create keep-warm request", "error", err)
+		return
+	}
+
+	startTime := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.metrics.RecordKeepWarmFailure()
+		p.log.Warn("Upstream keep-warm query failed", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+	duration := time.Since(startTime)
+
+	if resp.StatusCode != http.StatusOK {
+		p.metrics.RecordKeepWarmFailure()
+		p.log.Warn("Upstream keep-warm query returned unexpected status",
+			"status", resp.StatusCode,
+			"duration_ms", duration.Milliseconds())
+		return
+	}
+
+	p.metrics.RecordKeepWarmLatency(duration.Seconds())
+	p.log.Debug("Upstream keep-warm query succeeded",
+		"duration_ms", duration.Milliseconds())
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// keySchemaVersion is the version of the cache key layout. Bump it when
+// the way keys are built changes so entries stored under the old layout
+// are never served.
+const keySchemaVersion = 1
+
+// keyPrefix returns the prefix of every cache key stored by the proxy:
+// the configured namespace, the key schema version and a fingerprint of
+// the options that shape keys. Changing any of them moves the proxy to a
+// fresh key space, entries of the previous configuration are left to
+// expire instead of being served for requests they no longer match.
+func keyPrefix(opts Options, cacheTTL string) string {
+	var b strings.Builder
+	if opts.KeyNamespace != "" {
+		b.WriteString(opts.KeyNamespace)
+		b.WriteString(":")
+	}
+	fmt.Fprintf(&b, "v%d.%s:", keySchemaVersion, keyFingerprint(opts, cacheTTL))
+	return b.String()
+}
+
+// keyFingerprint hashes the options that decide which requests share a
+// cache key: time alignment, excluded parameters, key hashing and the
+// rewrites and headers applied before keys are built.
+func keyFingerprint(opts Options, cacheTTL string) string {
+	excluded := slices.Clone(opts.KeyExcludeParams)
+	slices.Sort(excluded)
+	thanos := make([]string, 0, len(opts.ThanosDefaults))
+	for param, value := range opts.ThanosDefaults {
+		thanos = append(thanos, param+"="+value)
+	}
+	slices.Sort(thanos)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "ttl=%s\n", cacheTTL)
+	fmt.Fprintf(h, "exact=%t\n", opts.ExactTime)
+	fmt.Fprintf(h, "hash=%t\n", opts.HashKeys)
+	fmt.Fprintf(h, "exclude=%s\n", strings.Join(excluded, ","))
+	fmt.Fprintf(h, "downsample=%s\n", opts.Downsample)
+	fmt.Fprintf(h, "thanos=%s\n", strings.Join(thanos, ","))
+	fmt.Fprintf(h, "enforce=%s;%s\n", opts.EnforceLabel, opts.EnforceLabelHeader)
+	fmt.Fprintf(h, "tenant=%s\n", opts.TenantHeader)
+	return hex.EncodeToString(h.Sum(nil)[:4])
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the credentials of the pod's service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubernetesRetryInterval is the pause before listing endpoints again
+	// after the watch failed
+	kubernetesRetryInterval = 5 * time.Second
+)
+
+// endpointSlice is the part of a discovery.k8s.io/v1 EndpointSlice the
+// watcher needs
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			// Ready is nil if the readiness is unknown, which counts as
+			// ready
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+// readyAddresses returns the addresses of the ready endpoints
+func (s endpointSlice) readyAddresses() []string {
+	var addrs []string
+	for _, endpoint := range s.Endpoints {
+		if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+			addrs = append(addrs, endpoint.Addresses...)
+		}
+	}
+	return addrs
+}
+
+// kubernetesWatcher watches the EndpointSlices of a service through the
+// Kubernetes API of the cluster promcached runs in
+type kubernetesWatcher struct {
+	client    *http.Client
+	apiURL    string
+	namespace string
+	service   string
+	// tokenFile holds the service account token
+	tokenFile string
+	log       *slog.Logger
+	// slices holds the ready addresses by EndpointSlice name
+	slices map[string][]string
+}
+
+// newKubernetesWatcher creates a watcher of the service named by host,
+// either "<service>" in the pod's namespace or "<service>.<namespace>"
+// optionally followed by ".svc" and the cluster domain
+func newKubernetesWatcher(host string, log *slog.Logger) (*kubernetesWatcher, error) {
+	apiHost, apiPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if apiHost == "" || apiPort == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA certificate")
+	}
+
+	service, namespace, _ := strings.Cut(host, ".")
+	namespace, _, _ = strings.Cut(namespace, ".")
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &kubernetesWatcher{
+		client:    &http.Client{Transport: transport},
+		apiURL:    "https://" + net.JoinHostPort(apiHost, apiPort),
+		namespace: namespace,
+		service:   service,
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		log:       log,
+	}, nil
+}
+
+// run lists and then watches the service's EndpointSlices, calling update
+// with the ready addresses whenever they change. It never returns.
+func (w *kubernetesWatcher) run(update func([]string)) {
+	var resourceVersion string
+	for {
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = w.list(update)
+		}
+		if err == nil {
+			resourceVersion, err = w.watch(resourceVersion, update)
+			// The API server ends watches after timeoutSeconds, resume
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+		}
+
+		resourceVersion = ""
+		w.log.Warn("Watching Kubernetes endpoints failed, retrying",
+			"service", w.namespace+"/"+w.service,
+			"error", err)
+		time.Sleep(kubernetesRetryInterval)
+	}
+}
+
+// list fetches all EndpointSlices of the service and returns the resource
+// version to watch from
+func (w *kubernetesWatcher) list(update func([]string)) (string, error) {
+	resp, err := w.get(url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	w.slices = make(map[string][]string, len(list.Items))
+	for _, slice := range list.Items {
+		w.slices[slice.Metadata.Name] = slice.readyAddresses()
+	}
+	update(w.addresses())
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies changes to the EndpointSlices until the watch ends and
+// returns the resource version to resume watching from
+func (w *kubernetesWatcher) watch(resourceVersion string, update func([]string)) (string, error) {
+	resp, err := w.get(url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+	})
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			return resourceVersion, err
+		}
+		if event.Type == "ERROR" {
+			return resourceVersion, fmt.Errorf("watch error: %s", event.Object)
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = slice.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[slice.Metadata.Name] = slice.readyAddresses()
+		case "DELETED":
+			delete(w.slices, slice.Metadata.Name)
+		default:
+			continue
+		}
+		update(w.addresses())
+	}
+}
+
+// get requests the service's EndpointSlices with the given parameters
+func (w *kubernetesWatcher) get(params url.Values) (*http.Response, error) {
+	// Service account tokens are rotated, read the current one
+	token, err := os.ReadFile(w.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Set("labelSelector", "kubernetes.io/service-name="+w.service)
+	target := w.apiURL + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(w.namespace) + "/endpointslices?" + params.Encode()
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API responded with %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// addresses returns the ready addresses of all EndpointSlices
+func (w *kubernetesWatcher) addresses() []string {
+	var addrs []string
+	for _, slice := range w.slices {
+		addrs = append(addrs, slice...)
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs)
+}
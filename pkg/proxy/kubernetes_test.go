@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// kubernetesAPI serves list as the service's EndpointSlices and events
+// as their watch
+func kubernetesAPI(t *testing.T, list string, events ...string) *kubernetesWatcher {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/monitoring/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=prometheus" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			io.WriteString(w, list)
+			return
+		}
+		if got := r.URL.Query().Get("resourceVersion"); got != "10" {
+			t.Errorf("watch from resource version %q, want 10", got)
+		}
+		for _, event := range events {
+			io.WriteString(w, event+"\n")
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &kubernetesWatcher{
+		client:    api.Client(),
+		apiURL:    api.URL,
+		namespace: "monitoring",
+		service:   "prometheus",
+		tokenFile: tokenFile,
+		log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+const testEndpointSlices = `{"metadata":{"resourceVersion":"10"},"items":[{"metadata":{"name":"a","resourceVersion":"9"},"endpoints":[` +
+	`{"addresses":["10.0.0.1"],"conditions":{"ready":true}},` +
+	`{"addresses":["10.0.0.2"],"conditions":{"ready":false}},` +
+	`{"addresses":["10.0.0.3"],"conditions":{}}]}]}`
+
+func TestKubernetesWatch(t *testing.T) {
+	w := kubernetesAPI(t, testEndpointSlices,
+		`{"type":"BOOKMARK","object":{"kind":"EndpointSlice","metadata":{"resourceVersion":"11"}}}`,
+		`{"type":"ADDED","object":{"metadata":{"name":"b","resourceVersion":"12"},"endpoints":[{"addresses":["10.0.0.4"],"conditions":{"ready":null}}]}}`,
+		`{"type":"MODIFIED","object":{"metadata":{"name":"a","resourceVersion":"13"},"endpoints":[`+
+			`{"addresses":["10.0.0.1"],"conditions":{"ready":false}},{"addresses":["10.0.0.2"],"conditions":{"ready":true}}]}}`,
+		`{"type":"DELETED","object":{"metadata":{"name":"b","resourceVersion":"14"}}}`,
+		`{"type":"BOOKMARK","object":{"kind":"EndpointSlice","metadata":{"resourceVersion":"15"}}}`,
+	)
+
+	var updates [][]string
+	update := func(addrs []string) { updates = append(updates, addrs) }
+
+	resourceVersion, err := w.list(update)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if resourceVersion != "10" {
+		t.Errorf("list resource version = %q, want 10", resourceVersion)
+	}
+	resourceVersion, err = w.watch(resourceVersion, update)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("watch error = %v, want EOF", err)
+	}
+	// Watches resume after the last bookmark
+	if resourceVersion != "15" {
+		t.Errorf("watch resource version = %q, want 15", resourceVersion)
+	}
+
+	// Bookmarks don't change the addresses
+	want := [][]string{
+		{"10.0.0.1", "10.0.0.3"},
+		{"10.0.0.1", "10.0.0.3", "10.0.0.4"},
+		{"10.0.0.2", "10.0.0.4"},
+		{"10.0.0.2"},
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("updates = %v, want %v", updates, want)
+	}
+}
+
+func TestKubernetesWatchError(t *testing.T) {
+	w := kubernetesAPI(t, testEndpointSlices,
+		`{"type":"MODIFIED","object":{"metadata":{"name":"a","resourceVersion":"11"},"endpoints":[]}}`,
+		`{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired"}}`,
+	)
+	if _, err := w.list(func([]string) {}); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	resourceVersion, err := w.watch("10", func([]string) {})
+	if err == nil || !strings.Contains(err.Error(), "Expired") {
+		t.Errorf("watch error = %v, want the watch error", err)
+	}
+	if resourceVersion != "11" {
+		t.Errorf("watch resource version = %q, want 11", resourceVersion)
+	}
+}
+
+func TestKubernetesUnauthorized(t *testing.T) {
+	w := kubernetesAPI(t, testEndpointSlices)
+	os.WriteFile(w.tokenFile, []byte("expired"), 0o600)
+
+	called := false
+	if _, err := w.list(func([]string) { called = true }); err == nil {
+		t.Error("list with a rejected token succeeded")
+	}
+	if called {
+		t.Error("list with a rejected token updated the addresses")
+	}
+}
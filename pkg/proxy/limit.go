@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueTimeHeader is the response header telling clients how long their
+// request waited for an upstream slot, in seconds
+const QueueTimeHeader = "X-Promcache-Queue-Time"
+
+// errOverloaded is returned when no upstream slot became available in time
+var errOverloaded = errors.New("too many concurrent upstream requests")
+
+// Semaphore caps the number of in-flight upstream requests. Requests over
+// the limit queue for a bounded time.
+type Semaphore struct {
+	slots   chan struct{}
+	timeout time.Duration
+	// waiting is the number of queued requests
+	waiting atomic.Int64
+
+	mu sync.Mutex
+	// hold is the moving average of how long requests hold a slot
+	hold time.Duration
+}
+
+// NewSemaphore creates a semaphore admitting up to limit concurrent
+// requests, queueing excess requests for up to timeout. Returns nil if limit
+// is not positive, which admits everything.
+func NewSemaphore(limit int, timeout time.Duration) *Semaphore {
+	if limit <= 0 {
+		return nil
+	}
+	return &Semaphore{
+		slots:   make(chan struct{}, limit),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting for up to the queue timeout. The returned
+// function releases the slot and is safe to call more than once.
+func (s *Semaphore) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	// Fast path without allocating a timer
+	select {
+	case s.slots <- struct{}{}:
+		return s.releaseFunc(), nil
+	default:
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	s.waiting.Add(1)
+	defer s.waiting.Add(-1)
+
+	select {
+	case s.slots <- struct{}{}:
+		return s.releaseFunc(), nil
+	case <-timer.C:
+		return nil, errOverloaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// tryAcquire takes a slot if one is free right away
+func (s *Semaphore) tryAcquire() (func(), bool) {
+	if s == nil {
+		return func() {}, true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return s.releaseFunc(), true
+	default:
+		return nil, false
+	}
+}
+
+// releaseFunc returns a function releasing one slot exactly once
+func (s *Semaphore) releaseFunc() func() {
+	var once sync.Once
+	acquired := time.Now()
+	return func() {
+		once.Do(func() {
+			s.recordHold(time.Since(acquired))
+			<-s.slots
+		})
+	}
+}
+
+// recordHold adds the time a slot was held to the moving average
+func (s *Semaphore) recordHold(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hold == 0 {
+		s.hold = d
+		return
+	}
+	s.hold += (d - s.hold) / 5
+}
+
+// drainTime estimates how long the queue takes to drain so that a new
+// request gets a slot right away, 0 if unknown
+func (s *Semaphore) drainTime() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	hold := s.hold
+	s.mu.Unlock()
+	return hold * time.Duration(s.waiting.Load()+1) / time.Duration(cap(s.slots))
+}
+
+// acquireUpstream takes a slot of the global and the per-upstream
+// semaphore, returning how long the request waited for them
+func (p *HTTPCacheProxy) acquireUpstream(ctx context.Context) (func(), time.Duration, error) {
+	start := time.Now()
+	releaseGlobal, err := p.opts.GlobalSemaphore.acquire(ctx)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	releaseUpstream, err := p.semaphore.acquire(ctx)
+	if err != nil {
+		releaseGlobal()
+		return nil, time.Since(start), err
+	}
+	queued := time.Since(start)
+
+	p.metrics.AddUpstreamInflight(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.metrics.AddUpstreamInflight(-1)
+			releaseUpstream()
+			releaseGlobal()
+		})
+	}, queued, nil
+}
+
+// setQueueTime tells the client how long its request queued, if it did
+func setQueueTime(w http.ResponseWriter, queued time.Duration) {
+	if queued >= time.Millisecond {
+		w.Header().Set(QueueTimeHeader, strconv.FormatFloat(queued.Seconds(), 'f', 3, 64))
+	}
+}
+
+// writeOverloaded responds with 503 Service Unavailable asking the client to
+// retry once the queue is expected to have drained, estimated from the
+// queue length and how long requests hold their slots
+func (p *HTTPCacheProxy) writeOverloaded(w http.ResponseWriter, queued time.Duration) {
+	p.metrics.RecordUpstreamOverloaded()
+
+	retryAfter := max(p.opts.GlobalSemaphore.drainTime(), p.semaphore.drainTime())
+	if retryAfter <= 0 {
+		retryAfter = p.opts.UpstreamQueueTimeout
+	}
+	setQueueTime(w, queued)
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retryAfter.Seconds())), 1)))
+	http.Error(w, "Too many concurrent upstream requests", http.StatusServiceUnavailable)
+}
+
+// Drain waits until all in-flight upstream requests, including those of
+// the cache warmer, finished or ctx is done
+func (p *HTTPCacheProxy) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
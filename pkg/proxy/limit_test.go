@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/f0o/promcache/internal/metrics"
+)
+
+func TestSemaphore(t *testing.T) {
+	s := NewSemaphore(1, 20*time.Millisecond)
+	release, err := s.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	if _, err := s.acquire(context.Background()); !errors.Is(err, errOverloaded) {
+		t.Fatalf("second acquire = %v, want %v", err, errOverloaded)
+	}
+	release()
+	release()
+	release, err = s.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
+
+	if s := NewSemaphore(0, time.Second); s != nil {
+		t.Errorf("NewSemaphore(0) = %v, want nil", s)
+	}
+}
+
+func TestSemaphoreDrainTime(t *testing.T) {
+	s := NewSemaphore(2, time.Second)
+	if d := s.drainTime(); d != 0 {
+		t.Errorf("drain time without history = %s, want 0", d)
+	}
+
+	s.recordHold(4 * time.Second)
+	if d := s.drainTime(); d != 2*time.Second {
+		t.Errorf("drain time of an empty queue = %s, want 2s", d)
+	}
+	s.waiting.Add(3)
+	if d := s.drainTime(); d != 8*time.Second {
+		t.Errorf("drain time of 3 waiting = %s, want 8s", d)
+	}
+}
+
+func TestWriteOverloaded(t *testing.T) {
+	p := &HTTPCacheProxy{
+		opts:      Options{UpstreamQueueTimeout: 10 * time.Second},
+		semaphore: NewSemaphore(1, 10*time.Second),
+		metrics:   metrics.New(nil, metrics.Options{}),
+	}
+
+	w := httptest.NewRecorder()
+	p.writeOverloaded(w, 1500*time.Millisecond)
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After without history = %q, want 10", got)
+	}
+	if got := w.Header().Get(QueueTimeHeader); got != "1.500" {
+		t.Errorf("%s = %q, want 1.500", QueueTimeHeader, got)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+
+	p.semaphore.recordHold(3 * time.Second)
+	p.semaphore.waiting.Add(4)
+	w = httptest.NewRecorder()
+	p.writeOverloaded(w, 0)
+	if got := w.Header().Get("Retry-After"); got != "15" {
+		t.Errorf("Retry-After with 4 waiting = %q, want 15", got)
+	}
+	if got := w.Header().Get(QueueTimeHeader); got != "" {
+		t.Errorf("%s = %q, want none", QueueTimeHeader, got)
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LokiPathPrefix is the path prefix of Grafana Loki's HTTP API
+const LokiPathPrefix = "/loki/api/"
+
+// isLoki reports whether path is a Loki API endpoint. Loki takes times in
+// nanoseconds and LogQL instead of PromQL, so its requests are normalized
+// differently.
+func isLoki(path string) bool {
+	return strings.HasPrefix(path, LokiPathPrefix)
+}
+
+// parseLokiTime parses a Loki time parameter the way Loki does: decimal
+// Unix seconds, integer Unix seconds of up to 10 digits, integer Unix
+// nanoseconds or RFC 3339
+func parseLokiTime(s string) (time.Time, bool) {
+	if strings.Contains(s, ".") {
+		if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+			return time.Unix(0, int64(seconds*1e9)), true
+		}
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, err == nil
+	}
+	if len(s) <= 10 {
+		return time.Unix(value, 0), true
+	}
+	return time.Unix(0, value), true
+}
+
+// alignLokiTimes rounds the time parameters of a Loki request to the larger
+// of the TTL and the step, written as Unix nanoseconds, and the step to
+// seconds. Aligning to the step keeps the evaluation timestamps of metric
+// queries stable across requests sharing an entry.
+func (p *HTTPCacheProxy) alignLokiTimes(query url.Values) {
+	unit := p.cacheTTL
+	if step, ok := parseDuration(query.Get("step")); ok {
+		query.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+		unit = max(unit, step)
+	}
+	if unit < time.Second {
+		return
+	}
+
+	for _, name := range timeParameters {
+		t, ok := parseLokiTime(query.Get(name))
+		if !ok {
+			continue
+		}
+		aligned := t.Truncate(unit)
+		if name == "end" && !aligned.Equal(t) {
+			aligned = aligned.Add(unit)
+		}
+		query.Set(name, strconv.FormatInt(aligned.UnixNano(), 10))
+	}
+}
+
+// normalizeLokiParams rewrites the expression and selectors of a Loki
+// request into a canonical form
+func normalizeLokiParams(query url.Values) {
+	if expr := query.Get("query"); expr != "" {
+		query.Set("query", normalizeLogQL(expr))
+	}
+	if matches, found := query["match[]"]; found {
+		query["match[]"] = uniqueTrimmed(matches)
+	}
+	// Loki's default direction is backward
+	if strings.EqualFold(query.Get("direction"), "backward") {
+		query.Del("direction")
+	}
+}
+
+// normalizeLogQL returns a LogQL expression with surrounding whitespace
+// removed and the matchers of each stream selector sorted, so selectors
+// written in different orders share an entry. Line filters, parsers and
+// templates are left untouched.
+func normalizeLogQL(expr string) string {
+	expr = strings.TrimSpace(expr)
+
+	var b strings.Builder
+	b.Grow(len(expr))
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; c {
+		case '"', '\'', '`':
+			end := skipString(expr, i)
+			b.WriteString(expr[i:end])
+			i = end
+		case '{':
+			end := skipGroup(expr, i, '{', '}')
+			if expr[end-1] != '}' {
+				// Unterminated selectors are left for Loki to reject
+				b.WriteString(expr[i:])
+				return b.String()
+			}
+			b.WriteByte('{')
+			b.WriteString(strings.Join(sortedMatchers(expr[i+1:end-1]), ","))
+			b.WriteByte('}')
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// sortedMatchers splits the comma-separated label matchers of a stream
+// selector and returns them sorted with surrounding whitespace removed
+func sortedMatchers(inner string) []string {
+	var matchers []string
+	start := 0
+	for i := 0; i < len(inner); {
+		switch inner[i] {
+		case '"', '\'', '`':
+			i = skipString(inner, i)
+			continue
+		case ',':
+			matchers = append(matchers, inner[start:i])
+			start = i + 1
+		}
+		i++
+	}
+	matchers = append(matchers, inner[start:])
+
+	sorted := matchers[:0]
+	for _, matcher := range matchers {
+		if matcher = strings.TrimSpace(matcher); matcher != "" {
+			sorted = append(sorted, matcher)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
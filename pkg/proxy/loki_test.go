@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseLokiTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"1700000000", time.Unix(1700000000, 0), true},
+		{"1700000000.5", time.Unix(1700000000, 5e8), true},
+		{"1700000000000000000", time.Unix(1700000000, 0), true},
+		{"2023-11-14T22:13:20.5Z", time.Unix(1700000000, 5e8), true},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseLokiTime(tt.s)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseLokiTime(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAlignLokiTimes(t *testing.T) {
+	// The test cache's TTL is a minute
+	p := New("http://loki:3100", newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	ns := func(seconds int64) string {
+		return strconv.FormatInt(seconds*1e9, 10)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  url.Values
+	}{
+		{
+			name:  "seconds to the TTL",
+			query: url.Values{"start": {"1700000010"}, "end": {"1700000010"}},
+			want:  url.Values{"start": {ns(1699999980)}, "end": {ns(1700000040)}},
+		},
+		{
+			name:  "nanoseconds and RFC 3339",
+			query: url.Values{"start": {"1700000010000000000"}, "end": {"2023-11-14T22:14:00Z"}, "time": {"1700000000.5"}},
+			want:  url.Values{"start": {ns(1699999980)}, "end": {ns(1700000040)}, "time": {ns(1699999980)}},
+		},
+		{
+			name:  "to a step above the TTL",
+			query: url.Values{"start": {"1700000000"}, "end": {"1700000000"}, "step": {"5m"}},
+			want:  url.Values{"start": {ns(1699999800)}, "end": {ns(1700000100)}, "step": {"300"}},
+		},
+		{
+			name:  "step below the TTL",
+			query: url.Values{"start": {"1700000000"}, "step": {"15"}},
+			want:  url.Values{"start": {ns(1699999980)}, "step": {"15"}},
+		},
+		{
+			name:  "invalid times are left",
+			query: url.Values{"start": {"yesterday"}},
+			want:  url.Values{"start": {"yesterday"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.alignLokiTimes(tt.query)
+			if got, want := tt.query.Encode(), tt.want.Encode(); got != want {
+				t.Errorf("alignLokiTimes = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNormalizeLogQL(t *testing.T) {
+	tests := map[string]string{
+		` {job="api", app="web"} |= "a, b" `:                       `{app="web",job="api"} |= "a, b"`,
+		`sum(rate({job="api",app=~"w.*"}[5m]))`:                    `sum(rate({app=~"w.*",job="api"}[5m]))`,
+		`{job="{x,y}", app="web"} | json | line_format "{{.msg}}"`: `{app="web",job="{x,y}"} | json | line_format "{{.msg}}"`,
+		`{job="api", app="web"`:                                    `{job="api", app="web"`,
+	}
+	for expr, want := range tests {
+		if got := normalizeLogQL(expr); got != want {
+			t.Errorf("normalizeLogQL(%q) = %q, want %q", expr, got, want)
+		}
+	}
+}
+
+func TestNormalizeLokiParams(t *testing.T) {
+	query := url.Values{
+		"query":     {`{job="api",app="web"}`},
+		"match[]":   {`{job="api"}`, ` {job="api"} `},
+		"direction": {"BACKWARD"},
+	}
+	normalizeLokiParams(query)
+	want := url.Values{"query": {`{app="web",job="api"}`}, "match[]": {`{job="api"}`}}
+	if got := query.Encode(); got != want.Encode() {
+		t.Errorf("normalizeLokiParams = %s, want %s", got, want.Encode())
+	}
+
+	forward := url.Values{"direction": {"forward"}}
+	normalizeLokiParams(forward)
+	if forward.Get("direction") != "forward" {
+		t.Errorf("direction = %q, want forward", forward.Get("direction"))
+	}
+}
+
+func TestLokiKeysShareEntries(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"streams","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	// The same query in Loki's time formats and with reordered selectors
+	for _, query := range []url.Values{
+		{"query": {`{job="api",app="web"}`}, "start": {"1700000010"}, "end": {"1700000020"}},
+		{"query": {`{app="web", job="api"}`}, "start": {"1700000010000000000"}, "end": {"2023-11-14T22:13:40Z"}, "direction": {"backward"}},
+	} {
+		w := httptest.NewRecorder()
+		p.HandleRequest(w, httptest.NewRequest(http.MethodGet, LokiPathPrefix+"v1/query_range?"+query.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", w.Code)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LoopHeader carries the number of promcached hops a request has passed
+const LoopHeader = "X-Promcache-Loop"
+
+// hopCount returns the number of promcached hops recorded on the request
+func hopCount(r *http.Request) int {
+	hops, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(LoopHeader)))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// checkLoop rejects requests that have passed through more promcached hops
+// than allowed or that already carry this instance in their Via header,
+// both of which indicate a request loop. Returns true if the request was
+// rejected.
+func (p *HTTPCacheProxy) checkLoop(w http.ResponseWriter, r *http.Request) bool {
+	if p.opts.MaxHops <= 0 {
+		return false
+	}
+
+	hops := hopCount(r)
+	if hops < p.opts.MaxHops && !p.seenVia(r) {
+		return false
+	}
+
+	traceStep(r, "loop_detected", strconv.Itoa(hops))
+	p.log.WarnContext(r.Context(), "Rejecting looping request",
+		"path", r.URL.Path,
+		"hops", hops,
+		"max_hops", p.opts.MaxHops)
+	http.Error(w, "Request loop detected", http.StatusLoopDetected)
+	return true
+}
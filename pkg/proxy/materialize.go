@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// View is a named query evaluated against the upstream on a schedule, like
+// a recording rule. Matching requests are served its latest result.
+type View struct {
+	// Name identifies the view in logs and its cache key
+	Name string
+	// Query is the PromQL expression
+	Query string
+	// Interval is the time between evaluations
+	Interval time.Duration
+	// Range makes the view a range query over the given duration ending at
+	// the evaluation time, 0 evaluates an instant query
+	Range time.Duration
+	// Step is the resolution of range views, defaults to Range/250
+	Step time.Duration
+}
+
+// view is a view with the time of its latest successful evaluation
+type view struct {
+	View
+	// key is the cache key of the latest result
+	key string
+	// evaluatedAt is the Unix time of the latest successful evaluation,
+	// 0 before the first one
+	evaluatedAt atomic.Int64
+}
+
+// path returns the API path of the view's query
+func (v *view) path() string {
+	if v.Range > 0 {
+		return "/api/v1/query_range"
+	}
+	return "/api/v1/query"
+}
+
+// requestURL returns the request evaluating the view at now
+func (v *view) requestURL(now time.Time) string {
+	params := url.Values{"query": {v.Query}}
+	if v.Range <= 0 {
+		params.Set("time", strconv.FormatInt(now.Unix(), 10))
+	} else {
+		params.Set("start", strconv.FormatInt(now.Add(-v.Range).Unix(), 10))
+		params.Set("end", strconv.FormatInt(now.Unix(), 10))
+		params.Set("step", strconv.FormatFloat(v.Step.Seconds(), 'f', -1, 64))
+	}
+	return v.path() + "?" + params.Encode()
+}
+
+// viewMatchKey identifies the views a request can be answered from: the
+// path, the expression without insignificant whitespace and the step
+func viewMatchKey(path string, expr string, step time.Duration) string {
+	return path + "\x00" + compactExpr(expr) + "\x00" + step.String()
+}
+
+// compactExpr removes whitespace and comments outside of string literals
+// from a PromQL expression, so structurally identical expressions compare
+// equal
+func compactExpr(expr string) string {
+	var b strings.Builder
+	b.Grow(len(expr))
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; c {
+		case '"', '\'', '`':
+			end := skipString(expr, i)
+			b.WriteString(expr[i:end])
+			i = end
+		case ' ', '\t', '\n', '\r':
+			i++
+		case '#':
+			i = skipComment(expr, i)
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// StartViews evaluates the views on their schedules and serves matching
+// requests from their latest results. It must be called before the proxy
+// serves requests.
+func (p *HTTPCacheProxy) StartViews(views []View) {
+	if len(views) == 0 {
+		return
+	}
+
+	p.views = make(map[string][]*view, len(views))
+	for _, v := range views {
+		if v.Range > 0 && v.Step <= 0 {
+			v.Step = max(v.Range/250, time.Second)
+		}
+		mv := &view{View: v, key: p.keyPrefix + "view:" + v.Name}
+		matchKey := viewMatchKey(mv.path(), v.Query, v.Step)
+		p.views[matchKey] = append(p.views[matchKey], mv)
+
+		p.log.Info("Starting materialized view",
+			"name", v.Name,
+			"query", v.Query,
+			"interval", v.Interval,
+			"range", v.Range)
+		go p.runView(mv)
+	}
+}
+
+// runView evaluates a view every interval
+func (p *HTTPCacheProxy) runView(v *view) {
+	ticker := time.NewTicker(v.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.evaluateView(v, time.Now())
+		<-ticker.C
+	}
+}
+
+// evaluateView queries the upstream for the view and stores the result
+func (p *HTTPCacheProxy) evaluateView(v *view, now time.Time) {
+	req, err := http.NewRequest(http.MethodGet, v.requestURL(now), nil)
+	if err != nil {
+		p.log.Error("Failed to create view request", "view", v.Name, "error", err)
+		return
+	}
+
+	rec := &viewRecorder{header: make(http.Header)}
+	p.forwardRequest(rec, req, "", false)
+	if rec.status != http.StatusOK {
+		p.log.Warn("Failed to evaluate materialized view",
+			"view", v.Name,
+			"status", rec.status)
+		return
+	}
+
+	resp := Response{
+		Headers:    make(http.Header),
+		StatusCode: rec.status,
+		Body:       rec.body.Bytes(),
+		StoredAt:   now,
+	}
+	for name, values := range rec.header {
+		if name != "Via" && name != "X-Cache" && name != "Content-Length" {
+			resp.Headers[name] = values
+		}
+	}
+	data, err := encodeResponse(p.serializer, &resp)
+	if err != nil {
+		p.log.Error("Failed to marshal view result", "view", v.Name, "error", err)
+		return
+	}
+
+	// Results outlive a missed evaluation, but not a failing upstream
+	p.cacheSet(req.Context(), v.key, data, 2*v.Interval)
+	v.evaluatedAt.Store(now.Unix())
+	p.log.Debug("Evaluated materialized view", "view", v.Name, "size", len(resp.Body))
+}
+
+// tryServeView answers a query matching a materialized view from the
+// view's latest result. The requested evaluation time, or for range
+// queries the end and range, must be within the view's interval of the
+// result. Returns true if the request was answered.
+func (p *HTTPCacheProxy) tryServeView(w http.ResponseWriter, r *http.Request) bool {
+	if len(p.views) == 0 {
+		return false
+	}
+
+	query := r.URL.Query()
+	expr := query.Get("query")
+	if expr == "" {
+		return false
+	}
+	var step time.Duration
+	if r.URL.Path == "/api/v1/query_range" {
+		var ok bool
+		if step, ok = parseDuration(query.Get("step")); !ok {
+			return false
+		}
+	}
+
+	for _, v := range p.views[viewMatchKey(r.URL.Path, expr, step)] {
+		if !v.covers(query, time.Now()) {
+			continue
+		}
+		traceStep(r, "materialized_view", v.Name)
+		if p.tryServeCachedResponse(w, r, v.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the latest result of the view answers a query
+// with the given parameters
+func (v *view) covers(query url.Values, now time.Time) bool {
+	evaluatedAt := float64(v.evaluatedAt.Load())
+	if evaluatedAt == 0 {
+		return false
+	}
+	tolerance := v.Interval.Seconds()
+
+	if v.Range <= 0 {
+		t := float64(now.Unix())
+		if s := query.Get("time"); s != "" {
+			var ok bool
+			if t, ok = parseTime(s); !ok {
+				return false
+			}
+		}
+		return math.Abs(t-evaluatedAt) <= tolerance
+	}
+
+	start, hasStart := parseTime(query.Get("start"))
+	end, hasEnd := parseTime(query.Get("end"))
+	if !hasStart || !hasEnd {
+		return false
+	}
+	return math.Abs(end-evaluatedAt) <= tolerance && math.Abs(end-start-v.Range.Seconds()) <= tolerance
+}
+
+// viewRecorder captures the response of a view evaluation
+type viewRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *viewRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *viewRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *viewRecorder) WriteHeader(status int) {
+	r.status = status
+}
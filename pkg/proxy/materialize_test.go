@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestViewRequestURL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		view View
+		want string
+	}{
+		{View{Query: "up"}, "/api/v1/query?query=up&time=1700000000"},
+		{View{Query: "up", Range: time.Hour, Step: 30 * time.Second}, "/api/v1/query_range?end=1700000000&query=up&start=1699996400&step=30"},
+	}
+	for _, tt := range tests {
+		v := &view{View: tt.view}
+		if got := v.requestURL(now); got != tt.want {
+			t.Errorf("requestURL(%+v) = %s, want %s", tt.view, got, tt.want)
+		}
+	}
+}
+
+func TestCompactExpr(t *testing.T) {
+	tests := map[string]string{
+		"sum by (job) (\n  rate(up[5m]) # comment\n)": "sumby(job)(rate(up[5m]))",
+		`up{job="a b"}`: `up{job="a b"}`,
+		"up{job=`#x`} ": "up{job=`#x`}",
+	}
+	for expr, want := range tests {
+		if got := compactExpr(expr); got != want {
+			t.Errorf("compactExpr(%q) = %q, want %q", expr, got, want)
+		}
+	}
+}
+
+func TestViewCovers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	instant := &view{View: View{Interval: time.Minute}}
+	ranged := &view{View: View{Interval: time.Minute, Range: time.Hour}}
+	unevaluated := &view{View: View{Interval: time.Minute}}
+	instant.evaluatedAt.Store(now.Unix())
+	ranged.evaluatedAt.Store(now.Unix())
+
+	tests := []struct {
+		name  string
+		view  *view
+		query url.Values
+		want  bool
+	}{
+		{"instant now", instant, url.Values{}, true},
+		{"instant within interval", instant, url.Values{"time": {"1700000060"}}, true},
+		{"instant too old", instant, url.Values{"time": {"1699999900"}}, false},
+		{"instant bad time", instant, url.Values{"time": {"yesterday"}}, false},
+		{"not evaluated", unevaluated, url.Values{}, false},
+		{"range", ranged, url.Values{"start": {"1699996430"}, "end": {"1700000030"}}, true},
+		{"range too short", ranged, url.Values{"start": {"1699999000"}, "end": {"1700000000"}}, false},
+		{"range ends too early", ranged, url.Values{"start": {"1699992800"}, "end": {"1699996400"}}, false},
+		{"range without start", ranged, url.Values{"end": {"1700000000"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.view.covers(tt.query, now); got != tt.want {
+				t.Errorf("covers(%v) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeView(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	p.StartViews([]View{{Name: "jobs", Query: "sum by (job) (up)", Interval: time.Hour}})
+	// The first evaluation runs in the background
+	for p.views[viewMatchKey("/api/v1/query", "sum by (job) (up)", 0)][0].evaluatedAt.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	get := func(expr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		target := fmt.Sprintf("/api/v1/query?query=%s&time=%d", url.QueryEscape(expr), time.Now().Unix())
+		p.HandleRequest(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	// Whitespace doesn't matter, the expression does
+	if w := get("sum by(job)(up)"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("X-Cache of the view's query = %q, want HIT", w.Header().Get("X-Cache"))
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+	if w := get("sum by (instance) (up)"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache of another query = %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+}
@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// matrixSample is a float sample of a range query result
+type matrixSample struct {
+	// T is the timestamp in milliseconds
+	T int64
+	// V is the sample value
+	V float64
+}
+
+// histogramSample is a native histogram sample of a range query result
+type histogramSample struct {
+	// T is the timestamp in milliseconds
+	T int64
+	// H is the histogram
+	H nativeHistogram
+}
+
+// matrixSeries is a series of a range query result
+type matrixSeries struct {
+	Metric     json.RawMessage   `json:"metric"`
+	Values     []matrixSample    `json:"values,omitempty"`
+	Histograms []histogramSample `json:"histograms,omitempty"`
+}
+
+// matrix is a decoded range query response. Fields of the envelope and the
+// data section other than the result are kept as they are.
+type matrix struct {
+	envelope map[string]json.RawMessage
+	data     map[string]json.RawMessage
+	series   []matrixSeries
+}
+
+var (
+	// errNotMatrix is returned for responses that aren't successful range
+	// query results
+	errNotMatrix = errors.New("response is not a matrix")
+	// errNotCanonical is returned for sample values that wouldn't be
+	// written back the way the upstream formatted them
+	errNotCanonical = errors.New("sample value is not formatted like Prometheus does")
+)
+
+// parseMatrix decodes a range query response
+func parseMatrix(body []byte) (*matrix, error) {
+	m := &matrix{}
+	if err := json.Unmarshal(body, &m.envelope); err != nil {
+		return nil, err
+	}
+	if string(m.envelope["status"]) != `"success"` {
+		return nil, errNotMatrix
+	}
+	if err := json.Unmarshal(m.envelope["data"], &m.data); err != nil {
+		return nil, err
+	}
+	if string(m.data["resultType"]) != `"matrix"` {
+		return nil, errNotMatrix
+	}
+	if err := json.Unmarshal(m.data["result"], &m.series); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// cachedMatrix decodes the range query result of a cached response, stored
+// either parsed or as JSON
+func cachedMatrix(resp *Response) (*matrix, error) {
+	body := resp.Body
+	if resp.Compressed {
+		var err error
+		if body, err = decompressBody(body); err != nil {
+			return nil, err
+		}
+	}
+	if resp.Matrix {
+		return unmarshalMatrix(body)
+	}
+	return parseMatrix(body)
+}
+
+// encode returns the response in Prometheus' JSON format
+func (m *matrix) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.writeJSON(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSON streams the response in Prometheus' JSON format, one series at
+// a time, so large results are never held in memory twice
+func (m *matrix) writeJSON(w io.Writer) error {
+	bw := bufio.NewWriterSize(w, 32<<10)
+	bw.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+
+	var b []byte
+	for i, s := range m.series {
+		b = b[:0]
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = s.appendJSON(b)
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	bw.WriteByte(']')
+	writeRawFields(bw, m.data, "resultType", "result")
+	bw.WriteByte('}')
+	writeRawFields(bw, m.envelope, "status", "data")
+	bw.WriteByte('}')
+	return bw.Flush()
+}
+
+// writeRawFields writes the fields of an object other than the skipped
+// ones, sorted by name, each preceded by a comma
+func writeRawFields(w *bufio.Writer, fields map[string]json.RawMessage, skip ...string) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !slices.Contains(skip, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key, _ := json.Marshal(name)
+		w.WriteByte(',')
+		w.Write(key)
+		w.WriteByte(':')
+		w.Write(fields[name])
+	}
+}
+
+// appendJSON appends the series as a JSON object
+func (s *matrixSeries) appendJSON(b []byte) []byte {
+	b = append(b, `{"metric":`...)
+	if len(s.Metric) == 0 {
+		b = append(b, "{}"...)
+	} else {
+		b = append(b, s.Metric...)
+	}
+	if len(s.Values) > 0 {
+		b = append(b, `,"values":[`...)
+		for i, sample := range s.Values {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = sample.appendJSON(b)
+		}
+		b = append(b, ']')
+	}
+	if len(s.Histograms) > 0 {
+		b = append(b, `,"histograms":[`...)
+		for i, sample := range s.Histograms {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = sample.appendJSON(b)
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// writeMatrixBody streams a parsed range query result to the client,
+// gzip-compressed when accepted
+func writeMatrixBody(w http.ResponseWriter, r *http.Request, statusCode int, m *matrix) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+
+	// HEAD responses carry the length of the identity-encoded body
+	if r.Method == http.MethodHead {
+		var n byteCounter
+		m.writeJSON(&n)
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(n), 10))
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	if !acceptsGzip(r) {
+		w.WriteHeader(statusCode)
+		m.writeJSON(w)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	setGzipETag(w.Header())
+	w.WriteHeader(statusCode)
+	zw := gzip.NewWriter(w)
+	m.writeJSON(zw)
+	zw.Close()
+}
+
+// byteCounter is a writer counting the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// The parsed matrix encoding stores a range query result as:
+//
+//	uvarint length, envelope JSON without the data section
+//	uvarint length, data JSON without the result
+//	uvarint series count, then per series:
+//	        uvarint length, metric JSON
+//	        uvarint sample count, then per sample:
+//	                varint timestamp delta in milliseconds, 8 byte float64
+//	        uvarint histogram count, then per histogram:
+//	                varint timestamp delta in milliseconds, histogram
+//	                as written by nativeHistogram.appendBinary
+//
+// Timestamps are stored relative to the previous sample of the series,
+// which keeps evenly spaced samples at one or two bytes each.
+
+// marshalBinary returns the result in the parsed matrix encoding
+func (m *matrix) marshalBinary() ([]byte, error) {
+	envelope, err := marshalWithout(m.envelope, "data")
+	if err != nil {
+		return nil, err
+	}
+	data, err := marshalWithout(m.data, "result")
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(envelope) + len(data) + 3*binary.MaxVarintLen64
+	for _, s := range m.series {
+		size += len(s.Metric) + 3*binary.MaxVarintLen64 + 12*len(s.Values)
+		for _, h := range s.Histograms {
+			size += 16 + 25*len(h.H.Buckets) + 2*binary.MaxVarintLen64
+		}
+	}
+
+	b := make([]byte, 0, size)
+	b = appendBytes(b, envelope)
+	b = appendBytes(b, data)
+	b = binary.AppendUvarint(b, uint64(len(m.series)))
+	for _, s := range m.series {
+		b = appendBytes(b, s.Metric)
+
+		b = binary.AppendUvarint(b, uint64(len(s.Values)))
+		var last int64
+		for _, sample := range s.Values {
+			b = binary.AppendVarint(b, sample.T-last)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(sample.V))
+			last = sample.T
+		}
+
+		b = binary.AppendUvarint(b, uint64(len(s.Histograms)))
+		last = 0
+		for _, sample := range s.Histograms {
+			b = binary.AppendVarint(b, sample.T-last)
+			b = sample.H.appendBinary(b)
+			last = sample.T
+		}
+	}
+	return b, nil
+}
+
+// unmarshalMatrix decodes a result in the parsed matrix encoding
+func unmarshalMatrix(data []byte) (*matrix, error) {
+	d := binaryDecoder{data: data}
+	m := &matrix{}
+
+	if err := json.Unmarshal(d.bytes(), &m.envelope); d.err == nil && err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d.bytes(), &m.data); d.err == nil && err != nil {
+		return nil, err
+	}
+
+	count := d.count()
+	m.series = make([]matrixSeries, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		s := matrixSeries{Metric: d.bytes()}
+
+		values := d.count()
+		s.Values = make([]matrixSample, 0, values)
+		var t int64
+		for j := uint64(0); j < values && d.err == nil; j++ {
+			t += d.varint()
+			s.Values = append(s.Values, matrixSample{T: t, V: math.Float64frombits(d.uint64())})
+		}
+
+		histograms := d.count()
+		s.Histograms = make([]histogramSample, 0, histograms)
+		t = 0
+		for j := uint64(0); j < histograms && d.err == nil; j++ {
+			t += d.varint()
+			s.Histograms = append(s.Histograms, histogramSample{T: t, H: d.histogram()})
+		}
+
+		m.series = append(m.series, s)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+// marshalWithout encodes an object without one of its fields
+func marshalWithout(fields map[string]json.RawMessage, skip string) ([]byte, error) {
+	rest := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if name != skip {
+			rest[name] = value
+		}
+	}
+	return json.Marshal(rest)
+}
+
+// appendBytes appends a length-prefixed byte string
+func appendBytes(b []byte, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// parseTimestamp converts a JSON timestamp in seconds to milliseconds
+func parseTimestamp(raw json.RawMessage) (int64, error) {
+	seconds, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(seconds * 1000)), nil
+}
+
+// appendTimestamp appends a timestamp in milliseconds as JSON seconds
+func appendTimestamp(b []byte, ms int64) []byte {
+	return strconv.AppendFloat(b, float64(ms)/1000, 'f', -1, 64)
+}
+
+// UnmarshalJSON decodes a [<timestamp>, "<value>"] pair. Values must be
+// formatted the way Prometheus does, so that re-encoding them returns the
+// upstream's response unchanged.
+func (s *matrixSample) UnmarshalJSON(b []byte) error {
+	var pair [2]json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	t, err := parseTimestamp(pair[0])
+	if err != nil {
+		return err
+	}
+	var value string
+	if err := json.Unmarshal(pair[1], &value); err != nil {
+		return err
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if formatSampleValue(v) != value {
+		return errNotCanonical
+	}
+	s.T = t
+	s.V = v
+	return nil
+}
+
+// appendJSON appends the sample as a [<timestamp>, "<value>"] pair
+func (s matrixSample) appendJSON(b []byte) []byte {
+	b = append(b, '[')
+	b = appendTimestamp(b, s.T)
+	b = append(b, ',', '"')
+	b = append(b, formatSampleValue(s.V)...)
+	return append(b, '"', ']')
+}
+
+// UnmarshalJSON decodes a [<timestamp>, <histogram>] pair
+func (s *histogramSample) UnmarshalJSON(b []byte) error {
+	var pair [2]json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	t, err := parseTimestamp(pair[0])
+	if err != nil {
+		return err
+	}
+	s.T = t
+	return json.Unmarshal(pair[1], &s.H)
+}
+
+// appendJSON appends the sample as a [<timestamp>, <histogram>] pair
+func (s histogramSample) appendJSON(b []byte) []byte {
+	b = append(b, '[')
+	b = appendTimestamp(b, s.T)
+	b = append(b, ',')
+	b = s.H.appendJSON(b)
+	return append(b, ']')
+}
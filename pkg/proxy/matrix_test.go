@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const testMatrixBody = `{"status":"success","data":{"resultType":"matrix","result":[` +
+	`{"metric":{"__name__":"up","job":"api"},"values":[[1700000000,"1"],[1700000015,"0.5"],[1700000030.5,"NaN"]]},` +
+	`{"metric":{},"values":[[1700000000,"+Inf"],[1700000015,"-0.00001"]]}` +
+	`]},"warnings":["partial result"]}`
+
+func TestMatrixRoundTrip(t *testing.T) {
+	m, err := parseMatrix([]byte(testMatrixBody))
+	if err != nil {
+		t.Fatalf("parseMatrix: %v", err)
+	}
+	encoded, err := m.encode()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if string(encoded) != testMatrixBody {
+		t.Errorf("encode =\n%s\nwant\n%s", encoded, testMatrixBody)
+	}
+
+	data, err := m.marshalBinary()
+	if err != nil {
+		t.Fatalf("marshalBinary: %v", err)
+	}
+	decoded, err := unmarshalMatrix(data)
+	if err != nil {
+		t.Fatalf("unmarshalMatrix: %v", err)
+	}
+	if encoded, err = decoded.encode(); err != nil || string(encoded) != testMatrixBody {
+		t.Errorf("binary round trip =\n%s (%v)\nwant\n%s", encoded, err, testMatrixBody)
+	}
+
+	for n := range data {
+		if _, err := unmarshalMatrix(data[:n]); err == nil {
+			t.Errorf("unmarshalMatrix of %d of %d bytes succeeded", n, len(data))
+			break
+		}
+	}
+}
+
+func TestParseMatrixRejects(t *testing.T) {
+	tests := map[string]struct {
+		body string
+		want error
+	}{
+		"error":         {`{"status":"error","errorType":"bad_data","error":"parse error"}`, errNotMatrix},
+		"vector":        {`{"status":"success","data":{"resultType":"vector","result":[]}}`, errNotMatrix},
+		"not canonical": {`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1.0"]]}]}}`, errNotCanonical},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseMatrix([]byte(tt.body)); !errors.Is(err, tt.want) {
+				t.Errorf("parseMatrix = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatrixPrepend(t *testing.T) {
+	series := func(metric string, times ...int64) matrixSeries {
+		s := matrixSeries{Metric: json.RawMessage(metric)}
+		for _, ts := range times {
+			s.Values = append(s.Values, matrixSample{T: ts, V: float64(ts)})
+		}
+		return s
+	}
+
+	head := &matrix{series: []matrixSeries{
+		series(`{"job":"both"}`, 1000, 2000, 3000),
+		series(`{"job":"head"}`, 1000),
+		series(`{"job":"empty head"}`),
+	}}
+	tail := &matrix{series: []matrixSeries{
+		series(`{"job":"tail"}`, 4000),
+		series(`{"job":"both"}`, 2000, 3000, 4000, 5000),
+		series(`{"job":"empty head"}`, 3000),
+	}}
+	tail.prepend(head)
+
+	want := []matrixSeries{
+		series(`{"job":"both"}`, 1000, 2000, 3000, 4000, 5000),
+		series(`{"job":"head"}`, 1000),
+		series(`{"job":"empty head"}`, 3000),
+		series(`{"job":"tail"}`, 4000),
+	}
+	if !reflect.DeepEqual(tail.series, want) {
+		t.Errorf("prepend =\n%+v\nwant\n%+v", tail.series, want)
+	}
+}
+
+func TestMatrixHitETag(t *testing.T) {
+	// Field order and the empty warnings differ from the re-encoded JSON
+	const body = `{"data":{"result":[{"values":[[1700000000,"1"]],"metric":{"__name__":"up"}}],"resultType":"matrix"},"status":"success","warnings":[]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{ParseMatrix: true})
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&start=1699999980&end=1700000040&step=60", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		p.HandleRequest(w, r)
+		return w
+	}
+
+	miss := get("")
+	if miss.Header().Get("X-Cache") != "MISS" || miss.Body.String() != body {
+		t.Fatalf("miss = %s %q, want the upstream's body", miss.Header().Get("X-Cache"), miss.Body.String())
+	}
+	hit := get("")
+	if hit.Header().Get("X-Cache") != "HIT" || hit.Body.String() == body {
+		t.Fatalf("hit = %s %q, want a re-encoded body", hit.Header().Get("X-Cache"), hit.Body.String())
+	}
+	// The strong ETag of the upstream's bytes doesn't label the hit's
+	if etag := hit.Header().Get("ETag"); etag != "W/"+miss.Header().Get("ETag") {
+		t.Errorf("hit ETag = %s, want the weak form of %s", etag, miss.Header().Get("ETag"))
+	}
+	if w := get(miss.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want 304", w.Code)
+	}
+}
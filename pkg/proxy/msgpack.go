@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errShortBuffer is returned when a msgpack value is truncated
+var errShortBuffer = errors.New("msgpack: unexpected end of data")
+
+// msgpackSerializer encodes responses as a msgpack map, which is compact
+// and can still be inspected with standard msgpack tooling
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Name() string {
+	return "msgpack"
+}
+
+func (msgpackSerializer) Marshal(resp *Response) ([]byte, error) {
+	b := make([]byte, 0, len(resp.Body)+256)
+
+	b = appendMapLen(b, 6)
+
+	b = appendString(b, "headers")
+	b = appendMapLen(b, len(resp.Headers))
+	for _, name := range sortedHeaderNames(resp.Headers) {
+		values := resp.Headers[name]
+		b = appendString(b, name)
+		b = appendArrayLen(b, len(values))
+		for _, value := range values {
+			b = appendString(b, value)
+		}
+	}
+
+	b = appendString(b, "status_code")
+	b = appendInt(b, int64(resp.StatusCode))
+
+	b = appendString(b, "body")
+	b = appendBin(b, resp.Body)
+
+	b = appendString(b, "compressed")
+	b = appendBool(b, resp.Compressed)
+
+	b = appendString(b, "matrix")
+	b = appendBool(b, resp.Matrix)
+
+	b = appendString(b, "stored_at")
+	b = appendInt(b, resp.StoredAt.UnixNano())
+
+	return b, nil
+}
+
+func (msgpackSerializer) Unmarshal(data []byte, resp *Response) error {
+	d := &msgpackDecoder{data: data}
+
+	fields, err := d.mapLen()
+	if err != nil {
+		return err
+	}
+
+	*resp = Response{Headers: make(http.Header)}
+	for i := 0; i < fields; i++ {
+		key, err := d.str()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "headers":
+			n, err := d.mapLen()
+			if err != nil {
+				return err
+			}
+			for j := 0; j < n; j++ {
+				name, err := d.str()
+				if err != nil {
+					return err
+				}
+				count, err := d.arrayLen()
+				if err != nil {
+					return err
+				}
+				values := make([]string, count)
+				for k := range values {
+					if values[k], err = d.str(); err != nil {
+						return err
+					}
+				}
+				resp.Headers[name] = values
+			}
+		case "status_code":
+			status, err := d.int()
+			if err != nil {
+				return err
+			}
+			resp.StatusCode = int(status)
+		case "body":
+			if resp.Body, err = d.bin(); err != nil {
+				return err
+			}
+		case "compressed":
+			if resp.Compressed, err = d.bool(); err != nil {
+				return err
+			}
+		case "matrix":
+			if resp.Matrix, err = d.bool(); err != nil {
+				return err
+			}
+		case "stored_at":
+			storedAt, err := d.int()
+			if err != nil {
+				return err
+			}
+			resp.StoredAt = time.Unix(0, storedAt)
+		default:
+			// Fields of newer versions are skipped so their entries stay
+			// readable
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func appendMapLen(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func appendArrayLen(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= 0xff:
+		b = append(b, 0xd9, byte(n))
+	case n <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendBin(b []byte, data []byte) []byte {
+	switch n := len(data); {
+	case n <= 0xff:
+		b = append(b, 0xc4, byte(n))
+	case n <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, data...)
+}
+
+func appendInt(b []byte, v int64) []byte {
+	if v >= 0 && v < 128 {
+		return append(b, byte(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+// msgpackDecoder reads the msgpack subset produced by msgpackSerializer
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errShortBuffer
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// count checks an element count read from the data, which can't exceed
+// the remaining bytes as every element takes at least one
+func (d *msgpackDecoder) count(n uint64, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errShortBuffer
+	}
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) mapLen() (int, error) {
+	t, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case t&0xf0 == 0x80:
+		return d.count(uint64(t&0x0f), nil)
+	case t == 0xde:
+		return d.count(d.uint(2))
+	case t == 0xdf:
+		return d.count(d.uint(4))
+	}
+	return 0, fmt.Errorf("msgpack: expected map, got 0x%02x", t)
+}
+
+func (d *msgpackDecoder) arrayLen() (int, error) {
+	t, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case t&0xf0 == 0x90:
+		return d.count(uint64(t&0x0f), nil)
+	case t == 0xdc:
+		return d.count(d.uint(2))
+	case t == 0xdd:
+		return d.count(d.uint(4))
+	}
+	return 0, fmt.Errorf("msgpack: expected array, got 0x%02x", t)
+}
+
+// skip reads past the next value of any type, iterating rather than
+// recursing into arrays and maps so nesting can't exhaust the stack
+func (d *msgpackDecoder) skip() error {
+	for pending := 1; pending > 0; pending-- {
+		t, err := d.byte()
+		if err != nil {
+			return err
+		}
+
+		var n uint64
+		switch {
+		case t < 0x80, t >= 0xe0, t == 0xc0, t == 0xc2, t == 0xc3:
+			// fixint, nil and bool carry no further bytes
+		case t&0xf0 == 0x80, t&0xf0 == 0x90:
+			n = uint64(t & 0x0f)
+			if t&0xf0 == 0x80 {
+				n *= 2
+			}
+		case t&0xe0 == 0xa0:
+			_, err = d.next(int(t & 0x1f))
+		case t == 0xc4, t == 0xd9:
+			err = d.skipSized(1, 0)
+		case t == 0xc5, t == 0xda:
+			err = d.skipSized(2, 0)
+		case t == 0xc6, t == 0xdb:
+			err = d.skipSized(4, 0)
+		case t == 0xc7, t == 0xc8, t == 0xc9:
+			// ext 8/16/32: length, type byte, data
+			err = d.skipSized(1<<(t-0xc7), 1)
+		case t == 0xca:
+			_, err = d.next(4)
+		case t == 0xcb:
+			_, err = d.next(8)
+		case t >= 0xcc && t <= 0xcf:
+			_, err = d.next(1 << (t - 0xcc))
+		case t >= 0xd0 && t <= 0xd3:
+			_, err = d.next(1 << (t - 0xd0))
+		case t >= 0xd4 && t <= 0xd8:
+			// fixext: type byte and 1 to 16 bytes of data
+			_, err = d.next(1 + 1<<(t-0xd4))
+		case t == 0xdc:
+			n, err = d.uint(2)
+		case t == 0xdd:
+			n, err = d.uint(4)
+		case t == 0xde:
+			n, err = d.uint(2)
+			n *= 2
+		case t == 0xdf:
+			n, err = d.uint(4)
+			n *= 2
+		default:
+			return fmt.Errorf("msgpack: invalid type 0x%02x", t)
+		}
+		if err != nil {
+			return err
+		}
+		if n > uint64(len(d.data)-d.pos) {
+			return errShortBuffer
+		}
+		pending += int(n)
+	}
+	return nil
+}
+
+// skipSized reads past a value with a length of size bytes followed by
+// extra bytes and the data
+func (d *msgpackDecoder) skipSized(size int, extra int) error {
+	n, err := d.uint(size)
+	if err != nil {
+		return err
+	}
+	_, err = d.next(int(n) + extra)
+	return err
+}
+
+func (d *msgpackDecoder) str() (string, error) {
+	t, err := d.byte()
+	if err != nil {
+		return "", err
+	}
+
+	var n uint64
+	switch {
+	case t&0xe0 == 0xa0:
+		n = uint64(t & 0x1f)
+	case t == 0xd9:
+		n, err = d.uint(1)
+	case t == 0xda:
+		n, err = d.uint(2)
+	case t == 0xdb:
+		n, err = d.uint(4)
+	default:
+		return "", fmt.Errorf("msgpack: expected string, got 0x%02x", t)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := d.next(int(n))
+	return string(b), err
+}
+
+func (d *msgpackDecoder) bin() ([]byte, error) {
+	t, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint64
+	switch t {
+	case 0xc4:
+		n, err = d.uint(1)
+	case 0xc5:
+		n, err = d.uint(2)
+	case 0xc6:
+		n, err = d.uint(4)
+	default:
+		return nil, fmt.Errorf("msgpack: expected bin, got 0x%02x", t)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := d.next(int(n))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (d *msgpackDecoder) int() (int64, error) {
+	t, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case t < 0x80:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t >= 0xcc && t <= 0xcf:
+		n, err := d.uint(1 << (t - 0xcc))
+		return int64(n), err
+	case t >= 0xd0 && t <= 0xd3:
+		size := 1 << (t - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return 0, err
+		}
+		switch size {
+		case 1:
+			return int64(int8(n)), nil
+		case 2:
+			return int64(int16(n)), nil
+		case 4:
+			return int64(int32(n)), nil
+		}
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("msgpack: expected integer, got 0x%02x", t)
+}
+
+func (d *msgpackDecoder) bool() (bool, error) {
+	t, err := d.byte()
+	if err != nil {
+		return false, err
+	}
+	switch t {
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	}
+	return false, fmt.Errorf("msgpack: expected bool, got 0x%02x", t)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMsgpackSkipsUnknownFields(t *testing.T) {
+	unknown := map[string][]byte{
+		"nil":         {0xc0},
+		"string":      appendString(nil, "value"),
+		"bin":         appendBin(nil, []byte{1, 2, 3}),
+		"float64":     {0xcb, 0, 0, 0, 0, 0, 0, 0, 0},
+		"uint32":      {0xce, 0, 0, 1, 0},
+		"negative":    {0xff},
+		"fixext":      {0xd5, 0x01, 0xaa, 0xbb},
+		"ext8":        {0xc7, 0x02, 0x01, 0xaa, 0xbb},
+		"nested":      appendString(appendString(appendString(appendArrayLen(appendString(appendMapLen(nil, 2), "a"), 1), "b"), "c"), "d"),
+		"array16":     {0xdc, 0x00, 0x02, 0xc2, 0xc3},
+		"empty map32": {0xdf, 0, 0, 0, 0},
+	}
+
+	for name, value := range unknown {
+		t.Run(name, func(t *testing.T) {
+			b := appendMapLen(nil, 3)
+			b = appendString(b, "status_code")
+			b = appendInt(b, 200)
+			b = appendString(b, "added_later")
+			b = append(b, value...)
+			b = appendString(b, "body")
+			b = appendBin(b, []byte("ok"))
+
+			var resp Response
+			if err := (msgpackSerializer{}).Unmarshal(b, &resp); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if resp.StatusCode != 200 || !bytes.Equal(resp.Body, []byte("ok")) {
+				t.Errorf("got status %d body %q, want 200 %q", resp.StatusCode, resp.Body, "ok")
+			}
+		})
+	}
+}
+
+func TestMsgpackRejectsOversizedCounts(t *testing.T) {
+	tests := map[string][]byte{
+		"header values": append(appendString(append(appendString(appendMapLen(nil, 1), "headers"), 0x81), "Vary"), 0xdd, 0xff, 0xff, 0xff, 0xff),
+		"headers":       append(appendString(appendMapLen(nil, 1), "headers"), 0xdf, 0xff, 0xff, 0xff, 0xff),
+		"fields":        {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"skipped array": append(appendString(appendMapLen(nil, 1), "added_later"), 0xdd, 0xff, 0xff, 0xff, 0xff),
+		"skipped map":   append(appendString(appendMapLen(nil, 1), "added_later"), 0xdf, 0x7f, 0xff, 0xff, 0xff),
+		"skipped bin":   append(appendString(appendMapLen(nil, 1), "added_later"), 0xc6, 0xff, 0xff, 0xff, 0xff),
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			var resp Response
+			if err := (msgpackSerializer{}).Unmarshal(data, &resp); !errors.Is(err, errShortBuffer) {
+				t.Errorf("Unmarshal = %v, want %v", err, errShortBuffer)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Policies of paths outside the API
+const (
+	// PathCache caches responses like a generic HTTP cache
+	PathCache = "cache"
+	// PathProxy forwards requests to the upstream without caching
+	PathProxy = "proxy"
+	// PathBlock rejects requests with 403 Forbidden
+	PathBlock = "block"
+)
+
+// PathHandler returns the handler applying a policy to requests of paths
+// outside the API
+func (p *HTTPCacheProxy) PathHandler(policy string) (http.HandlerFunc, error) {
+	switch policy {
+	case PathCache:
+		return p.HandleGeneric, nil
+	case PathProxy:
+		return p.HandlePassthrough, nil
+	case PathBlock:
+		return p.handleBlocked, nil
+	}
+	return nil, fmt.Errorf("unknown path policy %q, expected cache, proxy or block", policy)
+}
+
+// HandlePassthrough forwards requests to the upstream without caching, so
+// promcached can front pages such as the Prometheus UI. Conditional
+// requests are passed on as sent.
+func (p *HTTPCacheProxy) HandlePassthrough(w http.ResponseWriter, r *http.Request) {
+	// Record internal steps in a response header when debugging
+	if p.opts.DebugTrace {
+		var trace *Trace
+		r, trace = withTrace(r)
+		w = &traceWriter{ResponseWriter: w, trace: trace}
+	}
+
+	// Reject requests looping back through promcached
+	if p.checkLoop(w, r) {
+		return
+	}
+
+	startTime := time.Now()
+	sw := &sizeWriter{ResponseWriter: w}
+	defer func() {
+		p.metrics.RecordResponse("uncacheable", time.Since(startTime).Seconds(), sw.size)
+	}()
+
+	conditional := make(http.Header)
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		if values := r.Header.Values(name); len(values) > 0 {
+			conditional[name] = values
+		}
+	}
+	resp, body, err := p.fetchGeneric(r, conditional)
+	if err != nil {
+		p.writeGenericError(sw, r, err)
+		return
+	}
+	p.writeGeneric(sw, r, resp.StatusCode, resp.Header, body, false, "MISS")
+}
+
+// handleBlocked rejects requests to blocked paths
+func (p *HTTPCacheProxy) handleBlocked(w http.ResponseWriter, r *http.Request) {
+	p.log.WarnContext(r.Context(), "Rejecting request to blocked path",
+		"path", r.URL.Path,
+		"method", r.Method)
+	http.Error(w, "Path blocked by promcache", http.StatusForbidden)
+}
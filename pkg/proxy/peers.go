@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// Peers shares the cache with other promcached instances, each entry being
+// stored only by the peer owning its key
+type Peers interface {
+	// Owner returns the peer owning key, remote is false if this instance
+	// owns it
+	Owner(key string) (peer string, remote bool)
+	// PreviousOwner returns the peer that owned key before the last
+	// membership change while the key is handed off to its new owner, ok
+	// is false otherwise
+	PreviousOwner(key string) (peer string, remote bool, ok bool)
+	// Get fetches the entry of key from peer
+	Get(ctx context.Context, peer string, key string) ([]byte, bool, error)
+	// Set stores the entry of key on peer
+	Set(ctx context.Context, peer string, key string, value []byte, ttl time.Duration) error
+}
+
+// cacheGet looks up key in the cache of its owner. While the key is handed
+// off after a membership change, misses are looked up at its previous
+// owner. Errors are returned when the owning peer can't be reached.
+func (p *HTTPCacheProxy) cacheGet(ctx context.Context, key string) ([]byte, bool, error) {
+	if p.opts.Peers == nil {
+		value, found := p.cache.Get(ctx, key)
+		return value, found, nil
+	}
+
+	peer, remote := p.opts.Peers.Owner(key)
+	value, found, err := p.peerGet(ctx, peer, remote, key)
+	if found || err != nil {
+		return value, found, err
+	}
+	if peer, remote, ok := p.opts.Peers.PreviousOwner(key); ok {
+		// The previous owner being unreachable is just a miss, the owner
+		// answered already
+		value, found, _ = p.peerGet(ctx, peer, remote, key)
+	}
+	return value, found, nil
+}
+
+// peerGet looks up key in the cache of peer, the local cache if remote is
+// false
+func (p *HTTPCacheProxy) peerGet(ctx context.Context, peer string, remote bool, key string) ([]byte, bool, error) {
+	if !remote {
+		value, found := p.cache.Get(ctx, key)
+		return value, found, nil
+	}
+	value, found, err := p.opts.Peers.Get(ctx, peer, key)
+	if err != nil {
+		p.log.Warn("Failed to get entry from peer",
+			"peer", peer,
+			"key", key,
+			"error", err)
+	}
+	return value, found, err
+}
+
+// cacheSet stores key in the cache of its owner and, while the key is
+// handed off after a membership change, of its previous owner, so
+// instances still routing by the previous ring find it too. Entries owned
+// by peers are sent in the background so the client doesn't wait for
+// them. Entries are stored even if ctx is canceled, the response was
+// fetched already.
+func (p *HTTPCacheProxy) cacheSet(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if p.opts.Peers == nil {
+		p.cache.Set(context.WithoutCancel(ctx), key, value, ttl)
+		return
+	}
+
+	peer, remote := p.opts.Peers.Owner(key)
+	p.peerSet(ctx, peer, remote, key, value, ttl)
+	if peer, remote, ok := p.opts.Peers.PreviousOwner(key); ok {
+		p.peerSet(ctx, peer, remote, key, value, ttl)
+	}
+}
+
+// peerSet stores key in the cache of peer, the local cache if remote is
+// false
+func (p *HTTPCacheProxy) peerSet(ctx context.Context, peer string, remote bool, key string, value []byte, ttl time.Duration) {
+	if !remote {
+		p.cache.Set(context.WithoutCancel(ctx), key, value, ttl)
+		return
+	}
+	p.inflight.Add(1)
+	go func() {
+		defer p.inflight.Done()
+		if err := p.opts.Peers.Set(context.Background(), peer, key, value, ttl); err != nil {
+			p.log.Warn("Failed to store entry on peer",
+				"peer", peer,
+				"key", key,
+				"error", err)
+		}
+	}()
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// handoffPeers are Peers with one remote owner of every key, handed off
+// from this instance
+type handoffPeers struct {
+	mu      sync.Mutex
+	handoff bool
+	entries map[string][]byte
+}
+
+func (p *handoffPeers) Owner(key string) (string, bool) {
+	return "http://b:9091", true
+}
+
+func (p *handoffPeers) PreviousOwner(key string) (string, bool, bool) {
+	return "http://a:9091", false, p.handoff
+}
+
+func (p *handoffPeers) Get(ctx context.Context, peer string, key string) ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	value, found := p.entries[key]
+	return value, found, nil
+}
+
+func (p *handoffPeers) Set(ctx context.Context, peer string, key string, value []byte, ttl time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries[key] = value
+	return nil
+}
+
+func TestCacheHandoff(t *testing.T) {
+	local := newMapCache()
+	peers := &handoffPeers{handoff: true, entries: make(map[string][]byte)}
+	p := New("http://prometheus:9090", local, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{Peers: peers})
+	ctx := context.Background()
+
+	// Entries of the previous owner are found during the handoff
+	local.Set(ctx, "old", []byte("old"), time.Minute)
+	if value, found, err := p.cacheGet(ctx, "old"); err != nil || !found || string(value) != "old" {
+		t.Errorf("cacheGet(old) = %q, %v, %v during the handoff, want the previous owner's entry", value, found, err)
+	}
+
+	// New entries are stored on both owners during the handoff
+	p.cacheSet(ctx, "new", []byte("new"), time.Minute)
+	p.inflight.Wait()
+	if _, found := local.Get(ctx, "new"); !found {
+		t.Error("new entry isn't stored on the previous owner")
+	}
+	if _, found, _ := peers.Get(ctx, "http://b:9091", "new"); !found {
+		t.Error("new entry isn't stored on the owner")
+	}
+
+	// After the handoff only the owner is used
+	peers.handoff = false
+	if _, found, _ := p.cacheGet(ctx, "old"); found {
+		t.Error("previous owner's entry is found after the handoff")
+	}
+	p.cacheSet(ctx, "newer", []byte("newer"), time.Minute)
+	p.inflight.Wait()
+	if _, found := local.Get(ctx, "newer"); found {
+		t.Error("entry is stored on the previous owner after the handoff")
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// adminPathPrefix is the prefix of Prometheus' TSDB admin endpoints
+const adminPathPrefix = "/api/v1/admin/"
+
+// writePaths are the endpoints ingesting samples into the upstream
+var writePaths = []string{"/api/v1/write", "/api/v1/otlp/v1/metrics"}
+
+// isDangerousEndpoint reports whether path modifies the upstream's data or
+// state, such as deleting series or writing samples
+func isDangerousEndpoint(path string) bool {
+	if strings.HasPrefix(path, adminPathPrefix) {
+		return true
+	}
+	for _, writePath := range writePaths {
+		if path == writePath {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEndpointPolicy rejects requests to admin and write endpoints with
+// 403 Forbidden unless their path is explicitly allowed. Returns true if
+// the request was rejected.
+func (p *HTTPCacheProxy) checkEndpointPolicy(w http.ResponseWriter, r *http.Request) bool {
+	if !isDangerousEndpoint(r.URL.Path) || p.allowedEndpoints[r.URL.Path] {
+		return false
+	}
+
+	traceStep(r, "endpoint_denied", r.URL.Path)
+	p.log.WarnContext(r.Context(), "Rejecting request to blocked endpoint",
+		"path", r.URL.Path,
+		"method", r.Method)
+	http.Error(w, "Endpoint blocked by promcache", http.StatusForbidden)
+	return true
+}
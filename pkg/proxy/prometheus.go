@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Empty result caching policies
+const (
+	// EmptyResultCache caches empty results like any other response
+	EmptyResultCache = "cache"
+	// EmptyResultSkip never caches empty results
+	EmptyResultSkip = "skip"
+	// EmptyResultShort caches empty results with a shorter TTL
+	EmptyResultShort = "short"
+)
+
+// apiEnvelope is the common envelope of Prometheus HTTP API responses
+type apiEnvelope struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// queryData is the data section of query and query_range responses
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// isValidResponse reports whether body is a well-formed Prometheus API
+// response with status success. Truncated bodies and HTML error pages from
+// intermediate proxies fail this check.
+func isValidResponse(body []byte) bool {
+	var envelope apiEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return false
+	}
+	return envelope.Status == "success"
+}
+
+// isEmptyResult reports whether body is a Prometheus API response without
+// any results, either an empty query result or an empty data list as
+// returned by the series and label endpoints
+func isEmptyResult(body []byte) bool {
+	var envelope apiEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return false
+	}
+	if envelope.Status != "success" {
+		return false
+	}
+
+	data := bytes.TrimSpace(envelope.Data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return true
+	}
+
+	switch data[0] {
+	case '[':
+		return isEmptyArray(data)
+	case '{':
+		var qd queryData
+		if err := json.Unmarshal(data, &qd); err != nil || qd.Result == nil {
+			return false
+		}
+		result := bytes.TrimSpace(qd.Result)
+		return bytes.Equal(result, []byte("null")) || isEmptyArray(result)
+	}
+	return false
+}
+
+// isEmptyArray reports whether raw is an empty JSON array
+func isEmptyArray(raw []byte) bool {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return false
+	}
+	return len(items) == 0
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// promqlKeywords are identifiers that are never metric names, including
+// aggregation operators written before their by or without clause
+var promqlKeywords = map[string]bool{
+	"sum": true, "min": true, "max": true, "avg": true, "group": true,
+	"stddev": true, "stdvar": true, "count": true, "count_values": true,
+	"bottomk": true, "topk": true, "quantile": true,
+	"limitk": true, "limit_ratio": true,
+	"and": true, "or": true, "unless": true, "atan2": true,
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true, "bool": true, "offset": true,
+	"start": true, "end": true, "inf": true, "nan": true,
+}
+
+// labelListKeywords are followed by a parenthesized list of label names
+var labelListKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true,
+}
+
+// nameMatcher matches an equality matcher on the metric name inside braces
+var nameMatcher = regexp.MustCompile(`__name__\s*=\s*("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`[^`]*`" + `)`)
+
+// selector is the position of a vector selector within an expression
+type selector struct {
+	// name is the metric name, empty for selectors with only matchers
+	name string
+	// nameEnd is the index after the metric name
+	nameEnd int
+	// matchers are the bounds of the braces holding the label matchers,
+	// -1 if the selector has none
+	matchersStart, matchersEnd int
+}
+
+// selectors returns the vector selectors of a PromQL expression or series
+// selector. It is a lexical scan rather than a full parse: identifiers
+// outside of strings, comments, label matchers, ranges and label lists
+// that aren't function calls are taken to be metric names, and every brace
+// group is taken to be a set of label matchers. Keywords are metric names
+// too where PromQL's grammar reads them as such, e.g. a lone sum.
+func selectors(expr string) []selector {
+	var sels []selector
+	var lastIdent string
+	// operand is set where an operand is expected rather than an operator
+	operand := true
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == '#':
+			i = skipComment(expr, i)
+		case c == '"' || c == '\'' || c == '`':
+			i = skipString(expr, i)
+			lastIdent = ""
+			operand = false
+		case c == '{':
+			end := skipGroup(expr, i, '{', '}')
+			sels = append(sels, selector{nameEnd: i, matchersStart: i, matchersEnd: end})
+			i = end
+			lastIdent = ""
+			operand = false
+		case c == '[':
+			i = skipGroup(expr, i, '[', ']')
+			lastIdent = ""
+			operand = false
+		case c == '(' && labelListKeywords[lastIdent]:
+			i = skipGroup(expr, i, '(', ')')
+			lastIdent = ""
+			operand = true
+		case isIdentStart(c):
+			start := i
+			for i < len(expr) && isIdentChar(expr[i]) {
+				i++
+			}
+			ident := expr[start:i]
+			lastIdent = strings.ToLower(ident)
+
+			// Function calls and keywords aren't metric names
+			next := skipSpace(expr, i)
+			if next < len(expr) && expr[next] == '(' && !labelListKeywords[lastIdent] {
+				operand = true
+				continue
+			}
+			if promqlKeywords[lastIdent] && !(operand && keywordIsMetric(lastIdent, expr, next)) {
+				operand = lastIdent != "offset"
+				continue
+			}
+
+			sel := selector{name: ident, nameEnd: i, matchersStart: -1, matchersEnd: -1}
+			if next < len(expr) && expr[next] == '{' {
+				sel.matchersStart = next
+				sel.matchersEnd = skipGroup(expr, next, '{', '}')
+				i = sel.matchersEnd
+			}
+			sels = append(sels, sel)
+			lastIdent = ""
+			operand = false
+		case c >= '0' && c <= '9' || c == '.':
+			// Skip numbers and durations such as 5m or 1e3
+			for i < len(expr) && (isIdentChar(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			lastIdent = ""
+			operand = false
+		default:
+			switch c {
+			case ' ', '\t', '\n', '\r':
+			case ')':
+				lastIdent = ""
+				operand = false
+			default:
+				lastIdent = ""
+				operand = true
+			}
+			i++
+		}
+	}
+	return sels
+}
+
+// keywordIsMetric reports whether the keyword kw, found where an operand is
+// expected and followed by the byte at next, is a metric name. PromQL reads
+// keywords such as sum, by or offset as metric names unless they start an
+// aggregation, modifier or function call.
+func keywordIsMetric(kw string, expr string, next int) bool {
+	if kw == "inf" || kw == "nan" {
+		// Numbers, not identifiers
+		return false
+	}
+	if next >= len(expr) {
+		return true
+	}
+	switch c := expr[next]; c {
+	case ')', ',', ']', '[', '{', '@', '*', '/', '%', '^', '=', '!', '<', '>':
+		return true
+	case '+', '-':
+		// bool may precede a signed number
+		return kw != "bool"
+	default:
+		if !isIdentStart(c) {
+			return false
+		}
+		end := next
+		for end < len(expr) && isIdentChar(expr[end]) {
+			end++
+		}
+		switch strings.ToLower(expr[next:end]) {
+		case "offset", "and", "or", "unless", "atan2":
+			return true
+		}
+		return false
+	}
+}
+
+// metricNames returns the metric names referenced by a PromQL expression,
+// including __name__ equality matchers
+func metricNames(expr string) []string {
+	var names []string
+	for _, sel := range selectors(expr) {
+		if sel.name != "" {
+			names = append(names, sel.name)
+		}
+		if sel.matchersStart >= 0 {
+			for _, m := range nameMatcher.FindAllStringSubmatch(expr[sel.matchersStart:sel.matchersEnd], -1) {
+				names = append(names, strings.Trim(m[1], "\"'`"))
+			}
+		}
+	}
+	return names
+}
+
+// injectMatcher adds the label matcher name="value" to every vector
+// selector of expr. Matchers are ANDed, so a conflicting matcher already in
+// the selector can only narrow the result further.
+func injectMatcher(expr string, name string, value string) string {
+	matcher := name + "=" + strconv.Quote(value)
+
+	var b strings.Builder
+	b.Grow(len(expr) + len(matcher)*4)
+	last := 0
+	for _, sel := range selectors(expr) {
+		if sel.matchersStart < 0 {
+			b.WriteString(expr[last:sel.nameEnd])
+			b.WriteString("{" + matcher + "}")
+			last = sel.nameEnd
+			continue
+		}
+
+		// Insert before the closing brace, after any existing matchers
+		closing := sel.matchersEnd - 1
+		if closing < sel.matchersStart || expr[closing] != '}' {
+			// Unterminated matchers are left for the upstream to reject
+			continue
+		}
+		b.WriteString(expr[last:closing])
+		if lastToken := lastSignificant(expr[sel.matchersStart+1 : closing]); lastToken != 0 && lastToken != ',' {
+			b.WriteByte(',')
+		}
+		b.WriteString(matcher)
+		last = closing
+	}
+	b.WriteString(expr[last:])
+	return b.String()
+}
+
+// lastSignificant returns the last byte of s outside of whitespace and
+// comments, 0 if there is none
+func lastSignificant(s string) byte {
+	var last byte
+	for i := 0; i < len(s); {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n', '\r':
+			i++
+		case '#':
+			i = skipComment(s, i)
+		case '"', '\'', '`':
+			i = skipString(s, i)
+			last = c
+		default:
+			last = c
+			i++
+		}
+	}
+	return last
+}
+
+// isIdentStart reports whether c can start a metric name
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+// isIdentChar reports whether c can be part of a metric name
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// skipSpace returns the index of the first byte at or after i that is
+// neither whitespace nor part of a comment
+func skipSpace(expr string, i int) int {
+	for i < len(expr) {
+		switch expr[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		case '#':
+			i = skipComment(expr, i)
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipComment returns the index after the # comment starting at i, which
+// runs to the end of the line
+func skipComment(expr string, i int) int {
+	if end := strings.IndexByte(expr[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(expr)
+}
+
+// skipString returns the index after the string literal starting at i. A
+// # inside it is part of the string; callers skip comments before they
+// could mistake a quote in one for the start of a string.
+func skipString(expr string, i int) int {
+	quote := expr[i]
+	for i++; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && quote != '`':
+			i++
+		case expr[i] == quote:
+			return i + 1
+		}
+	}
+	return len(expr)
+}
+
+// skipGroup returns the index after the group opened at i, skipping
+// nested groups, string literals and comments
+func skipGroup(expr string, i int, open, close byte) int {
+	depth := 0
+	for i < len(expr) {
+		switch expr[i] {
+		case '"', '\'', '`':
+			i = skipString(expr, i)
+			continue
+		case '#':
+			i = skipComment(expr, i)
+			continue
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(expr)
+}
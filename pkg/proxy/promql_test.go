@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestInjectMatcher(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"bare metric", `up`, `up{namespace="team-a"}`},
+		{"existing matchers", `up{job="api"}`, `up{job="api",namespace="team-a"}`},
+		{"trailing comma", `up{job="api",}`, `up{job="api",namespace="team-a"}`},
+		{"empty braces", `up{}`, `up{namespace="team-a"}`},
+		{"matchers only", `{__name__="up"}`, `{__name__="up",namespace="team-a"}`},
+		{"quoted UTF-8 name", `{"http.requests", code="200"}`, `{"http.requests", code="200",namespace="team-a"}`},
+		{"function and range", `rate(http_requests_total[5m])`, `rate(http_requests_total{namespace="team-a"}[5m])`},
+		{"aggregation", `sum by (job) (rate(a[5m]))`, `sum by (job) (rate(a{namespace="team-a"}[5m]))`},
+		{"aggregation modifier after", `sum(a) without (instance)`, `sum(a{namespace="team-a"}) without (instance)`},
+		{"binary operators", `a / on(job) group_left(team) b`, `a{namespace="team-a"} / on(job) group_left(team) b{namespace="team-a"}`},
+		{"set operators", `a and b or c unless d`, `a{namespace="team-a"} and b{namespace="team-a"} or c{namespace="team-a"} unless d{namespace="team-a"}`},
+		{"bool modifier", `a > bool 1`, `a{namespace="team-a"} > bool 1`},
+		{"nested subquery", `max_over_time(rate(a[5m])[1h:1m])`, `max_over_time(rate(a{namespace="team-a"}[5m])[1h:1m])`},
+		{"offset", `a offset 5m`, `a{namespace="team-a"} offset 5m`},
+		{"at modifier", `a @ 1700000000 offset -1h`, `a{namespace="team-a"} @ 1700000000 offset -1h`},
+		{"at start", `rate(a[5m] @ start())`, `rate(a{namespace="team-a"}[5m] @ start())`},
+		{"string containing braces", `label_replace(a, "dst", "{x}", "src", "(.*)")`, `label_replace(a{namespace="team-a"}, "dst", "{x}", "src", "(.*)")`},
+		{"escaped quote", `a{job="x\"}"} or b`, `a{job="x\"}",namespace="team-a"} or b{namespace="team-a"}`},
+		{"single quotes", `a{job='x}'} or b`, `a{job='x}',namespace="team-a"} or b{namespace="team-a"}`},
+		{"backticks", "a{job=`x\\`} or b", "a{job=`x\\`,namespace=\"team-a\"} or b{namespace=\"team-a\"}"},
+		{"hash in string", `a{job="#"} or b`, `a{job="#",namespace="team-a"} or b{namespace="team-a"}`},
+		{"comment with brace", "# {\nsecret_metric", "# {\nsecret_metric{namespace=\"team-a\"}"},
+		{"comment with quote", "vector(0) # \"\n or secret_metric", "vector(0) # \"\n or secret_metric{namespace=\"team-a\"}"},
+		{"comment with backtick", "vector(0) # `\n or secret_metric", "vector(0) # `\n or secret_metric{namespace=\"team-a\"}"},
+		{"comment in matchers", "a{job=\"x\" # }\n} or b", "a{job=\"x\" # }\n,namespace=\"team-a\"} or b{namespace=\"team-a\"}"},
+		{"comment after comma", "a{job=\"x\", # c\n}", "a{job=\"x\", # c\nnamespace=\"team-a\"}"},
+		{"comment before braces", "a # c\n{job=\"x\"}", "a # c\n{job=\"x\",namespace=\"team-a\"}"},
+		{"keyword as metric", `sum`, `sum{namespace="team-a"}`},
+		{"keyword as argument", `topk(3, count)`, `topk(3, count{namespace="team-a"})`},
+		{"keyword as operand", `vector(1) or offset`, `vector(1) or offset{namespace="team-a"}`},
+		{"keyword with matchers", `sum{job="x"}`, `sum{job="x",namespace="team-a"}`},
+		{"numbers", `a * 1e3 + Inf`, `a{namespace="team-a"} * 1e3 + Inf`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := injectMatcher(tt.expr, "namespace", "team-a"); got != tt.want {
+				t.Errorf("injectMatcher(%q) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{`rate(a[5m]) / b`, []string{"a", "b"}},
+		{`{__name__="a"} or {__name__ = 'b'}`, []string{"a", "b"}},
+		{"vector(0) # \"\n or secret", []string{"secret"}},
+		{"# {\nsecret", []string{"secret"}},
+		{`sum by (job) (c)`, []string{"c"}},
+		{`sum`, []string{"sum"}},
+		{`label_replace(a, "d", "b", "s", ".*")`, []string{"a"}},
+	}
+	for _, tt := range tests {
+		if got := metricNames(tt.expr); !slices.Equal(got, tt.want) {
+			t.Errorf("metricNames(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
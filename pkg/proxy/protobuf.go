@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the cached response protobuf message:
+//
+//	message Response {
+//	  repeated Header headers = 1;
+//	  int32 status_code = 2;
+//	  bytes body = 3;
+//	  bool compressed = 4;
+//	  int64 stored_at_unix_nano = 5;
+//	  bool matrix = 6;
+//	}
+//
+//	message Header {
+//	  string name = 1;
+//	  repeated string values = 2;
+//	}
+const (
+	pbResponseHeaders    protowire.Number = 1
+	pbResponseStatusCode protowire.Number = 2
+	pbResponseBody       protowire.Number = 3
+	pbResponseCompressed protowire.Number = 4
+	pbResponseStoredAt   protowire.Number = 5
+	pbResponseMatrix     protowire.Number = 6
+
+	pbHeaderName   protowire.Number = 1
+	pbHeaderValues protowire.Number = 2
+)
+
+// protobufSerializer encodes responses as protobuf messages
+type protobufSerializer struct{}
+
+func (protobufSerializer) Name() string {
+	return "protobuf"
+}
+
+func (protobufSerializer) Marshal(resp *Response) ([]byte, error) {
+	b := make([]byte, 0, len(resp.Body)+256)
+
+	for _, name := range sortedHeaderNames(resp.Headers) {
+		var header []byte
+		header = protowire.AppendTag(header, pbHeaderName, protowire.BytesType)
+		header = protowire.AppendString(header, name)
+		for _, value := range resp.Headers[name] {
+			header = protowire.AppendTag(header, pbHeaderValues, protowire.BytesType)
+			header = protowire.AppendString(header, value)
+		}
+
+		b = protowire.AppendTag(b, pbResponseHeaders, protowire.BytesType)
+		b = protowire.AppendBytes(b, header)
+	}
+
+	b = protowire.AppendTag(b, pbResponseStatusCode, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(resp.StatusCode))
+
+	b = protowire.AppendTag(b, pbResponseBody, protowire.BytesType)
+	b = protowire.AppendBytes(b, resp.Body)
+
+	if resp.Compressed {
+		b = protowire.AppendTag(b, pbResponseCompressed, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+
+	if resp.Matrix {
+		b = protowire.AppendTag(b, pbResponseMatrix, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+
+	b = protowire.AppendTag(b, pbResponseStoredAt, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(resp.StoredAt.UnixNano()))
+
+	return b, nil
+}
+
+func (protobufSerializer) Unmarshal(data []byte, resp *Response) error {
+	*resp = Response{Headers: make(http.Header)}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == pbResponseHeaders && typ == protowire.BytesType:
+			header, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			if err := unmarshalProtobufHeader(header, resp.Headers); err != nil {
+				return err
+			}
+		case num == pbResponseStatusCode && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			resp.StatusCode = int(v)
+		case num == pbResponseBody && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			resp.Body = append([]byte(nil), v...)
+		case num == pbResponseCompressed && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			resp.Compressed = protowire.DecodeBool(v)
+		case num == pbResponseMatrix && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			resp.Matrix = protowire.DecodeBool(v)
+		case num == pbResponseStoredAt && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			resp.StoredAt = time.Unix(0, int64(v))
+		default:
+			// Skip unknown fields for forward compatibility
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// unmarshalProtobufHeader decodes a Header message into header
+func unmarshalProtobufHeader(data []byte, header http.Header) error {
+	var name string
+	var values []string
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			return fmt.Errorf("protobuf: unexpected wire type %d in header", typ)
+		}
+
+		v, n := protowire.ConsumeString(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case pbHeaderName:
+			name = v
+		case pbHeaderValues:
+			values = append(values, v)
+		}
+	}
+
+	header[name] = values
+	return nil
+}
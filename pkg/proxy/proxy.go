@@ -3,17 +3,21 @@ package proxy
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/metrics"
 )
 
 // Headers that shouldn't be cached
@@ -22,6 +26,7 @@ var skipCacheHeaders = []string{
 	"Connection",
 	"Transfer-Encoding",
 	"Keep-Alive",
+	"X-Cache",
 }
 
 // Response represents a cached HTTP response
@@ -29,141 +34,640 @@ type Response struct {
 	Headers    http.Header `json:"headers"`
 	StatusCode int         `json:"status_code"`
 	Body       []byte      `json:"body"`
+	// Compressed is set when Body is stored gzip-compressed
+	Compressed bool `json:"compressed,omitempty"`
+	// Matrix is set when Body holds a range query result in the parsed
+	// matrix encoding rather than as JSON
+	Matrix bool `json:"matrix,omitempty"`
+	// StoredAt is the time the response was stored in the cache
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// TransportOptions configures the upstream HTTP client
+type TransportOptions struct {
+	// Timeout is the overall upstream request timeout, 0 means no timeout.
+	// Requests with a timeout parameter use that instead.
+	Timeout time.Duration
+	// DialTimeout is the maximum time to establish a TCP connection
+	DialTimeout time.Duration
+	// KeepAlive is the TCP keep-alive period, negative disables TCP keep-alives
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout is the maximum time to wait for a TLS handshake
+	TLSHandshakeTimeout time.Duration
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept per upstream host
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long idle connections are kept open
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives disables HTTP keep-alives, using each connection for a single request
+	DisableKeepAlives bool
+}
+
+// newUpstreamClient creates the HTTP client used to talk to the upstream
+func newUpstreamClient(opts TransportOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}).DialContext
+	transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.MaxIdleConns = 0
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+
+	// The overall timeout is applied per request, see upstreamTimeout
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+// Options holds optional proxy behaviour settings
+type Options struct {
+	// Transport configures the upstream HTTP client
+	Transport TransportOptions
+	// RoundTripper sends upstream requests instead of a transport built
+	// from Transport, e.g. when the proxy is embedded as a library
+	RoundTripper http.RoundTripper
+	// Compress enables gzip compression of cached bodies
+	Compress bool
+	// CompressMinBytes is the minimum body size before compression kicks in
+	CompressMinBytes int
+	// ParseMatrix stores range query results decoded into series and
+	// samples rather than as JSON
+	ParseMatrix bool
+	// MaxObjectBytes is the maximum body size that will be cached, 0 means unlimited
+	MaxObjectBytes int
+	// EmptyResultPolicy controls caching of empty results (cache, skip or short)
+	EmptyResultPolicy string
+	// EmptyResultTTL is the TTL for empty results under the short policy
+	EmptyResultTTL time.Duration
+	// ValidateResponses only caches bodies that are valid Prometheus API responses
+	ValidateResponses bool
+	// MaxHops is the maximum number of promcached hops before a request is
+	// rejected as a loop, 0 disables loop detection
+	MaxHops int
+	// InstanceName identifies this instance in Via and X-Cache headers
+	InstanceName string
+	// UpstreamIsPromcache marks the upstream as a parent promcached tier
+	UpstreamIsPromcache bool
+	// ExactTime disables rounding of time parameters; cached entries
+	// evaluated within FreshnessBudget of the requested time are served
+	// instead
+	ExactTime bool
+	// FreshnessBudget is the maximum distance between requested and cached
+	// evaluation times in exact-time mode
+	FreshnessBudget time.Duration
+	// Serializer encodes cached responses, defaults to the binary encoding
+	Serializer Serializer
+	// DebugTrace adds a JSON trace of internal steps to every response
+	DebugTrace bool
+	// HashKeys stores entries under a hash of the normalized cache key
+	HashKeys bool
+	// KeepReadableKeys labels hashed entries with their readable key for debugging
+	KeepReadableKeys bool
+	// KeyExcludeParams are query parameters left out of cache keys because
+	// they don't affect the result, such as timeouts and cache busters
+	KeyExcludeParams []string
+	// KeyNamespace prefixes every cache key, so instances with different
+	// purposes can share a cache without their entries colliding
+	KeyNamespace string
+	// MaxUpstreamRequests caps in-flight requests to the upstream, 0 means unlimited
+	MaxUpstreamRequests int
+	// UpstreamQueueTimeout is how long requests over the limit wait for a slot
+	UpstreamQueueTimeout time.Duration
+	// GlobalSemaphore caps in-flight upstream requests across all proxies
+	// sharing it, nil means unlimited
+	GlobalSemaphore *Semaphore
+	// Rules allow or deny queries before they are served, nil allows all
+	Rules *RuleSet
+	// CacheRules override the caching of queries, nil caches all with the
+	// endpoint's TTL
+	CacheRules *CacheRuleSet
+	// Limits bounds the cost of range queries
+	Limits QueryLimits
+	// TenantLimits overrides Limits per tenant
+	TenantLimits map[string]QueryLimits
+	// TenantHeader is the request header identifying the tenant
+	TenantHeader string
+	// LimitAction is LimitReject or LimitClamp
+	LimitAction string
+	// EnforceLabel is a label matcher injected into every query, empty
+	// disables label enforcement
+	EnforceLabel string
+	// EnforceLabelHeader is the request header holding the enforced label's
+	// value, defaults to the tenant header
+	EnforceLabelHeader string
+	// Peers shares the cache with other instances, nil keeps all entries
+	// local
+	Peers Peers
+	// HedgeDelay is how long to wait for a discovered upstream replica
+	// before sending the request to a second one, 0 disables hedging
+	HedgeDelay time.Duration
+	// FederateTTL is the TTL of /federate responses, 0 uses the cache TTL
+	FederateTTL time.Duration
+	// MetadataTTL is the TTL of metric metadata responses, 0 uses the
+	// cache TTL
+	MetadataTTL time.Duration
+	// RulesTTL is the TTL of rule and alert responses, 0 uses the cache
+	// TTL
+	RulesTTL time.Duration
+	// AllowedEndpoints are admin and write endpoint paths passed through to
+	// the upstream instead of being rejected
+	AllowedEndpoints []string
+	// ThanosDefaults are values of Thanos query parameters set on requests
+	// leaving them out
+	ThanosDefaults map[string]string
+	// Downsample answers range queries from cached responses at a finer
+	// step, DownsamplePick or DownsampleAvg; empty disables downsampling
+	Downsample string
+	// PeerFailClosed rejects requests with 503 when the peer owning their
+	// entry can't be reached instead of passing them to the upstream
+	PeerFailClosed bool
+	// Shadow forwards every request to the upstream and only simulates
+	// caching, exposing the hits it would have served as metrics
+	Shadow bool
+	// Coalesce makes identical concurrent cache misses wait for the first
+	// one to fill the cache instead of all querying the upstream
+	Coalesce bool
+	// Toggles switch stale serving, coalescing and shadow mode at runtime,
+	// nil creates them from Shadow and Coalesce with stale serving enabled
+	Toggles *Toggles
+	// VerifyFraction is the fraction of cache hits compared against a
+	// fresh upstream response in the background, 0 disables verification
+	VerifyFraction float64
+	// HitTracker counts hits per entry and query, nil disables tracking
+	HitTracker *HitTracker
+	// QueryStats aggregates statistics per query, nil disables them
+	QueryStats *QueryStats
+	// DashboardLabels caps the Grafana dashboards counted separately in
+	// the dashboard metrics, nil disables them
+	DashboardLabels *LabelLimiter
+	// TenantLabels caps the tenants counted separately in the tenant
+	// metrics, nil disables them
+	TenantLabels *LabelLimiter
+	// TenantLabelHash labels the tenant metrics with a hash of the tenant
+	// instead of its ID
+	TenantLabelHash bool
+	// RecentWindow splits range queries ending within this window of now
+	// into a cached head and a tail always fetched from the upstream, 0
+	// disables splitting
+	RecentWindow time.Duration
+	// MinCacheableAge is how long before now the end or evaluation time of
+	// a query must be for its response to be cached, 0 caches all
+	MinCacheableAge time.Duration
+	// MinCacheableAgeTTL caches the responses to queries within the
+	// minimum cacheable age briefly instead of not at all
+	MinCacheableAgeTTL time.Duration
+	// AdaptiveTTLThreshold is the upstream duration of queries cached for
+	// the cache TTL; faster queries are cached shorter and slower ones
+	// longer, 0 disables adaptive TTLs
+	AdaptiveTTLThreshold time.Duration
+	// AdaptiveTTLMin and AdaptiveTTLMax bound adaptive TTLs
+	AdaptiveTTLMin time.Duration
+	AdaptiveTTLMax time.Duration
+	// MinCacheDuration and MinCacheSamples only cache query responses the
+	// upstream took at least this long for or that cost at least this many
+	// samples; either threshold suffices, 0 disables it
+	MinCacheDuration time.Duration
+	MinCacheSamples  int
+	// MaxHeaderTTL caps the TTL clients may request through the
+	// X-Promcache-TTL header, 0 ignores the header
+	MaxHeaderTTL time.Duration
+	// UpstreamTTLHints caches responses for the TTL set by the upstream's
+	// Cache-Control or Expires headers instead of the endpoint's TTL
+	UpstreamTTLHints bool
+	// Metrics are recorded to, nil records to unregistered metrics
+	Metrics *metrics.Metrics
 }
 
 // HTTPCacheProxy forwards requests to an upstream server and caches the responses
 type HTTPCacheProxy struct {
 	upstreamURL string
-	cache       *cache.Cache
-	client      *http.Client
-	log         *slog.Logger
-	cacheTTL    time.Duration
+	// upstreamName labels the upstream's metrics
+	upstreamName string
+	cache        Cache
+	client       *http.Client
+	log          *slog.Logger
+	metrics      *metrics.Metrics
+	cacheTTL     time.Duration
+	opts         Options
+	timeIndex    *timeIndex
+	// resolutionIndex maps range queries to the steps they are cached at
+	resolutionIndex *timeIndex
+	serializer      Serializer
+	// keyPrefix prefixes every stored cache key, see keyPrefix
+	keyPrefix string
+	// keyExcluded holds the query parameters left out of cache keys
+	keyExcluded map[string]bool
+	// allowedEndpoints holds the admin and write endpoints passed through
+	allowedEndpoints map[string]bool
+	// semaphore caps in-flight requests to this proxy's upstream
+	semaphore *Semaphore
+	// inflight tracks forwarded requests so shutdown can wait for them
+	inflight sync.WaitGroup
+	// views are the materialized views by their match key
+	views map[string][]*view
+	// toggles are the behaviors switched at runtime
+	toggles *Toggles
+	// coalescer holds the misses other identical misses wait for
+	coalescer coalescer
 }
 
 // New creates a new HTTP caching proxy
-func New(upstreamURL string, cache *cache.Cache, log *slog.Logger) *HTTPCacheProxy {
-	return &HTTPCacheProxy{
-		upstreamURL: upstreamURL,
-		cache:       cache,
-		client: &http.Client{
-			Timeout: 30 * time.Second, // Add reasonable timeout
-		},
-		log:      log,
-		cacheTTL: cache.TTL(),
+func New(upstreamURL string, cache Cache, log *slog.Logger, opts Options) *HTTPCacheProxy {
+	upstreamURL, discovery := cutDiscoveryPrefix(upstreamURL)
+	p := &HTTPCacheProxy{
+		upstreamURL:     upstreamURL,
+		upstreamName:    upstreamLabel(upstreamURL),
+		cache:           cache,
+		client:          newUpstreamClient(opts.Transport),
+		log:             log,
+		metrics:         opts.Metrics,
+		cacheTTL:        cache.TTL(),
+		opts:            opts,
+		timeIndex:       newTimeIndex(cache.TTL()),
+		resolutionIndex: newTimeIndex(cache.TTL()),
+		serializer:      opts.Serializer,
+		semaphore:       NewSemaphore(opts.MaxUpstreamRequests, opts.UpstreamQueueTimeout),
+		toggles:         opts.Toggles,
+	}
+	if p.toggles == nil {
+		p.toggles = NewToggles(ToggleState{ServeStale: true, Coalesce: opts.Coalesce, Shadow: opts.Shadow})
+	}
+	p.keyPrefix = keyPrefix(opts, cache.TTL().String())
+	p.keyExcluded = make(map[string]bool, len(opts.KeyExcludeParams))
+	for _, param := range opts.KeyExcludeParams {
+		p.keyExcluded[param] = true
+	}
+	p.allowedEndpoints = make(map[string]bool, len(opts.AllowedEndpoints))
+	for _, path := range opts.AllowedEndpoints {
+		p.allowedEndpoints[path] = true
+	}
+	if p.serializer == nil {
+		p.serializer = binarySerializer{}
 	}
+	if p.metrics == nil {
+		p.metrics = metrics.New(nil, metrics.Options{})
+	}
+	if opts.RoundTripper != nil {
+		p.client = &http.Client{Transport: opts.RoundTripper}
+	} else if discovery != "" {
+		resolver := discoverUpstream(p.client, upstreamURL, discovery, log)
+		if resolver != nil && opts.HedgeDelay > 0 {
+			p.client.Transport = newHedgedTransport(p.client.Transport.(*http.Transport), resolver, opts.HedgeDelay, p.upstreamName, p.metrics, opts.GlobalSemaphore, p.semaphore)
+		}
+	}
+
+	if opts.ExactTime {
+		go p.timeIndex.startCleanup()
+	}
+	if opts.Downsample != "" {
+		go p.resolutionIndex.startCleanup()
+	}
+
+	return p
 }
 
 // HandleRequest processes an incoming request, checking the cache first
 // and forwarding to the upstream if necessary
 func (p *HTTPCacheProxy) HandleRequest(w http.ResponseWriter, r *http.Request) {
-	// Only cache GET requests
-	isCacheable := r.Method == http.MethodGet
+	// Record internal steps in a response header when debugging
+	if p.opts.DebugTrace {
+		var trace *Trace
+		r, trace = withTrace(r)
+		w = &traceWriter{ResponseWriter: w, trace: trace}
+	}
+
+	// Reject requests looping back through promcached
+	if p.checkLoop(w, r) {
+		return
+	}
+
+	// Reject requests to admin and write endpoints unless allowed
+	if p.checkEndpointPolicy(w, r) {
+		return
+	}
+
+	// Reject queries denied by the query rules
+	if p.checkRules(w, r) {
+		return
+	}
+
+	// Scope queries to the enforced label
+	if p.enforceLabel(w, r) {
+		return
+	}
+
+	// Pin Thanos query parameters the client left to the upstream
+	if p.applyThanosDefaults(w, r) {
+		return
+	}
+
+	// Reject or clamp queries exceeding their limits
+	if p.checkCost(w, r) {
+		return
+	}
+
+	// Only cache GET requests and remote reads; HEAD requests share the
+	// entries of GET requests
+	isCacheable := cacheMethod(r) == http.MethodGet || isRemoteRead(r)
+	if rule := p.cacheRule(r); isCacheable && rule != nil && rule.action == CacheRuleSkip {
+		traceStep(r, "cache_rule_skip", rule.name)
+		isCacheable = false
+	}
+
+	// Remote reads that can't be normalized have no key to share entries
+	// under, the upstream may still accept them
+	if isCacheable && isRemoteRead(r) {
+		if _, err := p.remoteReadKey(r); err != nil {
+			p.log.DebugContext(r.Context(), "Failed to normalize remote read request, bypassing the cache", "error", err)
+			traceStep(r, "remote_read_uncacheable", err.Error())
+			isCacheable = false
+		}
+	}
 
 	// Generate cache key from request
-	cacheKey := p.generateCacheKey(r)
-	p.log.Debug("Request received",
+	readableKey := p.generateCacheKey(r)
+	if !p.opts.ExactTime && !isLoki(r.URL.Path) {
+		p.recordRoundingDeltas(r.URL.Query(), p.normalizedQuery(r))
+	}
+	cacheKey := p.storageKey(readableKey)
+	p.log.DebugContext(r.Context(), "Request received",
 		"method", r.Method,
 		"path", r.URL.Path,
 		"query", r.URL.RawQuery,
-		"key", cacheKey,
+		"key", readableKey,
+		"storage_key", cacheKey,
 		"cacheable", isCacheable)
+	traceStep(r, "cache_key", readableKey)
+
+	// Shadow mode always asks the upstream and only simulates caching
+	if p.toggles.Shadow() {
+		p.serveShadow(w, r, cacheKey, isCacheable)
+		return
+	}
+
+	// Time and size responses by how they were answered
+	startTime := time.Now()
+	sw := &sizeWriter{ResponseWriter: w}
+	w = sw
+	result := "hit"
+	var timer *upstreamTimer
+	if p.opts.QueryStats != nil {
+		r, timer = withUpstreamTimer(r)
+	}
+	defer func() {
+		p.metrics.RecordResponse(result, time.Since(startTime).Seconds(), sw.size)
+		p.recordTenantRequest(r, result)
+		if timer != nil {
+			p.recordQueryStats(r, result, sw.size, timer)
+		}
+	}()
 
-	// Try to get from cache for cacheable requests
-	if isCacheable && p.tryServeCachedResponse(w, r, cacheKey) {
+	// Try to get from cache for cacheable requests, materialized views
+	// first. Refreshes skip the lookup and replace the entry.
+	lookup := isCacheable && !isRefresh(r)
+	if isCacheable && !lookup {
+		traceStep(r, "refresh", "")
+	}
+	if lookup && p.tryServeView(w, r) {
+		return
+	}
+	if lookup && p.tryServeSplit(w, r) {
+		result = "partial"
 		return
 	}
 
+	// Queries of the most recent data are answered by the upstream, unless
+	// they may be cached briefly
+	if isCacheable && p.opts.MinCacheableAgeTTL <= 0 && p.isRecent(r) {
+		traceStep(r, "too_recent", "")
+		isCacheable = false
+	}
+	if lookup && isCacheable && p.tryServeCachedResponse(w, r, cacheKey) {
+		return
+	}
+	if lookup && isCacheable && p.tryServeDownsampled(w, r) {
+		return
+	}
+	if lookup && isCacheable && p.opts.ExactTime && !isLoki(r.URL.Path) && p.tryServeWithinBudget(w, r) {
+		return
+	}
+
+	// Identical concurrent misses wait for the first one to fill the cache
+	if lookup && isCacheable && p.toggles.Coalesce() {
+		done, wait := p.coalescer.join(cacheKey)
+		if wait != nil {
+			traceStep(r, "coalesced", "")
+			select {
+			case <-wait:
+			case <-r.Context().Done():
+			}
+			if p.tryServeCachedResponse(w, r, cacheKey) {
+				return
+			}
+		} else {
+			defer done()
+		}
+	}
+
 	// Cache miss or non-cacheable request, forward to upstream
-	p.log.Info("Cache miss, forwarding to upstream",
+	result = "uncacheable"
+	if isCacheable {
+		result = "miss"
+		p.metrics.RecordCacheMiss()
+		p.recordDashboardRequest(r, "miss")
+	}
+	traceStep(r, "cache_miss", "")
+	p.log.With(grafanaAttrs(r)...).DebugContext(r.Context(), "Cache miss, forwarding to upstream",
 		"path", r.URL.Path,
 		"key", cacheKey)
 	p.forwardRequest(w, r, cacheKey, isCacheable)
 }
 
 // tryServeCachedResponse attempts to serve a response from cache
-// Returns true if successful, false otherwise
+// Returns true if the request was answered, false otherwise
 func (p *HTTPCacheProxy) tryServeCachedResponse(w http.ResponseWriter, r *http.Request, cacheKey string) bool {
-	data, found := p.cache.Get(cacheKey)
+	data, found, err := p.cacheGet(r.Context(), cacheKey)
+	if err != nil && p.opts.PeerFailClosed {
+		traceStep(r, "peer_unavailable", err.Error())
+		http.Error(w, "Cache peer unavailable", http.StatusServiceUnavailable)
+		return true
+	}
 	if !found {
 		return false
 	}
+	traceStep(r, "cache_hit", cacheKey)
 
-	p.log.Info("Serving from cache",
+	p.log.With(grafanaAttrs(r)...).DebugContext(r.Context(), "Serving from cache",
 		"path", r.URL.Path,
 		"key", cacheKey)
 
 	var cachedResp Response
-	if err := json.Unmarshal(data, &cachedResp); err != nil {
-		p.log.Error("Failed to unmarshal cached response",
+	if err := decodeResponse(data, &cachedResp); err != nil {
+		p.log.ErrorContext(r.Context(), "Failed to unmarshal cached response",
 			"error", err,
 			"key", cacheKey)
 		return false
 	}
 
+	// Parsed range query results are re-encoded on the way out
+	var m *matrix
+	if cachedResp.Matrix {
+		if m, err = cachedMatrix(&cachedResp); err != nil {
+			p.log.ErrorContext(r.Context(), "Failed to decode cached matrix",
+				"error", err,
+				"key", cacheKey)
+			return false
+		}
+	}
+	p.metrics.RecordCacheHit()
+	p.metrics.RecordHierarchyRequest("local")
+	p.recordHit(r, cacheKey)
+	p.recordDashboardRequest(r, "hit")
+
 	// Write headers from cache
 	for name, values := range cachedResp.Headers {
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
-	w.Header().Set("X-Cache", "HIT")
+	w.Header().Add("Via", p.viaValue(r))
+	p.setCacheStatus(w, "HIT", "")
+
+	// Expose the entry's age so clients can tell how stale the data is
+	if !cachedResp.StoredAt.IsZero() {
+		age := strconv.FormatInt(int64(max(time.Since(cachedResp.StoredAt), 0).Seconds()), 10)
+		w.Header().Set("Age", age)
+		w.Header().Set("X-Cache-Age", age)
+	}
 
 	// Send response
-	w.WriteHeader(cachedResp.StatusCode)
-	w.Write(cachedResp.Body)
+	if writeNotModified(w, r) {
+		return true
+	}
+	switch {
+	case m != nil:
+		writeMatrixBody(w, r, cachedResp.StatusCode, m)
+	case cachedResp.Compressed:
+		writeCompressedBody(w, r, cachedResp.StatusCode, cachedResp.Body)
+	default:
+		writeBody(w, r, cachedResp.StatusCode, cachedResp.Body)
+	}
+	p.maybeVerify(r, &cachedResp, m)
 	return true
 }
 
 // forwardRequest forwards a request to the upstream server
 func (p *HTTPCacheProxy) forwardRequest(w http.ResponseWriter, r *http.Request, cacheKey string, isCacheable bool) {
+	p.inflight.Add(1)
+	defer p.inflight.Done()
+
 	// Prepare upstream request
 	upstreamReq, err := p.prepareUpstreamRequest(r)
 	if err != nil {
-		p.log.Error("Failed to prepare upstream request",
+		p.log.ErrorContext(r.Context(), "Failed to prepare upstream request",
 			"error", err,
 			"path", r.URL.Path)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	upstreamReq, cancel := p.withUpstreamTimeout(upstreamReq, r)
+	defer cancel()
+
+	// Wait for an upstream slot
+	release, queued, err := p.acquireUpstream(upstreamReq.Context())
+	if err != nil {
+		p.log.WarnContext(r.Context(), "No upstream slot available",
+			"error", err,
+			"path", r.URL.Path)
+		traceStep(r, "upstream_overloaded", err.Error())
+		p.writeOverloaded(w, queued)
+		return
+	}
+	defer release()
+	setQueueTime(w, queued)
+
 	// Send request to upstream
+	traceStep(r, "upstream_request", upstreamReq.URL.Redacted())
 	startTime := time.Now()
 	resp, err := p.client.Do(upstreamReq)
 	requestDuration := time.Since(startTime)
+	p.recordUpstreamLatency(r, resp, err, requestDuration)
 
 	if err != nil {
-		p.log.Error("Failed to forward request to upstream",
+		p.log.ErrorContext(r.Context(), "Failed to forward request to upstream",
 			"error", err,
 			"duration_ms", requestDuration.Milliseconds(),
 			"path", r.URL.Path)
+		traceStep(r, "upstream_error", err.Error())
 		http.Error(w, "Failed to reach upstream server", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
 
 	// Read response body
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		p.log.Error("Failed to read upstream response",
+		p.log.ErrorContext(r.Context(), "Failed to read upstream response",
 			"error", err,
 			"path", r.URL.Path)
 		http.Error(w, "Failed to read upstream response", http.StatusInternalServerError)
 		return
 	}
+	release()
+
+	// Decode the body into its canonical identity form
+	decodedBody, err := decodeBody(resp.Header, respBody)
+	if err != nil {
+		p.log.WarnContext(r.Context(), "Failed to decode upstream response, passing through uncached",
+			"error", err,
+			"path", r.URL.Path)
+		p.writeRawResponse(w, r, resp, respBody)
+		return
+	}
+	respBody = decodedBody
 
-	p.log.Debug("Received upstream response",
+	traceStep(r, "upstream_response", resp.Status)
+	p.log.DebugContext(r.Context(), "Received upstream response",
 		"status", resp.StatusCode,
 		"size", len(respBody),
 		"duration_ms", requestDuration.Milliseconds(),
 		"path", r.URL.Path)
 
+	// Track which tier of a hierarchical deployment answered
+	if isCacheable {
+		if strings.HasPrefix(resp.Header.Get("X-Cache"), "HIT") {
+			p.metrics.RecordHierarchyRequest("parent")
+		} else {
+			p.metrics.RecordHierarchyRequest("origin")
+		}
+	}
+
+	// Tag successful responses so polling clients can revalidate cheaply
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") == "" {
+		resp.Header.Set("ETag", computeETag(respBody))
+	}
+
 	// Cache successful responses
 	if isCacheable && resp.StatusCode == http.StatusOK {
-		p.cacheResponse(cacheKey, resp, respBody)
+		stored := p.cacheResponse(r, cacheKey, resp, respBody, requestDuration)
+		traceStep(r, "cache_store", strconv.FormatBool(stored))
+		if stored && p.opts.HashKeys && p.opts.KeepReadableKeys {
+			p.cache.Label(cacheKey, p.generateCacheKey(r))
+		}
+		if stored && p.opts.ExactTime {
+			p.timeIndex.add(p.bucketKey(r), cacheKey, requestTimes(r.URL.Query(), r.URL.Path))
+		}
+		if stored {
+			p.indexResolution(r, cacheKey)
+		}
 	}
 
 	// Send response to client
-	p.writeResponse(w, resp, respBody)
+	p.writeResponse(w, r, resp, respBody)
 }
 
 // prepareUpstreamRequest creates a new request to the upstream server
@@ -178,6 +682,12 @@ func (p *HTTPCacheProxy) prepareUpstreamRequest(r *http.Request) (*http.Request,
 	upstream.Path = r.URL.Path
 	upstream.RawQuery = r.URL.RawQuery
 
+	// A parent promcached receives the aligned query so both tiers agree
+	// on the cache key
+	if p.opts.UpstreamIsPromcache && !p.opts.ExactTime && cacheMethod(r) == http.MethodGet {
+		upstream.RawQuery = p.normalizedQuery(r).Encode()
+	}
+
 	// Read and preserve request body
 	var bodyReader io.Reader
 	if r.Body != nil {
@@ -194,7 +704,7 @@ func (p *HTTPCacheProxy) prepareUpstreamRequest(r *http.Request) (*http.Request,
 	// Create upstream request
 	upstreamReq, err := http.NewRequestWithContext(
 		r.Context(),
-		r.Method,
+		cacheMethod(r),
 		upstream.String(),
 		bodyReader,
 	)
@@ -209,16 +719,84 @@ func (p *HTTPCacheProxy) prepareUpstreamRequest(r *http.Request) (*http.Request,
 		}
 	}
 
+	removeHopHeaders(upstreamReq.Header)
+	setForwardedHeaders(upstreamReq.Header, r)
+
+	// Conditional requests are answered by the proxy itself; the upstream
+	// must always return a full body that can be cached
+	upstreamReq.Header.Del("If-None-Match")
+	upstreamReq.Header.Del("If-Modified-Since")
+
+	// Count this hop for loop detection
+	upstreamReq.Header.Set(LoopHeader, strconv.Itoa(hopCount(r)+1))
+	upstreamReq.Header.Add("Via", p.viaValue(r))
+
+	// Always negotiate gzip with the upstream ourselves; the body is
+	// re-encoded according to the client's capabilities on the way out
+	upstreamReq.Header.Set("Accept-Encoding", "gzip")
+
 	return upstreamReq, nil
 }
 
-// cacheResponse stores a successful response in the cache
-func (p *HTTPCacheProxy) cacheResponse(cacheKey string, resp *http.Response, body []byte) {
+// cacheResponse stores a successful response the upstream took
+// upstreamDuration to compute in the cache
+// Returns true if the response was stored
+func (p *HTTPCacheProxy) cacheResponse(r *http.Request, cacheKey string, resp *http.Response, body []byte, upstreamDuration time.Duration) bool {
+	// Never let a single huge response evict the rest of the cache
+	if p.opts.MaxObjectBytes > 0 && len(body) > p.opts.MaxObjectBytes {
+		p.metrics.RecordCacheSkippedTooLarge()
+		p.log.DebugContext(r.Context(), "Response too large to cache",
+			"key", cacheKey,
+			"size", len(body),
+			"limit", p.opts.MaxObjectBytes)
+		return false
+	}
+
+	// Never cache and replay bodies that aren't valid API responses
+	if p.opts.ValidateResponses && !isValidResponse(body) && !isRemoteReadResponse(resp) && !isFederate(r.URL.Path) {
+		p.metrics.RecordCacheSkippedInvalid()
+		p.log.WarnContext(r.Context(), "Not caching invalid upstream response",
+			"key", cacheKey,
+			"content_type", resp.Header.Get("Content-Type"),
+			"size", len(body))
+		return false
+	}
+
+	// The upstream may declare its response stale already
+	if hint, ok := upstreamTTL(resp); ok && hint <= 0 && p.opts.UpstreamTTLHints {
+		p.log.DebugContext(r.Context(), "Not caching expired response", "key", cacheKey)
+		return false
+	}
+
+	// Cheap queries are fast enough to recompute, keep the memory for
+	// expensive ones
+	if p.isCheap(r.URL.Path, upstreamDuration, body) {
+		p.metrics.RecordCacheSkippedCheap()
+		p.log.DebugContext(r.Context(), "Not caching cheap query",
+			"key", cacheKey,
+			"duration_ms", upstreamDuration.Milliseconds())
+		return false
+	}
+
+	// Empty results are often caused by targets not yet scraped and
+	// resolve themselves quickly
+	ttl := p.entryTTL(r, resp, upstreamDuration)
+	if p.opts.EmptyResultPolicy != EmptyResultCache && isEmptyResult(body) {
+		switch p.opts.EmptyResultPolicy {
+		case EmptyResultSkip:
+			p.log.DebugContext(r.Context(), "Not caching empty result", "key", cacheKey)
+			return false
+		case EmptyResultShort:
+			ttl = p.opts.EmptyResultTTL
+		}
+	}
+
 	// Create cached response object
 	cachedResp := Response{
 		Headers:    make(http.Header),
 		StatusCode: resp.StatusCode,
 		Body:       body,
+		StoredAt:   time.Now(),
 	}
 
 	// Copy headers except those that shouldn't be cached
@@ -236,39 +814,136 @@ func (p *HTTPCacheProxy) cacheResponse(cacheKey string, resp *http.Response, bod
 		}
 	}
 
+	// Keep range query results decoded, so hits can be downsampled and
+	// merged without parsing JSON again
+	if p.opts.ParseMatrix && r.URL.Path == "/api/v1/query_range" && resp.Header.Get("Content-Encoding") == "" {
+		if m, err := parseMatrix(body); err == nil {
+			if encoded, err := m.marshalBinary(); err == nil {
+				cachedResp.Body = encoded
+				cachedResp.Matrix = true
+				// Hits re-encode the JSON, which differs byte for byte
+				weakenETag(cachedResp.Headers)
+			}
+		}
+	}
+
+	// Compress large bodies to cut memory usage
+	if p.opts.Compress && len(cachedResp.Body) >= p.opts.CompressMinBytes && resp.Header.Get("Content-Encoding") == "" {
+		compressed, err := compressBody(cachedResp.Body)
+		if err != nil {
+			p.log.ErrorContext(r.Context(), "Failed to compress response for caching",
+				"error", err,
+				"key", cacheKey)
+		} else {
+			cachedResp.Body = compressed
+			cachedResp.Compressed = true
+		}
+	}
+
 	// Serialize and store in cache
-	cachedData, err := json.Marshal(cachedResp)
+	cachedData, err := encodeResponse(p.serializer, &cachedResp)
 	if err != nil {
-		p.log.Error("Failed to marshal response for caching",
+		p.log.ErrorContext(r.Context(), "Failed to marshal response for caching",
 			"error", err,
 			"key", cacheKey)
-		return
+		return false
 	}
 
-	p.log.Debug("Caching response",
+	p.log.DebugContext(r.Context(), "Caching response",
 		"key", cacheKey,
 		"status", resp.StatusCode,
-		"size", len(body))
-	p.cache.Set(cacheKey, cachedData)
+		"size", len(body),
+		"stored_size", len(cachedResp.Body),
+		"ttl", ttl)
+	p.cacheSet(r.Context(), cacheKey, cachedData, ttl)
+	return true
 }
 
 // writeResponse sends the response to the client
-func (p *HTTPCacheProxy) writeResponse(w http.ResponseWriter, resp *http.Response, body []byte) {
+func (p *HTTPCacheProxy) writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, body []byte) {
 	// Copy headers
 	for name, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
-	w.Header().Set("X-Cache", "MISS")
+	w.Header().Add("Via", p.viaValue(r))
+	p.setCacheStatus(w, "MISS", resp.Header.Get("X-Cache"))
+
+	// Send response
+	if resp.StatusCode == http.StatusOK && writeNotModified(w, r) {
+		return
+	}
+	writeBody(w, r, resp.StatusCode, body)
+}
+
+// writeRawResponse sends the upstream response to the client without
+// touching its encoding
+func (p *HTTPCacheProxy) writeRawResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, body []byte) {
+	// Copy headers
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Add("Via", p.viaValue(r))
+	p.setCacheStatus(w, "MISS", resp.Header.Get("X-Cache"))
 
 	// Send response
 	w.WriteHeader(resp.StatusCode)
 	w.Write(body)
 }
 
+// cacheMethod returns the method under which a request is cached and
+// forwarded. HEAD requests are fetched as GET so the full response can be
+// cached and served to later GET requests.
+func cacheMethod(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return http.MethodGet
+	}
+	return r.Method
+}
+
 // generateCacheKey creates a unique key for caching based on the request
 func (p *HTTPCacheProxy) generateCacheKey(r *http.Request) string {
+	// Remote reads are keyed on their decoded protobuf request
+	if isRemoteRead(r) {
+		readKey, err := p.remoteReadKey(r)
+		if err != nil {
+			readKey = rawRemoteReadKey(r)
+		}
+		return keyNamespace(r) + r.Method + ":" + r.URL.Path + ":" + readKey
+	}
+
+	// Exact-time mode keys on the requested times as-is
+	if p.opts.ExactTime {
+		query := r.URL.Query()
+		normalizeEndpointParams(r.URL.Path, query)
+		return keyNamespace(r) + cacheMethod(r) + ":" + r.URL.Path + ":" + p.normalizeQueryString(query)
+	}
+
+	query := p.normalizedQuery(r)
+
+	// Build final key
+	return keyNamespace(r) + cacheMethod(r) + ":" + r.URL.Path + ":" + p.normalizeQueryString(query)
+}
+
+// storageKey returns the key under which a readable cache key is stored.
+// Normalized keys embed the full query text, so they are hashed to bound
+// their size when key hashing is enabled. Either way the key is prefixed
+// with the proxy's namespace and key version.
+func (p *HTTPCacheProxy) storageKey(readableKey string) string {
+	if !p.opts.HashKeys {
+		return p.keyPrefix + readableKey
+	}
+
+	sum := sha256.Sum256([]byte(readableKey))
+	return p.keyPrefix + hex.EncodeToString(sum[:16])
+}
+
+// normalizedQuery returns a copy of the request's query parameters with
+// time parameters aligned to TTL boundaries
+func (p *HTTPCacheProxy) normalizedQuery(r *http.Request) url.Values {
 	// Copy query parameters to avoid modifying the original
 	query := make(url.Values, len(r.URL.Query()))
 	for k, v := range r.URL.Query() {
@@ -277,14 +952,33 @@ func (p *HTTPCacheProxy) generateCacheKey(r *http.Request) string {
 
 	// Round time parameters for better cache hit rate
 	ttlSeconds := int64(p.cacheTTL.Seconds())
-	if ttlSeconds > 0 {
+	if isLoki(r.URL.Path) {
+		p.alignLokiTimes(query)
+	} else if ttlSeconds > 0 {
 		p.roundTimeParameter(query, "time", ttlSeconds, false)
 		p.roundTimeParameter(query, "start", ttlSeconds, false)
 		p.roundTimeParameter(query, "end", ttlSeconds, true)
 	}
+	normalizeEndpointParams(r.URL.Path, query)
 
-	// Build final key
-	return r.Method + ":" + r.URL.Path + ":" + p.normalizeQueryString(query)
+	return query
+}
+
+// recordRoundingDeltas records how far time parameters were shifted by
+// rounding to TTL boundaries
+func (p *HTTPCacheProxy) recordRoundingDeltas(original url.Values, normalized url.Values) {
+	for _, paramName := range timeParameters {
+		originalTime, err := strconv.ParseFloat(original.Get(paramName), 64)
+		if err != nil {
+			continue
+		}
+		roundedTime, err := strconv.ParseFloat(normalized.Get(paramName), 64)
+		if err != nil {
+			continue
+		}
+
+		p.metrics.RecordRoundingDelta(paramName, math.Abs(roundedTime-originalTime))
+	}
 }
 
 // normalizeQueryString creates a consistent string from URL query parameters
@@ -293,9 +987,13 @@ func (p *HTTPCacheProxy) normalizeQueryString(query url.Values) string {
 		return ""
 	}
 
-	// Get sorted keys for consistent ordering
+	// Get sorted keys for consistent ordering, leaving out parameters
+	// that don't affect the result
 	keys := make([]string, 0, len(query))
 	for k := range query {
+		if p.keyExcluded[k] {
+			continue
+		}
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
@@ -304,12 +1002,12 @@ func (p *HTTPCacheProxy) normalizeQueryString(query url.Values) string {
 	var b strings.Builder
 	b.Grow(128) // Pre-allocate buffer for better performance
 
-	for i, k := range keys {
+	for _, k := range keys {
 		values := query[k]
 		sort.Strings(values) // Sort values for consistency
 
-		for j, v := range values {
-			if i > 0 || j > 0 {
+		for _, v := range values {
+			if b.Len() > 0 {
 				b.WriteByte('&')
 			}
 			b.WriteString(k)
@@ -341,3 +1039,30 @@ func (p *HTTPCacheProxy) roundTimeParameter(query url.Values, paramName string,
 		query.Set(paramName, strconv.FormatInt(roundedTime, 10))
 	}
 }
+
+// sizeWriter records the status and body size of a response
+type sizeWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *sizeWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *sizeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *sizeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueryStats aggregates statistics per query fingerprint, the query
+// without its time parameters, like pg_stat_statements does for SQL. It
+// can be shared by several proxies and tracks up to maxTrackedHits
+// fingerprints; the least requested half is forgotten when it is reached.
+type QueryStats struct {
+	mu      sync.Mutex
+	queries map[string]*QueryStat
+	since   time.Time
+}
+
+// QueryStat are the statistics of all requests of a query
+type QueryStat struct {
+	Fingerprint string `json:"fingerprint"`
+	Path        string `json:"path"`
+	// Query is the expression, or the other parameters for endpoints
+	// without one
+	Query string `json:"query"`
+	// Requests counts requests however they were answered
+	Requests uint64 `json:"requests"`
+	// Hits counts requests answered from the cache, partial answers
+	// included
+	Hits             uint64  `json:"hits"`
+	HitRatio         float64 `json:"hit_ratio"`
+	UpstreamRequests uint64  `json:"upstream_requests"`
+	// UpstreamSeconds is the total time the upstream took for the query
+	UpstreamSeconds    float64 `json:"upstream_seconds"`
+	AvgUpstreamSeconds float64 `json:"avg_upstream_seconds"`
+	// Bytes is the total size of the response bodies sent to clients
+	Bytes    uint64 `json:"bytes"`
+	AvgBytes uint64 `json:"avg_bytes"`
+}
+
+// QueryStatsOrders are the orders Top sorts queries by
+var QueryStatsOrders = []string{"upstream_seconds", "requests", "hits", "bytes"}
+
+// NewQueryStats creates an empty query statistics aggregation
+func NewQueryStats() *QueryStats {
+	return &QueryStats{queries: make(map[string]*QueryStat), since: time.Now()}
+}
+
+// upstreamTimer accumulates the upstream time spent on a request
+type upstreamTimer struct {
+	mu       sync.Mutex
+	requests uint64
+	duration time.Duration
+}
+
+type upstreamTimerContextKey struct{}
+
+// withUpstreamTimer returns r with a timer collecting its upstream time
+func withUpstreamTimer(r *http.Request) (*http.Request, *upstreamTimer) {
+	t := &upstreamTimer{}
+	return r.WithContext(context.WithValue(r.Context(), upstreamTimerContextKey{}, t)), t
+}
+
+// addUpstreamTime adds an upstream request to the timer of r, if it has one
+func addUpstreamTime(r *http.Request, duration time.Duration) {
+	t, ok := r.Context().Value(upstreamTimerContextKey{}).(*upstreamTimer)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	t.duration += duration
+}
+
+// recordQueryStats adds a request answered with result to the statistics
+// of its query
+func (p *HTTPCacheProxy) recordQueryStats(r *http.Request, result string, bytes int, timer *upstreamTimer) {
+	fingerprint, readable := p.queryFingerprint(r)
+	timer.mu.Lock()
+	requests, duration := timer.requests, timer.duration
+	timer.mu.Unlock()
+	p.opts.QueryStats.record(fingerprint, r.URL.Path, readable, result == "hit" || result == "partial", requests, duration, bytes)
+}
+
+// record adds a request to the statistics of a query
+func (s *QueryStats) record(fingerprint, path, query string, hit bool, upstreamRequests uint64, upstreamDuration time.Duration, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, found := s.queries[fingerprint]
+	if !found {
+		if len(s.queries) >= maxTrackedHits {
+			forgetLeastHit(s.queries, func(q *QueryStat) uint64 { return q.Requests })
+		}
+		q = &QueryStat{Fingerprint: fingerprint, Path: path, Query: query}
+		s.queries[fingerprint] = q
+	}
+	q.Requests++
+	if hit {
+		q.Hits++
+	}
+	q.UpstreamRequests += upstreamRequests
+	q.UpstreamSeconds += upstreamDuration.Seconds()
+	q.Bytes += uint64(bytes)
+}
+
+// Top returns the statistics of the n queries ranking highest by order,
+// one of QueryStatsOrders, and the time since the statistics started
+func (s *QueryStats) Top(n int, order string) ([]QueryStat, time.Duration) {
+	s.mu.Lock()
+	queries := make([]QueryStat, 0, len(s.queries))
+	for _, q := range s.queries {
+		stat := *q
+		stat.HitRatio = float64(q.Hits) / float64(q.Requests)
+		stat.AvgBytes = q.Bytes / q.Requests
+		if q.UpstreamRequests > 0 {
+			stat.AvgUpstreamSeconds = q.UpstreamSeconds / float64(q.UpstreamRequests)
+		}
+		queries = append(queries, stat)
+	}
+	since := time.Since(s.since)
+	s.mu.Unlock()
+
+	value := func(q QueryStat) float64 {
+		switch order {
+		case "requests":
+			return float64(q.Requests)
+		case "hits":
+			return float64(q.Hits)
+		case "bytes":
+			return float64(q.Bytes)
+		default:
+			return q.UpstreamSeconds
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if vi, vj := value(queries[i]), value(queries[j]); vi != vj {
+			return vi > vj
+		}
+		return queries[i].Fingerprint < queries[j].Fingerprint
+	})
+	return queries[:min(n, len(queries))], since
+}
+
+// Reset forgets all statistics
+func (s *QueryStats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = make(map[string]*QueryStat)
+	s.since = time.Now()
+}
+
+// StartSummaryLog logs the n queries that took the upstream the longest
+// every interval
+func (s *QueryStats) StartSummaryLog(interval time.Duration, n int, log *slog.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			top, since := s.Top(n, "upstream_seconds")
+			for i, q := range top {
+				log.Info("Query statistics",
+					"rank", i+1,
+					"fingerprint", q.Fingerprint,
+					"path", q.Path,
+					"query", q.Query,
+					"requests", q.Requests,
+					"hit_ratio", q.HitRatio,
+					"upstream_requests", q.UpstreamRequests,
+					"upstream_seconds", q.UpstreamSeconds,
+					"avg_upstream_seconds", q.AvgUpstreamSeconds,
+					"bytes", q.Bytes,
+					"since", since.Round(time.Second))
+			}
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// readyPaths are probed in order to check the upstream; the first path it
+// serves decides. Prometheus and Thanos serve /-/ready, Loki /ready, and
+// other Prometheus-compatible APIs answer a constant query.
+var readyPaths = []string{"/-/ready", "/ready", "/api/v1/query?query=1"}
+
+// Upstream returns the URL of the proxy's upstream
+func (p *HTTPCacheProxy) Upstream() string {
+	return p.upstreamURL
+}
+
+// CheckUpstream verifies the upstream is reachable and ready to answer
+// queries
+func (p *HTTPCacheProxy) CheckUpstream(ctx context.Context) error {
+	for _, path := range readyPaths {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.upstreamURL, "/")+path, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			continue
+		case resp.StatusCode/100 != 2:
+			return fmt.Errorf("GET %s: %s", path, resp.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("upstream serves none of %s", strings.Join(readyPaths, ", "))
+}
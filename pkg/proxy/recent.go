@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// splitRecent returns the last step of a range query before the recent
+// window starts, where it is split into a cached head and a fresh tail.
+// The split point only moves once per cache TTL, so heads are looked up
+// under the same key until they expire. Returns false for queries that
+// don't reach into the window or lie mostly within it.
+func (p *HTTPCacheProxy) splitRecent(query url.Values, now time.Time) (splitMs int64, stepMs int64, ok bool) {
+	step, hasStep := parseDuration(query.Get("step"))
+	start, hasStart := parseTime(query.Get("start"))
+	end, hasEnd := parseTime(query.Get("end"))
+	if !hasStep || !hasStart || !hasEnd || end < start {
+		return 0, 0, false
+	}
+	stepMs = step.Milliseconds()
+	startMs := int64(start * 1000)
+	endMs := int64(end * 1000)
+
+	boundary := now.Add(-p.opts.RecentWindow).UnixMilli()
+	if align := p.cacheTTL.Milliseconds(); align > 0 {
+		boundary -= boundary % align
+	}
+	if stepMs <= 0 || endMs <= boundary || boundary < startMs+stepMs {
+		return 0, 0, false
+	}
+	return startMs + (boundary-startMs)/stepMs*stepMs, stepMs, true
+}
+
+// tryServeSplit answers a range query ending within the recent window from
+// a cached head up to the window and a tail fetched fresh from the
+// upstream. Returns true if the request was answered.
+func (p *HTTPCacheProxy) tryServeSplit(w http.ResponseWriter, r *http.Request) bool {
+	if p.opts.RecentWindow <= 0 || r.URL.Path != "/api/v1/query_range" || p.opts.ExactTime {
+		return false
+	}
+	query := r.URL.Query()
+	splitMs, stepMs, ok := p.splitRecent(query, time.Now())
+	if !ok {
+		return false
+	}
+
+	headQuery := r.URL.Query()
+	headQuery.Set("end", formatTime(float64(splitMs)/1000))
+	headReq := subRequest(r, headQuery)
+	tailQuery := r.URL.Query()
+	tailQuery.Set("start", formatTime(float64(splitMs+stepMs)/1000))
+	tailReq := subRequest(r, tailQuery)
+
+	// The head is cached like any range query
+	headKey := p.storageKey(p.generateCacheKey(headReq))
+	head, headStatus, rec := p.fetchHead(headReq, headKey)
+	if rec != nil {
+		writeRecorded(w, rec)
+		return true
+	}
+	if head == nil {
+		return false
+	}
+
+	// The tail always comes from the upstream
+	tailRec := &viewRecorder{header: make(http.Header)}
+	p.forwardRequest(tailRec, tailReq, "", false)
+	if tailRec.status != http.StatusOK {
+		writeRecorded(w, tailRec)
+		return true
+	}
+	tail, err := parseMatrix(tailRec.body.Bytes())
+	if err != nil {
+		p.log.DebugContext(r.Context(), "Failed to parse recent tail, forwarding whole query",
+			"path", r.URL.Path,
+			"error", err)
+		return false
+	}
+
+	traceStep(r, "recent_split", formatTime(float64(splitMs)/1000))
+	if headStatus == "HIT" {
+		p.metrics.RecordCacheHit()
+		p.recordHit(r, headKey)
+		p.recordDashboardRequest(r, "hit")
+	} else {
+		p.metrics.RecordCacheMiss()
+		p.recordDashboardRequest(r, "miss")
+	}
+	p.metrics.RecordRecentSplit(headStatus)
+
+	tail.prepend(head)
+	for name, values := range tailRec.header {
+		if name != "Content-Length" && name != "Content-Encoding" && name != "Etag" && name != "Via" && name != "X-Cache" {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Add("Via", p.viaValue(r))
+	p.setCacheStatus(w, "PARTIAL", "")
+	writeMatrixBody(w, r, http.StatusOK, tail)
+	return true
+}
+
+// fetchHead returns the head of a split query from the cache or the
+// upstream, caching it. A failed upstream response is returned as
+// recorded; a nil matrix without one falls back to the whole query.
+func (p *HTTPCacheProxy) fetchHead(r *http.Request, key string) (*matrix, string, *viewRecorder) {
+	if data, found, _ := p.cacheGet(r.Context(), key); found {
+		var cachedResp Response
+		if err := decodeResponse(data, &cachedResp); err == nil && cachedResp.StatusCode == http.StatusOK {
+			if m, err := cachedMatrix(&cachedResp); err == nil {
+				return m, "HIT", nil
+			}
+		}
+	}
+
+	rec := &viewRecorder{header: make(http.Header)}
+	p.forwardRequest(rec, r, key, true)
+	if rec.status != http.StatusOK {
+		return nil, "", rec
+	}
+	m, err := parseMatrix(rec.body.Bytes())
+	if err != nil {
+		p.log.DebugContext(r.Context(), "Failed to parse cached head, forwarding whole query",
+			"path", r.URL.Path,
+			"error", err)
+		return nil, "", nil
+	}
+	return m, "MISS", nil
+}
+
+// subRequest returns a copy of r asking for query, with an identity
+// encoded response
+func subRequest(r *http.Request, query url.Values) *http.Request {
+	sub := r.Clone(r.Context())
+	sub.URL.RawQuery = query.Encode()
+	sub.Header.Del("Accept-Encoding")
+	sub.Header.Del("If-None-Match")
+	sub.Header.Del("If-Modified-Since")
+	return sub
+}
+
+// writeRecorded sends a recorded response to the client
+func writeRecorded(w http.ResponseWriter, rec *viewRecorder) {
+	for name, values := range rec.header {
+		if name != "Content-Length" {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+// prepend adds the samples of head before those of m. Series are matched
+// by their labels; samples of m at or before the last sample of head are
+// dropped, so overlapping results don't repeat timestamps.
+func (m *matrix) prepend(head *matrix) {
+	index := make(map[string]int, len(m.series))
+	for i, s := range m.series {
+		index[string(s.Metric)] = i
+	}
+
+	merged := make([]matrixSeries, 0, len(head.series)+len(m.series))
+	used := make([]bool, len(m.series))
+	for _, h := range head.series {
+		i, found := index[string(h.Metric)]
+		if !found {
+			merged = append(merged, h)
+			continue
+		}
+		used[i] = true
+		t := m.series[i]
+		merged = append(merged, matrixSeries{
+			Metric:     h.Metric,
+			Values:     appendValuesAfter(h.Values, t.Values),
+			Histograms: appendHistogramsAfter(h.Histograms, t.Histograms),
+		})
+	}
+	for i, s := range m.series {
+		if !used[i] {
+			merged = append(merged, s)
+		}
+	}
+	m.series = merged
+}
+
+// appendValuesAfter appends the samples of tail after the last of head
+func appendValuesAfter(head []matrixSample, tail []matrixSample) []matrixSample {
+	if len(head) == 0 {
+		return tail
+	}
+	last := head[len(head)-1].T
+	for len(tail) > 0 && tail[0].T <= last {
+		tail = tail[1:]
+	}
+	return append(head, tail...)
+}
+
+// appendHistogramsAfter appends the histograms of tail after the last of
+// head
+func appendHistogramsAfter(head []histogramSample, tail []histogramSample) []histogramSample {
+	if len(head) == 0 {
+		return tail
+	}
+	last := head[len(head)-1].T
+	for len(tail) > 0 && tail[0].T <= last {
+		tail = tail[1:]
+	}
+	return append(head, tail...)
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitRecent(t *testing.T) {
+	p := New("http://prometheus:9090", newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{RecentWindow: 5 * time.Minute})
+	// The window starts at 1700000000 - 300, aligned down to the minute
+	now := time.Unix(1700000000, 0)
+	const boundary = 1699999680
+
+	tests := []struct {
+		name             string
+		start, end, step string
+		split            int64
+		ok               bool
+	}{
+		{name: "on the step grid", start: "1699996380", end: "1700000000", step: "60", split: boundary, ok: true},
+		{name: "off the step grid", start: "1699996410", end: "1700000000", step: "60", split: 1699999650, ok: true},
+		{name: "ends before the window", start: "1699996380", end: "1699999000", step: "60"},
+		{name: "mostly recent", start: "1699999650", end: "1700000000", step: "60"},
+		{name: "no step", start: "1699996380", end: "1700000000", step: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"start": {tt.start}, "end": {tt.end}, "step": {tt.step}}
+			splitMs, stepMs, ok := p.splitRecent(query, now)
+			if ok != tt.ok {
+				t.Fatalf("splitRecent ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if splitMs != tt.split*1000 || stepMs != 60000 {
+				t.Errorf("splitRecent = %d, %d, want %d, 60000", splitMs, stepMs, tt.split*1000)
+			}
+			// The split point is a step of the query at or before the window
+			start, _ := strconv.ParseInt(tt.start, 10, 64)
+			if (splitMs-start*1000)%stepMs != 0 || splitMs > boundary*1000 {
+				t.Errorf("split point %d isn't a step of the query before %d", splitMs, boundary*1000)
+			}
+		})
+	}
+}
+
+// evaluatingUpstream answers range queries like Prometheus, with a sample
+// valued by its timestamp at every step from start to end
+func evaluatingUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		start, _ := strconv.ParseInt(query.Get("start"), 10, 64)
+		end, _ := strconv.ParseInt(query.Get("end"), 10, 64)
+		step, _ := strconv.ParseInt(query.Get("step"), 10, 64)
+		var values []string
+		for ts := start; ts <= end; ts += step {
+			values = append(values, fmt.Sprintf(`[%d,"%d"]`, ts, ts))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[`+
+			strings.Join(values, ",")+`]}]}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestServeSplitBoundary(t *testing.T) {
+	upstream := evaluatingUpstream(t)
+
+	const step = 60
+	now := time.Now().Unix()
+	// Both on and off the minute, where the split point is
+	for _, start := range []int64{now - 3600 - now%step, now - 3600 - now%step + 17} {
+		t.Run(strconv.FormatInt(start%step, 10), func(t *testing.T) {
+			// Starts within one TTL share their head, so each gets a cache
+			p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{RecentWindow: 5 * time.Minute})
+			// Once with the head fetched, once with it cached
+			for range 2 {
+				w := httptest.NewRecorder()
+				target := fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=%d", start, now, step)
+				p.HandleRequest(w, httptest.NewRequest(http.MethodGet, target, nil))
+				if got := w.Header().Get("X-Cache"); got != "PARTIAL" {
+					t.Fatalf("X-Cache = %q, want PARTIAL", got)
+				}
+
+				m, err := parseMatrix(w.Body.Bytes())
+				if err != nil {
+					t.Fatalf("parseMatrix: %v", err)
+				}
+				if len(m.series) != 1 {
+					t.Fatalf("got %d series, want 1", len(m.series))
+				}
+				// Every step is answered exactly once, by the head or the tail
+				values := m.series[0].Values
+				if n := int((now-start)/step) + 1; len(values) != n {
+					t.Errorf("got %d samples, want %d", len(values), n)
+				}
+				for i, sample := range values {
+					if want := (start + int64(i)*step) * 1000; sample.T != want {
+						t.Errorf("sample %d at %d, want %d", i, sample.T, want)
+						break
+					}
+				}
+			}
+		})
+	}
+}
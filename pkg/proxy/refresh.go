@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// refreshContextKey is the context key marking cache refreshes
+type refreshContextKey struct{}
+
+// WithRefresh returns a request that skips the cache lookup and is always
+// answered by the upstream, storing the response as usual. The cache
+// warmer uses it to replace entries before they expire.
+func WithRefresh(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), refreshContextKey{}, true))
+}
+
+// isRefresh reports whether the request skips the cache lookup
+func isRefresh(r *http.Request) bool {
+	refresh, _ := r.Context().Value(refreshContextKey{}).(bool)
+	return refresh
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mapCache is a Cache keeping entries in a map, ignoring their TTL
+type mapCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{entries: make(map[string][]byte)}
+}
+
+func (c *mapCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.entries[key]
+	return value, ok
+}
+
+func (c *mapCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = value
+}
+
+func (c *mapCache) Delete(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *mapCache) Label(key string, label string) {}
+
+func (c *mapCache) TTL() time.Duration {
+	return time.Minute
+}
+
+func TestWithRefresh(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	get := func(refresh bool) string {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1700000000", nil)
+		if refresh {
+			r = WithRefresh(r)
+		}
+		w := httptest.NewRecorder()
+		p.HandleRequest(w, r)
+		return w.Header().Get("X-Cache")
+	}
+
+	if got := get(false); got != "MISS" {
+		t.Fatalf("first request X-Cache = %q, want MISS", got)
+	}
+	if got := get(false); got != "HIT" {
+		t.Fatalf("second request X-Cache = %q, want HIT", got)
+	}
+	if got := get(true); got != "MISS" {
+		t.Errorf("refresh X-Cache = %q, want MISS", got)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+	if got := get(false); got != "HIT" {
+		t.Errorf("request after refresh X-Cache = %q, want HIT", got)
+	}
+}
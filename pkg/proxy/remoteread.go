@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteReadPath is the path of the Prometheus remote read endpoint
+const remoteReadPath = "/api/v1/read"
+
+// matcherOps are the operators of the remote read LabelMatcher types
+var matcherOps = []string{"=", "!=", "=~", "!~"}
+
+// isRemoteRead reports whether r is a remote read request
+func isRemoteRead(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == remoteReadPath
+}
+
+// isRemoteReadResponse reports whether resp is a protobuf remote read
+// response, which can't be validated like the JSON API responses
+func isRemoteReadResponse(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/x-protobuf") ||
+		strings.HasPrefix(contentType, "application/x-streamed-protobuf")
+}
+
+// remoteReadKey returns the normalized form of a remote read request: its
+// accepted response types and, per query, the sorted matchers, the hints
+// and the time range aligned to TTL boundaries
+func (p *HTTPCacheProxy) remoteReadKey(r *http.Request) (string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Remote read requests are snappy-compressed protobuf ReadRequests
+	decoded, err := s2.Decode(nil, body)
+	if err != nil {
+		return "", fmt.Errorf("decoding remote read request: %w", err)
+	}
+
+	var queries []string
+	var types []string
+	for len(decoded) > 0 {
+		num, typ, n := protowire.ConsumeTag(decoded)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		decoded = decoded[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			query, n := protowire.ConsumeBytes(decoded)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			decoded = decoded[n:]
+			normalized, err := p.normalizeReadQuery(query)
+			if err != nil {
+				return "", err
+			}
+			queries = append(queries, normalized)
+		case num == 2 && typ == protowire.BytesType:
+			packed, n := protowire.ConsumeBytes(decoded)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			decoded = decoded[n:]
+			for len(packed) > 0 {
+				v, n := protowire.ConsumeVarint(packed)
+				if n < 0 {
+					return "", protowire.ParseError(n)
+				}
+				packed = packed[n:]
+				types = append(types, strconv.FormatUint(v, 10))
+			}
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(decoded)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			decoded = decoded[n:]
+			types = append(types, strconv.FormatUint(v, 10))
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, decoded)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			decoded = decoded[n:]
+		}
+	}
+	if len(queries) == 0 {
+		return "", errors.New("remote read request without queries")
+	}
+
+	return "types=" + strings.Join(types, ",") + ";" + strings.Join(queries, ";"), nil
+}
+
+// rawRemoteReadKey returns a key unique to the body of a remote read
+// request that can't be normalized, so it never shares another request's
+// entry
+func rawRemoteReadKey(r *http.Request) string {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return "raw=" + hex.EncodeToString(sum[:])
+}
+
+// normalizeReadQuery returns the normalized form of a remote read Query
+func (p *HTTPCacheProxy) normalizeReadQuery(query []byte) (string, error) {
+	var start, end int64
+	var matchers []string
+	var hints string
+	for len(query) > 0 {
+		num, typ, n := protowire.ConsumeTag(query)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		query = query[n:]
+
+		switch {
+		case (num == 1 || num == 2) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(query)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			query = query[n:]
+			if num == 1 {
+				start = int64(v)
+			} else {
+				end = int64(v)
+			}
+		case num == 3 && typ == protowire.BytesType:
+			matcher, n := protowire.ConsumeBytes(query)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			query = query[n:]
+			normalized, err := normalizeReadMatcher(matcher)
+			if err != nil {
+				return "", err
+			}
+			matchers = append(matchers, normalized)
+		case num == 4 && typ == protowire.BytesType:
+			raw, n := protowire.ConsumeBytes(query)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			query = query[n:]
+			normalized, err := normalizeReadHints(raw)
+			if err != nil {
+				return "", err
+			}
+			hints = normalized
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, query)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			query = query[n:]
+		}
+	}
+
+	// Align the time range like the time parameters of API queries
+	if ttl := p.cacheTTL.Milliseconds(); ttl > 0 {
+		start = start / ttl * ttl
+		end = (end + ttl - 1) / ttl * ttl
+	}
+	slices.Sort(matchers)
+	return fmt.Sprintf("%d-%d{%s}%s", start, end, strings.Join(matchers, ","), hints), nil
+}
+
+// normalizeReadMatcher returns the PromQL form of a remote read
+// LabelMatcher
+func normalizeReadMatcher(matcher []byte) (string, error) {
+	var op uint64
+	var name, value string
+	for len(matcher) > 0 {
+		num, typ, n := protowire.ConsumeTag(matcher)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		matcher = matcher[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			op, n = protowire.ConsumeVarint(matcher)
+		case (num == 2 || num == 3) && typ == protowire.BytesType:
+			var s string
+			s, n = protowire.ConsumeString(matcher)
+			if num == 2 {
+				name = s
+			} else {
+				value = s
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, matcher)
+		}
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		matcher = matcher[n:]
+	}
+	if op >= uint64(len(matcherOps)) {
+		return "", fmt.Errorf("unknown matcher type %d", op)
+	}
+	return name + matcherOps[op] + strconv.Quote(value), nil
+}
+
+// normalizeReadHints returns the ReadHints that shape the response: step,
+// function, grouping and range. The hinted time range mirrors the query's
+// and is left out so aligned queries share entries.
+func normalizeReadHints(hints []byte) (string, error) {
+	var fields []string
+	for len(hints) > 0 {
+		num, typ, n := protowire.ConsumeTag(hints)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		hints = hints[n:]
+
+		switch {
+		case (num == 1 || num == 7) && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(hints)
+			fields = append(fields, strconv.Itoa(int(num))+"="+strconv.FormatUint(v, 10))
+		case (num == 2 || num == 5) && typ == protowire.BytesType:
+			var s string
+			s, n = protowire.ConsumeString(hints)
+			fields = append(fields, strconv.Itoa(int(num))+"="+strconv.Quote(s))
+		case num == 6 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(hints)
+			fields = append(fields, "by="+strconv.FormatBool(v != 0))
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, hints)
+		}
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		hints = hints[n:]
+	}
+	return "[" + strings.Join(fields, ",") + "]", nil
+}
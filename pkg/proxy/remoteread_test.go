@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// readMatcher is a remote read LabelMatcher
+type readMatcher struct {
+	op          uint64
+	name, value string
+}
+
+// readRequest encodes a snappy-compressed remote read request of one query
+// with the given time range, matchers and hinted step
+func readRequest(start, end int64, matchers []readMatcher, step int64) []byte {
+	var query []byte
+	query = protowire.AppendTag(query, 1, protowire.VarintType)
+	query = protowire.AppendVarint(query, uint64(start))
+	query = protowire.AppendTag(query, 2, protowire.VarintType)
+	query = protowire.AppendVarint(query, uint64(end))
+	for _, m := range matchers {
+		var matcher []byte
+		matcher = protowire.AppendTag(matcher, 1, protowire.VarintType)
+		matcher = protowire.AppendVarint(matcher, m.op)
+		matcher = protowire.AppendTag(matcher, 2, protowire.BytesType)
+		matcher = protowire.AppendString(matcher, m.name)
+		matcher = protowire.AppendTag(matcher, 3, protowire.BytesType)
+		matcher = protowire.AppendString(matcher, m.value)
+		query = protowire.AppendTag(query, 3, protowire.BytesType)
+		query = protowire.AppendBytes(query, matcher)
+	}
+
+	// The hinted range mirrors the query's
+	var hints []byte
+	hints = protowire.AppendTag(hints, 1, protowire.VarintType)
+	hints = protowire.AppendVarint(hints, uint64(step))
+	hints = protowire.AppendTag(hints, 3, protowire.VarintType)
+	hints = protowire.AppendVarint(hints, uint64(start))
+	hints = protowire.AppendTag(hints, 4, protowire.VarintType)
+	hints = protowire.AppendVarint(hints, uint64(end))
+	query = protowire.AppendTag(query, 4, protowire.BytesType)
+	query = protowire.AppendBytes(query, hints)
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, query)
+	return s2.EncodeSnappy(nil, req)
+}
+
+func TestRemoteReadKey(t *testing.T) {
+	p := New("http://prometheus:9090", newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	key := func(body []byte) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, remoteReadPath, bytes.NewReader(body))
+		k, err := p.remoteReadKey(r)
+		if err != nil {
+			t.Fatalf("remoteReadKey: %v", err)
+		}
+		// The body is left for the upstream request
+		if rest, _ := io.ReadAll(r.Body); !bytes.Equal(rest, body) {
+			t.Error("remoteReadKey consumed the request body")
+		}
+		return k
+	}
+
+	job := readMatcher{0, "job", "api"}
+	name := readMatcher{0, "__name__", "up"}
+	base := key(readRequest(1700000000000, 1700003600000, []readMatcher{job, name}, 15000))
+
+	tests := []struct {
+		name string
+		body []byte
+		same bool
+	}{
+		{"matcher order", readRequest(1700000000000, 1700003600000, []readMatcher{name, job}, 15000), true},
+		{"aligned time range", readRequest(1700000001000, 1700003599000, []readMatcher{job, name}, 15000), true},
+		{"other time range", readRequest(1700000100000, 1700003700000, []readMatcher{job, name}, 15000), false},
+		{"other matcher type", readRequest(1700000000000, 1700003600000, []readMatcher{{2, "job", "api"}, name}, 15000), false},
+		{"other hinted step", readRequest(1700000000000, 1700003600000, []readMatcher{job, name}, 60000), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := key(tt.body); (got == base) != tt.same {
+				t.Errorf("key %s, base key %s, want same %v", got, base, tt.same)
+			}
+		})
+	}
+}
+
+func TestRemoteReadKeyInvalid(t *testing.T) {
+	p := New("http://prometheus:9090", newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	for name, body := range map[string][]byte{
+		"not snappy":    []byte("\xff\xff\xff"),
+		"no queries":    s2.EncodeSnappy(nil, nil),
+		"truncated":     s2.EncodeSnappy(nil, []byte{0x0a, 0x10}),
+		"unknown match": readRequest(0, 1, []readMatcher{{9, "job", "api"}}, 0),
+	} {
+		r := httptest.NewRequest(http.MethodPost, remoteReadPath, bytes.NewReader(body))
+		if _, err := p.remoteReadKey(r); err == nil {
+			t.Errorf("remoteReadKey of %s succeeded", name)
+		}
+	}
+}
+
+func TestRemoteReadInvalidBypassesCache(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	cache := newMapCache()
+	p := New(upstream.URL, cache, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{})
+	for _, body := range []string{"\xff\x01", "\xff\x02"} {
+		w := httptest.NewRecorder()
+		p.HandleRequest(w, httptest.NewRequest(http.MethodPost, remoteReadPath, bytes.NewReader([]byte(body))))
+		// Each request gets its own response, not the other's
+		if w.Body.String() != body {
+			t.Errorf("response %q to request %q", w.Body.String(), body)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+	if n := len(cache.entries); n != 0 {
+		t.Errorf("cached %d entries of invalid remote reads", n)
+	}
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Query rule actions
+const (
+	// RuleAllow lets matching queries through
+	RuleAllow = "allow"
+	// RuleDeny rejects matching queries with 403 Forbidden
+	RuleDeny = "deny"
+)
+
+// Rule allows or denies queries. A rule matches if all of its patterns
+// match; empty patterns are ignored.
+type Rule struct {
+	// Name identifies the rule in responses and logs
+	Name string
+	// Action is RuleAllow or RuleDeny
+	Action string
+	// Query is a regular expression searched for in the PromQL expression
+	Query string
+	// Metric is a regular expression matched against the metric names
+	// referenced by the expression, anchored like PromQL regex matchers.
+	// Deny rules match if any name matches, allow rules only if all do.
+	Metric string
+}
+
+// compiledRule is a rule with its patterns compiled
+type compiledRule struct {
+	name   string
+	action string
+	query  *regexp.Regexp
+	metric *regexp.Regexp
+	// anyMetric matches the metric pattern if any referenced name matches
+	// rather than all of them
+	anyMetric bool
+	// client matches the identity name of clients, nil matches all
+	client *regexp.Regexp
+	// ttl is the TTL of responses to queries matching a cache rule
+	ttl time.Duration
+}
+
+// RuleSet is an ordered list of query rules. The first matching rule
+// decides; queries matching no rule are allowed.
+type RuleSet struct {
+	rules []compiledRule
+}
+
+// NewRuleSet compiles the given rules
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for _, rule := range rules {
+		if rule.Action != RuleAllow && rule.Action != RuleDeny {
+			return nil, fmt.Errorf("rule %q: unknown action %q", rule.Name, rule.Action)
+		}
+		cr, err := compileRule(rule.Name, rule.Action, rule.Query, rule.Metric)
+		if err != nil {
+			return nil, err
+		}
+		cr.anyMetric = rule.Action == RuleDeny
+		rs.rules = append(rs.rules, cr)
+	}
+	return rs, nil
+}
+
+// compileRule compiles the patterns of a rule
+func compileRule(name, action, query, metric string) (compiledRule, error) {
+	if query == "" && metric == "" {
+		return compiledRule{}, fmt.Errorf("rule %q: needs a query or metric pattern", name)
+	}
+
+	cr := compiledRule{name: name, action: action}
+	if query != "" {
+		re, err := regexp.Compile(query)
+		if err != nil {
+			return compiledRule{}, fmt.Errorf("rule %q: %w", name, err)
+		}
+		cr.query = re
+	}
+	if metric != "" {
+		re, err := regexp.Compile("^(?:" + metric + ")$")
+		if err != nil {
+			return compiledRule{}, fmt.Errorf("rule %q: %w", name, err)
+		}
+		cr.metric = re
+	}
+	return cr, nil
+}
+
+// match returns the first rule matching expr of client, nil if none does
+func (rs *RuleSet) match(expr, client string) *compiledRule {
+	var names []string
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		if rule.client != nil && !rule.client.MatchString(client) {
+			continue
+		}
+		if rule.query != nil && !rule.query.MatchString(expr) {
+			continue
+		}
+		if rule.metric != nil {
+			if names == nil {
+				names = metricNames(expr)
+			}
+			if rule.anyMetric && !anyMatch(rule.metric, names) {
+				continue
+			}
+			if !rule.anyMetric && !allMatch(rule.metric, names) {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// anyMatch reports whether re matches any of values
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// allMatch reports whether re matches all of at least one value
+func allMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if !re.MatchString(v) {
+			return false
+		}
+	}
+	return len(values) > 0
+}
+
+// checkRules rejects requests containing an expression denied by the query
+// rules. Returns true if the request was rejected.
+func (p *HTTPCacheProxy) checkRules(w http.ResponseWriter, r *http.Request) bool {
+	if p.opts.Rules == nil {
+		return false
+	}
+
+	params, err := requestParams(r)
+	if err != nil {
+		writeParamsError(w, err)
+		return true
+	}
+
+	for _, expr := range queryExpressions(params) {
+		id, _ := IdentityFrom(r)
+		rule := p.opts.Rules.match(expr, id.Name)
+		if rule == nil || rule.action == RuleAllow {
+			continue
+		}
+
+		p.log.InfoContext(r.Context(), "Query denied by rule",
+			"rule", rule.name,
+			"path", r.URL.Path,
+			"query", expr)
+		traceStep(r, "rule_denied", rule.name)
+		http.Error(w, fmt.Sprintf("Query denied by rule %q", rule.name), http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// errUnsupportedBody is returned for POST bodies that aren't URL-encoded
+// forms. The upstream may read parameters from them, e.g. Prometheus from
+// multipart forms, which rules, limits and label enforcement can't check.
+var errUnsupportedBody = errors.New("request body must be empty or application/x-www-form-urlencoded")
+
+// requestParams returns the query and form parameters of r. A form body is
+// read and restored so it can still be forwarded upstream. POST bodies of
+// other content types are rejected with errUnsupportedBody.
+func requestParams(r *http.Request) (url.Values, error) {
+	params := r.URL.Query()
+	if r.Method != http.MethodPost || r.Body == nil || r.Body == http.NoBody {
+		return params, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return params, nil
+	}
+	if !isFormPost(r) {
+		return nil, errUnsupportedBody
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range form {
+		params[k] = append(params[k], v...)
+	}
+	return params, nil
+}
+
+// writeParamsError responds to a request whose parameters couldn't be read
+func writeParamsError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedBody) {
+		http.Error(w, "Unsupported Media Type: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(w, "Failed to read request", http.StatusBadRequest)
+}
+
+// isFormPost reports whether r carries its parameters in a form body
+func isFormPost(r *http.Request) bool {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return false
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return contentType == "application/x-www-form-urlencoded"
+}
+
+// queryExpressions returns the PromQL expressions and series selectors of
+// a request
+func queryExpressions(params url.Values) []string {
+	exprs := append([]string{}, params["query"]...)
+	return append(exprs, params["match[]"]...)
+}
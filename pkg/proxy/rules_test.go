@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestParams(t *testing.T) {
+	t.Run("form body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/query?time=1", strings.NewReader("query=up"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		params, err := requestParams(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.Get("query") != "up" || params.Get("time") != "1" {
+			t.Errorf("params = %v, want query and time", params)
+		}
+		// The body is restored for forwarding
+		if body, _ := io.ReadAll(r.Body); string(body) != "query=up" {
+			t.Errorf("body = %q after reading params", body)
+		}
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/query?query=up", nil)
+		r.Header.Set("Content-Type", "text/plain")
+		if _, err := requestParams(r); err != nil {
+			t.Errorf("requestParams of an empty body: %v", err)
+		}
+	})
+
+	t.Run("multipart body", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("query", "secret_metric")
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/query", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		if _, err := requestParams(r); !errors.Is(err, errUnsupportedBody) {
+			t.Fatalf("requestParams of a multipart body = %v, want errUnsupportedBody", err)
+		}
+
+		w := httptest.NewRecorder()
+		writeParamsError(w, errUnsupportedBody)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+		}
+	})
+}
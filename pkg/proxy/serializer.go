@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Serializer encodes cached responses for storage
+type Serializer interface {
+	// Name returns the name used to select the serializer in config
+	Name() string
+	// Marshal encodes a response
+	Marshal(resp *Response) ([]byte, error)
+	// Unmarshal decodes a response previously encoded by Marshal
+	Unmarshal(data []byte, resp *Response) error
+}
+
+// Format tags prefixed to every stored value so entries written with any
+// serializer can be read back regardless of the configured one
+const (
+	tagJSON     byte = 'J'
+	tagRaw      byte = 'R'
+	tagMsgpack  byte = 'M'
+	tagProtobuf byte = 'P'
+	tagBinary   byte = 'B'
+)
+
+// serializers maps format tags to their serializers
+var serializers = map[byte]Serializer{
+	tagJSON:     jsonSerializer{},
+	tagRaw:      rawSerializer{},
+	tagMsgpack:  msgpackSerializer{},
+	tagProtobuf: protobufSerializer{},
+	tagBinary:   binarySerializer{},
+}
+
+// NewSerializer returns the serializer with the given name
+func NewSerializer(name string) (Serializer, error) {
+	for _, s := range serializers {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown serializer %q", name)
+}
+
+// encodeResponse encodes a response with the given serializer, prefixed
+// with the serializer's format tag
+func encodeResponse(s Serializer, resp *Response) ([]byte, error) {
+	data, err := s.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	for tag, candidate := range serializers {
+		if candidate.Name() == s.Name() {
+			return append([]byte{tag}, data...), nil
+		}
+	}
+	return nil, fmt.Errorf("serializer %q is not registered", s.Name())
+}
+
+// decodeResponse decodes a stored response using the serializer identified
+// by its format tag. Untagged values are legacy JSON entries.
+func decodeResponse(data []byte, resp *Response) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty cache value")
+	}
+	if data[0] == '{' {
+		return json.Unmarshal(data, resp)
+	}
+
+	s, ok := serializers[data[0]]
+	if !ok {
+		return fmt.Errorf("unknown serialization format %q", data[0])
+	}
+	return s.Unmarshal(data[1:], resp)
+}
+
+// jsonSerializer encodes responses as JSON, which is easy to inspect but
+// base64-encodes the body
+type jsonSerializer struct{}
+
+func (jsonSerializer) Name() string {
+	return "json"
+}
+
+func (jsonSerializer) Marshal(resp *Response) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, resp *Response) error {
+	return json.Unmarshal(data, resp)
+}
+
+// Headers carrying Response fields in the raw HTTP format
+const (
+	rawStoredAtHeader   = "X-Promcache-Stored-At"
+	rawCompressedHeader = "X-Promcache-Compressed"
+	rawMatrixHeader     = "X-Promcache-Matrix"
+)
+
+// rawSerializer encodes responses in HTTP/1.1 wire format
+type rawSerializer struct{}
+
+func (rawSerializer) Name() string {
+	return "raw"
+}
+
+func (rawSerializer) Marshal(resp *Response) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+
+	header := resp.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Del("Content-Length")
+	header.Set(rawStoredAtHeader, strconv.FormatInt(resp.StoredAt.UnixNano(), 10))
+	header.Set(rawCompressedHeader, strconv.FormatBool(resp.Compressed))
+	if resp.Matrix {
+		header.Set(rawMatrixHeader, "true")
+	}
+	// Content-Length only frames the stored body, which may be compressed,
+	// and is stripped again when decoding
+	header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	if err := header.Write(&buf); err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(resp.Body)
+	return buf.Bytes(), nil
+}
+
+func (rawSerializer) Unmarshal(data []byte, resp *Response) error {
+	httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	storedAt, _ := strconv.ParseInt(httpResp.Header.Get(rawStoredAtHeader), 10, 64)
+	compressed, _ := strconv.ParseBool(httpResp.Header.Get(rawCompressedHeader))
+	matrix, _ := strconv.ParseBool(httpResp.Header.Get(rawMatrixHeader))
+	httpResp.Header.Del(rawStoredAtHeader)
+	httpResp.Header.Del(rawCompressedHeader)
+	httpResp.Header.Del(rawMatrixHeader)
+	httpResp.Header.Del("Content-Length")
+
+	*resp = Response{
+		Headers:    httpResp.Header,
+		StatusCode: httpResp.StatusCode,
+		Body:       body,
+		Compressed: compressed,
+		Matrix:     matrix,
+		StoredAt:   time.Unix(0, storedAt),
+	}
+	return nil
+}
+
+// sortedHeaderNames returns the header names in a stable order
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
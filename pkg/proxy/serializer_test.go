@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSerializersRoundTrip(t *testing.T) {
+	want := Response{
+		Headers: http.Header{
+			"Content-Type": {"application/json"},
+			"Vary":         {"Accept-Encoding", "Origin"},
+		},
+		StatusCode: http.StatusOK,
+		Body:       []byte("\x1f\x8b\x08\x00compressed body"),
+		Compressed: true,
+		Matrix:     true,
+		StoredAt:   time.Unix(1700000000, 123456789),
+	}
+
+	for _, s := range serializers {
+		t.Run(s.Name(), func(t *testing.T) {
+			data, err := encodeResponse(s, &want)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			var got Response
+			if err := decodeResponse(data, &got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got.Headers, want.Headers) {
+				t.Errorf("headers = %v, want %v", got.Headers, want.Headers)
+			}
+			if got.StatusCode != want.StatusCode || got.Compressed != want.Compressed || got.Matrix != want.Matrix {
+				t.Errorf("got status %d compressed %t matrix %t, want %d %t %t",
+					got.StatusCode, got.Compressed, got.Matrix, want.StatusCode, want.Compressed, want.Matrix)
+			}
+			if !bytes.Equal(got.Body, want.Body) {
+				t.Errorf("body = %q, want %q", got.Body, want.Body)
+			}
+			if !got.StoredAt.Equal(want.StoredAt) {
+				t.Errorf("stored at = %s, want %s", got.StoredAt, want.StoredAt)
+			}
+		})
+	}
+}
+
+func TestRawSerializerContentLength(t *testing.T) {
+	// A stale Content-Length of the decompressed body must not survive,
+	// nor must the framing length of the stored body
+	resp := Response{
+		Headers:    http.Header{"Content-Length": {"1000"}},
+		StatusCode: http.StatusOK,
+		Body:       []byte("gzip"),
+		Compressed: true,
+	}
+	data, err := encodeResponse(rawSerializer{}, &resp)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var got Response
+	if err := decodeResponse(data, &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cl := got.Headers.Get("Content-Length"); cl != "" {
+		t.Errorf("Content-Length = %q, want none", cl)
+	}
+	if string(got.Body) != "gzip" {
+		t.Errorf("body = %q, want %q", got.Body, "gzip")
+	}
+}
+
+func TestDecodeResponseErrors(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("X"), []byte("Mgarbage"), []byte("B\x01")} {
+		var resp Response
+		if err := decodeResponse(data, &resp); err == nil {
+			t.Errorf("decodeResponse(%q) = nil, want error", data)
+		}
+	}
+}
+
+func TestSerializersTruncated(t *testing.T) {
+	resp := Response{
+		Headers:    http.Header{"Content-Type": {"application/json"}},
+		StatusCode: http.StatusOK,
+		Body:       []byte(`{"status":"success"}`),
+		StoredAt:   time.Unix(1700000000, 0),
+	}
+
+	// Protobuf fields are optional and the binary format ends with the
+	// body, so some of their prefixes are valid values; decoding them must
+	// still not fail in any other way
+	framed := map[string]bool{"json": true, "raw": true, "msgpack": true}
+
+	for _, s := range serializers {
+		t.Run(s.Name(), func(t *testing.T) {
+			data, err := encodeResponse(s, &resp)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			for n := 1; n < len(data); n++ {
+				var got Response
+				if err := decodeResponse(data[:n], &got); err == nil && framed[s.Name()] {
+					t.Errorf("decoding %d of %d bytes succeeded", n, len(data))
+					break
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSerializers(b *testing.B) {
+	body := bytes.Repeat([]byte(`{"metric":{"__name__":"up","job":"api"},"values":[[1700000000,"1"]]},`), 2000)
+	resp := Response{
+		Headers: http.Header{
+			"Content-Type": {"application/json"},
+			"Date":         {"Tue, 14 Nov 2023 22:13:20 GMT"},
+			"Vary":         {"Accept-Encoding"},
+		},
+		StatusCode: http.StatusOK,
+		Body:       body,
+		StoredAt:   time.Unix(1700000000, 0),
+	}
+
+	tags := slices.Sorted(maps.Keys(serializers))
+	for _, tag := range tags {
+		s := serializers[tag]
+		data, err := encodeResponse(s, &resp)
+		if err != nil {
+			b.Fatalf("%s: %v", s.Name(), err)
+		}
+		b.Run(s.Name()+"/marshal", func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(data)), "stored-bytes")
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Marshal(&resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(s.Name()+"/unmarshal", func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var got Response
+				if err := decodeResponse(data, &got); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
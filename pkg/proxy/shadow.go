@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// shadowKeyPrefix prefixes the keys of simulated entries, so they don't
+// mix with real entries when shadow mode is toggled at runtime
+const shadowKeyPrefix = "shadow:"
+
+// serveShadow forwards a request to the upstream untouched and simulates
+// what caching it would have done. Instead of responses the cache holds
+// their sizes, so hits and the bytes they would have saved can be counted
+// under the same TTLs and eviction as real entries.
+func (p *HTTPCacheProxy) serveShadow(w http.ResponseWriter, r *http.Request, cacheKey string, isCacheable bool) {
+	if !isCacheable {
+		p.metrics.RecordShadowRequest("uncacheable")
+		p.forwardRequest(w, r, cacheKey, false)
+		return
+	}
+
+	shadowKey := shadowKeyPrefix + cacheKey
+	if data, found, _ := p.cacheGet(r.Context(), shadowKey); found {
+		size, _ := strconv.Atoi(string(data))
+		traceStep(r, "shadow_hit", cacheKey)
+		p.metrics.RecordShadowRequest("hit")
+		p.metrics.RecordShadowBytesSaved(size)
+		p.forwardRequest(w, r, cacheKey, false)
+		return
+	}
+
+	traceStep(r, "shadow_miss", cacheKey)
+	p.metrics.RecordShadowRequest("miss")
+	sw := &sizeWriter{ResponseWriter: w}
+	p.forwardRequest(sw, r, cacheKey, false)
+	if sw.status == http.StatusOK {
+		p.cacheSet(r.Context(), shadowKey, []byte(strconv.Itoa(sw.size)), p.entryTTL(r, nil, 0))
+	}
+}
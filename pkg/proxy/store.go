@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// Cache stores the cached responses of a proxy. The in-memory cache of
+// internal/cache implements it; other implementations may keep entries
+// elsewhere. Implementations reaching out to another service should give
+// up once ctx is done; failed lookups count as misses, and failures to store
+// or delete are theirs to report.
+type Cache interface {
+	// Get returns the value stored under key, if it exists and hasn't
+	// expired
+	Get(ctx context.Context, key string) ([]byte, bool)
+	// Set stores value under key for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	// Delete removes the value stored under key
+	Delete(ctx context.Context, key string)
+	// Label attaches a readable description to the entry of key, for
+	// debugging
+	Label(key string, label string)
+	// TTL is the default TTL, which query time parameters are aligned to
+	TTL() time.Duration
+}
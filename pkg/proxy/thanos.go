@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// thanosBoolParams are Thanos query parameters toggling deduplication and
+// partial responses
+var thanosBoolParams = []string{"dedup", "partial_response"}
+
+// normalizeThanosParams rewrites the Thanos query parameters of query into
+// a canonical form. Thanos accepts several spellings of the same flag, and
+// the flags change the response, so they must stay part of the key.
+func normalizeThanosParams(query url.Values) {
+	for _, name := range thanosBoolParams {
+		if value, err := strconv.ParseBool(strings.TrimSpace(query.Get(name))); err == nil {
+			query.Set(name, strconv.FormatBool(value))
+		}
+	}
+
+	if resolution := strings.TrimSpace(query.Get("max_source_resolution")); resolution != "" {
+		query.Set("max_source_resolution", canonicalResolution(resolution))
+	}
+
+	// Store matchers select stores in any order
+	if matches, found := query["storeMatch[]"]; found {
+		query["storeMatch[]"] = uniqueTrimmed(matches)
+	}
+}
+
+// canonicalResolution returns a max_source_resolution value as seconds.
+// Thanos accepts Prometheus durations and plain seconds; other values such
+// as "auto" are returned as-is.
+func canonicalResolution(resolution string) string {
+	if seconds, err := strconv.ParseFloat(resolution, 64); err == nil {
+		return strconv.FormatFloat(seconds, 'f', -1, 64)
+	}
+	if d, err := model.ParseDuration(resolution); err == nil {
+		return strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64)
+	}
+	return resolution
+}
+
+// applyThanosDefaults sets the configured default of each Thanos parameter
+// the request leaves out, so the upstream's own defaults never decide what
+// a shared cache entry contains. Returns true if the request was rejected.
+func (p *HTTPCacheProxy) applyThanosDefaults(w http.ResponseWriter, r *http.Request) bool {
+	if len(p.opts.ThanosDefaults) == 0 || (!isQueryEndpoint(r.URL.Path) && !isSeriesEndpoint(r.URL.Path)) {
+		return false
+	}
+
+	params, err := requestParams(r)
+	if err != nil {
+		writeParamsError(w, err)
+		return true
+	}
+
+	changes := url.Values{}
+	for name, value := range p.opts.ThanosDefaults {
+		if _, found := params[name]; !found {
+			changes.Set(name, value)
+		}
+	}
+	if len(changes) == 0 {
+		return false
+	}
+	traceStep(r, "thanos_defaults", changes.Encode())
+	if err := rewriteParams(r, changes); err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// timeoutMargin is added to a client-provided query timeout so the upstream
+// gets to report its own timeout error before the proxy gives up
+const timeoutMargin = 5 * time.Second
+
+// parseDuration parses a duration the way the Prometheus API does, either as
+// a floating point number of seconds or as a Prometheus duration string
+func parseDuration(s string) (time.Duration, bool) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds <= 0 || seconds > math.MaxInt64/float64(time.Second) {
+			return 0, false
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if d, err := model.ParseDuration(s); err == nil && d > 0 {
+		return time.Duration(d), true
+	}
+	return 0, false
+}
+
+// upstreamTimeout returns the deadline for forwarding r upstream. Requests
+// carrying a Prometheus timeout parameter get that timeout plus a margin,
+// capped at the configured timeout so clients can't extend it, all others
+// get the configured timeout.
+func (p *HTTPCacheProxy) upstreamTimeout(r *http.Request) time.Duration {
+	if timeout, ok := parseDuration(r.URL.Query().Get("timeout")); ok {
+		if p.opts.Transport.Timeout > 0 {
+			return min(timeout+timeoutMargin, p.opts.Transport.Timeout)
+		}
+		return timeout + timeoutMargin
+	}
+	return p.opts.Transport.Timeout
+}
+
+// withUpstreamTimeout returns a copy of req bounded by the upstream timeout
+// of the client request r
+func (p *HTTPCacheProxy) withUpstreamTimeout(req *http.Request, r *http.Request) (*http.Request, context.CancelFunc) {
+	timeout := p.upstreamTimeout(r)
+	if timeout <= 0 {
+		return req, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured time.Duration
+		query      string
+		want       time.Duration
+	}{
+		{"default", 30 * time.Second, "", 30 * time.Second},
+		{"shorter parameter", 30 * time.Second, "timeout=10s", 15 * time.Second},
+		{"longer parameter capped", 30 * time.Second, "timeout=1h", 30 * time.Second},
+		{"seconds parameter", 30 * time.Second, "timeout=2.5", 7500 * time.Millisecond},
+		{"invalid parameter", 30 * time.Second, "timeout=-1", 30 * time.Second},
+		{"no configured timeout", 0, "timeout=1h", time.Hour + timeoutMargin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &HTTPCacheProxy{opts: Options{Transport: TransportOptions{Timeout: tt.configured}}}
+			r := httptest.NewRequest("GET", "/api/v1/query?"+tt.query, nil)
+			if got := p.upstreamTimeout(r); got != tt.want {
+				t.Errorf("upstreamTimeout = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
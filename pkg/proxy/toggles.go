@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ToggleState is the state of the runtime toggles
+type ToggleState struct {
+	// ServeStale serves stale entries when the upstream fails
+	ServeStale bool `json:"serve_stale"`
+	// Coalesce makes identical concurrent cache misses wait for the first
+	// one to fill the cache instead of all querying the upstream
+	Coalesce bool `json:"coalesce"`
+	// Shadow forwards every request to the upstream and only simulates
+	// caching
+	Shadow bool `json:"shadow"`
+}
+
+// ToggleNames are the names of the runtime toggles, their JSON names in
+// ToggleState
+var ToggleNames = []string{"serve_stale", "coalesce", "shadow"}
+
+// Toggles are behaviors that can be switched at runtime, without a
+// restart. They are safe for concurrent use and may be shared by proxies.
+type Toggles struct {
+	serveStale atomic.Bool
+	coalesce   atomic.Bool
+	shadow     atomic.Bool
+}
+
+// NewToggles creates toggles in the given state
+func NewToggles(state ToggleState) *Toggles {
+	t := &Toggles{}
+	t.serveStale.Store(state.ServeStale)
+	t.coalesce.Store(state.Coalesce)
+	t.shadow.Store(state.Shadow)
+	return t
+}
+
+// State returns the current state of the toggles
+func (t *Toggles) State() ToggleState {
+	return ToggleState{
+		ServeStale: t.serveStale.Load(),
+		Coalesce:   t.coalesce.Load(),
+		Shadow:     t.shadow.Load(),
+	}
+}
+
+// Set switches the toggle of the given name, one of ToggleNames
+func (t *Toggles) Set(name string, enabled bool) error {
+	switch name {
+	case "serve_stale":
+		t.serveStale.Store(enabled)
+	case "coalesce":
+		t.coalesce.Store(enabled)
+	case "shadow":
+		t.shadow.Store(enabled)
+	default:
+		return fmt.Errorf("unknown toggle %q, expected one of %s", name, strings.Join(ToggleNames, ", "))
+	}
+	return nil
+}
+
+// ServeStale reports whether stale entries are served when the upstream
+// fails
+func (t *Toggles) ServeStale() bool {
+	return t.serveStale.Load()
+}
+
+// Coalesce reports whether identical concurrent cache misses are coalesced
+func (t *Toggles) Coalesce() bool {
+	return t.coalesce.Load()
+}
+
+// Shadow reports whether caching is only simulated
+func (t *Toggles) Shadow() bool {
+	return t.shadow.Load()
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestToggles(t *testing.T) {
+	toggles := NewToggles(ToggleState{ServeStale: true})
+	if err := toggles.Set("shadow", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := toggles.Set("serve_stale", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := toggles.Set("breaker", true); err == nil {
+		t.Error("Set of an unknown toggle succeeded")
+	}
+	want := ToggleState{ServeStale: false, Coalesce: false, Shadow: true}
+	if got := toggles.State(); got != want {
+		t.Errorf("State() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// Give the other requests time to join the first
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	for _, coalesce := range []bool{false, true} {
+		requests.Store(0)
+		p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{Coalesce: coalesce})
+
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				p.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1700000000", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("status = %d, want 200", w.Code)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := requests.Load(); coalesce && n != 1 {
+			t.Errorf("upstream requests with coalescing = %d, want 1", n)
+		} else if !coalesce && n != 5 {
+			t.Errorf("upstream requests without coalescing = %d, want 5", n)
+		}
+	}
+}
+
+func TestShadowToggle(t *testing.T) {
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	toggles := NewToggles(ToggleState{Shadow: true})
+	p := New(upstream.URL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{Toggles: toggles})
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1700000000", nil))
+		return w
+	}
+
+	// Simulated entries aren't served once shadow mode is switched off
+	get()
+	toggles.Set("shadow", false)
+	if w := get(); w.Header().Get("X-Cache") != "MISS" || w.Body.Len() == 0 {
+		t.Errorf("X-Cache = %q with body %q after shadow mode, want a MISS", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if w := get(); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("X-Cache = %q, want HIT", w.Header().Get("X-Cache"))
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// maxTrackedHits bounds the number of entries and queries a HitTracker
+// counts hits of; the least hit half is forgotten when it is reached
+const maxTrackedHits = 10000
+
+// HitTracker counts cache hits per entry and per query fingerprint, the
+// query without its time parameters, so the queries and dashboards
+// benefiting most from the cache can be found. It can be shared by
+// several proxies.
+type HitTracker struct {
+	mu      sync.Mutex
+	entries map[string]*EntryHits
+	queries map[string]*QueryHits
+	labels  *LabelLimiter
+}
+
+// EntryHits are the hits of a cache entry
+type EntryHits struct {
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+	Hits        uint64 `json:"hits"`
+}
+
+// QueryHits are the hits of all entries of a query
+type QueryHits struct {
+	Fingerprint string `json:"fingerprint"`
+	Path        string `json:"path"`
+	// Query is the expression, or the other parameters for endpoints
+	// without one
+	Query string `json:"query"`
+	Hits  uint64 `json:"hits"`
+}
+
+// TopHits lists the most hit queries and entries
+type TopHits struct {
+	Queries []QueryHits `json:"queries"`
+	Entries []EntryHits `json:"entries"`
+}
+
+// NewHitTracker creates a hit tracker exposing the hits of up to
+// metricLimit query fingerprints as promcache_query_hits_total series;
+// the hits of all others are counted as fingerprint "other"
+func NewHitTracker(metricLimit int) *HitTracker {
+	return &HitTracker{
+		entries: make(map[string]*EntryHits),
+		queries: make(map[string]*QueryHits),
+		labels:  NewLabelLimiter(metricLimit),
+	}
+}
+
+// queryFingerprint returns the fingerprint of a request and its readable
+// form: the path and normalized parameters without the evaluation times
+// and step
+func (p *HTTPCacheProxy) queryFingerprint(r *http.Request) (string, string) {
+	params := p.normalizedQuery(r)
+	for _, name := range timeParameters {
+		params.Del(name)
+	}
+	params.Del("step")
+
+	readable := params.Get("query")
+	if readable == "" {
+		readable = params.Encode()
+	}
+	sum := sha256.Sum256([]byte(r.URL.Path + "?" + params.Encode()))
+	return hex.EncodeToString(sum[:8]), readable
+}
+
+// recordHit counts a hit of the entry stored under cacheKey
+func (p *HTTPCacheProxy) recordHit(r *http.Request, cacheKey string) {
+	if p.opts.HitTracker == nil {
+		return
+	}
+	fingerprint, readable := p.queryFingerprint(r)
+	p.metrics.RecordQueryHit(p.opts.HitTracker.record(cacheKey, fingerprint, r.URL.Path, readable))
+}
+
+// record counts a hit of an entry of a query and returns the fingerprint
+// label of its hits metric
+func (t *HitTracker) record(key, fingerprint, path, query string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, found := t.entries[key]
+	if !found {
+		if len(t.entries) >= maxTrackedHits {
+			forgetLeastHit(t.entries, func(e *EntryHits) uint64 { return e.Hits })
+		}
+		entry = &EntryHits{Key: key, Fingerprint: fingerprint}
+		t.entries[key] = entry
+	}
+	entry.Hits++
+
+	q, found := t.queries[fingerprint]
+	if !found {
+		if len(t.queries) >= maxTrackedHits {
+			forgetLeastHit(t.queries, func(q *QueryHits) uint64 { return q.Hits })
+		}
+		q = &QueryHits{Fingerprint: fingerprint, Path: path, Query: query}
+		t.queries[fingerprint] = q
+	}
+	q.Hits++
+
+	return t.labels.Label(fingerprint)
+}
+
+// forgetLeastHit removes the least hit half of the items
+func forgetLeastHit[T any](items map[string]T, hits func(T) uint64) {
+	counts := make([]uint64, 0, len(items))
+	for _, item := range items {
+		counts = append(counts, hits(item))
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	median := counts[len(counts)/2]
+
+	for key, item := range items {
+		if hits(item) <= median {
+			delete(items, key)
+		}
+	}
+}
+
+// Top returns the n most hit queries and entries
+func (t *HitTracker) Top(n int) TopHits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	top := TopHits{
+		Queries: make([]QueryHits, 0, len(t.queries)),
+		Entries: make([]EntryHits, 0, len(t.entries)),
+	}
+	for _, q := range t.queries {
+		top.Queries = append(top.Queries, *q)
+	}
+	for _, e := range t.entries {
+		top.Entries = append(top.Entries, *e)
+	}
+
+	sort.Slice(top.Queries, func(i, j int) bool {
+		if top.Queries[i].Hits != top.Queries[j].Hits {
+			return top.Queries[i].Hits > top.Queries[j].Hits
+		}
+		return top.Queries[i].Fingerprint < top.Queries[j].Fingerprint
+	})
+	sort.Slice(top.Entries, func(i, j int) bool {
+		if top.Entries[i].Hits != top.Entries[j].Hits {
+			return top.Entries[i].Hits > top.Entries[j].Hits
+		}
+		return top.Entries[i].Key < top.Entries[j].Key
+	})
+	top.Queries = top.Queries[:min(n, len(top.Queries))]
+	top.Entries = top.Entries[:min(n, len(top.Entries))]
+	return top
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TraceHeader carries the JSON-encoded request trace in debug trace mode
+const TraceHeader = "X-Promcache-Trace"
+
+// traceContextKey is the context key of the request trace
+type traceContextKey struct{}
+
+// Trace records the internal steps taken while handling a request
+type Trace struct {
+	mu    sync.Mutex
+	start time.Time
+	Steps []TraceStep `json:"steps"`
+}
+
+// TraceStep is a single step of a request trace
+type TraceStep struct {
+	// Step names what happened
+	Step string `json:"step"`
+	// Detail holds step-specific information such as the cache key or upstream URL
+	Detail string `json:"detail,omitempty"`
+	// ElapsedMs is the time since the request started in milliseconds
+	ElapsedMs float64 `json:"elapsed_ms"`
+}
+
+// withTrace returns a request carrying a new trace
+func withTrace(r *http.Request) (*http.Request, *Trace) {
+	t := &Trace{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), traceContextKey{}, t)), t
+}
+
+// traceStep appends a step to the request's trace if tracing is enabled
+func traceStep(r *http.Request, step string, detail string) {
+	t, ok := r.Context().Value(traceContextKey{}).(*Trace)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Steps = append(t.Steps, TraceStep{
+		Step:      step,
+		Detail:    detail,
+		ElapsedMs: float64(time.Since(t.start).Microseconds()) / 1000,
+	})
+}
+
+// traceWriter adds the trace header right before the response headers are
+// written
+type traceWriter struct {
+	http.ResponseWriter
+	trace       *Trace
+	wroteHeader bool
+}
+
+func (w *traceWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		w.trace.mu.Lock()
+		data, err := json.Marshal(w.trace)
+		w.trace.mu.Unlock()
+		if err == nil {
+			w.Header().Set(TraceHeader, string(data))
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController
+func (w *traceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
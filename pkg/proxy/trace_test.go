@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceRedactsUpstreamPassword(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	upstreamURL := strings.Replace(upstream.URL, "http://", "http://user:secret@", 1)
+	p := New(upstreamURL, newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{DebugTrace: true})
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1700000000", nil)
+	w := httptest.NewRecorder()
+	p.HandleRequest(w, r)
+
+	trace := w.Header().Get(TraceHeader)
+	if !strings.Contains(trace, "upstream_request") {
+		t.Fatalf("trace %s has no upstream_request step", trace)
+	}
+	if strings.Contains(trace, "secret") {
+		t.Errorf("trace %s contains the upstream password", trace)
+	}
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// traceID returns the trace ID of the W3C Trace Context traceparent header
+// of a request, e.g. 4bf92f3577b34da6a3ce929d0e0e4736 of
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Empty when the
+// request isn't part of a trace.
+func traceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 {
+		return ""
+	}
+	id := parts[1]
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ""
+		}
+	}
+	if strings.Trim(id, "0") == "" {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// TTLHeader lets clients ask for the TTL of the response to their request,
+// e.g. "30s" or "2h"
+const TTLHeader = "X-Promcache-TTL"
+
+// headerTTL returns the TTL requested by the TTLHeader of r, capped at the
+// maximum header TTL. Returns false if header TTLs are disabled or the
+// header is missing or invalid.
+func (p *HTTPCacheProxy) headerTTL(r *http.Request) (time.Duration, bool) {
+	value := r.Header.Get(TTLHeader)
+	if p.opts.MaxHeaderTTL <= 0 || value == "" {
+		return 0, false
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		p.log.DebugContext(r.Context(), "Ignoring invalid TTL header",
+			"value", value,
+			"path", r.URL.Path)
+		return 0, false
+	}
+	return min(ttl, p.opts.MaxHeaderTTL), true
+}
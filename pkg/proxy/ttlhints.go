@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of Cache-Control headers by their
+// lower case name
+type cacheControl map[string]string
+
+// parseCacheControl returns the Cache-Control directives of h
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// has reports whether the directive is present
+func (cc cacheControl) has(directive string) bool {
+	_, found := cc[directive]
+	return found
+}
+
+// seconds returns the delta-seconds argument of directive. Returns false
+// if the directive is missing or its argument invalid.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, found := cc[directive]
+	if !found {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// upstreamTTL returns the TTL the upstream set for resp through its
+// Cache-Control s-maxage or max-age directive, less the Age of the
+// response, or else through its Expires header relative to its Date.
+// Returns false if the response carries no TTL.
+func upstreamTTL(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	lifetime, ok := explicitLifetime(resp.Header)
+	if !ok {
+		return 0, false
+	}
+	return max(lifetime-initialAge(resp.Header), 0), true
+}
+
+// explicitLifetime returns the freshness lifetime set by the headers of a
+// response: s-maxage, which a shared cache prefers, else max-age, else
+// the time from Date to Expires. Returns false if none is set.
+func explicitLifetime(h http.Header) (time.Duration, bool) {
+	cc := parseCacheControl(h)
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime, true
+	}
+
+	expires := h.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	// Invalid dates such as "0" mean already expired
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0, true
+	}
+	now := time.Now()
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		now = date
+	}
+	return max(expiresAt.Sub(now), 0), true
+}
+
+// initialAge returns the Age of a response when it was received
+func initialAge(h http.Header) time.Duration {
+	age, err := strconv.ParseInt(h.Get("Age"), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * time.Second
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// labeledEndpoints are the endpoints upstream metrics are labeled with,
+// requests to other paths are labeled other to bound the label's
+// cardinality
+var labeledEndpoints = map[string]bool{
+	"/api/v1/query":                   true,
+	"/api/v1/query_range":             true,
+	"/api/v1/query_exemplars":         true,
+	"/api/v1/series":                  true,
+	"/api/v1/labels":                  true,
+	"/api/v1/label/:name/values":      true,
+	"/api/v1/metadata":                true,
+	"/api/v1/targets/metadata":        true,
+	"/api/v1/rules":                   true,
+	"/api/v1/alerts":                  true,
+	"/api/v1/read":                    true,
+	"/loki/api/v1/query":              true,
+	"/loki/api/v1/query_range":        true,
+	"/loki/api/v1/series":             true,
+	"/loki/api/v1/labels":             true,
+	"/loki/api/v1/label/:name/values": true,
+	"/loki/api/v1/index/stats":        true,
+	"/loki/api/v1/index/volume":       true,
+	"/loki/api/v1/index/volume_range": true,
+	federatePath:                      true,
+}
+
+// upstreamLabel returns the name of an upstream in metrics, the host of its
+// URL
+func upstreamLabel(upstreamURL string) string {
+	if u, err := url.Parse(upstreamURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return upstreamURL
+}
+
+// endpointLabel returns the endpoint of path in upstream metrics, with
+// label names in label value paths replaced by :name
+func endpointLabel(path string) string {
+	for _, prefix := range []string{"/api/v1/label/", "/loki/api/v1/label/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && strings.HasSuffix(rest, "/values") {
+			path = prefix + ":name/values"
+		}
+	}
+	if labeledEndpoints[path] {
+		return path
+	}
+	return "other"
+}
+
+// statusClass returns the status class of an upstream response, 2xx to
+// 5xx, or error if the upstream couldn't be reached
+func statusClass(resp *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode/100) + "xx"
+}
+
+// recordUpstreamLatency records the duration of the upstream request of r
+// that returned resp or err
+func (p *HTTPCacheProxy) recordUpstreamLatency(r *http.Request, resp *http.Response, err error, duration time.Duration) {
+	p.metrics.RecordUpstreamLatency(p.upstreamName, endpointLabel(r.URL.Path), statusClass(resp, err), duration.Seconds(), traceID(r))
+	addUpstreamTime(r, duration)
+}
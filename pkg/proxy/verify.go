@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+)
+
+// sampleFields are the result fields holding [<timestamp>, <value>] pairs
+var sampleFields = map[string]bool{
+	"value":      true,
+	"values":     true,
+	"histogram":  true,
+	"histograms": true,
+}
+
+// maybeVerify re-runs a sample of the requests answered from the cache
+// against the upstream in the background and compares the responses
+func (p *HTTPCacheProxy) maybeVerify(r *http.Request, cachedResp *Response, m *matrix) {
+	if p.opts.VerifyFraction <= 0 || r.Method != http.MethodGet || isRemoteRead(r) || rand.Float64() >= p.opts.VerifyFraction {
+		return
+	}
+
+	var body []byte
+	var err error
+	switch {
+	case m != nil:
+		body, err = m.encode()
+	case cachedResp.Compressed:
+		body, err = decompressBody(cachedResp.Body)
+	default:
+		body = cachedResp.Body
+	}
+	if err != nil {
+		return
+	}
+
+	// The client may be gone before the upstream answers
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	p.inflight.Add(1)
+	go func() {
+		defer p.inflight.Done()
+		p.verify(req, body)
+	}()
+}
+
+// verify sends the request as the client sent it to the upstream and
+// compares the result with the cached one
+func (p *HTTPCacheProxy) verify(r *http.Request, cached []byte) {
+	rec := &viewRecorder{header: make(http.Header)}
+	p.forwardRequest(rec, r, "", false)
+	if rec.status != http.StatusOK {
+		p.metrics.RecordVerifyResult("error")
+		return
+	}
+
+	diff, err := diffResults(cached, rec.body.Bytes())
+	switch {
+	case err != nil:
+		p.metrics.RecordVerifyResult("error")
+		p.log.DebugContext(r.Context(), "Failed to compare cached response", "path", r.URL.Path, "error", err)
+	case diff != "":
+		p.metrics.RecordVerifyResult("mismatch")
+		p.log.WarnContext(r.Context(), "Cached response differs from upstream",
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"diff", diff)
+	default:
+		p.metrics.RecordVerifyResult("match")
+	}
+}
+
+// diffResults compares the status and data of two API responses and
+// describes their first difference, or returns "" if they agree. Sample
+// timestamps are ignored as time rounding shifts them by design, and
+// series are compared regardless of their order.
+func diffResults(cached, fresh []byte) (string, error) {
+	var a, b map[string]any
+	if err := json.Unmarshal(cached, &a); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(fresh, &b); err != nil {
+		return "", err
+	}
+
+	if diff := diffJSON("status", a["status"], b["status"]); diff != "" {
+		return diff, nil
+	}
+	return diffJSON("data", comparableData(a["data"]), comparableData(b["data"])), nil
+}
+
+// comparableData drops sample timestamps from a response's data and
+// sorts its series by their labels
+func comparableData(data any) any {
+	obj, ok := data.(map[string]any)
+	if !ok {
+		return data
+	}
+	result, ok := obj["result"].([]any)
+	if !ok {
+		return data
+	}
+
+	series := make([]any, 0, len(result))
+	for _, s := range result {
+		fields, ok := s.(map[string]any)
+		if !ok {
+			series = append(series, s)
+			continue
+		}
+		stripped := make(map[string]any, len(fields))
+		for name, value := range fields {
+			if sampleFields[name] {
+				value = sampleValues(value)
+			}
+			stripped[name] = value
+		}
+		series = append(series, stripped)
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return seriesLabels(series[i]) < seriesLabels(series[j])
+	})
+
+	out := make(map[string]any, len(obj))
+	for name, value := range obj {
+		out[name] = value
+	}
+	out["result"] = series
+	// Query statistics differ on every evaluation
+	delete(out, "stats")
+	return out
+}
+
+// sampleValues returns the values of a [<timestamp>, <value>] pair or a
+// list of them
+func sampleValues(v any) any {
+	pair, ok := v.([]any)
+	if !ok {
+		return v
+	}
+	if len(pair) == 2 {
+		if _, isTimestamp := pair[0].(float64); isTimestamp {
+			return pair[1]
+		}
+	}
+	values := make([]any, len(pair))
+	for i, sample := range pair {
+		values[i] = sampleValues(sample)
+	}
+	return values
+}
+
+// seriesLabels returns the labels of a series as a sortable string
+func seriesLabels(series any) string {
+	fields, _ := series.(map[string]any)
+	b, _ := json.Marshal(fields["metric"])
+	return string(b)
+}
+
+// diffJSON describes the first difference between two decoded JSON values
+// at path, or returns "" if they are equal
+func diffJSON(path string, a, b any) string {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			return fmt.Sprintf("%s: %s != %s", path, brief(a), brief(b))
+		}
+		names := make([]string, 0, len(a)+len(b))
+		for name := range a {
+			names = append(names, name)
+		}
+		for name := range b {
+			if _, found := a[name]; !found {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if diff := diffJSON(path+"."+name, a[name], b[name]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			return fmt.Sprintf("%s: %s != %s", path, brief(a), brief(b))
+		}
+		for i := range min(len(a), len(b)) {
+			if diff := diffJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i]); diff != "" {
+				return diff
+			}
+		}
+		if len(a) != len(b) {
+			return fmt.Sprintf("%s: %d != %d elements", path, len(a), len(b))
+		}
+		return ""
+	default:
+		if a != b {
+			return fmt.Sprintf("%s: %s != %s", path, brief(a), brief(b))
+		}
+		return ""
+	}
+}
+
+// brief returns a value as JSON, shortened for logging
+func brief(v any) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 100 {
+		return string(b[:100]) + "..."
+	}
+	return string(b)
+}
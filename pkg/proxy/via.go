@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// viaPseudonym names instances without an InstanceName in Via headers,
+// which require a received-by field
+const viaPseudonym = "promcache"
+
+// viaValue returns this proxy's entry for a Via header
+func (p *HTTPCacheProxy) viaValue(r *http.Request) string {
+	name := p.opts.InstanceName
+	if name == "" {
+		name = viaPseudonym
+	}
+	return fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, name)
+}
+
+// seenVia reports whether the request already passed through this instance
+// according to its Via header. Unnamed instances can't tell their own
+// pseudonym from other instances', so they never see themselves.
+func (p *HTTPCacheProxy) seenVia(r *http.Request) bool {
+	if p.opts.InstanceName == "" {
+		return false
+	}
+
+	for _, header := range r.Header.Values("Via") {
+		for _, hop := range strings.Split(header, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && fields[1] == p.opts.InstanceName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setCacheStatus sets the X-Cache header to this hop's cache status,
+// followed by the status reported by any promcached further upstream, e.g.
+// "MISS from edge, HIT from regional"
+func (p *HTTPCacheProxy) setCacheStatus(w http.ResponseWriter, status string, upstreamStatus string) {
+	if p.opts.InstanceName != "" {
+		status += " from " + p.opts.InstanceName
+	}
+	if upstreamStatus != "" {
+		status += ", " + upstreamStatus
+	}
+	w.Header().Set("X-Cache", status)
+}
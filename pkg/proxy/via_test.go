@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestViaValue(t *testing.T) {
+	tests := []struct {
+		instance string
+		want     string
+	}{
+		{"edge", "1.1 edge"},
+		{"", "1.1 promcache"},
+	}
+	for _, tt := range tests {
+		p := New("http://prometheus:9090", newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{InstanceName: tt.instance})
+		if got := p.viaValue(httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)); got != tt.want {
+			t.Errorf("viaValue with instance %q = %q, want %q", tt.instance, got, tt.want)
+		}
+	}
+}
+
+func TestSeenVia(t *testing.T) {
+	tests := []struct {
+		instance string
+		via      string
+		want     bool
+	}{
+		{"edge", "1.1 regional, 1.1 edge", true},
+		{"edge", "1.1 edge-2 (comment)", false},
+		{"edge", "", false},
+		// Unnamed instances share the pseudonym
+		{"", "1.1 promcache", false},
+	}
+	for _, tt := range tests {
+		p := New("http://prometheus:9090", newMapCache(), slog.New(slog.NewTextHandler(io.Discard, nil)), Options{InstanceName: tt.instance})
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		if tt.via != "" {
+			r.Header.Set("Via", tt.via)
+		}
+		if got := p.seenVia(r); got != tt.want {
+			t.Errorf("seenVia(%q) of %q = %v, want %v", tt.via, tt.instance, got, tt.want)
+		}
+	}
+}
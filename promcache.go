@@ -0,0 +1,167 @@
+// Package promcache embeds promcached's Prometheus-aware cache in Go
+// programs. NewRoundTripper wraps the transport of a Prometheus API
+// client, so queries are answered from an in-process cache without running
+// the daemon. NewHandler serves the caching proxy itself, to mount it in an
+// existing service.
+package promcache
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/f0o/promcache/internal/cache"
+	"github.com/f0o/promcache/internal/metrics"
+	"github.com/f0o/promcache/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTTL is the cache TTL unless WithTTL sets another
+const DefaultTTL = 5 * time.Minute
+
+// Cache stores cached responses, see WithCache
+type Cache = proxy.Cache
+
+// CacheRule overrides the caching of queries, see NewCacheRules
+type CacheRule = proxy.CacheRule
+
+// CacheRules is a compiled, ordered list of cache rules
+type CacheRules = proxy.CacheRuleSet
+
+// Cache rule actions
+const (
+	CacheRuleCache = proxy.CacheRuleCache
+	CacheRuleSkip  = proxy.CacheRuleSkip
+)
+
+// NewMemoryCache creates an in-memory cache with the default TTL ttl, the
+// cache used unless WithCache sets another. Its size isn't exposed as a
+// metric.
+func NewMemoryCache(ttl time.Duration) Cache {
+	return cache.New(ttl, 0, cache.DefaultCleanupInterval, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.New(nil, metrics.Options{}))
+}
+
+// NewCacheRules compiles cache rules for WithCacheRules. The first rule
+// matching a query decides whether and how long its responses are cached.
+func NewCacheRules(rules ...CacheRule) (*CacheRules, error) {
+	return proxy.NewCacheRuleSet(rules)
+}
+
+// Option configures the cache
+type Option func(*options)
+
+// options are the settings collected from Options
+type options struct {
+	ttl        time.Duration
+	jitter     float64
+	cache      Cache
+	log        *slog.Logger
+	registerer prometheus.Registerer
+	proxy      proxy.Options
+}
+
+// WithTTL sets how long responses are cached. Time parameters of queries
+// are aligned to it, like promcached's -ttl. Ignored with WithCache, whose
+// cache's TTL is used instead.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithTTLJitter shortens each entry's TTL by a random fraction of up to
+// jitter, so entries stored together don't all expire at once
+func WithTTLJitter(jitter float64) Option {
+	return func(o *options) {
+		o.jitter = jitter
+	}
+}
+
+// WithCache stores responses in c instead of a new in-memory cache, e.g.
+// to share one cache between several handlers or round trippers
+func WithCache(c Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// WithCacheRules overrides the caching of the queries matching rules
+func WithCacheRules(rules *CacheRules) Option {
+	return func(o *options) {
+		o.proxy.CacheRules = rules
+	}
+}
+
+// WithLogger sets the logger of the cache, which discards its logs by
+// default
+func WithLogger(log *slog.Logger) Option {
+	return func(o *options) {
+		o.log = log
+	}
+}
+
+// WithRegisterer registers the promcache_* metrics of the cache with reg,
+// e.g. prometheus.DefaultRegisterer; they aren't registered by default.
+// Caches registered with the same reg share their metrics.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = reg
+	}
+}
+
+// WithEmptyResultTTL caches empty query results for ttl instead of the
+// cache TTL, 0 doesn't cache them at all
+func WithEmptyResultTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		if ttl > 0 {
+			o.proxy.EmptyResultPolicy = "short"
+			o.proxy.EmptyResultTTL = ttl
+		} else {
+			o.proxy.EmptyResultPolicy = "skip"
+		}
+	}
+}
+
+// WithExactTime keeps the time parameters of queries instead of aligning
+// them to the TTL; cached responses evaluated within budget of the
+// requested time are served instead
+func WithExactTime(budget time.Duration) Option {
+	return func(o *options) {
+		o.proxy.ExactTime = true
+		o.proxy.FreshnessBudget = budget
+	}
+}
+
+// newOptions applies opts to the defaults, which match promcached's
+func newOptions(opts []Option) *options {
+	o := &options{
+		ttl: DefaultTTL,
+		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		proxy: proxy.Options{
+			Compress:          true,
+			CompressMinBytes:  1024,
+			EmptyResultPolicy: "cache",
+			FederateTTL:       15 * time.Second,
+			MetadataTTL:       15 * time.Minute,
+			RulesTTL:          10 * time.Second,
+			ValidateResponses: true,
+			UpstreamTTLHints:  true,
+			HashKeys:          true,
+			KeyExcludeParams:  []string{"timeout", "_"},
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.proxy.Metrics = metrics.New(o.registerer, metrics.Options{})
+	return o
+}
+
+// newCache returns the cache of o, a new in-memory cache unless WithCache
+// set one
+func (o *options) newCache() Cache {
+	if o.cache != nil {
+		return o.cache
+	}
+	return cache.New(o.ttl, o.jitter, cache.DefaultCleanupInterval, o.log, o.proxy.Metrics)
+}
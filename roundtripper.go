@@ -0,0 +1,217 @@
+package promcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/f0o/promcache/pkg/proxy"
+)
+
+// readEndpoints are the API endpoints Prometheus clients POST forms to,
+// which are cached like GET requests
+var readEndpoints = map[string]bool{
+	"/api/v1/query":           true,
+	"/api/v1/query_range":     true,
+	"/api/v1/query_exemplars": true,
+	"/api/v1/series":          true,
+	"/api/v1/labels":          true,
+}
+
+// RoundTripper answers Prometheus API requests from a cache, sending
+// misses through the wrapped RoundTripper. Requests to other paths are
+// passed through unchanged. Use it as the RoundTripper of a
+// prometheus/client_golang/api client:
+//
+//	client, err := api.NewClient(api.Config{
+//		Address:      "http://prometheus:9090",
+//		RoundTripper: promcache.NewRoundTripper(api.DefaultRoundTripper),
+//	})
+type RoundTripper struct {
+	next  http.RoundTripper
+	opts  *options
+	cache Cache
+
+	mu sync.Mutex
+	// proxies serve the requests of each Prometheus server, by base URL
+	proxies map[string]*proxy.HTTPCacheProxy
+}
+
+// NewRoundTripper wraps upstream, http.DefaultTransport if nil, with the
+// Prometheus-aware cache of promcached
+func NewRoundTripper(upstream http.RoundTripper, opts ...Option) *RoundTripper {
+	if upstream == nil {
+		upstream = http.DefaultTransport
+	}
+	o := newOptions(opts)
+	return &RoundTripper{
+		next:    upstream,
+		opts:    o,
+		cache:   o.newCache(),
+		proxies: make(map[string]*proxy.HTTPCacheProxy),
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The API may be served below a path prefix, e.g. behind a reverse
+	// proxy
+	prefix, apiPath, found := strings.Cut(req.URL.Path, "/api/v1/")
+	if !found {
+		return t.next.RoundTrip(req)
+	}
+	apiPath = "/api/v1/" + apiPath
+	base := req.URL.Scheme + "://" + req.URL.Host + prefix
+
+	r, err := serverRequest(req, apiPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, upstreamErr := withUpstreamError(r.Context())
+	r = r.WithContext(ctx)
+
+	w := newResponseRecorder()
+	t.proxy(base).HandleRequest(w, r)
+
+	// Report transport errors as errors, like the wrapped RoundTripper
+	if *upstreamErr != nil && w.status == http.StatusBadGateway {
+		return nil, *upstreamErr
+	}
+	return w.response(req), nil
+}
+
+// proxy returns the proxy of the Prometheus server at base
+func (t *RoundTripper) proxy(base string) *proxy.HTTPCacheProxy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.proxies[base]
+	if !found {
+		opts := t.opts.proxy
+		opts.RoundTripper = &errorRecorder{next: t.next}
+		// Entries of different servers must never be mixed up
+		opts.KeyNamespace = base
+		p = proxy.New(base, t.cache, t.opts.log, opts)
+		t.proxies[base] = p
+	}
+	return p
+}
+
+// serverRequest returns the client request req as a server request to
+// path, with the parameters of forms POSTed to read endpoints moved to the
+// query string so they are cached like GET requests
+func serverRequest(req *http.Request, path string) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	r.URL = &url.URL{Path: path, RawQuery: req.URL.RawQuery}
+	r.RequestURI = r.URL.RequestURI()
+	r.Host = req.URL.Host
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodPost || !readEndpoints[path] || !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return r, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		// Leave malformed forms for the upstream to reject
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return r, nil
+	}
+	query := r.URL.Query()
+	for name, values := range form {
+		query[name] = append(query[name], values...)
+	}
+	r.Method = http.MethodGet
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.Header.Del("Content-Type")
+	r.Header.Del("Content-Length")
+	return r, nil
+}
+
+// upstreamErrorContextKey is the context key of the transport error of a
+// request's upstream request
+type upstreamErrorContextKey struct{}
+
+// withUpstreamError returns ctx with a slot errorRecorder stores the error
+// of the upstream request in
+func withUpstreamError(ctx context.Context) (context.Context, *error) {
+	var err error
+	return context.WithValue(ctx, upstreamErrorContextKey{}, &err), &err
+}
+
+// errorRecorder stores the transport errors of upstream requests in their
+// context, the proxy only answers them with 502 Bad Gateway
+type errorRecorder struct {
+	next http.RoundTripper
+}
+
+func (e *errorRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := e.next.RoundTrip(req)
+	if err != nil {
+		if slot, ok := req.Context().Value(upstreamErrorContextKey{}).(*error); ok {
+			*slot = err
+		}
+	}
+	return resp, err
+}
+
+// responseRecorder collects the response the proxy writes
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// response returns the collected response to req
+func (w *responseRecorder) response(req *http.Request) *http.Response {
+	w.WriteHeader(http.StatusOK)
+	w.header.Del("Content-Length")
+	if req.Method == http.MethodHead {
+		w.body.Reset()
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+}
@@ -0,0 +1,161 @@
+package promcache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const vectorBody = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`
+
+// countingUpstream returns a Prometheus server answering every request
+// with vectorBody and the number of requests it got
+func countingUpstream(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, vectorBody)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &requests
+}
+
+// roundTrip sends req through rt and returns the response and its body
+func roundTrip(t *testing.T, rt http.RoundTripper, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestRoundTripperHitAndMiss(t *testing.T) {
+	upstream, requests := countingUpstream(t)
+	rt := NewRoundTripper(nil)
+
+	tests := []struct {
+		name     string
+		cache    string
+		requests int64
+	}{
+		{name: "miss", cache: "MISS", requests: 1},
+		{name: "hit", cache: "HIT", requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, upstream.URL+"/api/v1/query?query=up&time=1700000000", nil)
+			req.RequestURI = ""
+			resp, body := roundTrip(t, rt, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := resp.Header.Get("X-Cache"); got != tt.cache {
+				t.Errorf("X-Cache = %q, want %q", got, tt.cache)
+			}
+			if body != vectorBody {
+				t.Errorf("body = %s, want %s", body, vectorBody)
+			}
+			if resp.Request != req {
+				t.Error("response doesn't refer to its request")
+			}
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("upstream requests = %d, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestRoundTripperPostedForm(t *testing.T) {
+	upstream, requests := countingUpstream(t)
+	rt := NewRoundTripper(nil)
+
+	// A form POSTed below a path prefix hits the entry of the same GET
+	get := httptest.NewRequest(http.MethodGet, upstream.URL+"/prometheus/api/v1/query?query=up&time=1700000000", nil)
+	get.RequestURI = ""
+	roundTrip(t, rt, get)
+
+	form := url.Values{"query": {"up"}, "time": {"1700000000"}}
+	post := httptest.NewRequest(http.MethodPost, upstream.URL+"/prometheus/api/v1/query", strings.NewReader(form.Encode()))
+	post.RequestURI = ""
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, body := roundTrip(t, rt, post)
+	if got := resp.Header.Get("X-Cache"); got != "HIT" {
+		t.Errorf("X-Cache = %q, want HIT", got)
+	}
+	if body != vectorBody {
+		t.Errorf("body = %s, want %s", body, vectorBody)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
+
+func TestRoundTripperServersAreSeparate(t *testing.T) {
+	first, firstRequests := countingUpstream(t)
+	second, secondRequests := countingUpstream(t)
+	rt := NewRoundTripper(nil)
+
+	for _, upstream := range []*httptest.Server{first, second} {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"/api/v1/query?query=up&time=1700000000", nil)
+		req.RequestURI = ""
+		if resp, _ := roundTrip(t, rt, req); resp.Header.Get("X-Cache") != "MISS" {
+			t.Errorf("X-Cache of %s = %q, want MISS", upstream.URL, resp.Header.Get("X-Cache"))
+		}
+	}
+	if n, m := firstRequests.Load(), secondRequests.Load(); n != 1 || m != 1 {
+		t.Errorf("upstream requests = %d and %d, want 1 each", n, m)
+	}
+}
+
+func TestRoundTripperPassesThrough(t *testing.T) {
+	upstream, requests := countingUpstream(t)
+	rt := NewRoundTripper(nil)
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"/-/healthy", nil)
+		req.RequestURI = ""
+		if resp, _ := roundTrip(t, rt, req); resp.Header.Get("X-Cache") != "" {
+			t.Errorf("X-Cache = %q outside the API, want none", resp.Header.Get("X-Cache"))
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+}
+
+// failingTransport fails every request with err
+type failingTransport struct {
+	err error
+}
+
+func (f failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, f.err
+}
+
+func TestRoundTripperTransportError(t *testing.T) {
+	errDown := errors.New("connection refused")
+	rt := NewRoundTripper(failingTransport{err: errDown})
+
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus:9090/api/v1/query?query=up&time=1700000000", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	if !errors.Is(err, errDown) {
+		t.Errorf("RoundTrip() error = %v, want %v", err, errDown)
+	}
+	if resp != nil {
+		t.Errorf("RoundTrip() response = %v, want nil", resp)
+	}
+}